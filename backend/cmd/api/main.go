@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,10 +11,17 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/frans-sjostrom/auth-service/internal/archive"
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/auth"
 	"github.com/frans-sjostrom/auth-service/internal/config"
 	"github.com/frans-sjostrom/auth-service/internal/database"
 	"github.com/frans-sjostrom/auth-service/internal/handlers"
+	"github.com/frans-sjostrom/auth-service/internal/identity"
+	"github.com/frans-sjostrom/auth-service/internal/mail"
+	"github.com/frans-sjostrom/auth-service/internal/metrics"
 	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/frans-sjostrom/auth-service/internal/ratelimit"
 	"github.com/go-chi/chi/v5"
 	chiMiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -26,6 +34,15 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify-audit":
+			os.Exit(verifyAudit(cfg))
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+	}
+
 	// Run migrations BEFORE connecting
 	log.Println("Running database migrations...")
 	if err := database.RunMigrations(cfg.DatabaseURL); err != nil {
@@ -41,8 +58,100 @@ func main() {
 
 	log.Println("Database connected successfully")
 
+	// Load signing keys
+	keys, err := auth.NewKeyRing(context.Background(), db, cfg)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+
+	// Load CORS origins of registered applications
+	origins, err := auth.NewOriginRegistry(context.Background(), db, cfg)
+	if err != nil {
+		log.Fatalf("Failed to load allowed origins: %v", err)
+	}
+
+	// Audit log partitions and retention
+	archiveStore, err := archive.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up audit archive: %v", err)
+	}
+	retention, err := auth.NewRetention(context.Background(), db, cfg, archiveStore)
+	if err != nil {
+		log.Fatalf("Failed to set up retention: %v", err)
+	}
+
+	// Revoked access tokens
+	denylist := auth.NewDenylist(db, cfg)
+	tokenVersions := auth.NewTokenVersions(db, cfg.TokenVersionCacheTTL)
+
+	// Set up upstream identity providers
+	providers, err := identity.NewRegistry(cfg.Providers)
+	if err != nil {
+		log.Fatalf("Failed to set up identity providers: %v", err)
+	}
+
+	// Rate limit buckets
+	limiter, err := ratelimit.New(cfg, db)
+	if err != nil {
+		log.Fatalf("Failed to set up rate limits: %v", err)
+	}
+
+	// Set up outgoing email
+	mailer, err := mail.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up mail: %v", err)
+	}
+
+	// Background jobs stop when the server shuts down
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	go keys.Run(jobsCtx, time.Minute)
+	go origins.Run(jobsCtx, time.Minute)
+	go denylist.Run(jobsCtx, time.Hour)
+	go denylist.Listen(jobsCtx)
+	go audit.NewChainer(db).Run(jobsCtx, time.Second)
+	if cfg.AuditCheckpointKey != nil {
+		go auth.NewAuditCheckpointer(db, cfg.AuditCheckpointKey).Run(jobsCtx, cfg.AuditCheckpointInterval)
+	} else {
+		log.Println("WARNING: AUDIT_CHECKPOINT_KEY_PATH is not set, the audit log's hash chain is not checkpointed")
+	}
+	go retention.Run(jobsCtx, time.Hour)
+	go limiter.Run(jobsCtx, time.Minute)
+
 	// Initialize handlers
-	h := handlers.New(db, cfg)
+	authService := auth.NewService(db, cfg, keys, denylist, mailer)
+	h := handlers.New(db, cfg, keys, denylist, origins, providers, authService)
+
+	// Rate limits of the route groups below. Sign-in endpoints are limited
+	// by IP address, as their callers are not known yet, and the endpoints
+	// checking credentials more tightly; refreshing also by the user and
+	// client of the refresh token; applications by client and IP address;
+	// and the protected API by user.
+	limits := middleware.NewRateLimiter(limiter, db)
+	authByIP := middleware.RateLimitRule{
+		Name: "auth_ip", Limit: ratelimit.Limit(cfg.RateLimitAuth), Key: middleware.KeyByIP,
+	}
+	credentialsByIP := middleware.RateLimitRule{
+		Name: "credentials_ip", Limit: ratelimit.Limit(cfg.RateLimitCredentials), Key: middleware.KeyByIP,
+	}
+	oauthByIP := middleware.RateLimitRule{
+		Name: "oauth_ip", Limit: ratelimit.Limit(cfg.RateLimitOAuthIP), Key: middleware.KeyByIP,
+	}
+	oauthByClient := middleware.RateLimitRule{
+		Name: "oauth_client", Limit: ratelimit.Limit(cfg.RateLimitOAuthClient), Key: middleware.KeyByClient(origins),
+	}
+	refreshByUser := middleware.RateLimitRule{
+		Name: "refresh_user", Limit: ratelimit.Limit(cfg.RateLimitRefreshUser), Key: middleware.KeyByRefreshTokenUser(authService),
+	}
+	// Shares the buckets of oauthByClient, so an application's refreshes
+	// count the same whichever endpoint they use
+	refreshByClient := middleware.RateLimitRule{
+		Name: "oauth_client", Limit: ratelimit.Limit(cfg.RateLimitOAuthClient), Key: middleware.KeyByRefreshTokenClient(authService),
+	}
+	apiByUser := middleware.RateLimitRule{
+		Name: "api_user", Limit: ratelimit.Limit(cfg.RateLimitAPIUser), Key: middleware.KeyByUser,
+	}
 
 	// Setup router
 	r := chi.NewRouter()
@@ -51,9 +160,10 @@ func main() {
 	r.Use(chiMiddleware.Logger)
 	r.Use(chiMiddleware.Recoverer)
 	r.Use(chiMiddleware.RequestID)
-	r.Use(chiMiddleware.RealIP)
+	r.Use(middleware.RealIP(cfg.TrustedProxies))
+	r.Use(audit.Middleware)
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   cfg.AllowedOrigins,
+		AllowOriginFunc:  origins.AllowOrigin,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
@@ -68,38 +178,197 @@ func main() {
 		w.Write([]byte(`{"status":"ok"}`))
 	})
 
+	// Counters in the Prometheus text format
+	r.Get("/metrics", metrics.Handler)
+
+	// Well-known discovery documents
+	r.Get("/.well-known/jwks.json", h.GetJWKS)
+	r.Get("/.well-known/openid-configuration", h.OpenIDConfiguration)
+
+	// OpenID Connect provider
+	r.Group(func(r chi.Router) {
+		r.Use(limits.Limit(oauthByIP, oauthByClient))
+
+		r.Get("/authorize", h.Authorize)
+		r.Post("/token", h.Token)
+		r.Post("/oauth/introspect", h.IntrospectToken)
+		r.Post("/oauth/revoke", h.RevokeToken)
+	})
+	r.Get("/oauth/revocations", h.ListRevocations)
+	r.Get("/oauth/revocations/stream", h.StreamRevocations)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware(keys, denylist))
+		if cfg.TokenVersionCheck {
+			r.Use(middleware.TokenVersionMiddleware(tokenVersions))
+		}
+
+		r.Get("/userinfo", h.UserInfo)
+		r.Post("/userinfo", h.UserInfo)
+	})
+
 	// Public routes
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/public-key", h.GetPublicKey)
 
 		r.Route("/auth", func(r chi.Router) {
-			r.Get("/google/login", h.GoogleLogin)
-			r.Get("/google/callback", h.GoogleCallback)
-			r.Post("/refresh", h.RefreshToken)
+			r.Use(limits.Limit(authByIP))
+
+			r.Get("/providers", h.ListProviders)
+			r.Get("/{provider}/login", h.Login)
+			r.Get("/{provider}/callback", h.Callback)
+			r.Post("/exchange", h.ExchangeLoginCode)
+			r.With(limits.Limit(refreshByUser, refreshByClient)).Post("/refresh", h.RefreshToken)
 			r.Post("/logout", h.Logout)
+			r.Post("/mfa/passkey", h.BeginMFAPasskey)
+			r.Post("/passkey/login/begin", h.BeginPasskeyLogin)
+
+			r.Group(func(r chi.Router) {
+				r.Use(limits.Limit(credentialsByIP))
+
+				r.Post("/mfa/verify", h.VerifyMFA)
+				r.Post("/passkey/login/finish", h.FinishPasskeyLogin)
+				r.Post("/register", h.Register)
+				r.Post("/verify-email", h.VerifyEmail)
+				r.Post("/password/login", h.PasswordLogin)
+				r.Post("/password/forgot", h.ForgotPassword)
+				r.Post("/password/reset", h.ResetPassword)
+				r.Post("/email/start", h.StartEmailLogin)
+				r.Post("/email/verify", h.FinishEmailLogin)
+			})
 		})
 
 		// Protected routes
 		r.Group(func(r chi.Router) {
-			r.Use(middleware.AuthMiddleware(cfg.JWTPublicKey))
+			r.Use(middleware.AuthMiddleware(keys, denylist))
+			r.Use(middleware.FirstPartyMiddleware)
+			if cfg.TokenVersionCheck {
+				r.Use(middleware.TokenVersionMiddleware(tokenVersions))
+			}
+			r.Use(limits.Limit(apiByUser))
 
 			r.Get("/auth/me", h.GetCurrentUser)
+			r.Post("/auth/logout/everywhere", h.LogoutEverywhere)
+			r.Get("/auth/sessions", h.ListMySessions)
+			r.Delete("/auth/sessions", h.RevokeOtherSessions)
+			r.Put("/auth/sessions/{sessionID}", h.RenameMySession)
+			r.Delete("/auth/sessions/{sessionID}", h.RevokeMySession)
+			r.Post("/auth/organization", h.SwitchOrganization)
+			r.Get("/auth/me/identities", h.ListMyIdentities)
+			r.Post("/auth/me/identities/{provider}", h.StartLinkIdentity)
+			r.Delete("/auth/me/identities/{identityID}", h.UnlinkIdentity)
+			r.Get("/auth/mfa", h.GetMFAStatus)
+			r.Post("/auth/mfa/totp", h.BeginTOTPEnrollment)
+			r.Post("/auth/mfa/totp/confirm", h.ConfirmTOTPEnrollment)
+			r.Post("/auth/mfa/totp/disable", h.DisableTOTP)
+			r.Post("/auth/mfa/recovery-codes", h.RegenerateRecoveryCodes)
+			r.Get("/auth/me/passkeys", h.ListPasskeys)
+			r.Post("/auth/me/passkeys/register/begin", h.BeginPasskeyRegistration)
+			r.Post("/auth/me/passkeys/register/finish", h.FinishPasskeyRegistration)
+			r.Delete("/auth/me/passkeys/{passkeyID}", h.DeletePasskey)
 
 			r.Route("/users", func(r chi.Router) {
-				// Mixed authorization - handlers check permissions
+				r.Use(middleware.MFAMiddleware(cfg.MFARequiredRoles))
+
+				// Users can read and update themselves; handlers check
+				// users:read and users:write for anyone else
 				r.Get("/{id}", h.GetUser)
 				r.Put("/{id}", h.UpdateUser)
 
-				// Admin-only routes
+				r.With(middleware.RequirePermission(auth.PermissionUsersRead)).Get("/", h.ListUsers)
+				r.With(middleware.RequirePermission(auth.PermissionUsersRead)).Get("/{id}/sessions", h.ListUserSessions)
+				r.With(middleware.RequirePermission(auth.PermissionUsersDelete)).Delete("/{id}", h.DeleteUser)
+				r.With(middleware.RequirePermission(auth.PermissionRolesWrite)).Put("/{id}/role", h.SetUserRole)
+
 				r.Group(func(r chi.Router) {
-					r.Use(middleware.AdminMiddleware())
+					r.Use(middleware.RequirePermission(auth.PermissionUsersWrite))
 
-					r.Get("/", h.ListUsers)
-					r.Delete("/{id}", h.DeleteUser)
 					r.Post("/{id}/activate", h.ActivateUser)
 					r.Post("/{id}/deactivate", h.DeactivateUser)
+					r.Delete("/{id}/sessions", h.RevokeUserSessions)
+					r.Delete("/{id}/sessions/{sessionID}", h.RevokeUserSession)
+				})
+			})
+
+			// Admin routes
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(middleware.MFAMiddleware(cfg.MFARequiredRoles))
+
+				r.With(middleware.RequirePermission(auth.PermissionKeysRead)).Get("/keys", h.ListSigningKeys)
+				r.With(middleware.RequirePermission(auth.PermissionKeysWrite)).Post("/keys/rotate", h.RotateSigningKey)
+			})
+
+			// Roles and the permissions they grant
+			r.Route("/roles", func(r chi.Router) {
+				r.Use(middleware.MFAMiddleware(cfg.MFARequiredRoles))
+
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.RequirePermission(auth.PermissionRolesRead))
+
+					r.Get("/", h.ListRoles)
+					r.Get("/{name}", h.GetRole)
+				})
+
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.RequirePermission(auth.PermissionRolesWrite))
+
+					r.Post("/", h.CreateRole)
+					r.Put("/{name}", h.UpdateRole)
+					r.Delete("/{name}", h.DeleteRole)
+				})
+			})
+			r.With(
+				middleware.MFAMiddleware(cfg.MFARequiredRoles),
+				middleware.RequirePermission(auth.PermissionRolesRead),
+			).Get("/permissions", h.ListPermissions)
+
+			// Registered applications
+			r.Route("/applications", func(r chi.Router) {
+				r.Use(middleware.MFAMiddleware(cfg.MFARequiredRoles))
+
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.RequirePermission(auth.PermissionApplicationsRead))
+
+					r.Get("/", h.ListApplications)
+					r.Get("/{clientID}", h.GetApplication)
+					r.Get("/{clientID}/secrets", h.ListApplicationSecrets)
+				})
+
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.RequirePermission(auth.PermissionApplicationsWrite))
+
+					r.Post("/", h.CreateApplication)
+					r.Put("/{clientID}", h.UpdateApplication)
+					r.Delete("/{clientID}", h.DeleteApplication)
+					r.Post("/{clientID}/secrets", h.CreateApplicationSecret)
+					r.Delete("/{clientID}/secrets/{secretID}", h.RevokeApplicationSecret)
 				})
 			})
+
+			// Audit log
+			r.Route("/audit", func(r chi.Router) {
+				r.Use(middleware.MFAMiddleware(cfg.MFARequiredRoles))
+				r.Use(middleware.RequirePermission(auth.PermissionAuditRead))
+
+				r.Get("/", h.ListAuditEvents)
+				r.Get("/export", h.ExportAuditEvents)
+			})
+
+			// Organizations check the caller's role in the organization
+			// itself, so they need no permission
+			r.Route("/organizations", func(r chi.Router) {
+				r.Get("/", h.ListMyOrganizations)
+				r.Post("/", h.CreateOrganization)
+				r.Post("/invites/accept", h.AcceptOrganizationInvite)
+				r.Get("/{orgID}", h.GetOrganization)
+				r.Put("/{orgID}", h.UpdateOrganization)
+				r.Delete("/{orgID}", h.DeleteOrganization)
+				r.Get("/{orgID}/members", h.ListOrganizationMembers)
+				r.Put("/{orgID}/members/{userID}", h.SetOrganizationMemberRole)
+				r.Delete("/{orgID}/members/{userID}", h.RemoveOrganizationMember)
+				r.Get("/{orgID}/invites", h.ListOrganizationInvites)
+				r.Post("/{orgID}/invites", h.InviteToOrganization)
+				r.Delete("/{orgID}/invites/{inviteID}", h.RevokeOrganizationInvite)
+			})
 		})
 	})
 
@@ -136,3 +405,36 @@ func main() {
 
 	log.Println("Server exited")
 }
+
+// verifyAudit checks the audit log's hash chain and checkpoints, printing
+// the report as JSON. It returns the exit status: 1 if the chain is broken.
+func verifyAudit(cfg *config.Config) int {
+	if len(cfg.AuditCheckpointPublicKeys) == 0 {
+		log.Fatalf("Verifying the audit log requires AUDIT_CHECKPOINT_PUBLIC_KEYS_PATH or AUDIT_CHECKPOINT_KEY_PATH")
+	}
+
+	db, err := database.Connect(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	report, err := auth.VerifyAuditChain(context.Background(), db, cfg.AuditCheckpointPublicKeys, cfg.AuditCheckpointInterval)
+	if err != nil {
+		log.Fatalf("Failed to verify audit log: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if report.Break != nil {
+		log.Printf("Audit log chain is broken at event %d: %s", report.Break.Seq, report.Break.Reason)
+		return 1
+	}
+	if report.UnpinnedCheckpoints > 0 {
+		log.Printf("Skipped %d checkpoints signed with keys that are not pinned", report.UnpinnedCheckpoints)
+	}
+	log.Printf("Audit log chain verified: %d events, %d checkpoints", report.Events, report.Checkpoints)
+	return 0
+}
@@ -0,0 +1,87 @@
+// Package archive keeps files, such as expired audit log partitions, in a
+// local directory or an S3-compatible bucket.
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+)
+
+// Store keeps archived files. Implementations are Dir and S3.
+type Store interface {
+	// Put stores the contents of f under name, replacing any file of that
+	// name. f is read from its start.
+	Put(ctx context.Context, name string, f *os.File) error
+
+	// Location describes where a file stored as name ends up, for logs
+	// and audit events
+	Location(name string) string
+}
+
+// New returns the store for AUDIT_ARCHIVE: an S3 bucket for s3://bucket/prefix
+// URLs and otherwise a local directory
+func New(cfg *config.Config) (Store, error) {
+	if !strings.HasPrefix(cfg.AuditArchive, "s3://") {
+		return Dir(cfg.AuditArchive), nil
+	}
+
+	u, err := url.Parse(cfg.AuditArchive)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid AUDIT_ARCHIVE: %q", cfg.AuditArchive)
+	}
+	return &S3{
+		Endpoint:        cfg.S3Endpoint,
+		Region:          cfg.S3Region,
+		Bucket:          u.Host,
+		Prefix:          strings.Trim(u.Path, "/"),
+		AccessKeyID:     cfg.S3AccessKeyID,
+		SecretAccessKey: cfg.S3SecretAccessKey,
+		SessionToken:    cfg.S3SessionToken,
+	}, nil
+}
+
+// Dir stores files in a local directory, creating it when needed
+type Dir string
+
+func (d Dir) Put(ctx context.Context, name string, f *os.File) error {
+	if err := os.MkdirAll(string(d), 0o750); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	// Written under a temporary name first, so that a file with the
+	// final name is always complete
+	tmp, err := os.CreateTemp(string(d), "."+name+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, f); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(string(d), name)); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+	return nil
+}
+
+func (d Dir) Location(name string) string {
+	return filepath.Join(string(d), name)
+}
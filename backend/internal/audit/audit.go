@@ -0,0 +1,288 @@
+// Package audit records events in the audit log: who did what to which
+// account or object, from which request, and which fields changed. Events
+// form a hash chain, so that edits to recorded history can be detected.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/metrics"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Target types of audit events
+const (
+	TargetUser               = "user"
+	TargetRole               = "role"
+	TargetApplication        = "application"
+	TargetApplicationSecret  = "application_secret"
+	TargetSigningKey         = "signing_key"
+	TargetOrganization       = "organization"
+	TargetOrganizationInvite = "organization_invite"
+	TargetAuditLogPartition  = "audit_log_partition"
+	TargetSession            = "session"
+	TargetRateLimit          = "rate_limit"
+)
+
+// Event is one entry of the audit log
+type Event struct {
+	Action string
+
+	// UserID is the account the event is about, if any
+	UserID *uuid.UUID
+
+	// TargetType and TargetID name the object that changed, such as "role"
+	// and the role's name
+	TargetType string
+	TargetID   string
+
+	// Changes holds the fields that changed, see Diff
+	Changes map[string]Change
+
+	// IPAddress and UserAgent default to the request's
+	IPAddress string
+	UserAgent string
+}
+
+// Change is the old and new value of a field. From is nil for created
+// objects and To for deleted ones.
+type Change struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// Request describes the request events are recorded for
+type Request struct {
+	// ActorID is the signed-in user making the request
+	ActorID   *uuid.UUID
+	IPAddress string
+	UserAgent string
+	RequestID string
+}
+
+type contextKey struct{}
+
+// WithRequest returns a context whose events are recorded for req
+func WithRequest(ctx context.Context, req Request) context.Context {
+	return context.WithValue(ctx, contextKey{}, req)
+}
+
+// RequestFrom returns the request of ctx, or a zero Request
+func RequestFrom(ctx context.Context) Request {
+	req, _ := ctx.Value(contextKey{}).(Request)
+	return req
+}
+
+// WithActor returns a context whose events are recorded as done by actorID
+func WithActor(ctx context.Context, actorID uuid.UUID) context.Context {
+	req := RequestFrom(ctx)
+	req.ActorID = &actorID
+	return WithRequest(ctx, req)
+}
+
+// Middleware records each request's client address, user agent and request
+// ID for the events recorded while handling it. It goes after chi's
+// RequestID and middleware.RealIP; the auth middleware adds the actor.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithRequest(r.Context(), Request{
+			IPAddress: ClientIP(r.RemoteAddr),
+			UserAgent: r.UserAgent(),
+			RequestID: chiMiddleware.GetReqID(r.Context()),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// DB is a connection pool or a transaction to record events with
+type DB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+var (
+	eventsRecorded = metrics.NewCounter("auth_audit_events_total", "Audit events recorded.")
+	writeFailures  = metrics.NewCounter("auth_audit_write_failures_total", "Audit events that failed to be recorded.")
+)
+
+// Record writes e with the actor and request of ctx. Pass the transaction
+// making the change, so that the change and its record commit together.
+// The event is added to the hash chain by a Chainer once it has committed,
+// so that writers never wait for each other. Failures are logged and
+// counted as well as returned.
+func Record(ctx context.Context, db DB, e Event) error {
+	if err := record(ctx, db, e); err != nil {
+		writeFailures.Inc()
+		log.Printf("Warning: failed to record %s audit event: %v", e.Action, err)
+		return err
+	}
+	eventsRecorded.Inc()
+	return nil
+}
+
+func record(ctx context.Context, db DB, e Event) error {
+	req := RequestFrom(ctx)
+	if e.IPAddress == "" {
+		e.IPAddress = req.IPAddress
+	}
+	if e.UserAgent == "" {
+		e.UserAgent = req.UserAgent
+	}
+
+	var changes *string
+	if len(e.Changes) > 0 {
+		data, err := json.Marshal(e.Changes)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit changes: %w", err)
+		}
+		s := string(data)
+		changes = &s
+	}
+
+	// A savepoint when db is a transaction
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO auth_audit_log (
+			id, user_id, actor_id, action, target_type, target_id, changes,
+			ip_address, user_agent, request_id, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7::jsonb, $8::inet, $9, $10, $11)
+	`
+	_, err = tx.Exec(ctx, query,
+		uuid.New(), e.UserID, req.ActorID, e.Action, nonEmpty(e.TargetType), nonEmpty(e.TargetID), changes,
+		nonEmpty(ClientIP(e.IPAddress)), nonEmpty(e.UserAgent), nonEmpty(req.RequestID),
+		// Postgres keeps microseconds
+		time.Now().UTC().Truncate(time.Microsecond),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// Hash returns the chain hash of e: the SHA-256, in hex, of its sequence
+// number, the previous event's hash and its content. Values are normalized
+// the way they read back from the database.
+func Hash(e models.AuthAuditLog) string {
+	id := func(v *uuid.UUID) string {
+		if v == nil {
+			return ""
+		}
+		return v.String()
+	}
+	str := func(v *string) string {
+		if v == nil {
+			return ""
+		}
+		return *v
+	}
+
+	content, _ := json.Marshal([]any{
+		e.Seq, e.PrevHash, e.ID.String(), id(e.UserID), id(e.ActorID), e.Action,
+		str(e.TargetType), str(e.TargetID), canonicalJSON(e.Changes),
+		ClientIP(str(e.IPAddress)), str(e.UserAgent), str(e.RequestID),
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalJSON re-encodes raw with sorted keys and no spaces, as jsonb
+// columns read back differently formatted
+func canonicalJSON(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return string(raw)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// ClientIP returns the address of addr, which may carry a port as
+// http.Request.RemoteAddr does, or "" if it is not an IP address
+func ClientIP(addr string) string {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap().String()
+	}
+	if a, err := netip.ParseAddr(addr); err == nil {
+		return a.Unmap().String()
+	}
+	return ""
+}
+
+// Diff compares the JSON encodings of before and after, either of which may
+// be nil, and returns the fields that differ. updated_at is left out, as it
+// changes with everything else.
+func Diff(before, after any) map[string]Change {
+	from := fields(before)
+	to := fields(after)
+
+	changes := make(map[string]Change)
+	for name, value := range from {
+		if other, ok := to[name]; !ok || !bytes.Equal(value, other) {
+			changes[name] = Change{From: decode(value), To: decode(to[name])}
+		}
+	}
+	for name, value := range to {
+		if _, ok := from[name]; !ok {
+			changes[name] = Change{To: decode(value)}
+		}
+	}
+	delete(changes, "updated_at")
+	return changes
+}
+
+// fields returns the JSON-encoded fields of v
+func fields(v any) map[string]json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(data, &m) != nil {
+		return nil
+	}
+	return m
+}
+
+func decode(raw json.RawMessage) any {
+	if raw == nil {
+		return nil
+	}
+	var v any
+	json.Unmarshal(raw, &v)
+	return v
+}
@@ -0,0 +1,164 @@
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func testEvent() models.AuthAuditLog {
+	return models.AuthAuditLog{
+		ID:         uuid.MustParse("5b0c6c3e-8f55-4a53-9a4a-2f0e0d7f4c1a"),
+		Seq:        42,
+		UserID:     ptr(uuid.MustParse("0f6f1b7e-3c7b-4d63-8d0c-3a3f9c2b6e11")),
+		ActorID:    ptr(uuid.MustParse("9a1d3c55-1b7e-4f0e-a0a2-8c4d2f6b7e90")),
+		Action:     "ROLE_CHANGED",
+		TargetType: ptr(TargetUser),
+		TargetID:   ptr("0f6f1b7e-3c7b-4d63-8d0c-3a3f9c2b6e11"),
+		Changes:    json.RawMessage(`{"role":{"from":"user","to":"admin"}}`),
+		IPAddress:  ptr("203.0.113.7"),
+		UserAgent:  ptr("curl/8.0"),
+		RequestID:  ptr("req-1"),
+		CreatedAt:  time.Date(2026, 10, 16, 12, 0, 0, 123456000, time.UTC),
+		PrevHash:   "6b86b273ff34fce19d6b804eff5a3f5747ada4ea2f1c8c2b3e0c2e2b1e2f3a4b",
+	}
+}
+
+func TestHashDetectsTampering(t *testing.T) {
+	want := Hash(testEvent())
+
+	tests := []struct {
+		name   string
+		tamper func(e *models.AuthAuditLog)
+	}{
+		{name: "seq", tamper: func(e *models.AuthAuditLog) { e.Seq++ }},
+		{name: "prev_hash", tamper: func(e *models.AuthAuditLog) { e.PrevHash = "" }},
+		{name: "id", tamper: func(e *models.AuthAuditLog) { e.ID = uuid.New() }},
+		{name: "user_id", tamper: func(e *models.AuthAuditLog) { e.UserID = nil }},
+		{name: "actor_id", tamper: func(e *models.AuthAuditLog) { e.ActorID = ptr(uuid.New()) }},
+		{name: "action", tamper: func(e *models.AuthAuditLog) { e.Action = "LOGIN" }},
+		{name: "target_type", tamper: func(e *models.AuthAuditLog) { e.TargetType = ptr(TargetRole) }},
+		{name: "target_id", tamper: func(e *models.AuthAuditLog) { e.TargetID = ptr("admin") }},
+		{name: "changes", tamper: func(e *models.AuthAuditLog) {
+			e.Changes = json.RawMessage(`{"role":{"from":"user","to":"viewer"}}`)
+		}},
+		{name: "ip_address", tamper: func(e *models.AuthAuditLog) { e.IPAddress = ptr("198.51.100.1") }},
+		{name: "user_agent", tamper: func(e *models.AuthAuditLog) { e.UserAgent = nil }},
+		{name: "request_id", tamper: func(e *models.AuthAuditLog) { e.RequestID = ptr("req-2") }},
+		{name: "created_at", tamper: func(e *models.AuthAuditLog) { e.CreatedAt = e.CreatedAt.Add(time.Microsecond) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testEvent()
+			tt.tamper(&e)
+			if Hash(e) == want {
+				t.Error("hash did not change")
+			}
+		})
+	}
+}
+
+func TestHashNormalizes(t *testing.T) {
+	want := Hash(testEvent())
+
+	tests := []struct {
+		name   string
+		modify func(e *models.AuthAuditLog)
+	}{
+		// jsonb reads back with its keys sorted and spaced differently
+		{name: "changes formatting", modify: func(e *models.AuthAuditLog) {
+			e.Changes = json.RawMessage(`{ "role": { "to": "admin", "from": "user" } }`)
+		}},
+		{name: "created_at location", modify: func(e *models.AuthAuditLog) {
+			e.CreatedAt = e.CreatedAt.In(time.FixedZone("CEST", 2*60*60))
+		}},
+		{name: "ip_address with port", modify: func(e *models.AuthAuditLog) { e.IPAddress = ptr("203.0.113.7:52100") }},
+		{name: "hash", modify: func(e *models.AuthAuditLog) { e.Hash = "anything" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testEvent()
+			tt.modify(&e)
+			if got := Hash(e); got != want {
+				t.Errorf("hash = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+type role struct {
+	Name        string    `json:"name"`
+	Permissions []string  `json:"permissions"`
+	Description *string   `json:"description,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func TestDiff(t *testing.T) {
+	before := role{Name: "support", Permissions: []string{"users:read"}, UpdatedAt: time.Unix(0, 0)}
+	after := role{Name: "support", Permissions: []string{"users:read", "audit:read"}, Description: ptr("Helpdesk"), UpdatedAt: time.Now()}
+
+	tests := []struct {
+		name          string
+		before, after any
+		want          map[string]Change
+	}{
+		{
+			name:   "changed",
+			before: before,
+			after:  after,
+			want: map[string]Change{
+				"permissions": {From: []any{"users:read"}, To: []any{"users:read", "audit:read"}},
+				"description": {To: "Helpdesk"},
+			},
+		},
+		{
+			name:   "unchanged but updated_at",
+			before: before,
+			after:  role{Name: "support", Permissions: []string{"users:read"}, UpdatedAt: time.Now()},
+			want:   map[string]Change{},
+		},
+		{
+			name:  "created",
+			after: before,
+			want: map[string]Change{
+				"name":        {To: "support"},
+				"permissions": {To: []any{"users:read"}},
+			},
+		},
+		{
+			name:   "deleted",
+			before: before,
+			want: map[string]Change{
+				"name":        {From: "support"},
+				"permissions": {From: []any{"users:read"}},
+			},
+		},
+		{
+			name:   "removed field",
+			before: after,
+			after:  before,
+			want: map[string]Change{
+				"permissions": {From: []any{"users:read", "audit:read"}, To: []any{"users:read"}},
+				"description": {From: "Helpdesk"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
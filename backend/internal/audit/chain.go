@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+// chainLock is the advisory lock that orders writers of the hash chain
+const chainLock = 0x61756469745f6c67
+
+// chainBatch is how many events a transaction of Chain links at most
+const chainBatch = 1000
+
+// Chainer adds committed events to the hash chain: it numbers them by seq
+// in the order they were recorded and hashes each with the one before.
+// Chainers on every replica take turns under an advisory lock, which is
+// only held while they link a batch.
+type Chainer struct {
+	db DB
+}
+
+func NewChainer(db DB) *Chainer {
+	return &Chainer{db: db}
+}
+
+// Chain links every event recorded so far and returns how many it linked
+func (c *Chainer) Chain(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := c.chainBatch(ctx)
+		total += n
+		if err != nil || n < chainBatch {
+			return total, err
+		}
+	}
+}
+
+func (c *Chainer) chainBatch(ctx context.Context) (int, error) {
+	tx, err := c.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(chainLock)); err != nil {
+		return 0, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	var head models.AuthAuditLog
+	err = tx.QueryRow(ctx, `
+		SELECT seq, COALESCE(hash, '') FROM auth_audit_log
+		WHERE seq IS NOT NULL
+		ORDER BY seq DESC LIMIT 1
+	`).Scan(&head.Seq, &head.Hash)
+	if err != nil && err != pgx.ErrNoRows {
+		return 0, fmt.Errorf("failed to query audit log head: %w", err)
+	}
+
+	// Read back the way Hash expects them, as verification will
+	rows, err := tx.Query(ctx, `
+		SELECT id, user_id, actor_id, action, target_type, target_id, changes,
+		       host(ip_address), user_agent, request_id, created_at
+		FROM auth_audit_log
+		WHERE seq IS NULL
+		ORDER BY created_at, id
+		LIMIT $1
+	`, chainBatch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query unchained audit events: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.AuthAuditLog, error) {
+		var e models.AuthAuditLog
+		err := row.Scan(
+			&e.ID, &e.UserID, &e.ActorID, &e.Action, &e.TargetType, &e.TargetID, &e.Changes,
+			&e.IPAddress, &e.UserAgent, &e.RequestID, &e.CreatedAt,
+		)
+		return e, err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to query unchained audit events: %w", err)
+	}
+
+	prev := head
+	for _, e := range events {
+		e.Seq = prev.Seq + 1
+		e.PrevHash = prev.Hash
+		e.Hash = Hash(e)
+
+		_, err := tx.Exec(ctx, `
+			UPDATE auth_audit_log SET seq = $3, prev_hash = NULLIF($4, ''), hash = $5
+			WHERE id = $1 AND created_at = $2
+		`, e.ID, e.CreatedAt, e.Seq, e.PrevHash, e.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to chain audit event: %w", err)
+		}
+		prev = e
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return len(events), nil
+}
+
+// Run chains new events every interval until ctx is cancelled
+func (c *Chainer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := c.Chain(ctx); err != nil {
+			log.Printf("Warning: audit chaining failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
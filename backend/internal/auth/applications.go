@@ -0,0 +1,551 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrApplicationNotFound is returned when no application has the client id
+var ErrApplicationNotFound = errors.New("application not found")
+
+const applicationColumns = `
+	client_id, name, is_public, redirect_uris, allowed_origins,
+	access_token_ttl, refresh_token_ttl, is_active, created_at, updated_at
+`
+
+func scanApplication(row pgx.Row) (*models.Application, error) {
+	var app models.Application
+	err := row.Scan(
+		&app.ClientID, &app.Name, &app.IsPublic, &app.RedirectURIs, &app.AllowedOrigins,
+		&app.AccessTokenTTL, &app.RefreshTokenTTL, &app.IsActive, &app.CreatedAt, &app.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// ApplicationUpdate holds the fields of an application to change; nil fields
+// are left as they are and a zero TTL resets it to the configured default
+type ApplicationUpdate struct {
+	Name            *string
+	RedirectURIs    []string
+	AllowedOrigins  []string
+	AccessTokenTTL  *int
+	RefreshTokenTTL *int
+	IsActive        *bool
+}
+
+// GetApplication loads an application, active or not
+func (s *Service) GetApplication(ctx context.Context, clientID string) (*models.Application, error) {
+	query := `SELECT ` + applicationColumns + ` FROM applications WHERE client_id = $1`
+
+	app, err := scanApplication(s.db.QueryRow(ctx, query, clientID))
+	if err == pgx.ErrNoRows {
+		return nil, ErrApplicationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query application: %w", err)
+	}
+
+	return app, nil
+}
+
+// GetClient loads an active application acting as an OAuth client
+func (s *Service) GetClient(ctx context.Context, clientID string) (*models.Application, error) {
+	app, err := s.GetApplication(ctx, clientID)
+	if errors.Is(err, ErrApplicationNotFound) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !app.IsActive {
+		return nil, ErrInvalidClient
+	}
+	return app, nil
+}
+
+// AuthenticateClient checks client credentials against every unrevoked
+// secret of the application. Public clients authenticate with their
+// client_id alone.
+func (s *Service) AuthenticateClient(ctx context.Context, clientID, clientSecret string) (*models.Application, error) {
+	app, err := s.GetClient(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.IsPublic {
+		if clientSecret != "" {
+			return nil, ErrInvalidClient
+		}
+		return app, nil
+	}
+
+	if clientSecret == "" {
+		return nil, ErrInvalidClient
+	}
+
+	query := `SELECT secret_hash FROM application_secrets WHERE client_id = $1 AND revoked_at IS NULL`
+	rows, err := s.db.Query(ctx, query, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query client secrets: %w", err)
+	}
+	defer rows.Close()
+
+	secretHash := hashSecret(clientSecret)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("failed to scan client secret: %w", err)
+		}
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(secretHash)) == 1 {
+			return app, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read client secrets: %w", err)
+	}
+
+	return nil, ErrInvalidClient
+}
+
+func (s *Service) ListApplications(ctx context.Context) ([]models.Application, error) {
+	query := `SELECT ` + applicationColumns + ` FROM applications ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query applications: %w", err)
+	}
+	defer rows.Close()
+
+	apps := []models.Application{}
+	for rows.Next() {
+		app, err := scanApplication(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan application: %w", err)
+		}
+		apps = append(apps, *app)
+	}
+
+	return apps, rows.Err()
+}
+
+// CreateApplication registers an application. For confidential applications
+// the generated client secret is returned; it is not stored in plain text and
+// cannot be retrieved again.
+func (s *Service) CreateApplication(ctx context.Context, app *models.Application) (*models.Application, string, error) {
+	if app.ClientID == "" {
+		clientID, err := randomToken(16)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate client id: %w", err)
+		}
+		app.ClientID = clientID
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO applications (client_id, name, is_public, redirect_uris, allowed_origins, access_token_ttl, refresh_token_ttl)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + applicationColumns
+
+	created, err := scanApplication(tx.QueryRow(ctx, query,
+		app.ClientID, app.Name, app.IsPublic, app.RedirectURIs, app.AllowedOrigins, app.AccessTokenTTL, app.RefreshTokenTTL,
+	))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create application: %w", err)
+	}
+
+	var secret string
+	if !created.IsPublic {
+		if _, secret, err = createApplicationSecret(ctx, tx, created.ClientID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := recordChange(ctx, tx, "APPLICATION_CREATED", audit.TargetApplication, created.ClientID, nil, created); err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, "", fmt.Errorf("failed to commit application: %w", err)
+	}
+
+	return created, secret, nil
+}
+
+func (s *Service) UpdateApplication(ctx context.Context, clientID string, update ApplicationUpdate) (*models.Application, error) {
+	query := `
+		UPDATE applications
+		SET name = COALESCE($1, name),
+		    redirect_uris = COALESCE($2, redirect_uris),
+		    allowed_origins = COALESCE($3, allowed_origins),
+		    access_token_ttl = NULLIF(COALESCE($4, access_token_ttl), 0),
+		    refresh_token_ttl = NULLIF(COALESCE($5, refresh_token_ttl), 0),
+		    is_active = COALESCE($6, is_active),
+		    updated_at = NOW()
+		WHERE client_id = $7
+		RETURNING ` + applicationColumns
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := scanApplication(tx.QueryRow(ctx, `SELECT `+applicationColumns+` FROM applications WHERE client_id = $1 FOR UPDATE`, clientID))
+	if err == pgx.ErrNoRows {
+		return nil, ErrApplicationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query application: %w", err)
+	}
+
+	app, err := scanApplication(tx.QueryRow(ctx, query,
+		update.Name, update.RedirectURIs, update.AllowedOrigins, update.AccessTokenTTL,
+		update.RefreshTokenTTL, update.IsActive, clientID,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update application: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "APPLICATION_UPDATED", audit.TargetApplication, clientID, before, app); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return app, nil
+}
+
+// DeleteApplication removes an application together with its secrets,
+// authorization codes and refresh tokens
+func (s *Service) DeleteApplication(ctx context.Context, clientID string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	app, err := scanApplication(tx.QueryRow(ctx, `DELETE FROM applications WHERE client_id = $1 RETURNING `+applicationColumns, clientID))
+	if err == pgx.ErrNoRows {
+		return ErrApplicationNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete application: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "APPLICATION_DELETED", audit.TargetApplication, clientID, app, nil); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) ListApplicationSecrets(ctx context.Context, clientID string) ([]models.ApplicationSecret, error) {
+	query := `
+		SELECT id, client_id, created_at, revoked_at
+		FROM application_secrets
+		WHERE client_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.Query(ctx, query, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query application secrets: %w", err)
+	}
+	defer rows.Close()
+
+	secrets := []models.ApplicationSecret{}
+	for rows.Next() {
+		var secret models.ApplicationSecret
+		if err := rows.Scan(&secret.ID, &secret.ClientID, &secret.CreatedAt, &secret.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan application secret: %w", err)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, rows.Err()
+}
+
+// CreateApplicationSecret adds a secret to a confidential application and
+// returns it in plain text, once
+func (s *Service) CreateApplicationSecret(ctx context.Context, clientID string) (*models.ApplicationSecret, string, error) {
+	app, err := s.GetApplication(ctx, clientID)
+	if err != nil {
+		return nil, "", err
+	}
+	if app.IsPublic {
+		return nil, "", fmt.Errorf("public applications cannot have secrets")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	secret, value, err := createApplicationSecret(ctx, tx, clientID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := recordChange(ctx, tx, "APPLICATION_SECRET_CREATED", audit.TargetApplicationSecret, secret.ID.String(), nil, secret); err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return secret, value, nil
+}
+
+func (s *Service) RevokeApplicationSecret(ctx context.Context, clientID string, secretID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE application_secrets
+		SET revoked_at = NOW()
+		WHERE id = $1 AND client_id = $2 AND revoked_at IS NULL
+		RETURNING revoked_at
+	`
+	var revokedAt time.Time
+	err = tx.QueryRow(ctx, query, secretID, clientID).Scan(&revokedAt)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("secret not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revoke application secret: %w", err)
+	}
+
+	err = recordChange(ctx, tx, "APPLICATION_SECRET_REVOKED", audit.TargetApplicationSecret, secretID.String(),
+		map[string]any{"client_id": clientID, "revoked_at": nil},
+		map[string]any{"client_id": clientID, "revoked_at": revokedAt},
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// querier is satisfied by both the connection pool and a transaction
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// execer is satisfied by both the connection pool and a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func createApplicationSecret(ctx context.Context, q querier, clientID string) (*models.ApplicationSecret, string, error) {
+	value, err := randomToken(32)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate client secret: %w", err)
+	}
+
+	var secret models.ApplicationSecret
+	query := `
+		INSERT INTO application_secrets (client_id, secret_hash)
+		VALUES ($1, $2)
+		RETURNING id, client_id, created_at, revoked_at
+	`
+	err = q.QueryRow(ctx, query, clientID, hashSecret(value)).Scan(
+		&secret.ID, &secret.ClientID, &secret.CreatedAt, &secret.RevokedAt,
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to store client secret: %w", err)
+	}
+
+	return &secret, value, nil
+}
+
+// tokenLifetimes returns the access and refresh token lifetimes for tokens
+// issued to clientID, falling back to the configured defaults
+func (s *Service) tokenLifetimes(ctx context.Context, clientID string) (access, refresh time.Duration, err error) {
+	access, refresh = s.cfg.JWTAccessTokenExpiry, s.cfg.JWTRefreshTokenExpiry
+	if clientID == "" {
+		return access, refresh, nil
+	}
+
+	app, err := s.GetClient(ctx, clientID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if app.AccessTokenTTL != nil {
+		access = time.Duration(*app.AccessTokenTTL) * time.Second
+	}
+	if app.RefreshTokenTTL != nil {
+		refresh = time.Duration(*app.RefreshTokenTTL) * time.Second
+	}
+	return access, refresh, nil
+}
+
+// OriginRegistry answers CORS origin checks from the allowed origins of all
+// active applications plus ALLOWED_ORIGINS, and whether a client_id names an
+// active application, cached in memory.
+type OriginRegistry struct {
+	db  *database.DB
+	cfg *config.Config
+
+	mu      sync.RWMutex
+	origins map[string]bool
+	clients map[string]bool
+}
+
+func NewOriginRegistry(ctx context.Context, db *database.DB, cfg *config.Config) (*OriginRegistry, error) {
+	o := &OriginRegistry{db: db, cfg: cfg}
+	if err := o.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// AllowOrigin reports whether origin may make cross-origin requests. Its
+// signature matches cors.Options.AllowOriginFunc.
+func (o *OriginRegistry) AllowOrigin(_ *http.Request, origin string) bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.origins[origin]
+}
+
+// IsClient reports whether clientID names an active application
+func (o *OriginRegistry) IsClient(clientID string) bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.clients[clientID]
+}
+
+// Reload reads the client ids and allowed origins of every active
+// application
+func (o *OriginRegistry) Reload(ctx context.Context) error {
+	query := `SELECT DISTINCT unnest(allowed_origins) FROM applications WHERE is_active = true`
+
+	rows, err := o.db.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to query allowed origins: %w", err)
+	}
+	defer rows.Close()
+
+	origins := make(map[string]bool)
+	for _, origin := range o.cfg.AllowedOrigins {
+		origins[origin] = true
+	}
+	for rows.Next() {
+		var origin string
+		if err := rows.Scan(&origin); err != nil {
+			return fmt.Errorf("failed to scan allowed origin: %w", err)
+		}
+		origins[origin] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read allowed origins: %w", err)
+	}
+
+	rows, err = o.db.Query(ctx, `SELECT client_id FROM applications WHERE is_active = true`)
+	if err != nil {
+		return fmt.Errorf("failed to query applications: %w", err)
+	}
+	clientIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to read applications: %w", err)
+	}
+	clients := make(map[string]bool, len(clientIDs))
+	for _, clientID := range clientIDs {
+		clients[clientID] = true
+	}
+
+	o.mu.Lock()
+	o.origins = origins
+	o.clients = clients
+	o.mu.Unlock()
+
+	return nil
+}
+
+// Run reloads the registry every interval until ctx is cancelled, so
+// replicas pick up application changes made elsewhere
+func (o *OriginRegistry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := o.Reload(ctx); err != nil {
+				log.Printf("Warning: allowed origins reload failed: %v", err)
+			}
+		}
+	}
+}
+
+// LoginRedirect resolves and validates where a login started on behalf of
+// clientID may send the user back to. Logins without a client id use
+// ALLOWED_ORIGINS, as the auth-service's own frontend does.
+func (s *Service) LoginRedirect(ctx context.Context, clientID, redirectURI string) (string, error) {
+	allowed := s.cfg.AllowedOrigins
+	if clientID != "" {
+		app, err := s.GetClient(ctx, clientID)
+		if err != nil {
+			return "", err
+		}
+		allowed = app.RedirectURIs
+	}
+
+	if redirectURI == "" {
+		// Default to the first allowed redirect if not specified
+		if len(allowed) == 0 {
+			return "", fmt.Errorf("no redirect configured")
+		}
+		return allowed[0], nil
+	}
+
+	if !redirectAllowed(allowed, redirectURI) {
+		return "", fmt.Errorf("redirect_uri not allowed")
+	}
+	return redirectURI, nil
+}
+
+// redirectAllowed reports whether redirectURI is one of allowed or a path
+// below one of them
+func redirectAllowed(allowed []string, redirectURI string) bool {
+	return slices.ContainsFunc(allowed, func(a string) bool {
+		return redirectURI == a || (len(redirectURI) > len(a) && redirectURI[:len(a)+1] == a+"/")
+	})
+}
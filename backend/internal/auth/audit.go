@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrInvalidAuditCursor is returned for a cursor that ListAuditEvents did
+// not hand out
+var ErrInvalidAuditCursor = errors.New("invalid audit log cursor")
+
+// ErrInvalidIPFilter is returned when an audit filter's IP is neither an
+// address nor a CIDR prefix
+var ErrInvalidIPFilter = errors.New("invalid IP address or prefix")
+
+// AuditFilter selects audit events. Zero fields match everything.
+type AuditFilter struct {
+	UserID  *uuid.UUID
+	ActorID *uuid.UUID
+	// TargetType and TargetID match the changed object
+	TargetType string
+	TargetID   string
+	// Actions matches any of the listed actions
+	Actions []string
+	// Since and Until bound created_at, inclusive and exclusive
+	Since *time.Time
+	Until *time.Time
+	// IP is an address or a CIDR prefix such as 10.0.0.0/8
+	IP string
+}
+
+// Events not chained yet have seq 0
+const auditColumns = `
+	id, COALESCE(seq, 0), user_id, actor_id, action, target_type, target_id, changes,
+	host(ip_address), user_agent, request_id, created_at,
+	COALESCE(prev_hash, ''), COALESCE(hash, '')
+`
+
+// where returns the filter's SQL conditions, numbering parameters after
+// args, and args with the filter's values appended
+func (f AuditFilter) where(args []any) (string, []any, error) {
+	conditions := []string{"TRUE"}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.UserID != nil {
+		conditions = append(conditions, "user_id = "+arg(*f.UserID))
+	}
+	if f.ActorID != nil {
+		conditions = append(conditions, "actor_id = "+arg(*f.ActorID))
+	}
+	if f.TargetType != "" {
+		conditions = append(conditions, "target_type = "+arg(f.TargetType))
+	}
+	if f.TargetID != "" {
+		conditions = append(conditions, "target_id = "+arg(f.TargetID))
+	}
+	if len(f.Actions) > 0 {
+		conditions = append(conditions, "action = ANY("+arg(f.Actions)+")")
+	}
+	if f.Since != nil {
+		conditions = append(conditions, "created_at >= "+arg(f.Since.UTC()))
+	}
+	if f.Until != nil {
+		conditions = append(conditions, "created_at < "+arg(f.Until.UTC()))
+	}
+	if f.IP != "" {
+		prefix, err := netip.ParsePrefix(f.IP)
+		if err != nil {
+			addr, err := netip.ParseAddr(f.IP)
+			if err != nil {
+				return "", nil, ErrInvalidIPFilter
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		conditions = append(conditions, "ip_address <<= "+arg(prefix.Masked().String())+"::inet")
+	}
+
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// Validate returns ErrInvalidIPFilter if the filter's IP does not parse
+func (f AuditFilter) Validate() error {
+	_, _, err := f.where(nil)
+	return err
+}
+
+// encodeAuditCursor returns a cursor for the events after e, newest first
+func encodeAuditCursor(e models.AuthAuditLog) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(e.CreatedAt.UTC().Format(time.RFC3339Nano) + "/" + e.ID.String()),
+	)
+}
+
+func decodeAuditCursor(cursor string) (time.Time, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	createdAt, id, ok := strings.Cut(string(raw), "/")
+	if !ok {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	return t, u, nil
+}
+
+// ListAuditEvents returns up to limit events matching filter, newest first,
+// starting after cursor if it is not empty. The returned cursor continues
+// the listing and is empty after the last page.
+func (s *Service) ListAuditEvents(ctx context.Context, filter AuditFilter, cursor string, limit int) ([]models.AuthAuditLog, string, error) {
+	where, args, err := filter.where(nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cursor != "" {
+		createdAt, id, err := decodeAuditCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, createdAt, id)
+		where += fmt.Sprintf(" AND (created_at, id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+
+	// One more than asked for tells whether there is a next page
+	args = append(args, limit+1)
+	query := fmt.Sprintf(`
+		SELECT %s FROM auth_audit_log
+		WHERE %s
+		ORDER BY created_at DESC, id DESC
+		LIMIT $%d
+	`, auditColumns, where, len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query audit log: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, scanAuditEvent)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query audit log: %w", err)
+	}
+
+	var next string
+	if len(events) > limit {
+		events = events[:limit]
+		next = encodeAuditCursor(events[limit-1])
+	}
+	return events, next, nil
+}
+
+// ExportAuditEvents calls fn with every event matching filter, oldest
+// first, reading them from the database as fn consumes them
+func (s *Service) ExportAuditEvents(ctx context.Context, filter AuditFilter, fn func(models.AuthAuditLog) error) error {
+	where, args, err := filter.where(nil)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s FROM auth_audit_log
+		WHERE %s
+		ORDER BY created_at, id
+	`, auditColumns, where)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func scanAuditEvent(row pgx.CollectableRow) (models.AuthAuditLog, error) {
+	var e models.AuthAuditLog
+	err := row.Scan(
+		&e.ID, &e.Seq, &e.UserID, &e.ActorID, &e.Action, &e.TargetType, &e.TargetID, &e.Changes,
+		&e.IPAddress, &e.UserAgent, &e.RequestID, &e.CreatedAt, &e.PrevHash, &e.Hash,
+	)
+	return e, err
+}
+
+// recordChange records action on the object targetType/targetID with the
+// fields that changed from before to after. before is nil for created
+// objects and after for deleted ones.
+func recordChange(ctx context.Context, db audit.DB, action, targetType, targetID string, before, after any) error {
+	return audit.Record(ctx, db, audit.Event{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Changes:    audit.Diff(before, after),
+	})
+}
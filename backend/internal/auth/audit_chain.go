@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// checkpointDigest is what a checkpoint's signature covers
+func checkpointDigest(seq int64, hash string) []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("auth-audit-checkpoint:%d:%s", seq, hash)))
+	return sum[:]
+}
+
+// CheckpointKeyID identifies the key that signed a checkpoint: the first
+// half of the SHA-256 of its PKIX encoding, in hex
+func CheckpointKeyID(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:16])
+}
+
+// AuditCheckpointer signs the head of the audit log's hash chain with
+// AUDIT_CHECKPOINT_KEY. Without checkpoints, someone with write access to
+// the database could rewrite an event and recompute every hash after it;
+// the key is kept out of the database so that they cannot sign new ones.
+type AuditCheckpointer struct {
+	db  *database.DB
+	key *rsa.PrivateKey
+	kid string
+}
+
+// NewAuditCheckpointer creates an AuditCheckpointer signing with key
+func NewAuditCheckpointer(db *database.DB, key *rsa.PrivateKey) *AuditCheckpointer {
+	return &AuditCheckpointer{db: db, key: key, kid: CheckpointKeyID(&key.PublicKey)}
+}
+
+// Checkpoint signs the latest event, unless it has been signed already
+func (c *AuditCheckpointer) Checkpoint(ctx context.Context) error {
+	var seq int64
+	var hash string
+	err := c.db.QueryRow(ctx, `
+		SELECT seq, hash FROM auth_audit_log
+		WHERE hash IS NOT NULL
+		ORDER BY seq DESC
+		LIMIT 1
+	`).Scan(&seq, &hash)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query audit log head: %w", err)
+	}
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, checkpointDigest(seq, hash))
+	if err != nil {
+		return fmt.Errorf("failed to sign audit checkpoint: %w", err)
+	}
+
+	query := `
+		INSERT INTO audit_checkpoints (seq, hash, key_id, signature)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (seq) DO NOTHING
+	`
+	_, err = c.db.Exec(ctx, query, seq, hash, c.kid, base64.RawURLEncoding.EncodeToString(signature))
+	if err != nil {
+		return fmt.Errorf("failed to store audit checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Run writes a checkpoint now and every interval until ctx is cancelled.
+// Checkpointing at once covers the events recorded while the service was
+// down.
+func (c *AuditCheckpointer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Checkpoint(ctx); err != nil {
+			log.Printf("Warning: audit checkpoint failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AuditChainBreak is the first event at which the audit log's hash chain
+// does not verify
+type AuditChainBreak struct {
+	Seq    int64      `json:"seq"`
+	ID     *uuid.UUID `json:"id,omitempty"`
+	Reason string     `json:"reason"`
+}
+
+// AuditChainReport is the outcome of VerifyAuditChain
+type AuditChainReport struct {
+	// FirstSeq and LastSeq bound the verified events. Events older than
+	// FirstSeq were recorded before the chain existed, or were removed by
+	// retention.
+	FirstSeq     int64 `json:"first_seq"`
+	LastSeq      int64 `json:"last_seq"`
+	Events       int64 `json:"events"`
+	LegacyEvents int64 `json:"legacy_events"`
+	Checkpoints  int   `json:"checkpoints"`
+
+	// UnchainedEvents were recorded but not added to the chain yet, which
+	// the service does within seconds while it runs
+	UnchainedEvents int64 `json:"unchained_events"`
+
+	// UnpinnedCheckpoints were signed with keys that are not pinned, such
+	// as the token signing keys checkpoints were once signed with. They
+	// vouch for nothing and are skipped.
+	UnpinnedCheckpoints int `json:"unpinned_checkpoints"`
+
+	// Break is nil if the chain verified
+	Break *AuditChainBreak `json:"break,omitempty"`
+}
+
+// auditReader is satisfied by both the connection pool and a transaction
+type auditReader interface {
+	querier
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// VerifyAuditChain walks the audit log in seq order, recomputing every
+// event's hash and checking that it links to the event before it and that
+// each checkpoint matches the event it signed. Checkpoints are verified
+// with the pinned keys only, as anything in the database may have been
+// rewritten. Checkpoints are expected every interval: an event that none
+// covers long after means the latest ones were deleted. It stops at the
+// first break.
+func VerifyAuditChain(ctx context.Context, db auditReader, pinned []*rsa.PublicKey, interval time.Duration) (*AuditChainReport, error) {
+	report := &AuditChainReport{}
+	checkpoints, forged, err := loadAuditCheckpoints(ctx, db, pinned, report)
+	if err != nil {
+		return nil, err
+	}
+	if forged != nil {
+		report.Break = forged
+		return report, nil
+	}
+
+	// Events are checkpointed every interval; one that no checkpoint covers
+	// well after that means the checkpoints after it were deleted
+	var last int64
+	for seq := range checkpoints {
+		last = max(last, seq)
+	}
+	overdue := time.Now().Add(-2 * interval)
+	var uncovered *models.AuthAuditLog
+
+	err = db.QueryRow(ctx, `SELECT COUNT(*) FROM auth_audit_log WHERE seq IS NULL`).Scan(&report.UnchainedEvents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count unchained audit events: %w", err)
+	}
+
+	rows, err := db.Query(ctx, fmt.Sprintf(`SELECT %s FROM auth_audit_log WHERE seq IS NOT NULL ORDER BY seq`, auditColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	fail := func(e models.AuthAuditLog, reason string, args ...any) {
+		id := e.ID
+		report.Break = &AuditChainBreak{Seq: e.Seq, ID: &id, Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	var prev models.AuthAuditLog
+	var started bool
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+
+		if started && e.Seq != prev.Seq+1 {
+			fail(e, "events %d to %d are missing", prev.Seq+1, e.Seq-1)
+			break
+		}
+		if e.Hash == "" {
+			if report.Events > 0 {
+				fail(e, "event has no hash")
+				break
+			}
+			// Recorded before the chain existed
+			report.LegacyEvents++
+			prev, started = e, true
+			continue
+		}
+
+		if report.Events == 0 {
+			// The first chained event links to a legacy or pruned one, which
+			// cannot be checked
+			report.FirstSeq = e.Seq
+		} else if e.PrevHash != prev.Hash {
+			fail(e, "prev_hash does not match the hash of event %d", prev.Seq)
+			break
+		}
+		if audit.Hash(e) != e.Hash {
+			fail(e, "content does not match its hash")
+			break
+		}
+
+		if cp, ok := checkpoints[e.Seq]; ok {
+			if cp.Hash != e.Hash {
+				fail(e, "hash does not match the checkpoint signed at %s", cp.CreatedAt.Format(time.RFC3339))
+				break
+			}
+			report.Checkpoints++
+		}
+		if e.Seq > last && uncovered == nil && e.CreatedAt.Before(overdue) {
+			uncovered = &e
+		}
+
+		report.Events++
+		report.LastSeq = e.Seq
+		prev, started = e, true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	if report.Break != nil {
+		return report, nil
+	}
+
+	// A checkpoint past the end of the log means events were deleted from
+	// its tail
+	if last > prev.Seq {
+		report.Break = &AuditChainBreak{
+			Seq:    prev.Seq + 1,
+			Reason: fmt.Sprintf("events %d to %d are missing, a checkpoint was signed at event %d", prev.Seq+1, last, last),
+		}
+		return report, nil
+	}
+	if uncovered != nil {
+		fail(*uncovered, "no checkpoint covers the event, recorded at %s, though checkpoints are signed every %s",
+			uncovered.CreatedAt.Format(time.RFC3339), interval)
+	}
+	return report, nil
+}
+
+// loadAuditCheckpoints returns the checkpoints signed with a pinned key by
+// seq, or the first of them whose signature does not verify. Checkpoints
+// signed with other keys are counted in report.
+func loadAuditCheckpoints(ctx context.Context, db auditReader, pinned []*rsa.PublicKey, report *AuditChainReport) (map[int64]models.AuditCheckpoint, *AuditChainBreak, error) {
+	keys := make(map[string]*rsa.PublicKey, len(pinned))
+	for _, pub := range pinned {
+		keys[CheckpointKeyID(pub)] = pub
+	}
+
+	rows, err := db.Query(ctx, `SELECT seq, hash, key_id, signature, created_at FROM audit_checkpoints ORDER BY seq`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query audit checkpoints: %w", err)
+	}
+	checkpoints, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.AuditCheckpoint])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query audit checkpoints: %w", err)
+	}
+
+	bySeq := make(map[int64]models.AuditCheckpoint, len(checkpoints))
+	for _, cp := range checkpoints {
+		pub, ok := keys[cp.KeyID]
+		if !ok {
+			report.UnpinnedCheckpoints++
+			continue
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(cp.Signature)
+		if err != nil || rsa.VerifyPKCS1v15(pub, crypto.SHA256, checkpointDigest(cp.Seq, cp.Hash), signature) != nil {
+			return nil, &AuditChainBreak{Seq: cp.Seq, Reason: "checkpoint signature does not verify"}, nil
+		}
+		bySeq[cp.Seq] = cp
+	}
+	return bySeq, nil, nil
+}
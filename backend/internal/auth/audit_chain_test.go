@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// checkpointInterval is long enough that no event of earlier test runs
+// counts as uncovered
+const checkpointInterval = 100 * 365 * 24 * time.Hour
+
+// recordChainedEvents records n events, chains them and signs a checkpoint
+// at the last one with key, returning them in seq order
+func recordChainedEvents(t *testing.T, s *Service, key *rsa.PrivateKey, n int) []models.AuthAuditLog {
+	t.Helper()
+	ctx := context.Background()
+
+	targetID := uuid.NewString()
+	for i := range n {
+		err := audit.Record(ctx, s.db, audit.Event{
+			Action:     fmt.Sprintf("TEST_EVENT_%d", i),
+			TargetType: "test",
+			TargetID:   targetID,
+		})
+		if err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	if _, err := audit.NewChainer(s.db).Chain(ctx); err != nil {
+		t.Fatalf("Chain: %v", err)
+	}
+	if err := NewAuditCheckpointer(s.db, key).Checkpoint(ctx); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+
+	rows, err := s.db.Query(ctx, fmt.Sprintf(`SELECT %s FROM auth_audit_log WHERE target_id = $1 ORDER BY seq`, auditColumns), targetID)
+	if err != nil {
+		t.Fatalf("failed to query events: %v", err)
+	}
+	events, err := pgx.CollectRows(rows, scanAuditEvent)
+	if err != nil {
+		t.Fatalf("failed to query events: %v", err)
+	}
+	if len(events) != n {
+		t.Fatalf("got %d events, want %d", len(events), n)
+	}
+
+	var head int64
+	if err := s.db.QueryRow(ctx, `SELECT MAX(seq) FROM audit_checkpoints`).Scan(&head); err != nil {
+		t.Fatalf("failed to query checkpoints: %v", err)
+	}
+	if last := events[n-1]; last.Seq != head || last.Hash == "" {
+		t.Fatalf("last event %d is not the checkpointed head %d", last.Seq, head)
+	}
+	return events
+}
+
+// rehash stores events[i:] with their hashes recomputed, as someone
+// rewriting the chain from events[i] on would
+func rehash(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog, i int) {
+	t.Helper()
+
+	for ; i < len(events); i++ {
+		e := &events[i]
+		if i > 0 {
+			e.PrevHash = events[i-1].Hash
+		}
+		e.Hash = audit.Hash(*e)
+		_, err := tx.Exec(context.Background(), `
+			UPDATE auth_audit_log SET action = $2, prev_hash = $3, hash = $4 WHERE id = $1
+		`, e.ID, e.Action, e.PrevHash, e.Hash)
+		if err != nil {
+			t.Fatalf("failed to rewrite event: %v", err)
+		}
+	}
+}
+
+func TestVerifyAuditChainDetectsTampering(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate checkpoint key: %v", err)
+	}
+	pinned := []*rsa.PublicKey{&key.PublicKey}
+	events := recordChainedEvents(t, s, key, 3)
+
+	report, err := VerifyAuditChain(ctx, s.db, pinned, checkpointInterval)
+	if err != nil {
+		t.Fatalf("VerifyAuditChain: %v", err)
+	}
+	if report.Break != nil {
+		t.Fatalf("untouched chain broken at %d: %s", report.Break.Seq, report.Break.Reason)
+	}
+	if report.LastSeq < events[2].Seq || report.Checkpoints == 0 {
+		t.Errorf("report = %+v, want the events and their checkpoint verified", report)
+	}
+
+	tests := []struct {
+		name       string
+		tamper     func(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog)
+		wantSeq    int64
+		wantID     *uuid.UUID
+		wantReason string
+	}{
+		{
+			name: "edited event",
+			tamper: func(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog) {
+				tx.Exec(ctx, `UPDATE auth_audit_log SET action = 'TAMPERED' WHERE id = $1`, events[1].ID)
+			},
+			wantSeq:    events[1].Seq,
+			wantID:     &events[1].ID,
+			wantReason: "content does not match its hash",
+		},
+		{
+			name: "edited and rehashed event",
+			tamper: func(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog) {
+				events[1].Action = "TAMPERED"
+				rehash(t, tx, events[:2], 1)
+			},
+			wantSeq:    events[2].Seq,
+			wantID:     &events[2].ID,
+			wantReason: "prev_hash does not match",
+		},
+		{
+			name: "rewritten chain",
+			tamper: func(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog) {
+				events[1].Action = "TAMPERED"
+				rehash(t, tx, events, 1)
+			},
+			wantSeq:    events[2].Seq,
+			wantID:     &events[2].ID,
+			wantReason: "does not match the checkpoint",
+		},
+		{
+			name: "deleted event",
+			tamper: func(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog) {
+				tx.Exec(ctx, `DELETE FROM auth_audit_log WHERE id = $1`, events[1].ID)
+			},
+			wantSeq:    events[2].Seq,
+			wantID:     &events[2].ID,
+			wantReason: "are missing",
+		},
+		{
+			name: "deleted tail",
+			tamper: func(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog) {
+				tx.Exec(ctx, `DELETE FROM auth_audit_log WHERE id = $1`, events[2].ID)
+			},
+			wantSeq:    events[2].Seq,
+			wantReason: "a checkpoint was signed at event",
+		},
+		{
+			name: "forged checkpoint",
+			tamper: func(t *testing.T, tx pgx.Tx, events []models.AuthAuditLog) {
+				tx.Exec(ctx, `UPDATE audit_checkpoints SET hash = $2 WHERE seq = $1`, events[2].Seq, events[1].Hash)
+			},
+			wantSeq:    events[2].Seq,
+			wantReason: "checkpoint signature does not verify",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Tampering is rolled back with the transaction
+			tx, err := s.db.Begin(ctx)
+			if err != nil {
+				t.Fatalf("failed to begin transaction: %v", err)
+			}
+			defer tx.Rollback(ctx)
+
+			tt.tamper(t, tx, append([]models.AuthAuditLog(nil), events...))
+
+			report, err := VerifyAuditChain(ctx, tx, pinned, checkpointInterval)
+			if err != nil {
+				t.Fatalf("VerifyAuditChain: %v", err)
+			}
+			if report.Break == nil {
+				t.Fatal("tampering was not detected")
+			}
+			if report.Break.Seq != tt.wantSeq || !strings.Contains(report.Break.Reason, tt.wantReason) {
+				t.Errorf("break = %d: %s, want %d: ...%s...", report.Break.Seq, report.Break.Reason, tt.wantSeq, tt.wantReason)
+			}
+			if tt.wantID != nil && (report.Break.ID == nil || *report.Break.ID != *tt.wantID) {
+				t.Errorf("break names event %v, want %s", report.Break.ID, *tt.wantID)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditChainUnpinnedCheckpoint(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate checkpoint key: %v", err)
+	}
+	recordChainedEvents(t, s, key, 1)
+
+	// A checkpoint signed with a key that is not pinned vouches for nothing
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate checkpoint key: %v", err)
+	}
+	report, err := VerifyAuditChain(ctx, s.db, []*rsa.PublicKey{&other.PublicKey}, checkpointInterval)
+	if err != nil {
+		t.Fatalf("VerifyAuditChain: %v", err)
+	}
+	if report.UnpinnedCheckpoints == 0 {
+		t.Error("checkpoint signed with an unpinned key was not counted")
+	}
+}
+
+func TestRecordDoesNotWaitForOtherTransactions(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	// A transaction that recorded an event and has not committed yet
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	if err := audit.Record(ctx, tx, audit.Event{Action: "TEST_EVENT", TargetType: "test"}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	recordCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := audit.Record(recordCtx, s.db, audit.Event{Action: "TEST_EVENT", TargetType: "test"}); err != nil {
+		t.Fatalf("Record while another transaction is recording: %v", err)
+	}
+
+	// Chaining skips the uncommitted event rather than waiting for it
+	chainCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := audit.NewChainer(s.db).Chain(chainCtx); err != nil {
+		t.Fatalf("Chain while another transaction is recording: %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/mail"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// AMREmail marks a sign-in with a link or code sent by email. Like
+// AMRFederated it is not registered in RFC 8176.
+const AMREmail = "email"
+
+// Ways to sign in by email
+const (
+	EmailLoginLink = "link"
+	EmailLoginCode = "code"
+)
+
+const (
+	// emailLoginTTL is how long a sign-in link or code stays valid
+	emailLoginTTL = 10 * time.Minute
+
+	// emailLoginMaxAttempts is how many wrong codes a request tolerates
+	emailLoginMaxAttempts = 5
+
+	// emailLoginWindow is the period the rate limits below apply to
+	emailLoginWindow = 15 * time.Minute
+
+	// emailLoginMaxPerEmail and emailLoginMaxPerIP bound how many links
+	// and codes can be requested per window for one email address and
+	// from one IP address
+	emailLoginMaxPerEmail = 5
+	emailLoginMaxPerIP    = 20
+)
+
+var (
+	// ErrInvalidEmailLogin is returned for an unknown, expired, used or
+	// exhausted sign-in link or code
+	ErrInvalidEmailLogin = errors.New("invalid or expired sign-in link or code")
+
+	// ErrTooManyRequests is returned when an email address or IP address
+	// has requested too many sign-in emails recently
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// StartEmailLogin emails a sign-in link or code to email. loginCtx says
+// where the login goes once the email is proven. For codes it returns the
+// challenge to send back with the code; the browser keeps it so that a
+// code alone is useless. Emails without an account get one when they sign
+// in, so no error reveals whether an account exists.
+func (s *Service) StartEmailLogin(ctx context.Context, email, method string, loginCtx *LoginContext, remoteAddr string) (string, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return "", err
+	}
+	if method != EmailLoginLink && method != EmailLoginCode {
+		return "", fmt.Errorf("unknown email login method %q", method)
+	}
+	ip := audit.ClientIP(remoteAddr)
+
+	var byEmail, byIP int
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM email_logins WHERE email = $1 AND created_at > $3),
+			(SELECT COUNT(*) FROM email_logins WHERE ip_address = NULLIF($2, '')::inet AND created_at > $3)
+	`
+	if err := s.db.QueryRow(ctx, query, email, ip, time.Now().Add(-emailLoginWindow)).Scan(&byEmail, &byIP); err != nil {
+		return "", fmt.Errorf("failed to count email logins: %w", err)
+	}
+	if byEmail >= emailLoginMaxPerEmail || byIP >= emailLoginMaxPerIP {
+		return "", ErrTooManyRequests
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	var code string
+	var codeHash *string
+	if method == EmailLoginCode {
+		n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate code: %w", err)
+		}
+		code = fmt.Sprintf("%06d", n.Int64())
+		hash := s.hashLoginCode(token, code)
+		codeHash = &hash
+	}
+
+	encoded, err := json.Marshal(loginCtx)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode login context: %w", err)
+	}
+
+	query = `
+		INSERT INTO email_logins (email, token_hash, code_hash, login_context, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::inet, $6)
+	`
+	_, err = s.db.Exec(ctx, query, email, hashSecret(token), codeHash, encoded, ip, time.Now().Add(emailLoginTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store email login: %w", err)
+	}
+
+	if method == EmailLoginCode {
+		s.sendMail(email, mail.TemplateLoginCode, mail.TemplateData{
+			Code:      code,
+			ExpiresIn: emailLoginTTL,
+		})
+		return token, nil
+	}
+
+	s.sendMail(email, mail.TemplateMagicLink, mail.TemplateData{
+		URL:       s.cfg.FrontendURL + "/email-login?token=" + url.QueryEscape(token),
+		ExpiresIn: emailLoginTTL,
+	})
+	return "", nil
+}
+
+// FinishEmailLogin redeems a sign-in link's token, or a challenge and the
+// code emailed for it, and returns the user and the login to complete. The
+// user is created on their first sign-in. Wrong codes count as attempts.
+func (s *Service) FinishEmailLogin(ctx context.Context, token, code string) (*models.User, *LoginContext, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var requestID uuid.UUID
+	var email string
+	var codeHash *string
+	var encoded []byte
+	query := `
+		SELECT id, email, code_hash, login_context
+		FROM email_logins
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() AND attempts < $2
+		FOR UPDATE
+	`
+	err = tx.QueryRow(ctx, query, hashSecret(token), emailLoginMaxAttempts).Scan(&requestID, &email, &codeHash, &encoded)
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrInvalidEmailLogin
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query email login: %w", err)
+	}
+
+	// A link's token must not be accepted as a code's challenge and the
+	// other way round
+	if (codeHash == nil) != (code == "") {
+		return nil, nil, ErrInvalidEmailLogin
+	}
+	if codeHash != nil && !hmac.Equal([]byte(*codeHash), []byte(s.hashLoginCode(token, normalizeCode(code)))) {
+		// Count the failure outside the transaction so it is not rolled
+		// back; release the row lock first
+		tx.Rollback(ctx)
+		if _, err := s.db.Exec(ctx, `UPDATE email_logins SET attempts = attempts + 1 WHERE id = $1`, requestID); err != nil {
+			return nil, nil, fmt.Errorf("failed to record attempt: %w", err)
+		}
+		return nil, nil, ErrInvalidEmailLogin
+	}
+
+	// Every other link and code sent to the email stops working too
+	_, err = tx.Exec(ctx, `UPDATE email_logins SET used_at = NOW() WHERE email = $1 AND used_at IS NULL`, email)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to consume email login: %w", err)
+	}
+
+	user, created, err := s.provisionEmailUser(ctx, tx, email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if created {
+		s.LogAuthEvent(ctx, &user.ID, "USER_REGISTERED", "", "")
+	}
+
+	var loginCtx LoginContext
+	if err := json.Unmarshal(encoded, &loginCtx); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode login context: %w", err)
+	}
+	loginCtx.AMR = []string{AMREmail}
+	loginCtx.AuthTime = time.Now()
+
+	return user, &loginCtx, nil
+}
+
+// provisionEmailUser returns the user owning email, creating them if there
+// is none, and whether they were created. Signing in proves the email, so
+// it is marked verified and ADMIN_EMAILS get the admin role.
+func (s *Service) provisionEmailUser(ctx context.Context, tx pgx.Tx, email string) (*models.User, bool, error) {
+	var user models.User
+	var deleted bool
+	err := tx.QueryRow(ctx, `SELECT id, deleted_at IS NOT NULL FROM users WHERE lower(email) = $1`, email).Scan(&user.ID, &deleted)
+	switch {
+	case err == pgx.ErrNoRows:
+		role := models.RoleUser
+		if s.isAdminEmail(email) {
+			role = models.RoleAdmin
+		}
+		name, _, _ := strings.Cut(email, "@")
+
+		query := `
+			INSERT INTO users AS u (email, name, role, is_active, email_verified_at)
+			VALUES ($1, $2, $3, true, NOW())
+			RETURNING ` + userColumns + `
+		`
+		err = tx.QueryRow(ctx, query, email, name, role).Scan(
+			&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
+			&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
+		)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to create user: %w", err)
+		}
+		return &user, true, nil
+	case err != nil:
+		return nil, false, fmt.Errorf("failed to query user: %w", err)
+	case deleted:
+		return nil, false, ErrInvalidEmailLogin
+	}
+
+	if err := s.markEmailVerified(ctx, tx, user.ID); err != nil {
+		return nil, false, err
+	}
+
+	err = tx.QueryRow(ctx, `SELECT `+userColumns+` FROM users u WHERE u.id = $1`, user.ID).Scan(
+		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
+		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query user: %w", err)
+	}
+	return &user, false, nil
+}
+
+// hashLoginCode binds a code to its challenge under a server key. Six
+// digits are quickly brute-forced, so a plain hash would not protect them.
+func (s *Service) hashLoginCode(token, code string) string {
+	mac := hmac.New(sha256.New, s.cfg.MFAEncryptionKey)
+	mac.Write([]byte("email-login\x00" + token + "\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// linkRequestTTL is how long a user has to finish linking an identity
+const linkRequestTTL = 10 * time.Minute
+
+var (
+	// ErrIdentityNotFound is returned for an identity the user does not have
+	ErrIdentityNotFound = errors.New("identity not found")
+
+	// ErrIdentityInUse is returned when linking an identity that already
+	// belongs to another user
+	ErrIdentityInUse = errors.New("identity is linked to another account")
+
+	// ErrLastIdentity is returned when unlinking the only way a user can
+	// sign in
+	ErrLastIdentity = errors.New("cannot unlink the last identity")
+
+	// ErrInvalidLinkRequest is returned for an unknown, expired or used link
+	// request, or one for a different provider
+	ErrInvalidLinkRequest = errors.New("invalid link request")
+)
+
+// ListUserIdentities returns the provider accounts linked to a user
+func (s *Service) ListUserIdentities(ctx context.Context, userID uuid.UUID) ([]models.UserIdentity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, email, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []models.UserIdentity{}
+	for rows.Next() {
+		var identity models.UserIdentity
+		if err := rows.Scan(
+			&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject,
+			&identity.Email, &identity.CreatedAt, &identity.LastLoginAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan identity: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// CreateLinkRequest starts linking an identity at provider to a signed-in
+// user and returns the token that identifies the request through the login
+// round trip
+func (s *Service) CreateLinkRequest(ctx context.Context, userID uuid.UUID, provider string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate link token: %w", err)
+	}
+
+	query := `
+		INSERT INTO identity_link_requests (token_hash, user_id, provider, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err = s.db.Exec(ctx, query, hashSecret(token), userID, provider, time.Now().Add(linkRequestTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store link request: %w", err)
+	}
+
+	return token, nil
+}
+
+// LinkIdentity completes a link request by attaching identity to the user
+// who started it, and returns that user's ID
+func (s *Service) LinkIdentity(ctx context.Context, token string, identity *models.ExternalIdentity) (uuid.UUID, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID uuid.UUID
+	var provider string
+	err = tx.QueryRow(ctx, `
+		UPDATE identity_link_requests
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, provider
+	`, hashSecret(token)).Scan(&userID, &provider)
+	if err == pgx.ErrNoRows {
+		return uuid.Nil, ErrInvalidLinkRequest
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to redeem link request: %w", err)
+	}
+	if provider != identity.Provider {
+		return uuid.Nil, ErrInvalidLinkRequest
+	}
+
+	var ownerID uuid.UUID
+	err = tx.QueryRow(ctx, `
+		SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2
+	`, identity.Provider, identity.Subject).Scan(&ownerID)
+	switch {
+	case err == pgx.ErrNoRows:
+		if err := insertIdentity(ctx, tx, userID, identity); err != nil {
+			return uuid.Nil, err
+		}
+	case err != nil:
+		return uuid.Nil, fmt.Errorf("failed to query identity: %w", err)
+	case ownerID != userID:
+		return uuid.Nil, ErrIdentityInUse
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return userID, nil
+}
+
+// UnlinkIdentity removes one of a user's identities, refusing to remove
+// the last one unless the user has a password
+func (s *Service) UnlinkIdentity(ctx context.Context, userID, identityID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the user's identities so two concurrent unlinks cannot remove
+	// both of the last two
+	rows, err := tx.Query(ctx, `SELECT id FROM user_identities WHERE user_id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to query identities: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return fmt.Errorf("failed to query identities: %w", err)
+	}
+
+	found := false
+	for _, id := range ids {
+		if id == identityID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrIdentityNotFound
+	}
+	if len(ids) == 1 {
+		// A password is another way to sign in
+		var hasPassword bool
+		if err := tx.QueryRow(ctx, `SELECT password_hash IS NOT NULL FROM users WHERE id = $1`, userID).Scan(&hasPassword); err != nil {
+			return fmt.Errorf("failed to query user: %w", err)
+		}
+		if !hasPassword {
+			return ErrLastIdentity
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM user_identities WHERE id = $1`, identityID); err != nil {
+		return fmt.Errorf("failed to delete identity: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func insertIdentity(ctx context.Context, tx pgx.Tx, userID uuid.UUID, identity *models.ExternalIdentity) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`, userID, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		return fmt.Errorf("failed to create identity: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/jackc/pgx/v5"
+)
+
+const signingKeyBits = 4096
+
+// KeyRing holds the signing keys loaded from the signing_keys table: the
+// active key used to sign new tokens and every key that tokens may still be
+// verified with. It implements customJWT.KeyLookup.
+type KeyRing struct {
+	db  *database.DB
+	cfg *config.Config
+
+	// legacyKeyID is the kid of the key from JWT_PRIVATE_KEY_PATH, used for
+	// tokens that were signed before tokens carried a kid.
+	legacyKeyID string
+
+	mu     sync.RWMutex
+	active *customJWT.SigningKey
+	public map[string]*rsa.PublicKey
+	keys   []models.SigningKey
+}
+
+// NewKeyRing loads the key ring, seeding it with the configured key pair the
+// first time the service runs against an empty signing_keys table.
+func NewKeyRing(ctx context.Context, db *database.DB, cfg *config.Config) (*KeyRing, error) {
+	k := &KeyRing{
+		db:          db,
+		cfg:         cfg,
+		legacyKeyID: customJWT.KeyID(cfg.JWTPublicKey),
+	}
+
+	if err := k.bootstrap(ctx); err != nil {
+		return nil, err
+	}
+	if err := k.Reload(ctx); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (k *KeyRing) bootstrap(ctx context.Context) error {
+	privatePEM, publicPEM, err := encodeKeyPair(k.cfg.JWTPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO signing_keys (id, private_key, public_key, status, activates_at)
+		SELECT $1, $2, $3, 'active', NOW()
+		WHERE NOT EXISTS (SELECT 1 FROM signing_keys)
+		ON CONFLICT DO NOTHING
+	`
+	if _, err := k.db.Exec(ctx, query, k.legacyKeyID, privatePEM, publicPEM); err != nil {
+		return fmt.Errorf("failed to seed signing keys: %w", err)
+	}
+	return nil
+}
+
+// Active returns the key new tokens are signed with
+func (k *KeyRing) Active() *customJWT.SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// PublicKey returns the verification key for kid
+func (k *KeyRing) PublicKey(kid string) (*rsa.PublicKey, error) {
+	if kid == "" {
+		kid = k.legacyKeyID
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	pub, ok := k.public[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return pub, nil
+}
+
+// JWKS returns every published verification key
+func (k *KeyRing) JWKS() customJWT.JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	jwks := customJWT.JWKS{Keys: []customJWT.JWK{}}
+	for _, key := range k.keys {
+		jwks.Keys = append(jwks.Keys, customJWT.NewRSAJWK(key.ID, k.public[key.ID]))
+	}
+	return jwks
+}
+
+// Keys returns metadata for every published key
+func (k *KeyRing) Keys() []models.SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]models.SigningKey, len(k.keys))
+	copy(keys, k.keys)
+	return keys
+}
+
+// Reload reads the published keys from the database
+func (k *KeyRing) Reload(ctx context.Context) error {
+	query := `
+		SELECT id, algorithm, private_key, public_key, status, activates_at, retired_at, expires_at, created_at
+		FROM signing_keys
+		WHERE status <> 'retired' OR expires_at > NOW()
+		ORDER BY activates_at DESC
+	`
+
+	rows, err := k.db.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to query signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	var active *customJWT.SigningKey
+	public := make(map[string]*rsa.PublicKey)
+	keys := []models.SigningKey{}
+
+	for rows.Next() {
+		var key models.SigningKey
+		var privatePEM, publicPEM string
+		err := rows.Scan(
+			&key.ID, &key.Algorithm, &privatePEM, &publicPEM, &key.Status,
+			&key.ActivatesAt, &key.RetiredAt, &key.ExpiresAt, &key.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to scan signing key: %w", err)
+		}
+
+		pub, err := decodePublicKey(publicPEM)
+		if err != nil {
+			return fmt.Errorf("invalid public key %s: %w", key.ID, err)
+		}
+		public[key.ID] = pub
+		keys = append(keys, key)
+
+		if key.Status == models.KeyStatusActive {
+			priv, err := decodePrivateKey(privatePEM)
+			if err != nil {
+				return fmt.Errorf("invalid private key %s: %w", key.ID, err)
+			}
+			active = &customJWT.SigningKey{ID: key.ID, PrivateKey: priv}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read signing keys: %w", err)
+	}
+
+	if active == nil {
+		return fmt.Errorf("no active signing key")
+	}
+
+	k.mu.Lock()
+	k.active = active
+	k.public = public
+	k.keys = keys
+	k.mu.Unlock()
+
+	return nil
+}
+
+// ScheduleRotation generates a new key that becomes active at activateAt.
+// Until then it is published as an upcoming key.
+func (k *KeyRing) ScheduleRotation(ctx context.Context, activateAt time.Time) (*models.SigningKey, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	privatePEM, publicPEM, err := encodeKeyPair(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := k.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var key models.SigningKey
+	query := `
+		INSERT INTO signing_keys (id, private_key, public_key, status, activates_at)
+		VALUES ($1, $2, $3, 'upcoming', $4)
+		RETURNING id, algorithm, status, activates_at, retired_at, expires_at, created_at
+	`
+	err = tx.QueryRow(ctx, query, customJWT.KeyID(&priv.PublicKey), privatePEM, publicPEM, activateAt).Scan(
+		&key.ID, &key.Algorithm, &key.Status, &key.ActivatesAt, &key.RetiredAt, &key.ExpiresAt, &key.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store signing key: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "SIGNING_KEY_ROTATION_SCHEDULED", audit.TargetSigningKey, key.ID, nil, key); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if err := k.promote(ctx); err != nil {
+		return nil, err
+	}
+	if err := k.Reload(ctx); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// promote activates the most recent upcoming key whose activation time has
+// passed and retires the previously active key. It is safe to run
+// concurrently from several replicas.
+func (k *KeyRing) promote(ctx context.Context) error {
+	tx, err := k.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var kid string
+	dueQuery := `
+		SELECT id FROM signing_keys
+		WHERE status = 'upcoming' AND activates_at <= NOW()
+		ORDER BY activates_at DESC
+		LIMIT 1
+		FOR UPDATE
+	`
+	err = tx.QueryRow(ctx, dueQuery).Scan(&kid)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query upcoming keys: %w", err)
+	}
+
+	// Retire the active key and any upcoming key superseded by this one
+	retireQuery := `
+		UPDATE signing_keys
+		SET status = 'retired', retired_at = NOW(), expires_at = NOW() + make_interval(secs => $2)
+		WHERE id <> $1 AND (status = 'active' OR (status = 'upcoming' AND activates_at <= NOW()))
+	`
+	if _, err := tx.Exec(ctx, retireQuery, kid, k.cfg.JWTRetiredKeyTTL.Seconds()); err != nil {
+		return fmt.Errorf("failed to retire signing keys: %w", err)
+	}
+
+	activateQuery := `UPDATE signing_keys SET status = 'active' WHERE id = $1`
+	if _, err := tx.Exec(ctx, activateQuery, kid); err != nil {
+		return fmt.Errorf("failed to activate signing key: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit key rotation: %w", err)
+	}
+
+	log.Printf("Activated signing key %s", kid)
+	return nil
+}
+
+// Run promotes due keys and reloads the key ring every interval until ctx is
+// cancelled, so replicas pick up rotations made elsewhere.
+func (k *KeyRing) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.promote(ctx); err != nil {
+				log.Printf("Warning: signing key promotion failed: %v", err)
+			}
+			if err := k.Reload(ctx); err != nil {
+				log.Printf("Warning: signing key reload failed: %v", err)
+			}
+		}
+	}
+}
+
+func encodeKeyPair(priv *rsa.PrivateKey) (privatePEM, publicPEM string, err error) {
+	privateBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode private key: %w", err)
+	}
+	publicBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	privatePEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateBytes}))
+	publicPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}))
+	return privatePEM, publicPEM, nil
+}
+
+func decodePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func decodePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+	return rsaPub, nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// loginCodeTTL is how long the code a login redirects with can be exchanged
+const loginCodeTTL = time.Minute
+
+// Response modes say how a finished login hands its result to the redirect
+// URI's /auth/callback page
+const (
+	// ResponseModeQuery sends a one-time code in the query, to be exchanged
+	// for tokens with ExchangeLoginCode. It is the default.
+	ResponseModeQuery = "query"
+
+	// ResponseModeFragment sends the access token itself in the fragment,
+	// for clients written before login codes existed
+	ResponseModeFragment = "fragment"
+)
+
+// ErrInvalidLoginCode is returned for an unknown, expired or used login
+// code, or one issued for another redirect URI or application
+var ErrInvalidLoginCode = errors.New("invalid or expired login code")
+
+// CreateLoginCode stores a single-use code standing for userID's finished
+// login and returns it
+func (s *Service) CreateLoginCode(ctx context.Context, userID uuid.UUID, loginCtx *LoginContext) (string, error) {
+	code, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate login code: %w", err)
+	}
+
+	var clientID *string
+	if loginCtx.ClientID != "" {
+		clientID = &loginCtx.ClientID
+	}
+
+	query := `
+		INSERT INTO login_codes (code_hash, user_id, client_id, redirect_uri, amr, auth_time, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err = s.db.Exec(ctx, query,
+		hashSecret(code), userID, clientID, loginCtx.RedirectURI,
+		nonNilAMR(loginCtx.AMR), loginCtx.AuthTime, time.Now().Add(loginCodeTTL),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store login code: %w", err)
+	}
+
+	return code, nil
+}
+
+// ExchangeLoginCode redeems a login code issued for clientID and
+// redirectURI and issues the login's tokens
+func (s *Service) ExchangeLoginCode(ctx context.Context, code, clientID, redirectURI string) (*models.User, *models.TokenPair, error) {
+	query := `
+		UPDATE login_codes
+		SET used_at = NOW()
+		WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, COALESCE(client_id, ''), redirect_uri, amr
+	`
+
+	var userID uuid.UUID
+	var codeClientID, codeRedirectURI string
+	var amr []string
+	err := s.db.QueryRow(ctx, query, hashSecret(code)).Scan(&userID, &codeClientID, &codeRedirectURI, &amr)
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrInvalidLoginCode
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to redeem login code: %w", err)
+	}
+
+	if codeClientID != clientID || codeRedirectURI != redirectURI {
+		return nil, nil, ErrInvalidLoginCode
+	}
+
+	user, err := s.GetActiveUser(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens, err := s.GenerateTokens(ctx, user, TokenOptions{
+		ClientID: clientID,
+		AMR:      amr,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, tokens, nil
+}
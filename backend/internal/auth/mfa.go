@@ -0,0 +1,575 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/frans-sjostrom/auth-service/pkg/totp"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Authentication method references (RFC 8176) recorded in tokens
+const (
+	// AMRFederated marks a sign-in at an upstream identity provider. It is
+	// not registered in RFC 8176, which has no value for federated logins.
+	AMRFederated = "fed"
+	AMROTP       = "otp"
+	AMRMFA       = "mfa"
+
+	// AMRHardwareKey marks proof of possession of a passkey
+	AMRHardwareKey = "hwk"
+)
+
+const (
+	// mfaChallengeTTL is how long a user has to enter their second factor
+	mfaChallengeTTL = 5 * time.Minute
+
+	// mfaMaxAttempts is how many wrong codes a challenge tolerates, and how
+	// many a user may enter to enroll or change their second factors before
+	// being locked out for mfaLockout
+	mfaMaxAttempts = 5
+	mfaLockout     = 15 * time.Minute
+
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+
+	// totpSkew is the number of 30 second steps of clock drift accepted
+	totpSkew = 1
+
+	// totpIssuer names the account in authenticator apps
+	totpIssuer = "Auth Service"
+)
+
+var (
+	// ErrMFANotEnabled is returned when a user has no confirmed second factor
+	ErrMFANotEnabled = errors.New("multi-factor authentication is not enabled")
+
+	// ErrMFAAlreadyEnabled is returned when enrolling a user who already has
+	// a confirmed TOTP authenticator
+	ErrMFAAlreadyEnabled = errors.New("multi-factor authentication is already enabled")
+
+	// ErrInvalidMFACode is returned for a wrong, reused or expired code
+	ErrInvalidMFACode = errors.New("invalid code")
+
+	// ErrInvalidMFAChallenge is returned for an unknown, expired, used or
+	// exhausted challenge
+	ErrInvalidMFAChallenge = errors.New("invalid or expired challenge")
+
+	// ErrMFALocked is returned while a user is locked out of changing their
+	// second factors after too many wrong codes
+	ErrMFALocked = errors.New("too many invalid codes")
+)
+
+// LoginContext is what a login needs to finish once the second factor has
+// been verified
+type LoginContext struct {
+	// RedirectURI and ClientID describe a login to the auth-service's own
+	// frontend or a registered application
+	RedirectURI string `json:"redirect_uri,omitempty"`
+	ClientID    string `json:"client_id,omitempty"`
+
+	// ResponseMode is ResponseModeQuery or ResponseModeFragment
+	ResponseMode string `json:"response_mode,omitempty"`
+
+	// AuthorizeRequest is the encoded /authorize query of an OpenID Connect
+	// login
+	AuthorizeRequest string `json:"authorize_request,omitempty"`
+
+	AMR      []string  `json:"amr"`
+	AuthTime time.Time `json:"auth_time"`
+}
+
+// MFAEnabled reports whether a user has a second factor: a confirmed TOTP
+// authenticator or a passkey
+func (s *Service) MFAEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return hasSecondFactor(ctx, s.db, userID)
+}
+
+// GetMFAStatus describes a user's second factors
+func (s *Service) GetMFAStatus(ctx context.Context, userID uuid.UUID) (*models.MFAStatus, error) {
+	query := `
+		SELECT
+			(SELECT confirmed_at FROM user_totp WHERE user_id = $1),
+			(SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL),
+			(SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $1)
+	`
+
+	var status models.MFAStatus
+	if err := s.db.QueryRow(ctx, query, userID).Scan(&status.TOTPEnabledAt, &status.RecoveryCodesRemaining, &status.Passkeys); err != nil {
+		return nil, fmt.Errorf("failed to query MFA status: %w", err)
+	}
+	status.TOTPEnabled = status.TOTPEnabledAt != nil
+
+	return &status, nil
+}
+
+// BeginTOTPEnrollment generates a TOTP secret for user. It only takes effect
+// once confirmed with ConfirmTOTPEnrollment; starting again replaces an
+// unconfirmed secret.
+func (s *Service) BeginTOTPEnrollment(ctx context.Context, user *models.User) (*models.TOTPEnrollment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+
+	encrypted, err := s.encryptSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO user_totp (user_id, secret_encrypted)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret_encrypted = EXCLUDED.secret_encrypted, last_used_step = NULL, created_at = NOW()
+		WHERE user_totp.confirmed_at IS NULL
+	`
+	result, err := s.db.Exec(ctx, query, user.ID, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store TOTP secret: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	return &models.TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.URI(secret, totpIssuer, user.Email),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment enables TOTP for a user after checking a first code
+// from their authenticator, and returns their recovery codes. Wrong codes
+// count towards the same lockout as changing second factors.
+func (s *Service) ConfirmTOTPEnrollment(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var step int64
+	err = s.limitUserMFAAttempts(ctx, tx, userID, func() error {
+		var encrypted []byte
+		query := `SELECT secret_encrypted FROM user_totp WHERE user_id = $1 AND confirmed_at IS NULL FOR UPDATE`
+		err := tx.QueryRow(ctx, query, userID).Scan(&encrypted)
+		if err == pgx.ErrNoRows {
+			return ErrMFANotEnabled
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query TOTP secret: %w", err)
+		}
+
+		secret, err := s.decryptSecret(encrypted)
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		if step, ok = totp.Validate(secret, normalizeCode(code), time.Now(), totpSkew); !ok {
+			return ErrInvalidMFACode
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE user_totp SET confirmed_at = NOW(), last_used_step = $2 WHERE user_id = $1`, userID, step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable TOTP: %w", err)
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP removes a user's TOTP authenticator, and their recovery codes
+// unless they still have a passkey. A current code or recovery code is
+// required so a stolen session alone cannot turn the second factor off.
+func (s *Service) DisableTOTP(ctx context.Context, userID uuid.UUID, code string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := s.verifyUserSecondFactor(ctx, tx, userID, code); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, `DELETE FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete TOTP secret: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrMFANotEnabled
+	}
+	if err := deleteUnusableRecoveryCodes(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking a
+// current code
+func (s *Service) RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := s.verifyUserSecondFactor(ctx, tx, userID, code); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return codes, nil
+}
+
+// CreateMFAChallenge parks a login until the user has entered their second
+// factor and returns the token identifying it
+func (s *Service) CreateMFAChallenge(ctx context.Context, userID uuid.UUID, loginCtx *LoginContext) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	encoded, err := json.Marshal(loginCtx)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode login context: %w", err)
+	}
+
+	query := `
+		INSERT INTO mfa_challenges (token_hash, user_id, login_context, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err = s.db.Exec(ctx, query, hashSecret(token), userID, encoded, time.Now().Add(mfaChallengeTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store challenge: %w", err)
+	}
+
+	return token, nil
+}
+
+// VerifyMFAChallenge checks a second factor code against a challenge. On
+// success the challenge is consumed and the parked login is returned with
+// the second factor added to its amr.
+func (s *Service) VerifyMFAChallenge(ctx context.Context, token, code string) (*models.User, *LoginContext, error) {
+	verify := func(tx pgx.Tx, userID, _ uuid.UUID) error {
+		return s.verifySecondFactor(ctx, tx, userID, code)
+	}
+	return s.completeMFAChallenge(ctx, token, verify, AMROTP)
+}
+
+// completeMFAChallenge consumes a challenge once verify accepts the second
+// factor, adding amr to the parked login. Rejections count as attempts.
+func (s *Service) completeMFAChallenge(ctx context.Context, token string, verify func(tx pgx.Tx, userID, challengeID uuid.UUID) error, amr string) (*models.User, *LoginContext, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var challengeID, userID uuid.UUID
+	var encoded []byte
+	query := `
+		SELECT id, user_id, login_context
+		FROM mfa_challenges
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() AND attempts < $2
+		FOR UPDATE
+	`
+	err = tx.QueryRow(ctx, query, hashSecret(token), mfaMaxAttempts).Scan(&challengeID, &userID, &encoded)
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query challenge: %w", err)
+	}
+
+	if err := verify(tx, userID, challengeID); err != nil {
+		if !errors.Is(err, ErrInvalidMFACode) && !errors.Is(err, ErrInvalidPasskey) {
+			return nil, nil, err
+		}
+		// Count the failure outside the transaction so it is not rolled
+		// back; release the row lock first
+		tx.Rollback(ctx)
+		if _, dbErr := s.db.Exec(ctx, `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = $1`, challengeID); dbErr != nil {
+			return nil, nil, fmt.Errorf("failed to record attempt: %w", dbErr)
+		}
+		return nil, nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE mfa_challenges SET used_at = NOW() WHERE id = $1`, challengeID); err != nil {
+		return nil, nil, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	var loginCtx LoginContext
+	if err := json.Unmarshal(encoded, &loginCtx); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode login context: %w", err)
+	}
+	loginCtx.AMR = append(loginCtx.AMR, amr, AMRMFA)
+
+	user, err := s.GetActiveUser(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, &loginCtx, nil
+}
+
+// verifyUserSecondFactor checks a code a signed-in user entered to change
+// their second factors. Unlike at login there is no challenge to use up, so
+// wrong codes are counted per user: reaching mfaMaxAttempts locks the user
+// out for mfaLockout. On a wrong code tx is rolled back.
+func (s *Service) verifyUserSecondFactor(ctx context.Context, tx pgx.Tx, userID uuid.UUID, code string) error {
+	return s.limitUserMFAAttempts(ctx, tx, userID, func() error {
+		return s.verifySecondFactor(ctx, tx, userID, code)
+	})
+}
+
+// limitUserMFAAttempts runs verify unless userID is locked out, counting it
+// returning ErrInvalidMFACode as a wrong code. On a wrong code tx is rolled
+// back.
+func (s *Service) limitUserMFAAttempts(ctx context.Context, tx pgx.Tx, userID uuid.UUID, verify func() error) error {
+	var locked bool
+	query := `SELECT COALESCE(mfa_locked_until > NOW(), false) FROM users WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRow(ctx, query, userID).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to query user: %w", err)
+	}
+	if locked {
+		return ErrMFALocked
+	}
+
+	err := verify()
+	if errors.Is(err, ErrInvalidMFACode) {
+		// Count the failure outside the transaction so it is not rolled
+		// back; release the row lock first
+		tx.Rollback(ctx)
+		_, dbErr := s.db.Exec(ctx, `
+			UPDATE users
+			SET mfa_failed_attempts = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN 0 ELSE mfa_failed_attempts + 1 END,
+				mfa_locked_until = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN $3 ELSE mfa_locked_until END
+			WHERE id = $1
+		`, userID, mfaMaxAttempts, time.Now().Add(mfaLockout))
+		if dbErr != nil {
+			return fmt.Errorf("failed to record attempt: %w", dbErr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET mfa_failed_attempts = 0 WHERE id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to reset attempts: %w", err)
+	}
+	return nil
+}
+
+// verifySecondFactor checks a TOTP code, or else a recovery code. Used codes
+// are recorded within tx so they cannot be replayed.
+func (s *Service) verifySecondFactor(ctx context.Context, tx pgx.Tx, userID uuid.UUID, code string) error {
+	code = normalizeCode(code)
+
+	var encrypted []byte
+	var lastUsedStep *int64
+	query := `SELECT secret_encrypted, last_used_step FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL FOR UPDATE`
+	err := tx.QueryRow(ctx, query, userID).Scan(&encrypted, &lastUsedStep)
+	switch {
+	case err == pgx.ErrNoRows:
+		// Users with only passkeys still have recovery codes
+	case err != nil:
+		return fmt.Errorf("failed to query TOTP secret: %w", err)
+	default:
+		secret, err := s.decryptSecret(encrypted)
+		if err != nil {
+			return err
+		}
+
+		if step, ok := totp.Validate(secret, code, time.Now(), totpSkew); ok {
+			if lastUsedStep != nil && step <= *lastUsedStep {
+				return ErrInvalidMFACode
+			}
+			_, err := tx.Exec(ctx, `UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1`, userID, step)
+			if err != nil {
+				return fmt.Errorf("failed to record TOTP use: %w", err)
+			}
+			return nil
+		}
+	}
+
+	result, err := tx.Exec(ctx, `
+		UPDATE mfa_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashSecret(code))
+	if err != nil {
+		return fmt.Errorf("failed to check recovery code: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// replaceRecoveryCodes generates a fresh set of recovery codes for a user,
+// invalidating the old ones
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID uuid.UUID) ([]string, error) {
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		codes[i] = code
+
+		_, err = tx.Exec(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hashSecret(normalizeCode(code)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+
+	return codes, nil
+}
+
+// deleteUnusableRecoveryCodes removes a user's recovery codes once they have
+// no second factor left for them to stand in for
+func deleteUnusableRecoveryCodes(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error {
+	_, err := tx.Exec(ctx, `
+		DELETE FROM mfa_recovery_codes
+		WHERE user_id = $1
+		AND NOT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $1)
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	return nil
+}
+
+// recoveryCodeAlphabet leaves out characters that are easy to misread
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// generateRecoveryCode returns a code like "k3mp9-x2rtq"
+func generateRecoveryCode() (string, error) {
+	// Bytes at or above the largest multiple of the alphabet's length are
+	// drawn again, as taking them modulo the length would favour the first
+	// letters
+	limit := 256 - 256%len(recoveryCodeAlphabet)
+
+	code := make([]byte, 0, 11)
+	b := make([]byte, 16)
+	for len(code) < 11 {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			if int(c) >= limit || len(code) == 11 {
+				continue
+			}
+			if len(code) == 5 {
+				code = append(code, '-')
+			}
+			code = append(code, recoveryCodeAlphabet[int(c)%len(recoveryCodeAlphabet)])
+		}
+	}
+	return string(code), nil
+}
+
+// normalizeCode strips the spaces and dashes people type into codes
+func normalizeCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// encryptSecret seals a TOTP secret with AES-256-GCM, prefixing the nonce
+func (s *Service) encryptSecret(secret string) ([]byte, error) {
+	gcm, err := s.secretCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, []byte(secret), nil), nil
+}
+
+func (s *Service) decryptSecret(encrypted []byte) (string, error) {
+	gcm, err := s.secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	if len(encrypted) < gcm.NonceSize() {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: ciphertext too short")
+	}
+	nonce, ciphertext := encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():]
+
+	secret, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+
+	return string(secret), nil
+}
+
+func (s *Service) secretCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.cfg.MFAEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonNilAMR avoids storing NULL in the NOT NULL amr columns
+func nonNilAMR(amr []string) []string {
+	if amr == nil {
+		return []string{}
+	}
+	return amr
+}
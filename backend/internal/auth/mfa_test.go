@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/pkg/totp"
+)
+
+func TestConfirmTOTPEnrollmentLockout(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+
+	enrollment, err := s.BeginTOTPEnrollment(ctx, user)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment: %v", err)
+	}
+
+	for i := range mfaMaxAttempts {
+		if _, err := s.ConfirmTOTPEnrollment(ctx, user.ID, "abcdef"); !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("wrong code %d: err = %v, want ErrInvalidMFACode", i+1, err)
+		}
+	}
+
+	// Once locked out, even the right code is refused
+	code, err := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	if _, err := s.ConfirmTOTPEnrollment(ctx, user.ID, code); !errors.Is(err, ErrMFALocked) {
+		t.Fatalf("right code while locked out: err = %v, want ErrMFALocked", err)
+	}
+
+	if _, err := s.db.Exec(ctx, `UPDATE users SET mfa_locked_until = NULL WHERE id = $1`, user.ID); err != nil {
+		t.Fatalf("failed to lift lockout: %v", err)
+	}
+	codes, err := s.ConfirmTOTPEnrollment(ctx, user.ID, code)
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment after the lockout: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+}
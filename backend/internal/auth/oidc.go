@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/jackc/pgx/v5"
+)
+
+// authorizationCodeTTL is how long an authorization code can be redeemed
+const authorizationCodeTTL = time.Minute
+
+// PKCE code challenge method accepted by /authorize
+const CodeChallengeS256 = "S256"
+
+var (
+	// ErrInvalidClient is returned when a client is unknown or fails to authenticate
+	ErrInvalidClient = errors.New("invalid client")
+
+	// ErrInvalidGrant is returned when an authorization code is unknown,
+	// expired, already used or does not match the token request
+	ErrInvalidGrant = errors.New("invalid grant")
+)
+
+// CreateAuthorizationCode stores an authorization code for code and returns
+// the code to hand to the client.
+func (s *Service) CreateAuthorizationCode(ctx context.Context, code *models.AuthorizationCode) (string, error) {
+	value, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate authorization code: %w", err)
+	}
+
+	query := `
+		INSERT INTO oauth_authorization_codes (
+			code_hash, client_id, user_id, redirect_uri, scope, nonce,
+			code_challenge, code_challenge_method, amr, auth_time, expires_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`
+	_, err = s.db.Exec(ctx, query,
+		hashSecret(value), code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.Nonce,
+		code.CodeChallenge, code.CodeChallengeMethod, nonNilAMR(code.AMR), code.AuthTime, time.Now().Add(authorizationCodeTTL),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store authorization code: %w", err)
+	}
+
+	return value, nil
+}
+
+// RedeemAuthorizationCode marks an authorization code as used and returns it
+// after checking that it was issued to clientID for redirectURI and that
+// codeVerifier satisfies its PKCE challenge.
+func (s *Service) RedeemAuthorizationCode(ctx context.Context, value, clientID, redirectURI, codeVerifier string) (*models.AuthorizationCode, error) {
+	query := `
+		UPDATE oauth_authorization_codes
+		SET used_at = NOW()
+		WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING client_id, user_id, redirect_uri, scope, nonce, code_challenge, code_challenge_method, amr, auth_time, expires_at
+	`
+
+	var code models.AuthorizationCode
+	err := s.db.QueryRow(ctx, query, hashSecret(value)).Scan(
+		&code.ClientID, &code.UserID, &code.RedirectURI, &code.Scope, &code.Nonce,
+		&code.CodeChallenge, &code.CodeChallengeMethod, &code.AMR, &code.AuthTime, &code.ExpiresAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+
+	if code.ClientID != clientID || code.RedirectURI != redirectURI {
+		return nil, ErrInvalidGrant
+	}
+
+	if code.CodeChallenge != nil {
+		if !verifyCodeChallenge(*code.CodeChallenge, codeVerifier) {
+			return nil, ErrInvalidGrant
+		}
+	} else if codeVerifier != "" {
+		return nil, ErrInvalidGrant
+	}
+
+	return &code, nil
+}
+
+// GenerateIDToken issues an OpenID Connect ID token for user to clientID,
+// bound to and expiring with the access token in tokens
+func (s *Service) GenerateIDToken(user *models.User, clientID, nonce string, authTime time.Time, tokens *models.TokenPair) (string, error) {
+	params := customJWT.IDTokenParams{
+		Issuer:      s.cfg.IssuerURL,
+		Subject:     user.ID.String(),
+		Audience:    clientID,
+		Email:       user.Email,
+		Name:        user.Name,
+		Nonce:       nonce,
+		AuthTime:    authTime,
+		AMR:         tokens.AMR,
+		AccessToken: tokens.AccessToken,
+	}
+	if user.AvatarURL != nil {
+		params.Picture = *user.AvatarURL
+	}
+
+	return customJWT.GenerateIDToken(params, s.keys.Active(), tokens.ExpiresIn)
+}
+
+// verifyCodeChallenge checks an RFC 7636 S256 code verifier
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// hashSecret hashes a high-entropy secret such as a client secret or an
+// authorization code for storage
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
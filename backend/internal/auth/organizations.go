@@ -0,0 +1,708 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/mail"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	// ErrOrganizationNotFound is returned for organizations that do not
+	// exist or that the user is not a member of
+	ErrOrganizationNotFound = errors.New("organization not found")
+
+	// ErrOrganizationForbidden is returned when the user's role in the
+	// organization does not allow the change
+	ErrOrganizationForbidden = errors.New("insufficient organization role")
+
+	// ErrInvalidOrganizationRole is returned for roles other than owner,
+	// admin and member
+	ErrInvalidOrganizationRole = errors.New("invalid organization role")
+
+	// ErrLastOwner is returned when a change would leave an organization
+	// without an owner
+	ErrLastOwner = errors.New("organization must keep an owner")
+
+	// ErrMemberNotFound is returned when the user is not a member of the
+	// organization
+	ErrMemberNotFound = errors.New("member not found")
+
+	// ErrAlreadyMember is returned when inviting a member
+	ErrAlreadyMember = errors.New("user is already a member")
+
+	// ErrInvalidInvite is returned for an unknown, expired or accepted
+	// invitation, or one sent to another email address
+	ErrInvalidInvite = errors.New("invalid or expired invitation")
+)
+
+// orgRoleRank orders organization roles by privilege
+var orgRoleRank = map[string]int{
+	models.OrgRoleMember: 1,
+	models.OrgRoleAdmin:  2,
+	models.OrgRoleOwner:  3,
+}
+
+// organizationRole returns userID's role in orgID, or
+// ErrOrganizationNotFound if they are not a member
+func organizationRole(ctx context.Context, q querier, orgID, userID uuid.UUID) (string, error) {
+	var role string
+	query := `SELECT role FROM organization_members WHERE organization_id = $1 AND user_id = $2`
+	err := q.QueryRow(ctx, query, orgID, userID).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", ErrOrganizationNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query organization member: %w", err)
+	}
+	return role, nil
+}
+
+// requireOrganizationRole returns userID's role in orgID if it is at least
+// minRole
+func requireOrganizationRole(ctx context.Context, q querier, orgID, userID uuid.UUID, minRole string) (string, error) {
+	role, err := organizationRole(ctx, q, orgID, userID)
+	if err != nil {
+		return "", err
+	}
+	if orgRoleRank[role] < orgRoleRank[minRole] {
+		return "", ErrOrganizationForbidden
+	}
+	return role, nil
+}
+
+// CreateOrganization creates an organization owned by userID. It becomes
+// their active organization if they have none.
+func (s *Service) CreateOrganization(ctx context.Context, userID uuid.UUID, name string) (*models.Organization, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	org := models.Organization{Name: name, Role: models.OrgRoleOwner}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO organizations (name) VALUES ($1)
+		RETURNING id, created_at, updated_at
+	`, name).Scan(&org.ID, &org.CreatedAt, &org.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO organization_members (organization_id, user_id, role) VALUES ($1, $2, $3)
+	`, org.ID, userID, models.OrgRoleOwner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add owner: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE users SET active_organization_id = $1
+		WHERE id = $2 AND active_organization_id IS NULL
+	`, org.ID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set active organization: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "ORGANIZATION_CREATED", audit.TargetOrganization, org.ID.String(), nil, org); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &org, nil
+}
+
+// ListOrganizations lists the organizations userID is a member of, with
+// their role in each
+func (s *Service) ListOrganizations(ctx context.Context, userID uuid.UUID) ([]models.Organization, error) {
+	query := `
+		SELECT o.id, o.name, m.role, o.created_at, o.updated_at
+		FROM organizations o
+		JOIN organization_members m ON m.organization_id = o.id
+		WHERE m.user_id = $1
+		ORDER BY o.name
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organizations: %w", err)
+	}
+	defer rows.Close()
+
+	orgs := []models.Organization{}
+	for rows.Next() {
+		var org models.Organization
+		if err := rows.Scan(&org.ID, &org.Name, &org.Role, &org.CreatedAt, &org.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan organization: %w", err)
+		}
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+// GetOrganization loads an organization userID is a member of
+func (s *Service) GetOrganization(ctx context.Context, orgID, userID uuid.UUID) (*models.Organization, error) {
+	query := `
+		SELECT o.id, o.name, m.role, o.created_at, o.updated_at
+		FROM organizations o
+		JOIN organization_members m ON m.organization_id = o.id
+		WHERE o.id = $1 AND m.user_id = $2
+	`
+	var org models.Organization
+	err := s.db.QueryRow(ctx, query, orgID, userID).Scan(&org.ID, &org.Name, &org.Role, &org.CreatedAt, &org.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization: %w", err)
+	}
+	return &org, nil
+}
+
+// RenameOrganization renames an organization; userID must be an admin of it
+func (s *Service) RenameOrganization(ctx context.Context, orgID, userID uuid.UUID, name string) (*models.Organization, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := requireOrganizationRole(ctx, tx, orgID, userID, models.OrgRoleAdmin); err != nil {
+		return nil, err
+	}
+
+	var oldName string
+	err = tx.QueryRow(ctx, `
+		UPDATE organizations o SET name = $1, updated_at = NOW()
+		FROM (SELECT name FROM organizations WHERE id = $2 FOR UPDATE) old
+		WHERE o.id = $2
+		RETURNING old.name
+	`, name, orgID).Scan(&oldName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rename organization: %w", err)
+	}
+
+	err = recordChange(ctx, tx, "ORGANIZATION_UPDATED", audit.TargetOrganization, orgID.String(),
+		map[string]string{"name": oldName}, map[string]string{"name": name},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return s.GetOrganization(ctx, orgID, userID)
+}
+
+// DeleteOrganization deletes an organization with its memberships and
+// invitations; userID must be an owner of it
+func (s *Service) DeleteOrganization(ctx context.Context, orgID, userID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := requireOrganizationRole(ctx, tx, orgID, userID, models.OrgRoleOwner); err != nil {
+		return err
+	}
+
+	// Their tokens name the organization as active
+	rows, err := tx.Query(ctx, `SELECT id FROM users WHERE active_organization_id = $1`, orgID)
+	if err != nil {
+		return fmt.Errorf("failed to query members: %w", err)
+	}
+	activeUsers, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return fmt.Errorf("failed to query members: %w", err)
+	}
+
+	var org models.Organization
+	err = tx.QueryRow(ctx, `
+		DELETE FROM organizations WHERE id = $1
+		RETURNING id, name, created_at, updated_at
+	`, orgID).Scan(&org.ID, &org.Name, &org.CreatedAt, &org.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to delete organization: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "ORGANIZATION_DELETED", audit.TargetOrganization, orgID.String(), org, nil); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, id := range activeUsers {
+		if err := s.denylist.RevokeUser(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListOrganizationMembers lists the members of an organization userID is a
+// member of
+func (s *Service) ListOrganizationMembers(ctx context.Context, orgID, userID uuid.UUID) ([]models.OrganizationMember, error) {
+	if _, err := organizationRole(ctx, s.db, orgID, userID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT u.id, u.email, u.name, u.avatar_url, m.role, m.created_at
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.organization_id = $1 AND u.deleted_at IS NULL
+		ORDER BY u.name
+	`
+	rows, err := s.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []models.OrganizationMember{}
+	for rows.Next() {
+		var m models.OrganizationMember
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Name, &m.AvatarURL, &m.Role, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan member: %w", err)
+		}
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+// SetOrganizationMemberRole changes memberID's role in an organization.
+// Admins manage members and admins; only owners grant or take away
+// ownership, and the last owner stays.
+func (s *Service) SetOrganizationMemberRole(ctx context.Context, orgID, actorID, memberID uuid.UUID, role string) error {
+	if _, ok := orgRoleRank[role]; !ok {
+		return ErrInvalidOrganizationRole
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	actorRole, err := requireOrganizationRole(ctx, tx, orgID, actorID, models.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	oldRole, err := lockOrganizationMember(ctx, tx, orgID, memberID)
+	if err != nil {
+		return err
+	}
+	if oldRole == role {
+		return nil
+	}
+	if (oldRole == models.OrgRoleOwner || role == models.OrgRoleOwner) && actorRole != models.OrgRoleOwner {
+		return ErrOrganizationForbidden
+	}
+	if oldRole == models.OrgRoleOwner {
+		if err := keepAnOwner(ctx, tx, orgID, memberID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE organization_members SET role = $1 WHERE organization_id = $2 AND user_id = $3
+	`, role, orgID, memberID)
+	if err != nil {
+		return fmt.Errorf("failed to update member: %w", err)
+	}
+
+	if err := recordMemberEvent(ctx, tx, "ORGANIZATION_ROLE_CHANGED", orgID, memberID, oldRole, role); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return s.revokeIfActiveOrganization(ctx, memberID, orgID)
+}
+
+// RemoveOrganizationMember removes memberID from an organization. Members
+// can leave; admins remove members and admins, owners anyone. The last
+// owner cannot leave.
+func (s *Service) RemoveOrganizationMember(ctx context.Context, orgID, actorID, memberID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	minRole := models.OrgRoleAdmin
+	if actorID == memberID {
+		minRole = models.OrgRoleMember
+	}
+	actorRole, err := requireOrganizationRole(ctx, tx, orgID, actorID, minRole)
+	if err != nil {
+		return err
+	}
+
+	memberRole, err := lockOrganizationMember(ctx, tx, orgID, memberID)
+	if err != nil {
+		return err
+	}
+	if memberRole == models.OrgRoleOwner {
+		if actorRole != models.OrgRoleOwner {
+			return ErrOrganizationForbidden
+		}
+		if err := keepAnOwner(ctx, tx, orgID, memberID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM organization_members WHERE organization_id = $1 AND user_id = $2`, orgID, memberID)
+	if err != nil {
+		return fmt.Errorf("failed to remove member: %w", err)
+	}
+
+	if err := recordMemberEvent(ctx, tx, "ORGANIZATION_MEMBER_REMOVED", orgID, memberID, memberRole, ""); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return s.revokeIfActiveOrganization(ctx, memberID, orgID)
+}
+
+// lockOrganizationMember returns memberID's role, locking the membership
+func lockOrganizationMember(ctx context.Context, tx pgx.Tx, orgID, memberID uuid.UUID) (string, error) {
+	var role string
+	query := `SELECT role FROM organization_members WHERE organization_id = $1 AND user_id = $2 FOR UPDATE`
+	err := tx.QueryRow(ctx, query, orgID, memberID).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", ErrMemberNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query member: %w", err)
+	}
+	return role, nil
+}
+
+// keepAnOwner returns ErrLastOwner unless the organization has an owner
+// besides memberID
+func keepAnOwner(ctx context.Context, tx pgx.Tx, orgID, memberID uuid.UUID) error {
+	var others int
+	query := `
+		SELECT COUNT(*) FROM organization_members
+		WHERE organization_id = $1 AND role = $2 AND user_id <> $3
+	`
+	if err := tx.QueryRow(ctx, query, orgID, models.OrgRoleOwner, memberID).Scan(&others); err != nil {
+		return fmt.Errorf("failed to count owners: %w", err)
+	}
+	if others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// recordMemberEvent records a change of memberID's role in orgID from
+// oldRole to newRole, either of which is empty for added and removed members
+func recordMemberEvent(ctx context.Context, tx pgx.Tx, action string, orgID, memberID uuid.UUID, oldRole, newRole string) error {
+	change := audit.Change{}
+	if oldRole != "" {
+		change.From = oldRole
+	}
+	if newRole != "" {
+		change.To = newRole
+	}
+	return audit.Record(ctx, tx, audit.Event{
+		Action:     action,
+		UserID:     &memberID,
+		TargetType: audit.TargetOrganization,
+		TargetID:   orgID.String(),
+		Changes:    map[string]audit.Change{"role": change},
+	})
+}
+
+// revokeIfActiveOrganization revokes userID's access tokens if they were
+// issued for orgID, whose role claim no longer holds
+func (s *Service) revokeIfActiveOrganization(ctx context.Context, userID, orgID uuid.UUID) error {
+	var active bool
+	query := `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND active_organization_id = $2)`
+	if err := s.db.QueryRow(ctx, query, userID, orgID).Scan(&active); err != nil {
+		return fmt.Errorf("failed to query active organization: %w", err)
+	}
+	if !active {
+		return nil
+	}
+	return s.denylist.RevokeUser(ctx, userID)
+}
+
+// InviteToOrganization emails an invitation to join an organization with
+// role. Admins invite members and admins; only owners invite owners.
+func (s *Service) InviteToOrganization(ctx context.Context, orgID, actorID uuid.UUID, email, role string) (*models.OrganizationInvite, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := orgRoleRank[role]; !ok {
+		return nil, ErrInvalidOrganizationRole
+	}
+
+	actorRole, err := requireOrganizationRole(ctx, s.db, orgID, actorID, models.OrgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if role == models.OrgRoleOwner && actorRole != models.OrgRoleOwner {
+		return nil, ErrOrganizationForbidden
+	}
+
+	var isMember bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM organization_members m JOIN users u ON u.id = m.user_id
+			WHERE m.organization_id = $1 AND lower(u.email) = $2
+		)
+	`
+	if err := s.db.QueryRow(ctx, query, orgID, email).Scan(&isMember); err != nil {
+		return nil, fmt.Errorf("failed to query members: %w", err)
+	}
+	if isMember {
+		return nil, ErrAlreadyMember
+	}
+
+	var orgName string
+	if err := s.db.QueryRow(ctx, `SELECT name FROM organizations WHERE id = $1`, orgID).Scan(&orgName); err != nil {
+		return nil, fmt.Errorf("failed to query organization: %w", err)
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	invite := models.OrganizationInvite{
+		OrganizationID: orgID,
+		Email:          email,
+		Role:           role,
+		InvitedBy:      &actorID,
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO organization_invites (organization_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, expires_at, created_at
+	`, orgID, email, role, hashSecret(token), actorID, time.Now().Add(s.cfg.OrganizationInviteTTL)).Scan(
+		&invite.ID, &invite.ExpiresAt, &invite.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store invitation: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "ORGANIZATION_INVITE_SENT", audit.TargetOrganizationInvite, invite.ID.String(), nil, invite); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.sendMail(email, mail.TemplateOrganizationInvite, mail.TemplateData{
+		URL:          s.cfg.FrontendURL + "/invite?token=" + url.QueryEscape(token),
+		ExpiresIn:    s.cfg.OrganizationInviteTTL,
+		Organization: orgName,
+	})
+
+	return &invite, nil
+}
+
+// ListOrganizationInvites lists an organization's pending invitations;
+// userID must be an admin of it
+func (s *Service) ListOrganizationInvites(ctx context.Context, orgID, userID uuid.UUID) ([]models.OrganizationInvite, error) {
+	if _, err := requireOrganizationRole(ctx, s.db, orgID, userID, models.OrgRoleAdmin); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, organization_id, email, role, invited_by, expires_at, accepted_at, created_at
+		FROM organization_invites
+		WHERE organization_id = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invitations: %w", err)
+	}
+	defer rows.Close()
+
+	invites := []models.OrganizationInvite{}
+	for rows.Next() {
+		var i models.OrganizationInvite
+		if err := rows.Scan(&i.ID, &i.OrganizationID, &i.Email, &i.Role, &i.InvitedBy, &i.ExpiresAt, &i.AcceptedAt, &i.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan invitation: %w", err)
+		}
+		invites = append(invites, i)
+	}
+
+	return invites, rows.Err()
+}
+
+// RevokeOrganizationInvite withdraws a pending invitation; userID must be
+// an admin of the organization
+func (s *Service) RevokeOrganizationInvite(ctx context.Context, orgID, userID, inviteID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := requireOrganizationRole(ctx, tx, orgID, userID, models.OrgRoleAdmin); err != nil {
+		return err
+	}
+
+	var invite models.OrganizationInvite
+	err = tx.QueryRow(ctx, `
+		DELETE FROM organization_invites
+		WHERE id = $1 AND organization_id = $2 AND accepted_at IS NULL
+		RETURNING id, organization_id, email, role, invited_by, expires_at, accepted_at, created_at
+	`, inviteID, orgID).Scan(
+		&invite.ID, &invite.OrganizationID, &invite.Email, &invite.Role,
+		&invite.InvitedBy, &invite.ExpiresAt, &invite.AcceptedAt, &invite.CreatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return ErrInvalidInvite
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revoke invitation: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "ORGANIZATION_INVITE_REVOKED", audit.TargetOrganizationInvite, inviteID.String(), invite, nil); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// AcceptOrganizationInvite adds userID to the organization an invitation is
+// for. The invitation must have been sent to their email address.
+func (s *Service) AcceptOrganizationInvite(ctx context.Context, userID uuid.UUID, token string) (*models.Organization, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var inviteID, orgID uuid.UUID
+	var email, role string
+	err = tx.QueryRow(ctx, `
+		SELECT id, organization_id, email, role
+		FROM organization_invites
+		WHERE token_hash = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		FOR UPDATE
+	`, hashSecret(token)).Scan(&inviteID, &orgID, &email, &role)
+	if err == pgx.ErrNoRows {
+		return nil, ErrInvalidInvite
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invitation: %w", err)
+	}
+
+	var userEmail string
+	if err := tx.QueryRow(ctx, `SELECT email FROM users WHERE id = $1`, userID).Scan(&userEmail); err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	if !strings.EqualFold(userEmail, email) {
+		return nil, ErrInvalidInvite
+	}
+
+	result, err := tx.Exec(ctx, `
+		INSERT INTO organization_members (organization_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (organization_id, user_id) DO NOTHING
+	`, orgID, userID, role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add member: %w", err)
+	}
+	if result.RowsAffected() > 0 {
+		if err := recordMemberEvent(ctx, tx, "ORGANIZATION_MEMBER_ADDED", orgID, userID, "", role); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE organization_invites SET accepted_at = NOW() WHERE id = $1`, inviteID); err != nil {
+		return nil, fmt.Errorf("failed to accept invitation: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return s.GetOrganization(ctx, orgID, userID)
+}
+
+// SwitchOrganization makes orgID the organization userID's next tokens are
+// issued for, or none if orgID is nil
+func (s *Service) SwitchOrganization(ctx context.Context, userID uuid.UUID, orgID *uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if orgID != nil {
+		if _, err := organizationRole(ctx, tx, *orgID, userID); err != nil {
+			return err
+		}
+	}
+
+	var oldOrgID *uuid.UUID
+	err = tx.QueryRow(ctx, `
+		UPDATE users u SET active_organization_id = $1
+		FROM (SELECT active_organization_id FROM users WHERE id = $2 FOR UPDATE) old
+		WHERE u.id = $2
+		RETURNING old.active_organization_id
+	`, orgID, userID).Scan(&oldOrgID)
+	if err != nil {
+		return fmt.Errorf("failed to switch organization: %w", err)
+	}
+
+	err = audit.Record(ctx, tx, audit.Event{
+		Action:     "ORGANIZATION_SWITCHED",
+		UserID:     &userID,
+		TargetType: audit.TargetUser,
+		TargetID:   userID.String(),
+		Changes: audit.Diff(
+			map[string]*uuid.UUID{"active_organization_id": oldOrgID},
+			map[string]*uuid.UUID{"active_organization_id": orgID},
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/mail"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/frans-sjostrom/auth-service/pkg/password"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// AMRPassword marks a sign-in with a password
+const AMRPassword = "pwd"
+
+// Purposes of email tokens
+const (
+	emailTokenVerifyEmail   = "verify_email"
+	emailTokenPasswordReset = "password_reset"
+)
+
+// verifyEmailTTL is how long an email verification link stays valid
+const verifyEmailTTL = 24 * time.Hour
+
+// mailTimeout bounds sending one email in the background
+const mailTimeout = time.Minute
+
+var (
+	// ErrInvalidEmail is returned for a malformed email address
+	ErrInvalidEmail = errors.New("invalid email address")
+
+	// ErrInvalidCredentials is returned for an unknown email or a wrong
+	// password, without telling which
+	ErrInvalidCredentials = errors.New("invalid email or password")
+
+	// ErrEmailNotVerified is returned when a password account signs in
+	// before following its verification link
+	ErrEmailNotVerified = errors.New("email address is not verified")
+
+	// ErrInvalidEmailToken is returned for an unknown, expired or used
+	// verification or reset token
+	ErrInvalidEmailToken = errors.New("invalid or expired link")
+)
+
+// Register creates a password account and emails a verification link. To
+// not reveal which emails have accounts, an existing account's owner gets
+// a notice instead and no error is returned. Password policy violations are
+// returned as *password.PolicyError.
+func (s *Service) Register(ctx context.Context, email, name, newPassword string) error {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	if err := s.checkPassword(email, newPassword); err != nil {
+		return err
+	}
+
+	hash, err := password.Hash(newPassword, s.passwordParams())
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if name = strings.TrimSpace(name); name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Emails from identity providers are stored as given, so compare
+	// case-insensitively
+	var exists bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = $1)`, email).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query user: %w", err)
+	}
+
+	// New accounts never get the admin role here: the email is not proven
+	// yet. VerifyEmail grants it.
+	var userID uuid.UUID
+	if !exists {
+		query := `
+			INSERT INTO users (email, name, role, is_active, password_hash, password_changed_at)
+			VALUES ($1, $2, $3, true, $4, NOW())
+			ON CONFLICT (email) DO NOTHING
+			RETURNING id
+		`
+		err = tx.QueryRow(ctx, query, email, name, models.RoleUser, hash).Scan(&userID)
+	}
+	if exists || err == pgx.ErrNoRows {
+		s.sendMail(email, mail.TemplateAccountExists, mail.TemplateData{
+			URL: s.cfg.FrontendURL + "/forgot-password",
+		})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+
+	token, err := createEmailToken(ctx, tx, userID, emailTokenVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.sendMail(email, mail.TemplateVerifyEmail, mail.TemplateData{
+		URL:       s.cfg.FrontendURL + "/verify-email?token=" + url.QueryEscape(token),
+		ExpiresIn: verifyEmailTTL,
+	})
+
+	s.LogAuthEvent(ctx, &userID, "USER_REGISTERED", "", "")
+	return nil
+}
+
+// VerifyEmail redeems an email verification link and returns the user
+func (s *Service) VerifyEmail(ctx context.Context, token string) (uuid.UUID, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := consumeEmailToken(ctx, tx, token, emailTokenVerifyEmail)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := s.markEmailVerified(ctx, tx, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return userID, nil
+}
+
+// PasswordLogin checks an email and password. Inactive users are returned
+// like everywhere else so the caller can tell them apart.
+func (s *Service) PasswordLogin(ctx context.Context, email, pw string) (*models.User, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	var user models.User
+	var hash *string
+	var verifiedAt *time.Time
+	query := `
+		SELECT ` + userColumns + `, u.password_hash, u.email_verified_at
+		FROM users u
+		WHERE lower(u.email) = $1 AND u.deleted_at IS NULL
+	`
+	err = s.db.QueryRow(ctx, query, email).Scan(
+		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
+		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
+		&hash, &verifiedAt,
+	)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+
+	if hash == nil {
+		// Take as long as a wrong password so response times do not reveal
+		// which emails have accounts
+		password.Verify(pw, s.dummyPasswordHash())
+		return nil, ErrInvalidCredentials
+	}
+
+	ok, err := password.Verify(pw, *hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify password: %w", err)
+	}
+	if !ok {
+		s.LogAuthEvent(ctx, &user.ID, "PASSWORD_LOGIN_FAILED", "", "")
+		return nil, ErrInvalidCredentials
+	}
+
+	if verifiedAt == nil {
+		return nil, ErrEmailNotVerified
+	}
+
+	// Upgrade hashes made with older cost parameters
+	if params := s.passwordParams(); password.NeedsRehash(*hash, params) {
+		if newHash, err := password.Hash(pw, params); err == nil {
+			s.db.Exec(ctx, `UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3`, newHash, user.ID, *hash)
+		}
+	}
+
+	return &user, nil
+}
+
+// RequestPasswordReset emails a password reset link if the email belongs to
+// an account. Users who signed up with an identity provider can use it to
+// add a password. Unknown emails are silently ignored.
+func (s *Service) RequestPasswordReset(ctx context.Context, email string) error {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+
+	var userID uuid.UUID
+	err = s.db.QueryRow(ctx, `SELECT id FROM users WHERE lower(email) = $1 AND deleted_at IS NULL AND is_active = true`, email).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query user: %w", err)
+	}
+
+	token, err := createEmailToken(ctx, s.db, userID, emailTokenPasswordReset, s.cfg.PasswordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(email, mail.TemplatePasswordReset, mail.TemplateData{
+		URL:       s.cfg.FrontendURL + "/reset-password?token=" + url.QueryEscape(token),
+		ExpiresIn: s.cfg.PasswordResetTTL,
+	})
+
+	s.LogAuthEvent(ctx, &userID, "PASSWORD_RESET_REQUESTED", "", "")
+	return nil
+}
+
+// ResetPassword redeems a reset link, sets the new password and signs the
+// user out everywhere. Following the link also proves the email.
+func (s *Service) ResetPassword(ctx context.Context, token, newPassword string) (uuid.UUID, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := consumeEmailToken(ctx, tx, token, emailTokenPasswordReset)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	var email string
+	if err := tx.QueryRow(ctx, `SELECT email FROM users WHERE id = $1`, userID).Scan(&email); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	if err := s.checkPassword(email, newPassword); err != nil {
+		return uuid.Nil, err
+	}
+
+	hash, err := password.Hash(newPassword, s.passwordParams())
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET password_hash = $1, password_changed_at = NOW(), token_version = token_version + 1 WHERE id = $2`, hash, userID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if err := s.markEmailVerified(ctx, tx, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	// Other reset links and existing sessions stop working
+	_, err = tx.Exec(ctx, `
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`, userID, emailTokenPasswordReset)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to invalidate reset links: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return userID, nil
+}
+
+// markEmailVerified records that the user proved their email and grants
+// the admin role to ADMIN_EMAILS, which is only safe from this point on
+func (s *Service) markEmailVerified(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error {
+	var email string
+	err := tx.QueryRow(ctx, `
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $1
+		RETURNING email
+	`, userID).Scan(&email)
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	if s.isAdminEmail(email) {
+		_, err := tx.Exec(ctx, `UPDATE users SET role = $1 WHERE id = $2 AND role = $3`, models.RoleAdmin, userID, models.RoleUser)
+		if err != nil {
+			return fmt.Errorf("failed to update role: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// checkPassword applies the configured password policy
+func (s *Service) checkPassword(email, pw string) error {
+	policy := password.Policy{
+		MinLength:           s.cfg.PasswordMinLength,
+		MaxLength:           s.cfg.PasswordMaxLength,
+		MinCharacterClasses: s.cfg.PasswordMinCharacterClasses,
+	}
+	if err := policy.Check(pw); err != nil {
+		return err
+	}
+	if strings.EqualFold(pw, email) {
+		return &password.PolicyError{Reason: "Password must not be your email address"}
+	}
+	return nil
+}
+
+func (s *Service) passwordParams() password.Params {
+	return password.Params{
+		Memory:      s.cfg.Argon2Memory,
+		Iterations:  s.cfg.Argon2Iterations,
+		Parallelism: s.cfg.Argon2Parallelism,
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash returns a hash to verify against for unknown users
+func (s *Service) dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = password.Hash("not a password", s.passwordParams())
+	})
+	return dummyHash
+}
+
+// sendMail renders and delivers an email in the background so that response
+// times do not depend on the mail server, or reveal whether an email was
+// sent
+func (s *Service) sendMail(to, template string, data mail.TemplateData) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+
+		if err := s.mailer.Send(ctx, to, template, data); err != nil {
+			log.Printf("Warning: failed to send %s email: %v", template, err)
+		}
+	}()
+}
+
+// createEmailToken stores a single-use token for purpose and returns it
+func createEmailToken(ctx context.Context, q execer, userID uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	query := `
+		INSERT INTO email_tokens (token_hash, user_id, purpose, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	if _, err := q.Exec(ctx, query, hashSecret(token), userID, purpose, time.Now().Add(ttl)); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+
+	return token, nil
+}
+
+// consumeEmailToken marks a valid token used and returns its user
+func consumeEmailToken(ctx context.Context, tx pgx.Tx, token, purpose string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := tx.QueryRow(ctx, `
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashSecret(token), purpose).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return uuid.Nil, ErrInvalidEmailToken
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to consume token: %w", err)
+	}
+	return userID, nil
+}
+
+// normalizeEmail validates a bare email address and lowercases it
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 255 {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
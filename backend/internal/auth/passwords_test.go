@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// emailLink waits for the latest email to to and returns the token of the
+// link to path it contains
+func emailLink(t *testing.T, s *Service, to, path string) string {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := testInbox(s).Wait(ctx, to)
+	if err != nil {
+		t.Fatalf("no email to %s: %v", to, err)
+	}
+
+	for _, line := range strings.Split(msg.Text, "\n") {
+		if !strings.HasPrefix(line, testOrigin+path+"?") {
+			continue
+		}
+		link, err := url.Parse(strings.TrimSpace(line))
+		if err != nil {
+			t.Fatalf("invalid link %q: %v", line, err)
+		}
+		return link.Query().Get("token")
+	}
+	t.Fatalf("email %q has no link to %s:\n%s", msg.Subject, path, msg.Text)
+	return ""
+}
+
+// deleteUserByEmail removes an account a test registered when it ends
+func deleteUserByEmail(t *testing.T, s *Service, email string) {
+	t.Cleanup(func() {
+		s.db.Exec(context.Background(), `DELETE FROM users WHERE lower(email) = lower($1)`, email)
+	})
+}
+
+func TestRegisterSendsVerificationEmail(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	email := uuid.NewString() + "@example.com"
+	deleteUserByEmail(t, s, email)
+
+	if err := s.Register(ctx, email, "Ada", "correct horse battery"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if _, err := s.PasswordLogin(ctx, email, "correct horse battery"); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("PasswordLogin before verifying: err = %v, want ErrEmailNotVerified", err)
+	}
+
+	token := emailLink(t, s, email, "/verify-email")
+	userID, err := s.VerifyEmail(ctx, token)
+	if err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+	user, err := s.PasswordLogin(ctx, email, "correct horse battery")
+	if err != nil {
+		t.Fatalf("PasswordLogin after verifying: %v", err)
+	}
+	if user.ID != userID {
+		t.Errorf("signed in as %s, want %s", user.ID, userID)
+	}
+
+	if _, err := s.VerifyEmail(ctx, token); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Errorf("reused link: err = %v, want ErrInvalidEmailToken", err)
+	}
+
+	// Registering again only tells the owner that they have an account
+	testInbox(s).Reset()
+	if err := s.Register(ctx, strings.ToUpper(email), "Eve", "another password"); err != nil {
+		t.Fatalf("Register with a taken email: %v", err)
+	}
+	emailLink(t, s, strings.ToLower(email), "/forgot-password")
+}
+
+func TestPasswordResetEmail(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	email := uuid.NewString() + "@example.com"
+	deleteUserByEmail(t, s, email)
+
+	if err := s.Register(ctx, email, "Ada", "correct horse battery"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	testInbox(s).Reset()
+
+	if err := s.RequestPasswordReset(ctx, email); err != nil {
+		t.Fatalf("RequestPasswordReset: %v", err)
+	}
+	token := emailLink(t, s, email, "/reset-password")
+
+	if _, err := s.ResetPassword(ctx, token, "battery staple horse"); err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+
+	// Following the link also verified the email
+	if _, err := s.PasswordLogin(ctx, email, "battery staple horse"); err != nil {
+		t.Errorf("PasswordLogin with the new password: %v", err)
+	}
+	if _, err := s.PasswordLogin(ctx, email, "correct horse battery"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("PasswordLogin with the old password: err = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := s.ResetPassword(ctx, token, "yet another password"); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Errorf("reused link: err = %v, want ErrInvalidEmailToken", err)
+	}
+}
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/archive"
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// auditPartitionPrefix is followed by the partition's month as YYYYMM
+	auditPartitionPrefix = "auth_audit_log_"
+
+	// auditPartitionsAhead is how many months after the current one have
+	// their partition created in advance
+	auditPartitionsAhead = 2
+
+	// retentionLock is the advisory lock held by the replica enforcing
+	// retention
+	retentionLock = 0x726574656e74696f
+)
+
+// Retention keeps the audit log and refresh tokens from growing forever.
+// The audit log is partitioned by month: Retention creates the coming
+// months' partitions, and archives and drops the ones past
+// AUDIT_RETENTION_MONTHS. Refresh tokens are deleted once expired, or
+// REFRESH_TOKEN_RETENTION after they were revoked.
+type Retention struct {
+	db      *database.DB
+	cfg     *config.Config
+	archive archive.Store
+}
+
+// NewRetention creates the audit log partitions the coming events need
+func NewRetention(ctx context.Context, db *database.DB, cfg *config.Config, store archive.Store) (*Retention, error) {
+	r := &Retention{db: db, cfg: cfg, archive: store}
+
+	err := r.locked(ctx, true, func() error {
+		return r.createAuditPartitions(ctx, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// locked runs fn holding the retention lock, so that one replica at a time
+// changes partitions. Unless wait is set, fn is skipped while another
+// replica holds the lock.
+func (r *Retention) locked(ctx context.Context, wait bool, fn func() error) error {
+	conn, err := r.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if wait {
+		if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, int64(retentionLock)); err != nil {
+			return fmt.Errorf("failed to lock retention: %w", err)
+		}
+	} else {
+		var ok bool
+		if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, int64(retentionLock)).Scan(&ok); err != nil {
+			return fmt.Errorf("failed to lock retention: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, int64(retentionLock))
+
+	return fn()
+}
+
+// Enforce creates upcoming audit log partitions, archives expired ones and
+// purges refresh tokens. A failing step does not hold up the others.
+func (r *Retention) Enforce(ctx context.Context) error {
+	return r.locked(ctx, false, func() error {
+		now := time.Now()
+		return errors.Join(
+			r.createAuditPartitions(ctx, now),
+			r.archiveAuditPartitions(ctx, now),
+			r.purgeRefreshTokens(ctx),
+		)
+	})
+}
+
+// Run enforces retention every interval until ctx is cancelled
+func (r *Retention) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Enforce(ctx); err != nil {
+				log.Printf("Warning: retention failed: %v", err)
+			}
+		}
+	}
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func auditPartitionName(month time.Time) string {
+	return auditPartitionPrefix + month.Format("200601")
+}
+
+// createAuditPartitions creates the partitions of the current month and the
+// auditPartitionsAhead months after it
+func (r *Retention) createAuditPartitions(ctx context.Context, now time.Time) error {
+	for i := 0; i <= auditPartitionsAhead; i++ {
+		month := monthStart(now).AddDate(0, i, 0)
+		query := fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s PARTITION OF auth_audit_log FOR VALUES FROM ('%s') TO ('%s')`,
+			pgx.Identifier{auditPartitionName(month)}.Sanitize(),
+			month.Format(time.DateOnly), month.AddDate(0, 1, 0).Format(time.DateOnly),
+		)
+		if _, err := r.db.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to create audit log partition: %w", err)
+		}
+	}
+	return nil
+}
+
+// archiveAuditPartitions archives and drops the partitions whose month
+// ended more than AuditRetentionMonths whole months ago
+func (r *Retention) archiveAuditPartitions(ctx context.Context, now time.Time) error {
+	if r.cfg.AuditRetentionMonths == 0 {
+		return nil
+	}
+	cutoff := monthStart(now).AddDate(0, -r.cfg.AuditRetentionMonths, 0)
+
+	rows, err := r.db.Query(ctx, `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'auth_audit_log'::regclass
+		ORDER BY c.relname
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to list audit log partitions: %w", err)
+	}
+	partitions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to list audit log partitions: %w", err)
+	}
+
+	for _, name := range partitions {
+		month, err := time.Parse("200601", strings.TrimPrefix(name, auditPartitionPrefix))
+		if err != nil || !strings.HasPrefix(name, auditPartitionPrefix) {
+			// Not one of ours
+			continue
+		}
+		if month.AddDate(0, 1, 0).After(cutoff) {
+			break
+		}
+		if err := r.archiveAuditPartition(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedPartition is recorded as the dropped object of AUDIT_LOG_ARCHIVED
+type archivedPartition struct {
+	Events  int    `json:"events"`
+	Archive string `json:"archive"`
+}
+
+// archiveAuditPartition writes the events of partition name to the archive
+// as gzipped JSON Lines, oldest first, and drops the partition
+func (r *Retention) archiveAuditPartition(ctx context.Context, name string) error {
+	f, err := os.CreateTemp("", name+"-*.jsonl.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	rows, err := r.db.Query(ctx, fmt.Sprintf(
+		`SELECT %s FROM %s ORDER BY seq`, auditColumns, pgx.Identifier{name}.Sanitize(),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to query audit log partition: %w", err)
+	}
+	defer rows.Close()
+
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	var events int
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		if err := enc.Encode(event); err != nil {
+			return fmt.Errorf("failed to write archive file: %w", err)
+		}
+		events++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query audit log partition: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+
+	file := name + ".jsonl.gz"
+	if err := r.archive.Put(ctx, file, f); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Recorded before the drop: once this transaction holds the audit
+	// log's chain lock, no writer of the log can be waiting for it while the
+	// drop waits for them. The event also keeps the head of the chain in
+	// the current month.
+	partition := archivedPartition{Events: events, Archive: r.archive.Location(file)}
+	if err := recordChange(ctx, tx, "AUDIT_LOG_ARCHIVED", audit.TargetAuditLogPartition, name, partition, nil); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DROP TABLE `+pgx.Identifier{name}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to drop audit log partition: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to drop audit log partition: %w", err)
+	}
+
+	log.Printf("Archived %d audit events to %s", events, partition.Archive)
+	return nil
+}
+
+// purgeRefreshTokens deletes refresh tokens that have expired, or were
+// revoked more than RefreshTokenRetention ago, and the sessions left
+// without any
+func (r *Retention) purgeRefreshTokens(ctx context.Context) error {
+	query := `
+		DELETE FROM refresh_tokens
+		WHERE expires_at < NOW() OR revoked_at < NOW() - make_interval(secs => $1)
+	`
+	result, err := r.db.Exec(ctx, query, r.cfg.RefreshTokenRetention.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to purge refresh tokens: %w", err)
+	}
+	if n := result.RowsAffected(); n > 0 {
+		log.Printf("Purged %d refresh tokens", n)
+	}
+
+	// Sessions are stored just before their first token; the hour leaves
+	// those alone
+	_, err = r.db.Exec(ctx, `
+		DELETE FROM sessions s
+		WHERE s.last_used_at < NOW() - INTERVAL '1 hour'
+		  AND NOT EXISTS (SELECT 1 FROM refresh_tokens t WHERE t.family_id = s.id)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to purge sessions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,511 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/frans-sjostrom/auth-service/pkg/revocation"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// revocationChannel is the Postgres NOTIFY channel every instance announces
+// new revocations on
+const revocationChannel = "token_revocations"
+
+// subscriberBuffer is how many revocations a subscriber may fall behind
+// before it is dropped
+const subscriberBuffer = 64
+
+// ErrUnauthorizedClient is returned when a client revokes a token that was
+// issued to another client
+var ErrUnauthorizedClient = errors.New("token was issued to another client")
+
+// Denylist holds the access tokens revoked before they expire: single
+// tokens by their id (jti), and all tokens of a user issued before a point
+// in time. Access tokens are otherwise valid until they expire, so
+// everything that accepts them checks the denylist. New revocations are
+// pushed to subscribers, such as the revocation stream.
+type Denylist struct {
+	db  *database.DB
+	cfg *config.Config
+
+	mu          sync.Mutex
+	subscribers map[chan revocation.Entry]struct{}
+}
+
+func NewDenylist(db *database.DB, cfg *config.Config) *Denylist {
+	return &Denylist{
+		db:          db,
+		cfg:         cfg,
+		subscribers: make(map[chan revocation.Entry]struct{}),
+	}
+}
+
+// Add revokes the access token with claims
+func (d *Denylist) Add(ctx context.Context, claims *customJWT.Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		// Tokens issued before they had a jti cannot be revoked one by one
+		return nil
+	}
+
+	var clientID *string
+	if len(claims.Audience) > 0 {
+		clientID = &claims.Audience[0]
+	}
+
+	entry := revocation.Entry{
+		JTI:       claims.ID,
+		RevokedAt: time.Now().UTC(),
+		ExpiresAt: claims.ExpiresAt.UTC(),
+	}
+
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO revoked_access_tokens (jti, user_id, client_id, expires_at, revoked_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	if _, err := tx.Exec(ctx, query, entry.JTI, claims.UserID, clientID, entry.ExpiresAt, entry.RevokedAt); err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+	if err := announce(ctx, tx, []revocation.Entry{entry}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RevokeUser revokes every access token issued to userID so far. Tokens
+// issued afterwards, for example once they sign in again, are valid.
+func (d *Denylist) RevokeUser(ctx context.Context, userID uuid.UUID) error {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := d.RevokeUsers(ctx, tx, []uuid.UUID{userID}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RevokeUsers revokes every access token issued to userIDs so far as part
+// of tx, such as the change that calls for it
+func (d *Denylist) RevokeUsers(ctx context.Context, tx pgx.Tx, userIDs []uuid.UUID) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	// The entries are needed for as long as any application's tokens live
+	var maxTTL int
+	if err := tx.QueryRow(ctx, `SELECT COALESCE(MAX(access_token_ttl), 0) FROM applications`).Scan(&maxTTL); err != nil {
+		return fmt.Errorf("failed to query access token lifetimes: %w", err)
+	}
+
+	revokedAt := time.Now().UTC()
+	expiresAt := revokedAt.Add(max(d.cfg.JWTAccessTokenExpiry, time.Duration(maxTTL)*time.Second))
+
+	query := `
+		INSERT INTO revoked_subjects (user_id, revoked_at, expires_at)
+		SELECT user_id, $2, $3 FROM unnest($1::uuid[]) AS user_id
+		ON CONFLICT (user_id) DO UPDATE
+		SET revoked_at = EXCLUDED.revoked_at, expires_at = EXCLUDED.expires_at
+	`
+	if _, err := tx.Exec(ctx, query, userIDs, revokedAt, expiresAt); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+
+	entries := make([]revocation.Entry, len(userIDs))
+	for i, userID := range userIDs {
+		entries[i] = revocation.Entry{Subject: userID.String(), RevokedAt: revokedAt, ExpiresAt: expiresAt}
+	}
+	return announce(ctx, tx, entries)
+}
+
+// announce tells every instance about entries once tx commits
+func announce(ctx context.Context, tx pgx.Tx, entries []revocation.Entry) error {
+	payloads := make([]string, len(entries))
+	for i, entry := range entries {
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode revocation: %w", err)
+		}
+		payloads[i] = string(payload)
+	}
+	query := `SELECT pg_notify($1, payload) FROM unnest($2::text[]) AS payload`
+	if _, err := tx.Exec(ctx, query, revocationChannel, payloads); err != nil {
+		return fmt.Errorf("failed to announce revocation: %w", err)
+	}
+	return nil
+}
+
+// IsRevoked reports whether the access token with claims has been revoked,
+// by its jti or along with all tokens of its user
+func (d *Denylist) IsRevoked(ctx context.Context, claims *customJWT.Claims) (bool, error) {
+	var jtiRevoked bool
+	var userRevokedAt *time.Time
+	query := `
+		SELECT
+			EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = $1),
+			(SELECT revoked_at FROM revoked_subjects WHERE user_id = $2)
+	`
+	if err := d.db.QueryRow(ctx, query, claims.ID, claims.UserID).Scan(&jtiRevoked, &userRevokedAt); err != nil {
+		return false, fmt.Errorf("failed to query revoked access tokens: %w", err)
+	}
+	if jtiRevoked {
+		return true, nil
+	}
+	if userRevokedAt == nil {
+		return false, nil
+	}
+
+	entry := revocation.Entry{Subject: claims.UserID.String(), RevokedAt: *userRevokedAt}
+	return entry.Revokes(claims), nil
+}
+
+// Entries lists the revocations whose tokens have not expired yet
+func (d *Denylist) Entries(ctx context.Context) ([]revocation.Entry, error) {
+	query := `
+		SELECT jti, '', revoked_at, expires_at FROM revoked_access_tokens WHERE expires_at > $1
+		UNION ALL
+		SELECT '', user_id::text, revoked_at, expires_at FROM revoked_subjects WHERE expires_at > $1
+	`
+	rows, err := d.db.Query(ctx, query, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revocations: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []revocation.Entry{}
+	for rows.Next() {
+		var e revocation.Entry
+		if err := rows.Scan(&e.JTI, &e.Subject, &e.RevokedAt, &e.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan revocation: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query revocations: %w", err)
+	}
+	return entries, nil
+}
+
+// Subscribe returns a channel receiving every new revocation, and a function
+// to stop receiving them. The channel is closed if the subscriber falls
+// behind or revocations may have been missed; the subscriber should then
+// start over from Entries.
+func (d *Denylist) Subscribe() (<-chan revocation.Entry, func()) {
+	ch := make(chan revocation.Entry, subscriberBuffer)
+
+	d.mu.Lock()
+	d.subscribers[ch] = struct{}{}
+	d.mu.Unlock()
+
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, ok := d.subscribers[ch]; ok {
+			delete(d.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// broadcast hands entry to every subscriber, dropping those that are full
+func (d *Denylist) broadcast(entry revocation.Entry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for ch := range d.subscribers {
+		select {
+		case ch <- entry:
+		default:
+			delete(d.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// dropSubscribers closes every subscriber's channel
+func (d *Denylist) dropSubscribers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for ch := range d.subscribers {
+		delete(d.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Listen receives the revocations announced by every instance of the
+// service and hands them to subscribers until ctx is cancelled
+func (d *Denylist) Listen(ctx context.Context) {
+	for {
+		err := d.listen(ctx)
+
+		// Revocations may have been missed while not listening
+		d.dropSubscribers()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Warning: revocation listener failed: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (d *Denylist) listen(ctx context.Context) error {
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	// The connection stays subscribed to the channel, so do not hand it
+	// back to the pool
+	defer conn.Hijack().Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+revocationChannel); err != nil {
+		return fmt.Errorf("failed to listen for revocations: %w", err)
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for revocations: %w", err)
+		}
+
+		var entry revocation.Entry
+		if err := json.Unmarshal([]byte(n.Payload), &entry); err != nil {
+			log.Printf("Warning: ignoring malformed revocation: %v", err)
+			continue
+		}
+		d.broadcast(entry)
+	}
+}
+
+// Purge forgets revocations of tokens that have expired anyway
+func (d *Denylist) Purge(ctx context.Context) error {
+	now := time.Now().UTC()
+	if _, err := d.db.Exec(ctx, `DELETE FROM revoked_access_tokens WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("failed to purge revoked access tokens: %w", err)
+	}
+	if _, err := d.db.Exec(ctx, `DELETE FROM revoked_subjects WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("failed to purge revoked users: %w", err)
+	}
+	return nil
+}
+
+// Run purges the denylist every interval until ctx is cancelled
+func (d *Denylist) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Purge(ctx); err != nil {
+				log.Printf("Warning: revoked access token purge failed: %v", err)
+			}
+		}
+	}
+}
+
+// IntrospectToken describes an access or refresh token to client (RFC
+// 7662). Expired, revoked and unknown tokens, tokens of inactive users,
+// access tokens from before a token version bump and refresh tokens issued
+// to another client are all just inactive. The token's format tells access
+// and refresh tokens apart, so no token_type_hint is needed.
+func (s *Service) IntrospectToken(ctx context.Context, token string, client *models.Application) (*models.TokenIntrospection, error) {
+	if !isRefreshTokenFormat(token) {
+		if claims, err := customJWT.ValidateAccessToken(token, s.keys); err == nil {
+			return s.introspectAccessToken(ctx, claims)
+		}
+	}
+	return s.introspectRefreshToken(ctx, token, client)
+}
+
+func (s *Service) introspectAccessToken(ctx context.Context, claims *customJWT.Claims) (*models.TokenIntrospection, error) {
+	revoked, err := s.denylist.IsRevoked(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return &models.TokenIntrospection{}, nil
+	}
+
+	if _, err := s.GetActiveUser(ctx, claims.UserID); err != nil {
+		return &models.TokenIntrospection{}, nil
+	}
+
+	var tokenVersion int
+	if err := s.db.QueryRow(ctx, `SELECT token_version FROM users WHERE id = $1`, claims.UserID).Scan(&tokenVersion); err != nil {
+		return nil, fmt.Errorf("failed to query token version: %w", err)
+	}
+	if claims.TokenVersion != tokenVersion {
+		return &models.TokenIntrospection{}, nil
+	}
+
+	result := &models.TokenIntrospection{
+		Active:      true,
+		TokenType:   "Bearer",
+		Scope:       claims.Scope,
+		Subject:     claims.UserID.String(),
+		Username:    claims.Email,
+		Audience:    claims.Audience,
+		Issuer:      claims.Issuer,
+		JTI:         claims.ID,
+		Email:       claims.Email,
+		Name:        claims.Name,
+		Role:        claims.Role,
+		Permissions: claims.Permissions,
+		AMR:         claims.AMR,
+		OrgID:       claims.OrgID,
+		OrgRole:     claims.OrgRole,
+	}
+	if len(claims.Audience) > 0 {
+		result.ClientID = claims.Audience[0]
+	}
+	if claims.ExpiresAt != nil {
+		result.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		result.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return result, nil
+}
+
+func (s *Service) introspectRefreshToken(ctx context.Context, token string, client *models.Application) (*models.TokenIntrospection, error) {
+	rt, err := s.findRefreshToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if rt == nil || rt.RevokedAt != nil || time.Now().After(rt.ExpiresAt) || !issuedTo(rt, client) {
+		return &models.TokenIntrospection{}, nil
+	}
+
+	user, err := s.GetActiveUser(ctx, rt.UserID)
+	if err != nil {
+		return &models.TokenIntrospection{}, nil
+	}
+
+	return &models.TokenIntrospection{
+		Active:    true,
+		Scope:     rt.Scope,
+		ClientID:  client.ClientID,
+		Subject:   user.ID.String(),
+		Username:  user.Email,
+		ExpiresAt: rt.ExpiresAt.Unix(),
+		IssuedAt:  rt.CreatedAt.Unix(),
+		AMR:       rt.AMR,
+	}, nil
+}
+
+// RevokeToken revokes a token issued to client (RFC 7009). A refresh token
+// is revoked with its whole family; an access token goes on the denylist.
+// Unknown, invalid and expired tokens are ignored, as the RFC asks.
+func (s *Service) RevokeToken(ctx context.Context, token string, client *models.Application) error {
+	if !isRefreshTokenFormat(token) {
+		if claims, err := customJWT.ValidateAccessToken(token, s.keys); err == nil {
+			if !slices.Contains(claims.Audience, client.ClientID) {
+				return ErrUnauthorizedClient
+			}
+			if err := s.denylist.Add(ctx, claims); err != nil {
+				return err
+			}
+			s.LogAuthEvent(ctx, &claims.UserID, "ACCESS_TOKEN_REVOKED", "", "")
+			return nil
+		}
+	}
+
+	rt, err := s.findRefreshToken(ctx, token)
+	if err != nil || rt == nil {
+		return err
+	}
+	if !issuedTo(rt, client) {
+		return ErrUnauthorizedClient
+	}
+	if err := s.RevokeTokenFamily(ctx, rt.FamilyID); err != nil {
+		return err
+	}
+	s.LogAuthEvent(ctx, &rt.UserID, "REFRESH_TOKEN_REVOKED", "", "")
+	return nil
+}
+
+// RevokeAccessToken puts an access token on the denylist when its user signs
+// out. Invalid tokens are ignored.
+func (s *Service) RevokeAccessToken(ctx context.Context, token string) error {
+	claims, err := customJWT.ValidateAccessToken(token, s.keys)
+	if err != nil {
+		return nil
+	}
+	return s.denylist.Add(ctx, claims)
+}
+
+// RevokeUserTokens revokes every access token issued to userID so far, for
+// when they are deactivated, deleted or their role changes. Their refresh
+// tokens stop working with deactivation anyway, and after a role change
+// they get tokens with the new role.
+func (s *Service) RevokeUserTokens(ctx context.Context, userID uuid.UUID) error {
+	if err := s.denylist.RevokeUser(ctx, userID); err != nil {
+		return err
+	}
+	s.LogAuthEvent(ctx, &userID, "USER_TOKENS_REVOKED", "", "")
+	return nil
+}
+
+// revokeUsersTokens is RevokeUserTokens for every one of userIDs as part
+// of tx, so that the tokens are revoked if and only if the change calling
+// for it commits
+func (s *Service) revokeUsersTokens(ctx context.Context, tx pgx.Tx, userIDs []uuid.UUID) error {
+	if err := s.denylist.RevokeUsers(ctx, tx, userIDs); err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err := audit.Record(ctx, tx, audit.Event{Action: "USER_TOKENS_REVOKED", UserID: &userID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// issuedTo reports whether a refresh token belongs to client
+func issuedTo(rt *models.RefreshToken, client *models.Application) bool {
+	return rt.ClientID != nil && *rt.ClientID == client.ClientID
+}
+
+// isRefreshTokenFormat reports whether token looks like a selector/verifier
+// refresh token rather than a JWT
+func isRefreshTokenFormat(token string) bool {
+	return strings.Count(token, ".") == 1
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestDenylistRevokeUserSameSecond(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+	denylist := NewDenylist(s.db, &config.Config{JWTAccessTokenExpiry: 15 * time.Minute})
+
+	if err := denylist.RevokeUser(ctx, user.ID); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	var revokedAt time.Time
+	if err := s.db.QueryRow(ctx, `SELECT revoked_at FROM revoked_subjects WHERE user_id = $1`, user.ID).Scan(&revokedAt); err != nil {
+		t.Fatalf("failed to query revocation: %v", err)
+	}
+
+	claims := func(iat time.Time) *customJWT.Claims {
+		return &customJWT.Claims{
+			UserID: user.ID,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:       uuid.NewString(),
+				IssuedAt: jwt.NewNumericDate(iat),
+			},
+		}
+	}
+
+	tests := []struct {
+		name string
+		iat  time.Time
+		want bool
+	}{
+		{name: "issued the second before", iat: revokedAt.Add(-time.Second), want: true},
+		// A token refreshed right after the revocation has an iat
+		// truncated to the same second
+		{name: "issued in the same second", iat: revokedAt, want: false},
+		{name: "issued after", iat: revokedAt.Add(time.Second), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := denylist.IsRevoked(ctx, claims(tt.iat))
+			if err != nil {
+				t.Fatalf("IsRevoked: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("IsRevoked = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDenylistRevokeUsersCommitsWithTransaction(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	users := []*models.User{newTestUser(t, s), newTestUser(t, s)}
+	denylist := NewDenylist(s.db, &config.Config{JWTAccessTokenExpiry: 15 * time.Minute})
+
+	issued := time.Now().Add(-time.Minute)
+	revoked := func() []bool {
+		t.Helper()
+		got := make([]bool, len(users))
+		for i, user := range users {
+			claims := &customJWT.Claims{
+				UserID:           user.ID,
+				RegisteredClaims: jwt.RegisteredClaims{ID: uuid.NewString(), IssuedAt: jwt.NewNumericDate(issued)},
+			}
+			var err error
+			if got[i], err = denylist.IsRevoked(ctx, claims); err != nil {
+				t.Fatalf("IsRevoked: %v", err)
+			}
+		}
+		return got
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	if err := denylist.RevokeUsers(ctx, tx, []uuid.UUID{users[0].ID, users[1].ID}); err != nil {
+		t.Fatalf("RevokeUsers: %v", err)
+	}
+
+	if got := revoked(); slices.Contains(got, true) {
+		t.Errorf("revoked before commit = %v, want none", got)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("failed to commit transaction: %v", err)
+	}
+	if got := revoked(); slices.Contains(got, false) {
+		t.Errorf("revoked after commit = %v, want all", got)
+	}
+}
@@ -0,0 +1,373 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Permissions checked by the service's own endpoints
+const (
+	PermissionUsersRead         = "users:read"
+	PermissionUsersWrite        = "users:write"
+	PermissionUsersDelete       = "users:delete"
+	PermissionRolesRead         = "roles:read"
+	PermissionRolesWrite        = "roles:write"
+	PermissionApplicationsRead  = "applications:read"
+	PermissionApplicationsWrite = "applications:write"
+	PermissionKeysRead          = "keys:read"
+	PermissionKeysWrite         = "keys:write"
+	PermissionAuditRead         = "audit:read"
+)
+
+var (
+	// ErrRoleNotFound is returned when no role has the name
+	ErrRoleNotFound = errors.New("role not found")
+
+	// ErrRoleExists is returned when creating a role whose name is taken
+	ErrRoleExists = errors.New("role already exists")
+
+	// ErrRoleInUse is returned when deleting a role users still have
+	ErrRoleInUse = errors.New("role is assigned to users")
+
+	// ErrBuiltinRole is returned when deleting a built-in role or changing
+	// the admin role's permissions
+	ErrBuiltinRole = errors.New("built-in role cannot be changed")
+
+	// ErrInvalidRoleName is returned for role names that are not lowercase
+	// letters, digits, '-' and '_'
+	ErrInvalidRoleName = errors.New("invalid role name")
+
+	// ErrUnknownPermission is returned when granting a permission that does
+	// not exist
+	ErrUnknownPermission = errors.New("unknown permission")
+
+	// ErrUserNotFound is returned when no undeleted user has the id
+	ErrUserNotFound = errors.New("user not found")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,49}$`)
+
+const roleColumns = `
+	r.name, r.description,
+	COALESCE((SELECT array_agg(rp.permission ORDER BY rp.permission) FROM role_permissions rp WHERE rp.role = r.name), '{}'),
+	r.is_builtin, r.created_at, r.updated_at
+`
+
+func scanRole(row pgx.Row) (*models.Role, error) {
+	var role models.Role
+	err := row.Scan(&role.Name, &role.Description, &role.Permissions, &role.IsBuiltin, &role.CreatedAt, &role.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// RoleUpdate holds the fields of a role to change; nil fields are left as
+// they are
+type RoleUpdate struct {
+	Description *string
+	Permissions []string
+}
+
+func (s *Service) ListRoles(ctx context.Context) ([]models.Role, error) {
+	rows, err := s.db.Query(ctx, `SELECT `+roleColumns+` FROM roles r ORDER BY r.is_builtin DESC, r.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query roles: %w", err)
+	}
+	defer rows.Close()
+
+	roles := []models.Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan role: %w", err)
+		}
+		roles = append(roles, *role)
+	}
+
+	return roles, rows.Err()
+}
+
+func (s *Service) GetRole(ctx context.Context, name string) (*models.Role, error) {
+	return getRole(ctx, s.db, name)
+}
+
+func getRole(ctx context.Context, q querier, name string) (*models.Role, error) {
+	role, err := scanRole(q.QueryRow(ctx, `SELECT `+roleColumns+` FROM roles r WHERE r.name = $1`, name))
+	if err == pgx.ErrNoRows {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query role: %w", err)
+	}
+	return role, nil
+}
+
+// CreateRole defines a custom role granting permissions
+func (s *Service) CreateRole(ctx context.Context, name, description string, permissions []string) (*models.Role, error) {
+	if !roleNamePattern.MatchString(name) {
+		return nil, ErrInvalidRoleName
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `INSERT INTO roles (name, description) VALUES ($1, $2)`, name, description)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, ErrRoleExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create role: %w", err)
+	}
+
+	if err := setRolePermissions(ctx, tx, name, permissions); err != nil {
+		return nil, err
+	}
+
+	role, err := getRole(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordChange(ctx, tx, "ROLE_CREATED", audit.TargetRole, name, nil, role); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return role, nil
+}
+
+// UpdateRole changes a role's description or permissions. Tokens carry
+// their permissions, so a change bumps the token version of the role's
+// users, and taking a permission away also revokes their tokens.
+func (s *Service) UpdateRole(ctx context.Context, name string, update RoleUpdate) (*models.Role, error) {
+	if update.Permissions != nil && name == models.RoleAdmin {
+		// Keep at least one role that can manage everything else
+		return nil, ErrBuiltinRole
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM roles WHERE name = $1 FOR UPDATE`, name); err != nil {
+		return nil, fmt.Errorf("failed to lock role: %w", err)
+	}
+	before, err := getRole(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE roles SET description = COALESCE($1, description), updated_at = NOW()
+		WHERE name = $2
+	`, update.Description, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update role: %w", err)
+	}
+
+	var users []uuid.UUID
+	if update.Permissions != nil {
+		if _, err := tx.Exec(ctx, `DELETE FROM role_permissions WHERE role = $1`, name); err != nil {
+			return nil, fmt.Errorf("failed to update role permissions: %w", err)
+		}
+		if err := setRolePermissions(ctx, tx, name, update.Permissions); err != nil {
+			return nil, err
+		}
+		rows, err := tx.Query(ctx, `
+			UPDATE users SET token_version = token_version + 1 WHERE role = $1 AND deleted_at IS NULL
+			RETURNING id
+		`, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bump token versions: %w", err)
+		}
+		users, err = pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+		if err != nil {
+			return nil, fmt.Errorf("failed to bump token versions: %w", err)
+		}
+	}
+
+	role, err := getRole(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordChange(ctx, tx, "ROLE_UPDATED", audit.TargetRole, name, before, role); err != nil {
+		return nil, err
+	}
+
+	// Token versions are only checked with TOKEN_VERSION_CHECK, so access
+	// tokens still granting a removed permission are revoked
+	removed := slices.ContainsFunc(before.Permissions, func(p string) bool {
+		return !slices.Contains(role.Permissions, p)
+	})
+	if removed {
+		if err := s.revokeUsersTokens(ctx, tx, users); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return role, nil
+}
+
+// DeleteRole removes a custom role no user has
+func (s *Service) DeleteRole(ctx context.Context, name string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	role, err := getRole(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	if role.IsBuiltin {
+		return ErrBuiltinRole
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM roles WHERE name = $1`, name)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return ErrRoleInUse
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+
+	if err := recordChange(ctx, tx, "ROLE_DELETED", audit.TargetRole, name, role, nil); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) ListPermissions(ctx context.Context) ([]models.Permission, error) {
+	rows, err := s.db.Query(ctx, `SELECT name, description FROM permissions ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query permissions: %w", err)
+	}
+	defer rows.Close()
+
+	permissions := []models.Permission{}
+	for rows.Next() {
+		var p models.Permission
+		if err := rows.Scan(&p.Name, &p.Description); err != nil {
+			return nil, fmt.Errorf("failed to scan permission: %w", err)
+		}
+		permissions = append(permissions, p)
+	}
+
+	return permissions, rows.Err()
+}
+
+// SetUserRole assigns role to userID and revokes their tokens, which carry
+// the old role's permissions. Assigning the role they already have changes
+// nothing.
+func (s *Service) SetUserRole(ctx context.Context, userID uuid.UUID, role string) (*models.User, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := getRole(ctx, tx, role); err != nil {
+		return nil, err
+	}
+
+	var oldRole string
+	err = tx.QueryRow(ctx, `SELECT role FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, userID).Scan(&oldRole)
+	if err == pgx.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+
+	var user models.User
+	query := `
+		UPDATE users AS u
+		SET role = $1,
+		    token_version = token_version + CASE WHEN role <> $1 THEN 1 ELSE 0 END,
+		    updated_at = NOW()
+		WHERE id = $2
+		RETURNING ` + userColumns
+	err = tx.QueryRow(ctx, query, role, userID).Scan(
+		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
+		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update role: %w", err)
+	}
+
+	if oldRole != role {
+		err = audit.Record(ctx, tx, audit.Event{
+			Action:     "ROLE_CHANGED",
+			UserID:     &userID,
+			TargetType: audit.TargetUser,
+			TargetID:   userID.String(),
+			Changes:    audit.Diff(map[string]string{"role": oldRole}, map[string]string{"role": role}),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.revokeUsersTokens(ctx, tx, []uuid.UUID{userID}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &user, nil
+}
+
+// rolePermissions returns the permissions granted by role
+func rolePermissions(ctx context.Context, q querier, role string) ([]string, error) {
+	var permissions []string
+	query := `SELECT COALESCE(array_agg(permission ORDER BY permission), '{}') FROM role_permissions WHERE role = $1`
+	if err := q.QueryRow(ctx, query, role).Scan(&permissions); err != nil {
+		return nil, fmt.Errorf("failed to query role permissions: %w", err)
+	}
+	return permissions, nil
+}
+
+func setRolePermissions(ctx context.Context, tx pgx.Tx, role string, permissions []string) error {
+	for _, permission := range permissions {
+		_, err := tx.Exec(ctx, `INSERT INTO role_permissions (role, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING`, role, permission)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return fmt.Errorf("%w: %s", ErrUnknownPermission, permission)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to grant permission: %w", err)
+		}
+	}
+	return nil
+}
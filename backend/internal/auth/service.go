@@ -2,237 +2,408 @@ package auth
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"time"
 
+	"github.com/frans-sjostrom/auth-service/internal/audit"
 	"github.com/frans-sjostrom/auth-service/internal/config"
 	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/frans-sjostrom/auth-service/internal/mail"
 	"github.com/frans-sjostrom/auth-service/internal/models"
 	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 type Service struct {
-	db           *database.DB
-	cfg          *config.Config
-	googleConfig *oauth2.Config
+	db       *database.DB
+	cfg      *config.Config
+	keys     *KeyRing
+	denylist *Denylist
+	mailer   *mail.TemplateMailer
+	webauthn *webauthn.RelyingParty
 }
 
-func NewService(db *database.DB, cfg *config.Config) *Service {
-	googleConfig := &oauth2.Config{
-		ClientID:     cfg.GoogleClientID,
-		ClientSecret: cfg.GoogleClientSecret,
-		RedirectURL:  cfg.GoogleRedirectURL,
-		Scopes: []string{
-			"https://www.googleapis.com/auth/userinfo.email",
-			"https://www.googleapis.com/auth/userinfo.profile",
-		},
-		Endpoint: google.Endpoint,
-	}
-
+func NewService(db *database.DB, cfg *config.Config, keys *KeyRing, denylist *Denylist, mailer *mail.TemplateMailer) *Service {
 	return &Service{
-		db:           db,
-		cfg:          cfg,
-		googleConfig: googleConfig,
+		db:       db,
+		cfg:      cfg,
+		keys:     keys,
+		denylist: denylist,
+		mailer:   mailer,
+		webauthn: newRelyingParty(cfg),
 	}
 }
 
-func (s *Service) GetGoogleAuthURL(state string) string {
-	return s.googleConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
-}
+// ErrEmailInUse is returned when someone signs in with a new provider
+// identity whose email already belongs to another user
+var ErrEmailInUse = errors.New("email already belongs to another account")
 
-func (s *Service) ExchangeGoogleCode(ctx context.Context, code string) (*models.GoogleUserInfo, error) {
-	token, err := s.googleConfig.Exchange(ctx, code)
-	if err != nil {
-		return nil, fmt.Errorf("failed to exchange code: %w", err)
-	}
+const userColumns = `u.id, u.email, u.google_id, u.name, u.avatar_url, u.role, u.is_active, u.created_at, u.updated_at, u.deleted_at`
 
-	client := s.googleConfig.Client(ctx, token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
+// CreateOrUpdateUser returns the user linked to an upstream identity,
+// creating both on first sign-in and refreshing the profile otherwise
+func (s *Service) CreateOrUpdateUser(ctx context.Context, identity *models.ExternalIdentity) (*models.User, error) {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user info: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get user info: %s", body)
-	}
-
-	var userInfo models.GoogleUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		return nil, fmt.Errorf("failed to decode user info: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	return &userInfo, nil
-}
-
-func (s *Service) CreateOrUpdateUser(ctx context.Context, googleUserInfo *models.GoogleUserInfo) (*models.User, error) {
 	var user models.User
 
 	query := `
-		SELECT id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at
-		FROM users
-		WHERE google_id = $1 AND deleted_at IS NULL
+		SELECT ` + userColumns + `
+		FROM users u
+		JOIN user_identities i ON i.user_id = u.id
+		WHERE i.provider = $1 AND i.subject = $2 AND u.deleted_at IS NULL
 	`
 
-	err := s.db.QueryRow(ctx, query, googleUserInfo.ID).Scan(
+	err = tx.QueryRow(ctx, query, identity.Provider, identity.Subject).Scan(
 		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
 		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
 	)
 
+	autoLinked := false
 	if err == pgx.ErrNoRows {
-		// Create new user - determine initial role
-		initialRole := models.RoleUser
-
-		// Check if email is in admin list
-		for _, adminEmail := range s.cfg.AdminEmails {
-			if googleUserInfo.Email == adminEmail {
-				initialRole = models.RoleAdmin
-				break
+		// A user with the same email may already exist. Only attach the new
+		// identity to it when configured to and the provider vouches for
+		// the email; otherwise the user has to link it while signed in.
+		var existingID uuid.UUID
+		var existingDeleted bool
+		err = tx.QueryRow(ctx, `SELECT id, deleted_at IS NOT NULL FROM users WHERE email = $1`, identity.Email).Scan(&existingID, &existingDeleted)
+		switch {
+		case err == pgx.ErrNoRows:
+			if err := s.createUserWithIdentity(ctx, tx, identity, &user); err != nil {
+				return nil, err
 			}
-		}
-
-		insertQuery := `
-			INSERT INTO users (email, google_id, name, avatar_url, role, is_active)
-			VALUES ($1, $2, $3, $4, $5, true)
-			RETURNING id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at
-		`
-		err = s.db.QueryRow(ctx, insertQuery,
-			googleUserInfo.Email, googleUserInfo.ID, googleUserInfo.Name, googleUserInfo.Picture, initialRole,
-		).Scan(
-			&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
-			&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create user: %w", err)
+		case err != nil:
+			return nil, fmt.Errorf("failed to query user: %w", err)
+		case existingDeleted || !s.cfg.AutoLinkVerifiedEmail || !identity.EmailVerified:
+			return nil, ErrEmailInUse
+		default:
+			if err := insertIdentity(ctx, tx, existingID, identity); err != nil {
+				return nil, err
+			}
+			if err := tx.QueryRow(ctx, `SELECT `+userColumns+` FROM users u WHERE u.id = $1`, existingID).Scan(
+				&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
+				&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
+			); err != nil {
+				return nil, fmt.Errorf("failed to query user: %w", err)
+			}
+			autoLinked = true
 		}
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to query user: %w", err)
 	} else {
 		// Update existing user
 		// Auto-upgrade to admin if in ADMIN_EMAILS config but role is still 'user'
-		if user.Role == models.RoleUser {
-			for _, adminEmail := range s.cfg.AdminEmails {
-				if user.Email == adminEmail {
-					user.Role = models.RoleAdmin
-					break
-				}
-			}
+		if user.Role == models.RoleUser && s.isAdminEmail(user.Email) {
+			user.Role = models.RoleAdmin
 		}
 
 		updateQuery := `
-			UPDATE users
+			UPDATE users AS u
 			SET name = $1, avatar_url = $2, role = $3, updated_at = NOW()
 			WHERE id = $4
-			RETURNING id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at
+			RETURNING ` + userColumns + `
 		`
-		err = s.db.QueryRow(ctx, updateQuery, googleUserInfo.Name, googleUserInfo.Picture, user.Role, user.ID).Scan(
+		err = tx.QueryRow(ctx, updateQuery, identity.Name, identity.Picture, user.Role, user.ID).Scan(
 			&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
 			&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to update user: %w", err)
 		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE user_identities
+			SET email = $1, last_login_at = NOW()
+			WHERE provider = $2 AND subject = $3
+		`, identity.Email, identity.Provider, identity.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update identity: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if autoLinked {
+		s.LogAuthEvent(ctx, &user.ID, "IDENTITY_LINKED", "", "")
 	}
 
 	return &user, nil
 }
 
-func (s *Service) GenerateTokens(ctx context.Context, user *models.User) (*models.TokenPair, error) {
-	// Generate access token
-	accessToken, err := customJWT.GenerateAccessToken(
-		user.ID,
-		user.Email,
-		user.Name,
-		user.Role,
-		s.cfg.JWTPrivateKey,
-		s.cfg.JWTAccessTokenExpiry,
+// createUserWithIdentity creates a user for a first sign-in with identity
+func (s *Service) createUserWithIdentity(ctx context.Context, tx pgx.Tx, identity *models.ExternalIdentity, user *models.User) error {
+	// Determine initial role
+	initialRole := models.RoleUser
+	if identity.EmailVerified && s.isAdminEmail(identity.Email) {
+		initialRole = models.RoleAdmin
+	}
+
+	insertQuery := `
+		INSERT INTO users AS u (email, name, avatar_url, role, is_active)
+		VALUES ($1, $2, $3, $4, true)
+		RETURNING ` + userColumns + `
+	`
+	err := tx.QueryRow(ctx, insertQuery,
+		identity.Email, identity.Name, identity.Picture, initialRole,
+	).Scan(
+		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
+		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
 	)
+	if err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return insertIdentity(ctx, tx, user.ID, identity)
+}
+
+func (s *Service) isAdminEmail(email string) bool {
+	for _, adminEmail := range s.cfg.AdminEmails {
+		if email == adminEmail {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again. The token's whole family has been revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// TokenOptions describes who a token pair is issued to
+type TokenOptions struct {
+	// ClientID is the application the tokens are issued to, empty for the
+	// auth-service's own frontend. It becomes the access token's audience
+	// and selects the application's token lifetimes.
+	ClientID string
+
+	// Scope is the space-separated scope granted to ClientID
+	Scope string
+
+	// AMR lists the authentication methods the user signed in with
+	AMR []string
+}
+
+// RefreshRequest is a request to rotate a refresh token
+type RefreshRequest struct {
+	RefreshToken string
+
+	// ClientID, when set, must match the client the token was issued to
+	ClientID string
+
+	IPAddress string
+	UserAgent string
+}
+
+// GenerateTokens issues a token pair for a fresh login, starting a new refresh
+// token family.
+func (s *Service) GenerateTokens(ctx context.Context, user *models.User, opts TokenOptions) (*models.TokenPair, error) {
+	return s.issueTokens(ctx, s.db, user, opts, nil)
+}
+
+// tokenStore is satisfied by both the connection pool and a transaction
+type tokenStore interface {
+	querier
+	execer
+}
+
+// issueTokens generates an access token and a refresh token, storing them
+// with db. When parent is set the refresh token joins the parent's family.
+func (s *Service) issueTokens(ctx context.Context, db tokenStore, user *models.User, opts TokenOptions, parent *models.RefreshToken) (*models.TokenPair, error) {
+	accessExpiry, refreshExpiry, err := s.tokenLifetimes(ctx, opts.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := rolePermissions(ctx, s.db, user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	// The active organization only counts while the user is a member
+	var tokenVersion int
+	var orgID *uuid.UUID
+	var orgRole *string
+	query := `
+		SELECT u.token_version, m.organization_id, m.role
+		FROM users u
+		LEFT JOIN organization_members m ON m.organization_id = u.active_organization_id AND m.user_id = u.id
+		WHERE u.id = $1
+	`
+	if err := db.QueryRow(ctx, query, user.ID).Scan(&tokenVersion, &orgID, &orgRole); err != nil {
+		return nil, fmt.Errorf("failed to query token version: %w", err)
+	}
+
+	// A new family uses the id of its first token as family_id, which is
+	// also the id of its session
+	tokenID := uuid.New()
+	familyID := tokenID
+	var parentID *uuid.UUID
+	if parent != nil {
+		familyID = parent.FamilyID
+		parentID = &parent.ID
+	}
+
+	// Generate access token
+	params := customJWT.AccessTokenParams{
+		UserID:       user.ID,
+		Email:        user.Email,
+		Name:         user.Name,
+		Role:         user.Role,
+		Scope:        opts.Scope,
+		Audience:     opts.ClientID,
+		AMR:          opts.AMR,
+		Permissions:  permissions,
+		TokenVersion: tokenVersion,
+		SessionID:    familyID.String(),
+	}
+	if orgID != nil {
+		params.OrgID = orgID.String()
+		params.OrgRole = *orgRole
+	}
+	accessToken, err := customJWT.GenerateAccessToken(params, s.keys.Active(), accessExpiry)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate access token: %w", err)
 	}
 
 	// Generate refresh token
-	refreshToken, err := customJWT.GenerateRefreshToken()
+	refreshToken, selector, verifierHash, err := customJWT.GenerateRefreshToken()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
 	}
 
-	// Hash and store refresh token
-	tokenHash, err := customJWT.HashRefreshToken(refreshToken)
+	var clientID *string
+	if opts.ClientID != "" {
+		clientID = &opts.ClientID
+	}
+
+	// The session remembers the device it was last used from
+	device := audit.RequestFrom(ctx)
+	sessionQuery := `
+		INSERT INTO sessions (id, user_id, client_id, user_agent, ip_address)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, '')::inet)
+		ON CONFLICT (id) DO UPDATE SET
+			user_agent = COALESCE(EXCLUDED.user_agent, sessions.user_agent),
+			ip_address = COALESCE(EXCLUDED.ip_address, sessions.ip_address),
+			last_used_at = NOW()
+		RETURNING created_at
+	`
+	var sessionCreatedAt time.Time
+	err = db.QueryRow(ctx, sessionQuery, familyID, user.ID, clientID, device.UserAgent, audit.ClientIP(device.IPAddress)).Scan(&sessionCreatedAt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to hash refresh token: %w", err)
+		return nil, fmt.Errorf("failed to store session: %w", err)
 	}
 
 	insertQuery := `
-		INSERT INTO refresh_tokens (user_id, token_hash, expires_at)
-		VALUES ($1, $2, $3)
+		INSERT INTO refresh_tokens (id, user_id, selector, token_hash, family_id, parent_id, client_id, scope, amr, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`
-	_, err = s.db.Exec(ctx, insertQuery, user.ID, tokenHash, time.Now().Add(s.cfg.JWTRefreshTokenExpiry))
+	_, err = db.Exec(ctx, insertQuery,
+		tokenID, user.ID, selector, verifierHash, familyID, parentID, clientID, opts.Scope,
+		nonNilAMR(opts.AMR), s.refreshTokenExpiry(refreshExpiry, sessionCreatedAt),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to store refresh token: %w", err)
 	}
 
+	if parent == nil {
+		if err := s.evictSessions(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+
 	return &models.TokenPair{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
+		Scope:        opts.Scope,
+		ExpiresIn:    accessExpiry,
+		AMR:          opts.AMR,
 	}, nil
 }
 
-func (s *Service) RefreshAccessToken(ctx context.Context, refreshToken string) (*models.TokenPair, error) {
-	// Find valid refresh token
-	query := `
-		SELECT id, user_id, token_hash, expires_at
-		FROM refresh_tokens
-		WHERE revoked_at IS NULL AND expires_at > NOW()
-	`
+// RefreshAccessToken rotates a refresh token, returning a new token pair
+// issued to the same client with the same scope. The user is returned so
+// callers can add client-specific tokens such as an ID token.
+func (s *Service) RefreshAccessToken(ctx context.Context, req RefreshRequest) (*models.TokenPair, *models.User, error) {
+	tokenRecord, err := s.findRefreshToken(ctx, req.RefreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tokenRecord == nil || tokenRecord.ExpiresAt.Before(time.Now()) {
+		return nil, nil, fmt.Errorf("invalid or expired refresh token")
+	}
+
+	if req.ClientID != "" && (tokenRecord.ClientID == nil || *tokenRecord.ClientID != req.ClientID) {
+		return nil, nil, fmt.Errorf("refresh token was not issued to this client")
+	}
+
+	if tokenRecord.RevokedAt != nil {
+		return nil, nil, s.checkRefreshTokenReuse(ctx, tokenRecord, req.IPAddress, req.UserAgent)
+	}
+
+	if err := s.checkSessionPolicy(ctx, tokenRecord); err != nil {
+		return nil, nil, err
+	}
 
-	rows, err := s.db.Query(ctx, query)
+	// The old token is only revoked if the new pair is stored, so a failed
+	// refresh can be retried with it
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query refresh tokens: %w", err)
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer rows.Close()
+	defer tx.Rollback(ctx)
 
-	var tokenRecord *models.RefreshToken
-	for rows.Next() {
-		var rt models.RefreshToken
-		if err := rows.Scan(&rt.ID, &rt.UserID, &rt.TokenHash, &rt.ExpiresAt); err != nil {
-			continue
-		}
+	// Revoke old refresh token (rotating tokens). The revoked_at check makes
+	// concurrent refreshes with the same token race for a single winner.
+	revokeQuery := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`
+	result, err := tx.Exec(ctx, revokeQuery, tokenRecord.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to revoke old token: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return nil, nil, fmt.Errorf("invalid or expired refresh token")
+	}
 
-		// Compare token hash
-		if err := customJWT.CompareRefreshToken(rt.TokenHash, refreshToken); err == nil {
-			tokenRecord = &rt
-			break
-		}
+	user, err := s.GetActiveUser(ctx, tokenRecord.UserID)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if tokenRecord == nil {
-		return nil, fmt.Errorf("invalid or expired refresh token")
+	opts := TokenOptions{Scope: tokenRecord.Scope, AMR: tokenRecord.AMR}
+	if tokenRecord.ClientID != nil {
+		opts.ClientID = *tokenRecord.ClientID
 	}
 
-	// Revoke old refresh token (rotating tokens)
-	revokeQuery := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1`
-	_, err = s.db.Exec(ctx, revokeQuery, tokenRecord.ID)
+	// Generate new token pair in the same family
+	tokens, err := s.issueTokens(ctx, tx, user, opts, tokenRecord)
 	if err != nil {
-		return nil, fmt.Errorf("failed to revoke old token: %w", err)
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	// Get user
+	return tokens, user, nil
+}
+
+// GetActiveUser loads a user that is allowed to receive tokens
+func (s *Service) GetActiveUser(ctx context.Context, userID uuid.UUID) (*models.User, error) {
 	var user models.User
 	userQuery := `
 		SELECT id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at
 		FROM users
 		WHERE id = $1 AND is_active = true AND deleted_at IS NULL
 	`
-	err = s.db.QueryRow(ctx, userQuery, tokenRecord.UserID).Scan(
+	err := s.db.QueryRow(ctx, userQuery, userID).Scan(
 		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
 		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
 	)
@@ -240,50 +411,116 @@ func (s *Service) RefreshAccessToken(ctx context.Context, refreshToken string) (
 		return nil, fmt.Errorf("user not found or inactive: %w", err)
 	}
 
-	// Generate new token pair
-	return s.GenerateTokens(ctx, &user)
+	return &user, nil
 }
 
-func (s *Service) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
-	query := `
-		SELECT id, token_hash
-		FROM refresh_tokens
-		WHERE revoked_at IS NULL AND expires_at > NOW()
-	`
+// checkRefreshTokenReuse handles a revoked refresh token being presented. If
+// the token was revoked by rotation, someone is replaying an old token: the
+// whole family is revoked so neither the thief nor the victim can keep using
+// it, and the event is recorded in the audit log.
+func (s *Service) checkRefreshTokenReuse(ctx context.Context, tokenRecord *models.RefreshToken, ipAddress, userAgent string) error {
+	var rotated bool
+	rotatedQuery := `SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE parent_id = $1)`
+	if err := s.db.QueryRow(ctx, rotatedQuery, tokenRecord.ID).Scan(&rotated); err != nil {
+		return fmt.Errorf("failed to check refresh token rotation: %w", err)
+	}
+	if !rotated {
+		return fmt.Errorf("invalid or expired refresh token")
+	}
 
-	rows, err := s.db.Query(ctx, query)
-	if err != nil {
-		return fmt.Errorf("failed to query refresh tokens: %w", err)
+	if err := s.RevokeTokenFamily(ctx, tokenRecord.FamilyID); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	var tokenID uuid.UUID
-	for rows.Next() {
-		var id uuid.UUID
-		var tokenHash string
-		if err := rows.Scan(&id, &tokenHash); err != nil {
-			continue
-		}
+	s.LogAuthEvent(ctx, &tokenRecord.UserID, "REFRESH_TOKEN_REUSE", ipAddress, userAgent)
 
-		if err := customJWT.CompareRefreshToken(tokenHash, refreshToken); err == nil {
-			tokenID = id
-			break
-		}
+	return ErrRefreshTokenReused
+}
+
+// RevokeTokenFamily revokes every live refresh token in a family
+func (s *Service) RevokeTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	query := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`
+	if _, err := s.db.Exec(ctx, query, familyID); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
 	}
+	return nil
+}
 
-	if tokenID == uuid.Nil {
+// RevokeRefreshToken signs out of the session refreshToken belongs to by
+// revoking its whole family, like RevokeSession
+func (s *Service) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	tokenRecord, err := s.findRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	if tokenRecord == nil || tokenRecord.RevokedAt != nil {
 		return fmt.Errorf("refresh token not found")
 	}
 
-	revokeQuery := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1`
-	_, err = s.db.Exec(ctx, revokeQuery, tokenID)
-	return err
+	return s.RevokeTokenFamily(ctx, tokenRecord.FamilyID)
 }
 
-func (s *Service) LogAuthEvent(ctx context.Context, userID *uuid.UUID, action, ipAddress, userAgent string) {
+// RefreshTokenOwner returns the user and, if any, the client a refresh
+// token was issued to, whether or not it is still valid
+func (s *Service) RefreshTokenOwner(ctx context.Context, refreshToken string) (uuid.UUID, string, error) {
+	tokenRecord, err := s.findRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if tokenRecord == nil {
+		return uuid.Nil, "", fmt.Errorf("refresh token not found")
+	}
+
+	var clientID string
+	if tokenRecord.ClientID != nil {
+		clientID = *tokenRecord.ClientID
+	}
+	return tokenRecord.UserID, clientID, nil
+}
+
+// findRefreshToken returns the refresh token row matching refreshToken, or nil
+// if there is none. Selector/verifier tokens are returned even when revoked or
+// expired so callers can tell a replayed token from an unknown one.
+func (s *Service) findRefreshToken(ctx context.Context, refreshToken string) (*models.RefreshToken, error) {
+	selector, verifier, ok := customJWT.SplitRefreshToken(refreshToken)
+	if !ok {
+		return nil, nil
+	}
+
 	query := `
-		INSERT INTO auth_audit_log (user_id, action, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4)
+		SELECT id, user_id, selector, token_hash, family_id, parent_id, client_id, scope, amr, expires_at, created_at, revoked_at
+		FROM refresh_tokens
+		WHERE selector = $1
 	`
-	s.db.Exec(ctx, query, userID, action, ipAddress, userAgent)
+
+	var rt models.RefreshToken
+	err := s.db.QueryRow(ctx, query, selector).Scan(
+		&rt.ID, &rt.UserID, &rt.Selector, &rt.TokenHash, &rt.FamilyID, &rt.ParentID,
+		&rt.ClientID, &rt.Scope, &rt.AMR, &rt.ExpiresAt, &rt.CreatedAt, &rt.RevokedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query refresh token: %w", err)
+	}
+
+	if !customJWT.CompareRefreshVerifier(rt.TokenHash, verifier) {
+		return nil, nil
+	}
+
+	return &rt, nil
+}
+
+// LogAuthEvent records an event about userID's account on its own. Empty
+// ipAddress and userAgent default to those of the request in ctx. The event
+// is not worth failing the request over; audit.Record logs and counts
+// failures.
+func (s *Service) LogAuthEvent(ctx context.Context, userID *uuid.UUID, action, ipAddress, userAgent string) {
+	_ = audit.Record(ctx, s.db, audit.Event{
+		Action:    action,
+		UserID:    userID,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+	})
 }
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRefreshAccessTokenRetryAfterFailure(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+
+	tokens, err := s.GenerateTokens(ctx, user, TokenOptions{AMR: []string{AMRPassword}})
+	if err != nil {
+		t.Fatalf("GenerateTokens: %v", err)
+	}
+
+	// A refresh that fails after the token was revoked keeps the session
+	if _, err := s.db.Exec(ctx, `UPDATE users SET is_active = false WHERE id = $1`, user.ID); err != nil {
+		t.Fatalf("failed to deactivate user: %v", err)
+	}
+	if _, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: tokens.RefreshToken}); err == nil {
+		t.Fatal("RefreshAccessToken succeeded for an inactive user")
+	}
+	if _, err := s.db.Exec(ctx, `UPDATE users SET is_active = true WHERE id = $1`, user.ID); err != nil {
+		t.Fatalf("failed to reactivate user: %v", err)
+	}
+
+	rotated, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: tokens.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshAccessToken after a failed refresh: %v", err)
+	}
+	if rotated.RefreshToken == tokens.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+
+	if _, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: tokens.RefreshToken}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("RefreshAccessToken with the rotated token = %v, want ErrRefreshTokenReused", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+
+	first, err := s.GenerateTokens(ctx, user, TokenOptions{AMR: []string{AMRPassword}})
+	if err != nil {
+		t.Fatalf("GenerateTokens: %v", err)
+	}
+	second, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: first.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshAccessToken: %v", err)
+	}
+	third, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: second.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshAccessToken: %v", err)
+	}
+
+	// Another session of the same user is not affected
+	other, err := s.GenerateTokens(ctx, user, TokenOptions{AMR: []string{AMRPassword}})
+	if err != nil {
+		t.Fatalf("GenerateTokens: %v", err)
+	}
+
+	if _, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: first.RefreshToken}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("replaying a rotated token: err = %v, want ErrRefreshTokenReused", err)
+	}
+
+	record, err := s.findRefreshToken(ctx, first.RefreshToken)
+	if err != nil || record == nil {
+		t.Fatalf("findRefreshToken = %v, %v", record, err)
+	}
+	var live int
+	query := `SELECT COUNT(*) FROM refresh_tokens WHERE family_id = $1 AND revoked_at IS NULL`
+	if err := s.db.QueryRow(ctx, query, record.FamilyID).Scan(&live); err != nil {
+		t.Fatalf("failed to query refresh tokens: %v", err)
+	}
+	if live != 0 {
+		t.Errorf("%d tokens of the replayed family are still live", live)
+	}
+	if _, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: third.RefreshToken}); err == nil {
+		t.Error("the family's latest token still refreshes")
+	}
+
+	if _, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: other.RefreshToken}); err != nil {
+		t.Errorf("RefreshAccessToken in another session: %v", err)
+	}
+
+	var logged bool
+	query = `SELECT EXISTS (SELECT 1 FROM auth_audit_log WHERE user_id = $1 AND action = 'REFRESH_TOKEN_REUSE')`
+	if err := s.db.QueryRow(ctx, query, user.ID).Scan(&logged); err != nil {
+		t.Fatalf("failed to query audit log: %v", err)
+	}
+	if !logged {
+		t.Error("reuse was not recorded in the audit log")
+	}
+}
+
+func TestRevokeRefreshTokenRevokesFamily(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+
+	first, err := s.GenerateTokens(ctx, user, TokenOptions{AMR: []string{AMRPassword}})
+	if err != nil {
+		t.Fatalf("GenerateTokens: %v", err)
+	}
+	other, err := s.GenerateTokens(ctx, user, TokenOptions{AMR: []string{AMRPassword}})
+	if err != nil {
+		t.Fatalf("GenerateTokens: %v", err)
+	}
+
+	// A second live token in the family, as a refresh racing the logout
+	// would leave
+	record, err := s.findRefreshToken(ctx, first.RefreshToken)
+	if err != nil || record == nil {
+		t.Fatalf("findRefreshToken = %v, %v", record, err)
+	}
+	sibling, err := s.issueTokens(ctx, s.db, user, TokenOptions{AMR: []string{AMRPassword}}, record)
+	if err != nil {
+		t.Fatalf("issueTokens: %v", err)
+	}
+
+	if err := s.RevokeRefreshToken(ctx, first.RefreshToken); err != nil {
+		t.Fatalf("RevokeRefreshToken: %v", err)
+	}
+
+	var live int
+	query := `SELECT COUNT(*) FROM refresh_tokens WHERE family_id = $1 AND revoked_at IS NULL`
+	if err := s.db.QueryRow(ctx, query, record.FamilyID).Scan(&live); err != nil {
+		t.Fatalf("failed to query refresh tokens: %v", err)
+	}
+	if live != 0 {
+		t.Errorf("%d tokens of the session are still live", live)
+	}
+	if _, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: sibling.RefreshToken}); err == nil {
+		t.Error("another token of the session still refreshes")
+	}
+
+	if _, _, err := s.RefreshAccessToken(ctx, RefreshRequest{RefreshToken: other.RefreshToken}); err != nil {
+		t.Errorf("RefreshAccessToken in another session: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxSessionNameLength bounds the name users give a session
+const maxSessionNameLength = 100
+
+var (
+	// ErrSessionNotFound is returned for sessions that do not exist, have
+	// ended or belong to another user
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrInvalidSessionName is returned for session names that are too long
+	ErrInvalidSessionName = errors.New("invalid session name")
+
+	// ErrSessionExpired is returned when refreshing a session that was idle
+	// too long, reached its maximum age or was evicted by newer sessions
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// ListSessions returns the user's sessions that still have a usable refresh
+// token, most recently used first. The session current is marked as such.
+func (s *Service) ListSessions(ctx context.Context, userID, current uuid.UUID) ([]models.Session, error) {
+	query := `
+		SELECT s.id, s.user_id, s.client_id, s.name, s.user_agent, host(s.ip_address),
+		       s.created_at, s.last_used_at, MAX(t.expires_at)
+		FROM sessions s
+		JOIN refresh_tokens t ON t.family_id = s.id AND t.revoked_at IS NULL AND t.expires_at > NOW()
+		WHERE s.user_id = $1
+		GROUP BY s.id
+		ORDER BY s.last_used_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	sessions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.Session, error) {
+		var session models.Session
+		err := row.Scan(
+			&session.ID, &session.UserID, &session.ClientID, &session.Name, &session.UserAgent,
+			&session.IPAddress, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+		)
+		session.Current = session.ID == current
+		return session, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// RenameSession names one of the user's sessions, such as "Work laptop". An
+// empty name clears it.
+func (s *Service) RenameSession(ctx context.Context, userID, sessionID uuid.UUID, name string) error {
+	name = strings.TrimSpace(name)
+	if len(name) > maxSessionNameLength {
+		return ErrInvalidSessionName
+	}
+
+	result, err := s.db.Exec(ctx, `
+		UPDATE sessions SET name = NULLIF($3, '') WHERE id = $1 AND user_id = $2
+	`, sessionID, userID, name)
+	if err != nil {
+		return fmt.Errorf("failed to rename session: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// SessionOfRefreshToken returns the session a refresh token belongs to
+func (s *Service) SessionOfRefreshToken(ctx context.Context, refreshToken string) (uuid.UUID, error) {
+	token, err := s.findRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if token == nil {
+		return uuid.Nil, ErrSessionNotFound
+	}
+	return token.FamilyID, nil
+}
+
+// RevokeSession signs the user out of one session by revoking its refresh
+// tokens. Access tokens already issued to it stay valid until they expire.
+func (s *Service) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+	`, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+
+	err = audit.Record(ctx, tx, audit.Event{
+		Action:     "SESSION_REVOKED",
+		UserID:     &userID,
+		TargetType: audit.TargetSession,
+		TargetID:   sessionID.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RevokeOtherSessions signs the user out of every session but keep,
+// returning how many were revoked
+func (s *Service) RevokeOtherSessions(ctx context.Context, userID, keep uuid.UUID) (int64, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var revoked int64
+	err = tx.QueryRow(ctx, `
+		WITH revoked AS (
+			UPDATE refresh_tokens SET revoked_at = NOW()
+			WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL AND expires_at > NOW()
+			RETURNING family_id
+		)
+		SELECT COUNT(DISTINCT family_id) FROM revoked
+	`, userID, keep).Scan(&revoked)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	if revoked > 0 {
+		if err := audit.Record(ctx, tx, audit.Event{Action: "OTHER_SESSIONS_REVOKED", UserID: &userID}); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return revoked, nil
+}
+
+// sessionLimit returns how many sessions users of role can have at once, 0
+// meaning no limit
+func (s *Service) sessionLimit(role string) int {
+	if limit, ok := s.cfg.SessionRoleLimits[role]; ok {
+		return limit
+	}
+	return s.cfg.SessionLimit
+}
+
+// refreshTokenExpiry returns when a refresh token with the given lifetime
+// expires, brought forward to the idle timeout and to the end of its
+// session, started at createdAt, under SESSION_MAX_AGE
+func (s *Service) refreshTokenExpiry(lifetime time.Duration, createdAt time.Time) time.Time {
+	now := time.Now()
+	expiry := now.Add(lifetime)
+	if s.cfg.SessionIdleTimeout > 0 && now.Add(s.cfg.SessionIdleTimeout).Before(expiry) {
+		expiry = now.Add(s.cfg.SessionIdleTimeout)
+	}
+	if s.cfg.SessionMaxAge > 0 && createdAt.Add(s.cfg.SessionMaxAge).Before(expiry) {
+		expiry = createdAt.Add(s.cfg.SessionMaxAge)
+	}
+	return expiry
+}
+
+// checkSessionPolicy ends the session of a refresh token being rotated if it
+// has been idle longer than SESSION_IDLE_TIMEOUT, is older than
+// SESSION_MAX_AGE or is no longer among its user's newest sessions under
+// their limit. Tokens are issued to expire by the first two anyway; checking
+// here also covers tokens issued before the policy was tightened.
+func (s *Service) checkSessionPolicy(ctx context.Context, token *models.RefreshToken) error {
+	var createdAt, lastUsedAt time.Time
+	var role string
+	var newer int
+	query := `
+		SELECT s.created_at, s.last_used_at, u.role, (
+			SELECT COUNT(*) FROM sessions n
+			WHERE n.user_id = s.user_id AND (n.created_at, n.id) > (s.created_at, s.id)
+			  AND EXISTS (
+				SELECT 1 FROM refresh_tokens t
+				WHERE t.family_id = n.id AND t.revoked_at IS NULL AND t.expires_at > NOW()
+			  )
+		)
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = $1
+	`
+	err := s.db.QueryRow(ctx, query, token.FamilyID).Scan(&createdAt, &lastUsedAt, &role, &newer)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("invalid or expired refresh token")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query session: %w", err)
+	}
+
+	now := time.Now()
+	var action string
+	switch limit := s.sessionLimit(role); {
+	case s.cfg.SessionIdleTimeout > 0 && now.Sub(lastUsedAt) > s.cfg.SessionIdleTimeout:
+		action = "SESSION_IDLE_TIMEOUT"
+	case s.cfg.SessionMaxAge > 0 && now.Sub(createdAt) > s.cfg.SessionMaxAge:
+		action = "SESSION_MAX_AGE_REACHED"
+	case limit > 0 && newer >= limit:
+		action = "SESSION_EVICTED"
+	default:
+		return nil
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL
+	`, token.FamilyID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	err = audit.Record(ctx, tx, audit.Event{
+		Action:     action,
+		UserID:     &token.UserID,
+		TargetType: audit.TargetSession,
+		TargetID:   token.FamilyID.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return ErrSessionExpired
+}
+
+// evictSessions ends the user's oldest sessions beyond their limit, called
+// once a new session has started
+func (s *Service) evictSessions(ctx context.Context, user *models.User) error {
+	limit := s.sessionLimit(user.Role)
+	if limit == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		WITH evicted AS (
+			SELECT s.id FROM sessions s
+			WHERE s.user_id = $1 AND EXISTS (
+				SELECT 1 FROM refresh_tokens t
+				WHERE t.family_id = s.id AND t.revoked_at IS NULL AND t.expires_at > NOW()
+			)
+			ORDER BY s.created_at DESC, s.id DESC
+			OFFSET $2
+		), revoked AS (
+			UPDATE refresh_tokens t SET revoked_at = NOW()
+			FROM evicted e
+			WHERE t.family_id = e.id AND t.revoked_at IS NULL
+			RETURNING t.family_id
+		)
+		SELECT DISTINCT family_id FROM revoked
+	`, user.ID, limit)
+	if err != nil {
+		return fmt.Errorf("failed to evict sessions: %w", err)
+	}
+	evicted, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return fmt.Errorf("failed to evict sessions: %w", err)
+	}
+
+	for _, sessionID := range evicted {
+		err := audit.Record(ctx, tx, audit.Event{
+			Action:     "SESSION_EVICTED",
+			UserID:     &user.ID,
+			TargetType: audit.TargetSession,
+			TargetID:   sessionID.String(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
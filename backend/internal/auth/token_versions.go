@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// tokenVersionCacheSize is how many users TokenVersions remembers before it
+// starts forgetting expired lookups
+const tokenVersionCacheSize = 10_000
+
+// TokenVersions looks up users' current token versions for checking access
+// tokens against, caching each lookup for a short while so that checking
+// every request stays cheap. A bump takes up to the cache TTL to be seen by
+// older tokens; tokens issued after it reload the version.
+type TokenVersions struct {
+	db  *database.DB
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[uuid.UUID]cachedTokenVersion
+}
+
+type cachedTokenVersion struct {
+	version   int
+	fetchedAt time.Time
+}
+
+func NewTokenVersions(db *database.DB, ttl time.Duration) *TokenVersions {
+	return &TokenVersions{
+		db:      db,
+		ttl:     ttl,
+		entries: make(map[uuid.UUID]cachedTokenVersion),
+	}
+}
+
+// TokenVersion returns userID's current token version, or -1, which no
+// token carries, for unknown users
+func (v *TokenVersions) TokenVersion(ctx context.Context, userID uuid.UUID) (int, error) {
+	v.mu.Lock()
+	cached, ok := v.entries[userID]
+	v.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < v.ttl {
+		return cached.version, nil
+	}
+
+	return v.ReloadTokenVersion(ctx, userID)
+}
+
+// ReloadTokenVersion looks up userID's token version bypassing the cache,
+// for a token newer than the cached version: it was issued after a bump
+// the cache has not seen yet
+func (v *TokenVersions) ReloadTokenVersion(ctx context.Context, userID uuid.UUID) (int, error) {
+	now := time.Now()
+
+	var version int
+	err := v.db.QueryRow(ctx, `SELECT token_version FROM users WHERE id = $1`, userID).Scan(&version)
+	if err == pgx.ErrNoRows {
+		version = -1
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to query token version: %w", err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.entries) >= tokenVersionCacheSize {
+		for id, e := range v.entries {
+			if now.Sub(e.fetchedAt) >= v.ttl {
+				delete(v.entries, id)
+			}
+		}
+	}
+	v.entries[userID] = cachedTokenVersion{version: version, fetchedAt: now}
+
+	return version, nil
+}
+
+// SignOutEverywhere ends every session of userID: their refresh tokens are
+// revoked and the token version bump invalidates their access tokens
+func (s *Service) SignOutEverywhere(ctx context.Context, userID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET token_version = token_version + 1 WHERE id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to bump token version: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	if err := audit.Record(ctx, tx, audit.Event{Action: "LOGOUT_EVERYWHERE", UserID: &userID}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Verifiers that do not check token versions follow the denylist
+	return s.denylist.RevokeUser(ctx, userID)
+}
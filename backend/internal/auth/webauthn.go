@@ -0,0 +1,424 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// WebAuthn ceremonies
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+	ceremonyMFA          = "mfa"
+)
+
+// webauthnCeremonyTTL is how long a passkey prompt may take
+const webauthnCeremonyTTL = 5 * time.Minute
+
+var (
+	// ErrInvalidPasskey is returned when a WebAuthn response does not match
+	// a pending ceremony or a registered passkey
+	ErrInvalidPasskey = errors.New("invalid passkey response")
+
+	// ErrPasskeyNotFound is returned when a user has no passkey with an ID
+	ErrPasskeyNotFound = errors.New("passkey not found")
+
+	// ErrPasskeyExists is returned when registering a passkey twice
+	ErrPasskeyExists = errors.New("passkey already registered")
+)
+
+// webauthnCeremony is a pending row of webauthn_challenges
+type webauthnCeremony struct {
+	challenge      []byte
+	userID         *uuid.UUID
+	mfaChallengeID *uuid.UUID
+	loginContext   []byte
+}
+
+// newRelyingParty configures WebAuthn for the frontend
+func newRelyingParty(cfg *config.Config) *webauthn.RelyingParty {
+	return webauthn.New(webauthn.Config{
+		RPID:    cfg.WebAuthnRPID,
+		RPName:  cfg.WebAuthnRPName,
+		Origins: cfg.WebAuthnOrigins,
+		Timeout: webauthnCeremonyTTL,
+	})
+}
+
+// ListPasskeys returns a user's passkeys
+func (s *Service) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]models.WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, credential_id, public_key, sign_count, transports, name,
+			backup_eligible, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	passkeys := []models.WebAuthnCredential{}
+	for rows.Next() {
+		var p models.WebAuthnCredential
+		if err := rows.Scan(
+			&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &p.SignCount, &p.Transports, &p.Name,
+			&p.BackupEligible, &p.CreatedAt, &p.LastUsedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan passkey: %w", err)
+		}
+		passkeys = append(passkeys, p)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// BeginPasskeyRegistration returns the options for creating a passkey for
+// user in the browser
+func (s *Service) BeginPasskeyRegistration(ctx context.Context, user *models.User) (*webauthn.CreationOptions, error) {
+	existing, err := s.ListPasskeys(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := s.createWebAuthnCeremony(ctx, ceremonyRegistration, &user.ID, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The user handle is the user ID, which identifies the user when they
+	// sign in with the passkey
+	entity := webauthn.UserEntity{ID: user.ID[:], Name: user.Email, DisplayName: user.Name}
+	return s.webauthn.CreationOptions(challenge, entity, credentialDescriptors(existing)), nil
+}
+
+// FinishPasskeyRegistration verifies a new passkey and stores it. The first
+// second factor of a user also gets them recovery codes, which are returned.
+func (s *Service) FinishPasskeyRegistration(ctx context.Context, userID uuid.UUID, name string, resp *webauthn.CreationResponse) (*models.WebAuthnCredential, []string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	ceremony, err := consumeWebAuthnCeremony(ctx, tx, ceremonyRegistration, resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ceremony.userID == nil || *ceremony.userID != userID {
+		return nil, nil, ErrInvalidPasskey
+	}
+
+	cred, err := s.webauthn.VerifyRegistration(resp, ceremony.challenge)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPasskey, err)
+	}
+
+	hadSecondFactor, err := hasSecondFactor(ctx, tx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	passkey := models.WebAuthnCredential{
+		UserID:         userID,
+		CredentialID:   cred.ID,
+		PublicKey:      cred.PublicKey,
+		SignCount:      int64(cred.SignCount),
+		Transports:     cred.Transports,
+		Name:           name,
+		BackupEligible: cred.BackupEligible,
+	}
+	if passkey.Transports == nil {
+		passkey.Transports = []string{}
+	}
+
+	query := `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, aaguid, transports, name, backup_eligible, backup_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at
+	`
+	err = tx.QueryRow(ctx, query,
+		userID, cred.ID, cred.PublicKey, passkey.SignCount, cred.AAGUID, passkey.Transports, name,
+		cred.BackupEligible, cred.BackupState,
+	).Scan(&passkey.ID, &passkey.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, nil, ErrPasskeyExists
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store passkey: %w", err)
+	}
+
+	var codes []string
+	if !hadSecondFactor {
+		if codes, err = replaceRecoveryCodes(ctx, tx, userID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &passkey, codes, nil
+}
+
+// DeletePasskey removes one of a user's passkeys
+func (s *Service) DeletePasskey(ctx context.Context, userID, passkeyID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, passkeyID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrPasskeyNotFound
+	}
+
+	if err := deleteUnusableRecoveryCodes(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// BeginPasskeyLogin returns the options for signing in with any passkey.
+// loginCtx says where the login goes once the passkey is verified.
+func (s *Service) BeginPasskeyLogin(ctx context.Context, loginCtx *LoginContext) (*webauthn.RequestOptions, error) {
+	encoded, err := json.Marshal(loginCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode login context: %w", err)
+	}
+
+	challenge, err := s.createWebAuthnCeremony(ctx, ceremonyLogin, nil, nil, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.webauthn.RequestOptions(challenge, nil), nil
+}
+
+// FinishPasskeyLogin verifies a passkey sign-in and returns the user and
+// the login to complete. A passkey with user verification (PIN or
+// biometrics) counts as multi-factor on its own.
+func (s *Service) FinishPasskeyLogin(ctx context.Context, resp *webauthn.AssertionResponse) (*models.User, *LoginContext, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	ceremony, err := consumeWebAuthnCeremony(ctx, tx, ceremonyLogin, resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	passkey, assertion, err := s.verifyPasskey(ctx, tx, ceremony, resp, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	var loginCtx LoginContext
+	if err := json.Unmarshal(ceremony.loginContext, &loginCtx); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode login context: %w", err)
+	}
+	loginCtx.AMR = []string{AMRHardwareKey}
+	if assertion.UserVerified {
+		loginCtx.AMR = append(loginCtx.AMR, AMRMFA)
+	}
+	loginCtx.AuthTime = time.Now()
+
+	user, err := s.GetActiveUser(ctx, passkey.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, &loginCtx, nil
+}
+
+// BeginMFAPasskey returns the options for answering an MFA challenge with
+// one of the user's passkeys
+func (s *Service) BeginMFAPasskey(ctx context.Context, token string) (*webauthn.RequestOptions, error) {
+	var challengeID, userID uuid.UUID
+	query := `
+		SELECT id, user_id
+		FROM mfa_challenges
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() AND attempts < $2
+	`
+	err := s.db.QueryRow(ctx, query, hashSecret(token), mfaMaxAttempts).Scan(&challengeID, &userID)
+	if err == pgx.ErrNoRows {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query challenge: %w", err)
+	}
+
+	passkeys, err := s.ListPasskeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(passkeys) == 0 {
+		return nil, ErrPasskeyNotFound
+	}
+
+	challenge, err := s.createWebAuthnCeremony(ctx, ceremonyMFA, &userID, &challengeID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.webauthn.RequestOptions(challenge, credentialDescriptors(passkeys)), nil
+}
+
+// VerifyMFAChallengeWithPasskey answers an MFA challenge with a passkey
+// started with BeginMFAPasskey
+func (s *Service) VerifyMFAChallengeWithPasskey(ctx context.Context, token string, resp *webauthn.AssertionResponse) (*models.User, *LoginContext, error) {
+	verify := func(tx pgx.Tx, userID, challengeID uuid.UUID) error {
+		ceremony, err := consumeWebAuthnCeremony(ctx, tx, ceremonyMFA, resp.Response.ClientDataJSON)
+		if err != nil {
+			return err
+		}
+		if ceremony.mfaChallengeID == nil || *ceremony.mfaChallengeID != challengeID {
+			return ErrInvalidPasskey
+		}
+		_, _, err = s.verifyPasskey(ctx, tx, ceremony, resp, &userID)
+		return err
+	}
+	return s.completeMFAChallenge(ctx, token, verify, AMRHardwareKey)
+}
+
+// verifyPasskey checks an assertion against the stored passkey, optionally
+// requiring it to belong to userID, and records its use
+func (s *Service) verifyPasskey(ctx context.Context, tx pgx.Tx, ceremony *webauthnCeremony, resp *webauthn.AssertionResponse, userID *uuid.UUID) (*models.WebAuthnCredential, *webauthn.Assertion, error) {
+	var passkey models.WebAuthnCredential
+	query := `
+		SELECT id, user_id, public_key, sign_count
+		FROM webauthn_credentials
+		WHERE credential_id = $1
+		FOR UPDATE
+	`
+	err := tx.QueryRow(ctx, query, []byte(resp.RawID)).Scan(&passkey.ID, &passkey.UserID, &passkey.PublicKey, &passkey.SignCount)
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrInvalidPasskey
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query passkey: %w", err)
+	}
+
+	if userID != nil && passkey.UserID != *userID {
+		return nil, nil, ErrInvalidPasskey
+	}
+	if len(resp.Response.UserHandle) > 0 && !bytes.Equal(resp.Response.UserHandle, passkey.UserID[:]) {
+		return nil, nil, ErrInvalidPasskey
+	}
+
+	assertion, err := s.webauthn.VerifyAssertion(resp, ceremony.challenge, passkey.PublicKey, uint32(passkey.SignCount))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPasskey, err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE webauthn_credentials
+		SET sign_count = $2, backup_state = $3, last_used_at = NOW()
+		WHERE id = $1
+	`, passkey.ID, int64(assertion.SignCount), assertion.BackupState)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to update passkey: %w", err)
+	}
+
+	return &passkey, assertion, nil
+}
+
+// createWebAuthnCeremony stores a new ceremony and returns its challenge
+func (s *Service) createWebAuthnCeremony(ctx context.Context, ceremony string, userID, mfaChallengeID *uuid.UUID, loginContext []byte) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	query := `
+		INSERT INTO webauthn_challenges (challenge_hash, ceremony, user_id, mfa_challenge_id, login_context, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err = s.db.Exec(ctx, query,
+		hashSecret(string(challenge)), ceremony, userID, mfaChallengeID, loginContext, time.Now().Add(webauthnCeremonyTTL),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store challenge: %w", err)
+	}
+
+	return challenge, nil
+}
+
+// consumeWebAuthnCeremony finds the pending ceremony a response was made
+// for, by the challenge in its client data, and marks it used
+func consumeWebAuthnCeremony(ctx context.Context, tx pgx.Tx, kind string, clientDataJSON []byte) (*webauthnCeremony, error) {
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return nil, ErrInvalidPasskey
+	}
+
+	ceremony := &webauthnCeremony{challenge: challenge}
+	var id uuid.UUID
+	query := `
+		UPDATE webauthn_challenges
+		SET used_at = NOW()
+		WHERE challenge_hash = $1 AND ceremony = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING id, user_id, mfa_challenge_id, login_context
+	`
+	err = tx.QueryRow(ctx, query, hashSecret(string(challenge)), kind).Scan(&id, &ceremony.userID, &ceremony.mfaChallengeID, &ceremony.loginContext)
+	if err == pgx.ErrNoRows {
+		return nil, ErrInvalidPasskey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query challenge: %w", err)
+	}
+
+	return ceremony, nil
+}
+
+// hasSecondFactor reports whether a user has TOTP or a passkey
+func hasSecondFactor(ctx context.Context, q querier, userID uuid.UUID) (bool, error) {
+	var exists bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)
+			OR EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $1)
+	`
+	if err := q.QueryRow(ctx, query, userID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to query second factors: %w", err)
+	}
+	return exists, nil
+}
+
+func credentialDescriptors(passkeys []models.WebAuthnCredential) []webauthn.CredentialDescriptor {
+	descriptors := make([]webauthn.CredentialDescriptor, len(passkeys))
+	for i, p := range passkeys {
+		descriptors[i] = webauthn.CredentialDescriptor{Type: "public-key", ID: p.CredentialID, Transports: p.Transports}
+	}
+	return descriptors
+}
@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/frans-sjostrom/auth-service/internal/mail"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn/webauthntest"
+	"github.com/google/uuid"
+)
+
+const testOrigin = "https://auth.example.com"
+
+// newTestService connects to TEST_DATABASE_URL, migrating it, and skips the
+// test without it
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	t.Setenv("MIGRATIONS_PATH", "file://../../migrations")
+	if err := database.RunMigrations(url); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	db, err := database.Connect(url)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	cfg := &config.Config{
+		JWTAccessTokenExpiry:  15 * time.Minute,
+		JWTRefreshTokenExpiry: 24 * time.Hour,
+		WebAuthnRPID:          "auth.example.com",
+		WebAuthnRPName:        "Auth Service",
+		WebAuthnOrigins:       []string{testOrigin},
+		MFAEncryptionKey:      make([]byte, 32),
+		FrontendURL:           testOrigin,
+		PasswordResetTTL:      time.Hour,
+		PasswordMinLength:     8,
+		Argon2Memory:          1024,
+		Argon2Iterations:      1,
+		Argon2Parallelism:     1,
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate signing key: %v", err)
+	}
+	keys := &KeyRing{active: &customJWT.SigningKey{ID: "test", PrivateKey: key}}
+	templates, err := mail.LoadTemplates("")
+	if err != nil {
+		t.Fatalf("LoadTemplates: %v", err)
+	}
+	mailer := &mail.TemplateMailer{Mailer: mail.NewMemoryMailer(), Templates: templates}
+	return NewService(db, cfg, keys, nil, mailer)
+}
+
+// testInbox returns the mailer the emails of a service from newTestService
+// end up in
+func testInbox(s *Service) *mail.MemoryMailer {
+	return s.mailer.Mailer.(*mail.MemoryMailer)
+}
+
+// newTestUser creates a user that is deleted with everything it owns when
+// the test ends
+func newTestUser(t *testing.T, s *Service) *models.User {
+	t.Helper()
+	ctx := context.Background()
+
+	var id uuid.UUID
+	email := uuid.NewString() + "@example.com"
+	if err := s.db.QueryRow(ctx, `INSERT INTO users (email, name) VALUES ($1, 'Ada') RETURNING id`, email).Scan(&id); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	t.Cleanup(func() {
+		s.db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, id)
+	})
+
+	user, err := s.GetActiveUser(ctx, id)
+	if err != nil {
+		t.Fatalf("GetActiveUser: %v", err)
+	}
+	return user
+}
+
+// registerPasskey creates a passkey for user on a
+func registerPasskey(t *testing.T, s *Service, user *models.User, a *webauthntest.Authenticator) *models.WebAuthnCredential {
+	t.Helper()
+	ctx := context.Background()
+
+	opts, err := s.BeginPasskeyRegistration(ctx, user)
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %v", err)
+	}
+	resp, err := a.Create(opts)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	passkey, _, err := s.FinishPasskeyRegistration(ctx, user.ID, "Laptop", resp)
+	if err != nil {
+		t.Fatalf("FinishPasskeyRegistration: %v", err)
+	}
+	return passkey
+}
+
+// passkeyLogin signs in with a passkey on a
+func passkeyLogin(t *testing.T, s *Service, a *webauthntest.Authenticator) (*models.User, *LoginContext, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	opts, err := s.BeginPasskeyLogin(ctx, &LoginContext{RedirectURI: testOrigin + "/"})
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+	resp, err := a.Get(opts)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return s.FinishPasskeyLogin(ctx, resp)
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+	a := webauthntest.NewAuthenticator(testOrigin)
+
+	opts, err := s.BeginPasskeyRegistration(ctx, user)
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %v", err)
+	}
+	resp, err := a.Create(opts)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	passkey, codes, err := s.FinishPasskeyRegistration(ctx, user.ID, "Laptop", resp)
+	if err != nil {
+		t.Fatalf("FinishPasskeyRegistration: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes with the first second factor, want %d", len(codes), recoveryCodeCount)
+	}
+	if !passkey.BackupEligible {
+		t.Error("passkey is not backup eligible")
+	}
+
+	// The ceremony is used up
+	if _, _, err := s.FinishPasskeyRegistration(ctx, user.ID, "Laptop", resp); !errors.Is(err, ErrInvalidPasskey) {
+		t.Errorf("replayed FinishPasskeyRegistration = %v, want ErrInvalidPasskey", err)
+	}
+
+	// The authenticator refuses to register itself twice
+	opts, err = s.BeginPasskeyRegistration(ctx, user)
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %v", err)
+	}
+	if _, err := a.Create(opts); err == nil {
+		t.Error("Create succeeded for an excluded credential")
+	}
+
+	got, loginCtx, err := passkeyLogin(t, s, a)
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin: %v", err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("signed in as %s, want %s", got.ID, user.ID)
+	}
+	if want := []string{AMRHardwareKey, AMRMFA}; !slices.Equal(loginCtx.AMR, want) {
+		t.Errorf("amr = %v, want %v", loginCtx.AMR, want)
+	}
+	if loginCtx.RedirectURI != testOrigin+"/" {
+		t.Errorf("redirect_uri = %q, want the one the login began with", loginCtx.RedirectURI)
+	}
+
+	// Without user verification a passkey is a single factor
+	a.UserVerified = false
+	if _, loginCtx, err = passkeyLogin(t, s, a); err != nil {
+		t.Fatalf("FinishPasskeyLogin: %v", err)
+	}
+	if want := []string{AMRHardwareKey}; !slices.Equal(loginCtx.AMR, want) {
+		t.Errorf("amr without user verification = %v, want %v", loginCtx.AMR, want)
+	}
+}
+
+func TestPasskeySignCountRegression(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+	a := webauthntest.NewAuthenticator(testOrigin)
+	a.CountSignatures = true
+	passkey := registerPasskey(t, s, user, a)
+
+	for range 2 {
+		if _, _, err := passkeyLogin(t, s, a); err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+	}
+
+	// A clone of the authenticator made before the second sign-in
+	a.Credentials()[0].SignCount = 0
+	if _, _, err := passkeyLogin(t, s, a); !errors.Is(err, ErrInvalidPasskey) {
+		t.Fatalf("FinishPasskeyLogin with a cloned authenticator = %v, want ErrInvalidPasskey", err)
+	}
+
+	var signCount int64
+	if err := s.db.QueryRow(ctx, `SELECT sign_count FROM webauthn_credentials WHERE id = $1`, passkey.ID).Scan(&signCount); err != nil {
+		t.Fatalf("failed to query sign count: %v", err)
+	}
+	if signCount != 2 {
+		t.Errorf("stored sign count = %d, want 2", signCount)
+	}
+}
+
+func TestPasskeyAsSecondFactor(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+	a := webauthntest.NewAuthenticator(testOrigin)
+	registerPasskey(t, s, user, a)
+
+	other := newTestUser(t, s)
+	b := webauthntest.NewAuthenticator(testOrigin)
+	registerPasskey(t, s, other, b)
+
+	token, err := s.CreateMFAChallenge(ctx, user.ID, &LoginContext{AMR: []string{AMRFederated}})
+	if err != nil {
+		t.Fatalf("CreateMFAChallenge: %v", err)
+	}
+
+	// Another user's passkey does not answer the challenge, and counts as
+	// an attempt
+	opts, err := s.BeginMFAPasskey(ctx, token)
+	if err != nil {
+		t.Fatalf("BeginMFAPasskey: %v", err)
+	}
+	resp, err := b.Get(&webauthn.RequestOptions{Challenge: opts.Challenge, RPID: opts.RPID})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, _, err := s.VerifyMFAChallengeWithPasskey(ctx, token, resp); !errors.Is(err, ErrInvalidPasskey) {
+		t.Fatalf("VerifyMFAChallengeWithPasskey with another user's passkey = %v, want ErrInvalidPasskey", err)
+	}
+	var attempts int
+	if err := s.db.QueryRow(ctx, `SELECT attempts FROM mfa_challenges WHERE token_hash = $1`, hashSecret(token)).Scan(&attempts); err != nil {
+		t.Fatalf("failed to query attempts: %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1", attempts)
+	}
+
+	opts, err = s.BeginMFAPasskey(ctx, token)
+	if err != nil {
+		t.Fatalf("BeginMFAPasskey: %v", err)
+	}
+	resp, err = a.Get(opts)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, loginCtx, err := s.VerifyMFAChallengeWithPasskey(ctx, token, resp)
+	if err != nil {
+		t.Fatalf("VerifyMFAChallengeWithPasskey: %v", err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("signed in as %s, want %s", got.ID, user.ID)
+	}
+	if want := []string{AMRFederated, AMRHardwareKey, AMRMFA}; !slices.Equal(loginCtx.AMR, want) {
+		t.Errorf("amr = %v, want %v", loginCtx.AMR, want)
+	}
+
+	// The challenge is consumed
+	if _, err := s.BeginMFAPasskey(ctx, token); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("BeginMFAPasskey after success = %v, want ErrInvalidMFAChallenge", err)
+	}
+	if _, _, err := s.VerifyMFAChallengeWithPasskey(ctx, token, resp); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("replayed VerifyMFAChallengeWithPasskey = %v, want ErrInvalidMFAChallenge", err)
+	}
+}
+
+func TestPasskeySecondFactorAttemptsExhausted(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	user := newTestUser(t, s)
+	a := webauthntest.NewAuthenticator(testOrigin)
+	registerPasskey(t, s, user, a)
+
+	token, err := s.CreateMFAChallenge(ctx, user.ID, &LoginContext{})
+	if err != nil {
+		t.Fatalf("CreateMFAChallenge: %v", err)
+	}
+
+	// Assertions with a bad signature are rejected until the challenge is
+	// used up
+	for range mfaMaxAttempts {
+		opts, err := s.BeginMFAPasskey(ctx, token)
+		if err != nil {
+			t.Fatalf("BeginMFAPasskey: %v", err)
+		}
+		resp, err := a.Get(opts)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Response.Signature[len(resp.Response.Signature)-1] ^= 0xff
+		if _, _, err := s.VerifyMFAChallengeWithPasskey(ctx, token, resp); !errors.Is(err, ErrInvalidPasskey) {
+			t.Fatalf("VerifyMFAChallengeWithPasskey with a bad signature = %v, want ErrInvalidPasskey", err)
+		}
+	}
+
+	if _, err := s.BeginMFAPasskey(ctx, token); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("BeginMFAPasskey after %d failures = %v, want ErrInvalidMFAChallenge", mfaMaxAttempts, err)
+	}
+}
@@ -2,10 +2,15 @@ package config
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,19 +22,137 @@ type Config struct {
 	Port string
 	Env  string
 
+	// TrustedProxies are the networks of the reverse proxies in front of
+	// the service. Only requests from them have their X-Forwarded-For and
+	// X-Real-IP headers believed. It is empty when set to "none", for
+	// clients connecting directly.
+	TrustedProxies []netip.Prefix
+
+	// IssuerURL is the public base URL of the service, used as the OpenID
+	// Connect issuer
+	IssuerURL string
+
+	// FrontendURL is the auth-service's own frontend, which hosts pages
+	// such as the second factor prompt
+	FrontendURL string
+
 	// Database
 	DatabaseURL string
 
-	// Google OAuth
-	GoogleClientID     string
-	GoogleClientSecret string
-	GoogleRedirectURL  string
+	// Upstream identity providers, in the order they are offered. The first
+	// one is used when a login does not name a provider.
+	Providers []ProviderConfig
+
+	// AutoLinkVerifiedEmail links a new provider identity to the existing
+	// user with the same email when the provider says it is verified
+	AutoLinkVerifiedEmail bool
 
 	// JWT
-	JWTPrivateKey          *rsa.PrivateKey
-	JWTPublicKey           *rsa.PublicKey
-	JWTAccessTokenExpiry   time.Duration
-	JWTRefreshTokenExpiry  time.Duration
+	JWTPrivateKey         *rsa.PrivateKey
+	JWTPublicKey          *rsa.PublicKey
+	JWTAccessTokenExpiry  time.Duration
+	JWTRefreshTokenExpiry time.Duration
+	JWTKeyRotationLead    time.Duration
+	JWTRetiredKeyTTL      time.Duration
+
+	// TokenVersionCheck makes the protected endpoints compare each access
+	// token's token_version with the user's, looked up at most every
+	// TokenVersionCacheTTL
+	TokenVersionCheck    bool
+	TokenVersionCacheTTL time.Duration
+
+	// MFA
+	MFAEncryptionKey []byte
+	MFARequiredRoles []string
+
+	// WebAuthn relying party. Passkey ceremonies run on the frontend, so
+	// the RP ID defaults to its host and the origin to FrontendURL.
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
+
+	// Passwords
+	PasswordMinLength           int
+	PasswordMaxLength           int
+	PasswordMinCharacterClasses int
+	PasswordResetTTL            time.Duration
+	Argon2Memory                uint32
+	Argon2Iterations            uint32
+	Argon2Parallelism           uint8
+
+	// Mail. Without SMTPHost emails are only logged.
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+
+	// MailTemplatesDir holds templates replacing the built-in emails
+	MailTemplatesDir string
+
+	// OrganizationInviteTTL is how long an invitation to an organization
+	// can be accepted
+	OrganizationInviteTTL time.Duration
+
+	// AuditCheckpointInterval is how often the head of the audit log's hash
+	// chain is signed
+	AuditCheckpointInterval time.Duration
+
+	// AuditCheckpointKey signs the checkpoints. Unlike the token signing
+	// keys it is kept out of the database, which someone rewriting the log
+	// could write to as well. Without it no checkpoints are signed.
+	AuditCheckpointKey *rsa.PrivateKey
+
+	// AuditCheckpointPublicKeys verify checkpoints in verify-audit. They
+	// are pinned out of band and default to AuditCheckpointKey's.
+	AuditCheckpointPublicKeys []*rsa.PublicKey
+
+	// AuditRetentionMonths is how many whole months of audit events are
+	// kept. Older monthly partitions are written to AuditArchive and
+	// dropped. 0 keeps the audit log forever.
+	AuditRetentionMonths int
+
+	// AuditArchive is a local directory or an s3://bucket/prefix URL
+	AuditArchive string
+
+	// S3-compatible object storage for archives. S3Endpoint defaults to
+	// AWS's endpoint for S3Region.
+	S3Endpoint        string
+	S3Region          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3SessionToken    string
+
+	// RefreshTokenRetention is how long revoked refresh tokens are kept,
+	// so that replaying one is still detected. Expired ones are deleted
+	// right away.
+	RefreshTokenRetention time.Duration
+
+	// SessionIdleTimeout ends sessions whose refresh token has not been
+	// used for that long, and SessionMaxAge those started that long ago
+	// however often they were refreshed. 0 turns either off.
+	SessionIdleTimeout time.Duration
+	SessionMaxAge      time.Duration
+
+	// SessionLimit caps how many sessions a user can have at once; signing
+	// in once more ends the oldest. SessionRoleLimits overrides it for the
+	// users of a role. 0 means no limit.
+	SessionLimit      int
+	SessionRoleLimits map[string]int
+
+	// RateLimitStore keeps rate limit buckets: "memory" for each replica on
+	// its own, or "postgres" to share them
+	RateLimitStore string
+
+	// Rate limits of the route groups: sign-in endpoints and the ones
+	// checking credentials by IP address, the OpenID Connect provider by IP
+	// address and by client, and the protected API by user
+	RateLimitAuth        RateLimit
+	RateLimitCredentials RateLimit
+	RateLimitOAuthIP     RateLimit
+	RateLimitOAuthClient RateLimit
+	RateLimitAPIUser     RateLimit
+	RateLimitRefreshUser RateLimit
 
 	// CORS
 	AllowedOrigins []string
@@ -43,19 +166,48 @@ func Load() (*Config, error) {
 	godotenv.Load()
 
 	cfg := &Config{
-		Port:                  getEnv("PORT", "8080"),
-		Env:                   getEnv("ENV", "development"),
-		DatabaseURL:           getEnv("DATABASE_URL", ""),
-		GoogleClientID:        getEnv("GOOGLE_CLIENT_ID", ""),
-		GoogleClientSecret:    getEnv("GOOGLE_CLIENT_SECRET", ""),
-		GoogleRedirectURL:     getEnv("GOOGLE_REDIRECT_URL", "http://localhost:8080/api/auth/google/callback"),
-		AllowedOrigins:        parseCSV(getEnv("ALLOWED_ORIGINS", "http://localhost:3000,http://localhost:5173")),
-		AdminEmails:           parseCSV(getEnv("ADMIN_EMAILS", "")),
+		Port:             getEnv("PORT", "8080"),
+		Env:              getEnv("ENV", "development"),
+		DatabaseURL:      getEnv("DATABASE_URL", ""),
+		AllowedOrigins:   parseCSV(getEnv("ALLOWED_ORIGINS", "http://localhost:3000,http://localhost:5173")),
+		AdminEmails:      parseCSV(getEnv("ADMIN_EMAILS", "")),
+		MFARequiredRoles: parseCSV(getEnv("MFA_REQUIRED_ROLES", "")),
+		SMTPHost:         getEnv("SMTP_HOST", ""),
+		SMTPPort:         getEnv("SMTP_PORT", "587"),
+		SMTPUsername:     getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:     getEnv("SMTP_PASSWORD", ""),
+		MailFrom:         getEnv("MAIL_FROM", "Auth Service <noreply@localhost>"),
+		MailTemplatesDir: getEnv("MAIL_TEMPLATES_DIR", ""),
+	}
+
+	var err error
+
+	// Behind a proxy that is not trusted every client has the proxy's
+	// address, sharing its rate limits and audit trail, so outside
+	// development where the service runs has to be stated
+	switch proxies := getEnv("TRUSTED_PROXIES", ""); proxies {
+	case "":
+		if cfg.Env != "development" {
+			return nil, fmt.Errorf("TRUSTED_PROXIES is required: set it to the addresses of the proxies in front of the service, or to \"none\" if clients connect to it directly")
+		}
+	case "none":
+	default:
+		cfg.TrustedProxies, err = parsePrefixes(proxies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+		}
+	}
+
+	cfg.IssuerURL = strings.TrimSuffix(getEnv("ISSUER_URL", "http://localhost:"+cfg.Port), "/")
+
+	defaultFrontendURL := "http://localhost:3000"
+	if len(cfg.AllowedOrigins) > 0 {
+		defaultFrontendURL = cfg.AllowedOrigins[0]
 	}
+	cfg.FrontendURL = strings.TrimSuffix(getEnv("FRONTEND_URL", defaultFrontendURL), "/")
 
 	// Parse JWT token expiry
 	accessExpiry := getEnv("JWT_ACCESS_TOKEN_EXPIRY", "15m")
-	var err error
 	cfg.JWTAccessTokenExpiry, err = time.ParseDuration(accessExpiry)
 	if err != nil {
 		return nil, fmt.Errorf("invalid JWT_ACCESS_TOKEN_EXPIRY: %w", err)
@@ -67,6 +219,43 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("invalid JWT_REFRESH_TOKEN_EXPIRY: %w", err)
 	}
 
+	// Parse signing key rotation settings
+	rotationLead := getEnv("JWT_KEY_ROTATION_LEAD", "1h")
+	cfg.JWTKeyRotationLead, err = time.ParseDuration(rotationLead)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEY_ROTATION_LEAD: %w", err)
+	}
+
+	retiredKeyTTL := getEnv("JWT_RETIRED_KEY_TTL", "24h")
+	cfg.JWTRetiredKeyTTL, err = time.ParseDuration(retiredKeyTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_RETIRED_KEY_TTL: %w", err)
+	}
+
+	cfg.TokenVersionCheck, err = strconv.ParseBool(getEnv("TOKEN_VERSION_CHECK", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOKEN_VERSION_CHECK: %w", err)
+	}
+
+	cfg.TokenVersionCacheTTL, err = time.ParseDuration(getEnv("TOKEN_VERSION_CACHE_TTL", "10s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOKEN_VERSION_CACHE_TTL: %w", err)
+	}
+
+	cfg.OrganizationInviteTTL, err = time.ParseDuration(getEnv("ORGANIZATION_INVITE_TTL", "168h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ORGANIZATION_INVITE_TTL: %w", err)
+	}
+
+	cfg.AuditCheckpointInterval, err = time.ParseDuration(getEnv("AUDIT_CHECKPOINT_INTERVAL", "1h"))
+	if err != nil || cfg.AuditCheckpointInterval <= 0 {
+		return nil, fmt.Errorf("invalid AUDIT_CHECKPOINT_INTERVAL: must be a positive duration")
+	}
+
+	if err := loadRetentionSettings(cfg); err != nil {
+		return nil, err
+	}
+
 	// Load or generate RSA keys
 	privateKeyPath := getEnv("JWT_PRIVATE_KEY_PATH", "./keys/private_key.pem")
 	publicKeyPath := getEnv("JWT_PUBLIC_KEY_PATH", "./keys/public_key.pem")
@@ -76,18 +265,243 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("failed to load RSA keys: %w", err)
 	}
 
+	if err := loadAuditCheckpointKeys(cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.MFAEncryptionKey, err = loadMFAEncryptionKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	frontendURL, err := url.Parse(cfg.FrontendURL)
+	if err != nil || frontendURL.Hostname() == "" {
+		return nil, fmt.Errorf("invalid FRONTEND_URL: %q", cfg.FrontendURL)
+	}
+	cfg.WebAuthnRPID = getEnv("WEBAUTHN_RP_ID", frontendURL.Hostname())
+	cfg.WebAuthnRPName = getEnv("WEBAUTHN_RP_NAME", "Auth Service")
+	cfg.WebAuthnOrigins = parseCSV(getEnv("WEBAUTHN_ORIGINS", cfg.FrontendURL))
+
+	cfg.Providers, err = loadProviders(cfg.IssuerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AutoLinkVerifiedEmail, err = strconv.ParseBool(getEnv("AUTO_LINK_VERIFIED_EMAIL", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUTO_LINK_VERIFIED_EMAIL: %w", err)
+	}
+
+	if err := loadPasswordSettings(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := loadSessionSettings(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := loadRateLimitSettings(cfg); err != nil {
+		return nil, err
+	}
+
 	// Validate required fields
 	if cfg.DatabaseURL == "" {
 		return nil, fmt.Errorf("DATABASE_URL is required")
 	}
-	if cfg.GoogleClientID == "" {
-		return nil, fmt.Errorf("GOOGLE_CLIENT_ID is required")
+
+	return cfg, nil
+}
+
+// loadMFAEncryptionKey reads the AES-256 key that encrypts TOTP secrets.
+// Outside production it defaults to one derived from the JWT private key so
+// local setups work without extra configuration.
+func loadMFAEncryptionKey(cfg *Config) ([]byte, error) {
+	encoded := getEnv("MFA_ENCRYPTION_KEY", "")
+	if encoded == "" {
+		if cfg.Env == "production" {
+			return nil, fmt.Errorf("MFA_ENCRYPTION_KEY is required in production")
+		}
+		sum := sha256.Sum256(x509.MarshalPKCS1PrivateKey(cfg.JWTPrivateKey))
+		return sum[:], nil
 	}
-	if cfg.GoogleClientSecret == "" {
-		return nil, fmt.Errorf("GOOGLE_CLIENT_SECRET is required")
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MFA_ENCRYPTION_KEY: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid MFA_ENCRYPTION_KEY: must be 32 bytes, got %d", len(key))
 	}
+	return key, nil
+}
 
-	return cfg, nil
+// loadPasswordSettings reads the password policy and argon2id cost
+func loadPasswordSettings(cfg *Config) error {
+	var err error
+
+	cfg.PasswordMinLength, err = strconv.Atoi(getEnv("PASSWORD_MIN_LENGTH", "12"))
+	if err != nil || cfg.PasswordMinLength < 8 {
+		return fmt.Errorf("invalid PASSWORD_MIN_LENGTH: must be a number of at least 8")
+	}
+
+	cfg.PasswordMaxLength, err = strconv.Atoi(getEnv("PASSWORD_MAX_LENGTH", "128"))
+	if err != nil || cfg.PasswordMaxLength < cfg.PasswordMinLength {
+		return fmt.Errorf("invalid PASSWORD_MAX_LENGTH: must be a number not below PASSWORD_MIN_LENGTH")
+	}
+
+	cfg.PasswordMinCharacterClasses, err = strconv.Atoi(getEnv("PASSWORD_MIN_CHARACTER_CLASSES", "1"))
+	if err != nil || cfg.PasswordMinCharacterClasses < 0 || cfg.PasswordMinCharacterClasses > 4 {
+		return fmt.Errorf("invalid PASSWORD_MIN_CHARACTER_CLASSES: must be between 0 and 4")
+	}
+
+	cfg.PasswordResetTTL, err = time.ParseDuration(getEnv("PASSWORD_RESET_TTL", "30m"))
+	if err != nil {
+		return fmt.Errorf("invalid PASSWORD_RESET_TTL: %w", err)
+	}
+
+	memory, err := strconv.ParseUint(getEnv("ARGON2_MEMORY", "65536"), 10, 32)
+	if err != nil || memory < 8*1024 {
+		return fmt.Errorf("invalid ARGON2_MEMORY: must be at least 8192 KiB")
+	}
+	cfg.Argon2Memory = uint32(memory)
+
+	iterations, err := strconv.ParseUint(getEnv("ARGON2_ITERATIONS", "3"), 10, 32)
+	if err != nil || iterations == 0 {
+		return fmt.Errorf("invalid ARGON2_ITERATIONS: must be at least 1")
+	}
+	cfg.Argon2Iterations = uint32(iterations)
+
+	parallelism, err := strconv.ParseUint(getEnv("ARGON2_PARALLELISM", "2"), 10, 8)
+	if err != nil || parallelism == 0 {
+		return fmt.Errorf("invalid ARGON2_PARALLELISM: must be between 1 and 255")
+	}
+	cfg.Argon2Parallelism = uint8(parallelism)
+
+	return nil
+}
+
+// loadRetentionSettings reads how long audit events and refresh tokens are
+// kept and where expired audit events are archived
+func loadRetentionSettings(cfg *Config) error {
+	var err error
+
+	cfg.AuditRetentionMonths, err = strconv.Atoi(getEnv("AUDIT_RETENTION_MONTHS", "0"))
+	if err != nil || cfg.AuditRetentionMonths < 0 {
+		return fmt.Errorf("invalid AUDIT_RETENTION_MONTHS: must be a number of months, or 0 to keep events forever")
+	}
+
+	cfg.AuditArchive = getEnv("AUDIT_ARCHIVE", "./audit-archive")
+	cfg.S3Region = getEnv("AWS_REGION", "us-east-1")
+	cfg.S3Endpoint = strings.TrimSuffix(getEnv("S3_ENDPOINT", "https://s3."+cfg.S3Region+".amazonaws.com"), "/")
+	cfg.S3AccessKeyID = getEnv("AWS_ACCESS_KEY_ID", "")
+	cfg.S3SecretAccessKey = getEnv("AWS_SECRET_ACCESS_KEY", "")
+	cfg.S3SessionToken = getEnv("AWS_SESSION_TOKEN", "")
+
+	if strings.HasPrefix(cfg.AuditArchive, "s3://") && cfg.AuditRetentionMonths > 0 &&
+		(cfg.S3AccessKeyID == "" || cfg.S3SecretAccessKey == "") {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required to archive to %s", cfg.AuditArchive)
+	}
+
+	cfg.RefreshTokenRetention, err = time.ParseDuration(getEnv("REFRESH_TOKEN_RETENTION", "720h"))
+	if err != nil || cfg.RefreshTokenRetention < 0 {
+		return fmt.Errorf("invalid REFRESH_TOKEN_RETENTION: must be a duration such as 720h")
+	}
+
+	return nil
+}
+
+// loadSessionSettings reads how long sessions may last and how many a user
+// can have
+func loadSessionSettings(cfg *Config) error {
+	var err error
+
+	// A session in use refreshes its access token at least this often, so
+	// a shorter idle timeout would end sessions that are in use
+	cfg.SessionIdleTimeout, err = time.ParseDuration(getEnv("SESSION_IDLE_TIMEOUT", "0"))
+	if err != nil || cfg.SessionIdleTimeout < 0 ||
+		(cfg.SessionIdleTimeout > 0 && cfg.SessionIdleTimeout <= cfg.JWTAccessTokenExpiry) {
+		return fmt.Errorf("invalid SESSION_IDLE_TIMEOUT: must be 0 or longer than JWT_ACCESS_TOKEN_EXPIRY")
+	}
+
+	cfg.SessionMaxAge, err = time.ParseDuration(getEnv("SESSION_MAX_AGE", "0"))
+	if err != nil || cfg.SessionMaxAge < 0 {
+		return fmt.Errorf("invalid SESSION_MAX_AGE: must be 0 or a duration such as 720h")
+	}
+
+	cfg.SessionLimit, err = strconv.Atoi(getEnv("SESSION_LIMIT", "0"))
+	if err != nil || cfg.SessionLimit < 0 {
+		return fmt.Errorf("invalid SESSION_LIMIT: must be a number of sessions, or 0 for no limit")
+	}
+
+	// Formatted as role=limit pairs, such as "admin=1,support=3"
+	cfg.SessionRoleLimits = map[string]int{}
+	for _, pair := range parseCSV(getEnv("SESSION_ROLE_LIMITS", "")) {
+		role, limit, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || strings.TrimSpace(role) == "" || err != nil || n < 0 {
+			return fmt.Errorf("invalid SESSION_ROLE_LIMITS: %q is not a role=limit pair", pair)
+		}
+		cfg.SessionRoleLimits[strings.TrimSpace(role)] = n
+	}
+
+	return nil
+}
+
+// RateLimit allows Requests requests every Per. A zero RateLimit is none.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// loadRateLimitSettings reads where rate limit buckets are kept and the
+// limits of each route group
+func loadRateLimitSettings(cfg *Config) error {
+	cfg.RateLimitStore = getEnv("RATE_LIMIT_STORE", "memory")
+	if cfg.RateLimitStore != "memory" && cfg.RateLimitStore != "postgres" {
+		return fmt.Errorf("invalid RATE_LIMIT_STORE: must be memory or postgres")
+	}
+
+	limits := []struct {
+		key      string
+		fallback string
+		limit    *RateLimit
+	}{
+		{"RATE_LIMIT_AUTH", "60/1m", &cfg.RateLimitAuth},
+		{"RATE_LIMIT_CREDENTIALS", "10/1m", &cfg.RateLimitCredentials},
+		{"RATE_LIMIT_OAUTH_IP", "120/1m", &cfg.RateLimitOAuthIP},
+		{"RATE_LIMIT_OAUTH_CLIENT", "600/1m", &cfg.RateLimitOAuthClient},
+		{"RATE_LIMIT_API_USER", "300/1m", &cfg.RateLimitAPIUser},
+		{"RATE_LIMIT_REFRESH_USER", "30/1m", &cfg.RateLimitRefreshUser},
+	}
+	for _, l := range limits {
+		limit, err := parseRateLimit(getEnv(l.key, l.fallback))
+		if err != nil {
+			return fmt.Errorf("invalid %s: must be requests/duration such as 60/1m, or 0 for no limit", l.key)
+		}
+		*l.limit = limit
+	}
+
+	return nil
+}
+
+// parseRateLimit parses a limit such as "60/1m", or "0" for none
+func parseRateLimit(s string) (RateLimit, error) {
+	if s == "0" {
+		return RateLimit{}, nil
+	}
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("missing duration")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(requests))
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid number of requests")
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid duration")
+	}
+	return RateLimit{Requests: n, Per: d}, nil
 }
 
 func getEnv(key, defaultValue string) string {
@@ -97,6 +511,25 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// parsePrefixes parses a comma-separated list of CIDRs, such as
+// "10.0.0.0/8,fd00::/8". A bare IP address stands for itself.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range parseCSV(s) {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
 func parseCSV(s string) []string {
 	if s == "" {
 		return []string{}
@@ -111,6 +544,47 @@ func parseCSV(s string) []string {
 	return result
 }
 
+// loadAuditCheckpointKeys reads the key signing audit checkpoints and the
+// public keys verifying them
+func loadAuditCheckpointKeys(cfg *Config) error {
+	if path := getEnv("AUDIT_CHECKPOINT_KEY_PATH", ""); path != "" {
+		key, err := loadPrivateKey(path)
+		if err != nil {
+			return fmt.Errorf("invalid AUDIT_CHECKPOINT_KEY_PATH: %w", err)
+		}
+		cfg.AuditCheckpointKey = key
+		cfg.AuditCheckpointPublicKeys = []*rsa.PublicKey{&key.PublicKey}
+	}
+
+	// The file may hold several keys, such as retired ones whose
+	// checkpoints still have to verify
+	path := getEnv("AUDIT_CHECKPOINT_PUBLIC_KEYS_PATH", "")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("invalid AUDIT_CHECKPOINT_PUBLIC_KEYS_PATH: %w", err)
+	}
+	var keys []*rsa.PublicKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid AUDIT_CHECKPOINT_PUBLIC_KEYS_PATH: %w", err)
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("invalid AUDIT_CHECKPOINT_PUBLIC_KEYS_PATH: not an RSA public key")
+		}
+		keys = append(keys, rsaPub)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("invalid AUDIT_CHECKPOINT_PUBLIC_KEYS_PATH: no PEM public keys in %s", path)
+	}
+	cfg.AuditCheckpointPublicKeys = keys
+	return nil
+}
+
 func loadOrGenerateKeys(privateKeyPath, publicKeyPath string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	// Try to load existing keys
 	privateKey, err := loadPrivateKey(privateKeyPath)
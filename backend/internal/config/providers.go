@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Identity provider types
+const (
+	// ProviderTypeOIDC is any OpenID Connect provider that supports
+	// discovery: Google, Microsoft Entra ID, Keycloak, Dex, ...
+	ProviderTypeOIDC = "oidc"
+
+	// ProviderTypeGitHub is GitHub's OAuth2 apps, which do not speak OIDC
+	ProviderTypeGitHub = "github"
+)
+
+// ProviderConfig configures an upstream identity provider. Each provider
+// named in AUTH_PROVIDERS is read from PROVIDER_<NAME>_* variables.
+type ProviderConfig struct {
+	// Name identifies the provider in URLs and in user_identities
+	Name        string
+	Type        string
+	DisplayName string
+
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// IssuerURL is where OIDC providers are discovered from
+	IssuerURL string
+}
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func loadProviders(issuerURL string) ([]ProviderConfig, error) {
+	names := parseCSV(getEnv("AUTH_PROVIDERS", "google"))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("AUTH_PROVIDERS must name at least one provider")
+	}
+
+	providers := make([]ProviderConfig, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !providerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid provider name in AUTH_PROVIDERS: %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("provider %q is listed twice in AUTH_PROVIDERS", name)
+		}
+		seen[name] = true
+
+		provider, err := loadProvider(name, issuerURL)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
+
+func loadProvider(name, issuerURL string) (ProviderConfig, error) {
+	env := func(key, defaultValue string) string {
+		value := getEnv(providerEnvKey(name, key), "")
+		// Google keeps reading the GOOGLE_* variables it used before
+		// providers were configurable
+		if value == "" && name == "google" {
+			value = getEnv("GOOGLE_"+key, "")
+		}
+		if value == "" {
+			return defaultValue
+		}
+		return value
+	}
+
+	defaultType := ProviderTypeOIDC
+	if name == "github" {
+		defaultType = ProviderTypeGitHub
+	}
+
+	provider := ProviderConfig{
+		Name:         name,
+		Type:         env("TYPE", defaultType),
+		DisplayName:  env("DISPLAY_NAME", defaultDisplayName(name)),
+		ClientID:     env("CLIENT_ID", ""),
+		ClientSecret: env("CLIENT_SECRET", ""),
+		RedirectURL:  env("REDIRECT_URL", issuerURL+"/api/auth/"+name+"/callback"),
+	}
+
+	switch provider.Type {
+	case ProviderTypeOIDC:
+		defaultIssuer := ""
+		if name == "google" {
+			defaultIssuer = "https://accounts.google.com"
+		}
+		provider.IssuerURL = strings.TrimSuffix(env("ISSUER_URL", defaultIssuer), "/")
+		provider.Scopes = parseScopes(env("SCOPES", "openid email profile"))
+		if provider.IssuerURL == "" {
+			return provider, fmt.Errorf("%s is required", providerEnvKey(name, "ISSUER_URL"))
+		}
+	case ProviderTypeGitHub:
+		provider.Scopes = parseScopes(env("SCOPES", "read:user user:email"))
+	default:
+		return provider, fmt.Errorf("invalid %s: %q", providerEnvKey(name, "TYPE"), provider.Type)
+	}
+
+	if provider.ClientID == "" {
+		return provider, fmt.Errorf("%s is required", providerEnvKey(name, "CLIENT_ID"))
+	}
+
+	return provider, nil
+}
+
+// providerEnvKey returns the variable holding key for a provider, e.g.
+// PROVIDER_MY_KEYCLOAK_CLIENT_ID
+func providerEnvKey(name, key string) string {
+	return "PROVIDER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_" + key
+}
+
+func defaultDisplayName(name string) string {
+	switch name {
+	case "github":
+		return "GitHub"
+	case "microsoft":
+		return "Microsoft"
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func parseScopes(s string) []string {
+	return strings.Fields(strings.ReplaceAll(s, ",", " "))
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type applicationRequest struct {
+	ClientID        string   `json:"client_id"`
+	Name            *string  `json:"name"`
+	IsPublic        bool     `json:"is_public"`
+	RedirectURIs    []string `json:"redirect_uris"`
+	AllowedOrigins  []string `json:"allowed_origins"`
+	AccessTokenTTL  *int     `json:"access_token_ttl"`
+	RefreshTokenTTL *int     `json:"refresh_token_ttl"`
+	IsActive        *bool    `json:"is_active"`
+}
+
+// validate checks the URLs and lifetimes in the request, returning a message
+// for the client if something is wrong
+func (req *applicationRequest) validate() string {
+	for _, redirectURI := range req.RedirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil || u.Scheme == "" || u.Fragment != "" {
+			return "Invalid redirect URI: " + redirectURI
+		}
+	}
+	for _, origin := range req.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return "Invalid origin: " + origin
+		}
+	}
+	if (req.AccessTokenTTL != nil && *req.AccessTokenTTL < 0) || (req.RefreshTokenTTL != nil && *req.RefreshTokenTTL < 0) {
+		return "Token lifetimes must not be negative"
+	}
+	return ""
+}
+
+func (h *Handler) ListApplications(w http.ResponseWriter, r *http.Request) {
+	apps, err := h.authService.ListApplications(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to query applications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"applications": apps,
+	})
+}
+
+func (h *Handler) GetApplication(w http.ResponseWriter, r *http.Request) {
+	app, err := h.authService.GetApplication(r.Context(), chi.URLParam(r, "clientID"))
+	if errors.Is(err, auth.ErrApplicationNotFound) {
+		http.Error(w, "Application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query application", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app)
+}
+
+// CreateApplication registers an application. The client secret of a
+// confidential application is only ever returned in this response.
+func (h *Handler) CreateApplication(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var createReq applicationRequest
+	if err := json.NewDecoder(r.Body).Decode(&createReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if createReq.Name == nil || *createReq.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if msg := createReq.validate(); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	app := &models.Application{
+		ClientID:        createReq.ClientID,
+		Name:            *createReq.Name,
+		IsPublic:        createReq.IsPublic,
+		RedirectURIs:    nonNil(createReq.RedirectURIs),
+		AllowedOrigins:  nonNil(createReq.AllowedOrigins),
+		AccessTokenTTL:  nonZero(createReq.AccessTokenTTL),
+		RefreshTokenTTL: nonZero(createReq.RefreshTokenTTL),
+	}
+
+	created, secret, err := h.authService.CreateApplication(ctx, app)
+	if err != nil {
+		http.Error(w, "Failed to create application", http.StatusInternalServerError)
+		return
+	}
+
+	h.reloadOrigins(r)
+
+	response := map[string]interface{}{
+		"application": created,
+	}
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) UpdateApplication(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var updateReq applicationRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := updateReq.validate(); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	app, err := h.authService.UpdateApplication(ctx, chi.URLParam(r, "clientID"), auth.ApplicationUpdate{
+		Name:            updateReq.Name,
+		RedirectURIs:    updateReq.RedirectURIs,
+		AllowedOrigins:  updateReq.AllowedOrigins,
+		AccessTokenTTL:  updateReq.AccessTokenTTL,
+		RefreshTokenTTL: updateReq.RefreshTokenTTL,
+		IsActive:        updateReq.IsActive,
+	})
+	if errors.Is(err, auth.ErrApplicationNotFound) {
+		http.Error(w, "Application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update application", http.StatusInternalServerError)
+		return
+	}
+
+	h.reloadOrigins(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app)
+}
+
+func (h *Handler) DeleteApplication(w http.ResponseWriter, r *http.Request) {
+	err := h.authService.DeleteApplication(r.Context(), chi.URLParam(r, "clientID"))
+	if errors.Is(err, auth.ErrApplicationNotFound) {
+		http.Error(w, "Application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete application", http.StatusInternalServerError)
+		return
+	}
+
+	h.reloadOrigins(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Application deleted successfully",
+	})
+}
+
+func (h *Handler) ListApplicationSecrets(w http.ResponseWriter, r *http.Request) {
+	secrets, err := h.authService.ListApplicationSecrets(r.Context(), chi.URLParam(r, "clientID"))
+	if err != nil {
+		http.Error(w, "Failed to query application secrets", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secrets": secrets,
+	})
+}
+
+// CreateApplicationSecret adds a secret so the old one can be revoked once
+// the application has switched over
+func (h *Handler) CreateApplicationSecret(w http.ResponseWriter, r *http.Request) {
+	secret, value, err := h.authService.CreateApplicationSecret(r.Context(), chi.URLParam(r, "clientID"))
+	if errors.Is(err, auth.ErrApplicationNotFound) {
+		http.Error(w, "Application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create secret: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":        secret,
+		"client_secret": value,
+	})
+}
+
+func (h *Handler) RevokeApplicationSecret(w http.ResponseWriter, r *http.Request) {
+	secretID, err := uuid.Parse(chi.URLParam(r, "secretID"))
+	if err != nil {
+		http.Error(w, "Invalid secret ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authService.RevokeApplicationSecret(r.Context(), chi.URLParam(r, "clientID"), secretID); err != nil {
+		http.Error(w, "Secret not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Secret revoked successfully",
+	})
+}
+
+// reloadOrigins refreshes the CORS origins and client ids on this replica
+// right away; other replicas catch up on their next periodic reload
+func (h *Handler) reloadOrigins(r *http.Request) {
+	if err := h.origins.Reload(r.Context()); err != nil {
+		log.Printf("Warning: failed to reload allowed origins: %v", err)
+	}
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func nonZero(ttl *int) *int {
+	if ttl == nil || *ttl == 0 {
+		return nil
+	}
+	return ttl
+}
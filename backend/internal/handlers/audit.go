@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+
+	// auditExportFlushEvery is how many exported events are buffered
+	// before they are flushed to the client
+	auditExportFlushEvery = 500
+)
+
+var auditCSVHeader = []string{
+	"seq", "id", "user_id", "actor_id", "action", "target_type", "target_id", "changes",
+	"ip_address", "user_agent", "request_id", "created_at", "prev_hash", "hash",
+}
+
+// parseAuditFilter reads user_id, actor_id, target_type, target_id, action
+// (repeated or comma-separated), since, until (RFC 3339) and ip from the
+// query
+func parseAuditFilter(r *http.Request) (auth.AuditFilter, error) {
+	q := r.URL.Query()
+	var filter auth.AuditFilter
+
+	for _, param := range []struct {
+		name string
+		dst  **uuid.UUID
+	}{{"user_id", &filter.UserID}, {"actor_id", &filter.ActorID}} {
+		v := q.Get(param.name)
+		if v == "" {
+			continue
+		}
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s", param.name)
+		}
+		*param.dst = &id
+	}
+
+	filter.TargetType = q.Get("target_type")
+	filter.TargetID = q.Get("target_id")
+
+	for _, v := range q["action"] {
+		for _, action := range strings.Split(v, ",") {
+			if action = strings.TrimSpace(action); action != "" {
+				filter.Actions = append(filter.Actions, action)
+			}
+		}
+	}
+
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		v := q.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s, expected an RFC 3339 time", bound.name)
+		}
+		*bound.dst = &t
+	}
+
+	filter.IP = q.Get("ip")
+	if err := filter.Validate(); err != nil {
+		return filter, errors.New("invalid ip, expected an address or CIDR prefix")
+	}
+	return filter, nil
+}
+
+// ListAuditEvents returns a page of audit events, newest first. Pass the
+// response's next_cursor as cursor for the next page.
+func (h *Handler) ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > maxAuditPageSize {
+		limit = defaultAuditPageSize
+	}
+
+	events, next, err := h.authService.ListAuditEvents(r.Context(), filter, r.URL.Query().Get("cursor"), limit)
+	if errors.Is(err, auth.ErrInvalidAuditCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query audit log", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"events": events}
+	if next != "" {
+		response["next_cursor"] = next
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ExportAuditEvents streams every audit event matching the filters of
+// ListAuditEvents, oldest first, as CSV or JSON Lines (format=csv or
+// format=jsonl)
+func (h *Handler) ExportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	var contentType string
+	switch format {
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	case "jsonl":
+		contentType = "application/x-ndjson"
+	default:
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	// Exports can outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID); ok {
+		h.authService.LogAuthEvent(ctx, &userID, "AUDIT_LOG_EXPORTED", r.RemoteAddr, r.UserAgent())
+	}
+
+	filename := fmt.Sprintf("audit-log-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	var write func(models.AuthAuditLog) error
+	var flush func() error
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(auditCSVHeader); err != nil {
+			return
+		}
+		write = func(e models.AuthAuditLog) error {
+			return cw.Write(auditCSVRecord(e))
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		write = func(e models.AuthAuditLog) error {
+			return enc.Encode(e)
+		}
+		flush = func() error { return nil }
+	}
+
+	var n int
+	err = h.authService.ExportAuditEvents(ctx, filter, func(e models.AuthAuditLog) error {
+		if err := write(e); err != nil {
+			return err
+		}
+		n++
+		if n%auditExportFlushEvery == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// The status line has been sent; a truncated file is all we can do
+		log.Printf("Audit log export failed after %d events: %v", n, err)
+		return
+	}
+
+	if flush() == nil {
+		rc.Flush()
+	}
+}
+
+func auditCSVRecord(e models.AuthAuditLog) []string {
+	id := func(v *uuid.UUID) string {
+		if v == nil {
+			return ""
+		}
+		return v.String()
+	}
+	str := func(v *string) string {
+		if v == nil {
+			return ""
+		}
+		return *v
+	}
+	record := []string{
+		strconv.FormatInt(e.Seq, 10), e.ID.String(), id(e.UserID), id(e.ActorID), e.Action,
+		str(e.TargetType), str(e.TargetID), string(e.Changes),
+		str(e.IPAddress), str(e.UserAgent), str(e.RequestID),
+		e.CreatedAt.UTC().Format(time.RFC3339Nano), e.PrevHash, e.Hash,
+	}
+	for i, cell := range record {
+		record[i] = csvSafe(cell)
+	}
+	return record
+}
+
+// csvSafe stops spreadsheets from running a cell as a formula. Cells such as
+// user agents and changed names come from users, so one starting with a
+// formula character is prefixed with a quote. Spreadsheets skip spaces and
+// line breaks before a formula, so they do not hide one.
+func csvSafe(cell string) string {
+	if trimmed := strings.TrimLeft(cell, " \n"); trimmed != "" && strings.ContainsRune("=+-@\t\r", rune(trimmed[0])) {
+		return "'" + cell
+	}
+	return cell
+}
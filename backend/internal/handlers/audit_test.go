@@ -0,0 +1,33 @@
+package handlers
+
+import "testing"
+
+func TestCSVSafe(t *testing.T) {
+	tests := []struct {
+		name string
+		cell string
+		want string
+	}{
+		{name: "plain", cell: "Mozilla/5.0", want: "Mozilla/5.0"},
+		{name: "empty", cell: "", want: ""},
+		{name: "equals", cell: "=HYPERLINK(\"http://evil\")", want: "'=HYPERLINK(\"http://evil\")"},
+		{name: "plus", cell: "+1+1", want: "'+1+1"},
+		{name: "minus", cell: "-2+3", want: "'-2+3"},
+		{name: "at", cell: "@SUM(A1)", want: "'@SUM(A1)"},
+		{name: "tab", cell: "\t=1", want: "'\t=1"},
+		{name: "carriage return", cell: "\r=1", want: "'\r=1"},
+		{name: "space before formula", cell: "  =1+1", want: "'  =1+1"},
+		{name: "line break before formula", cell: "\n@SUM(A1)", want: "'\n@SUM(A1)"},
+		{name: "space before text", cell: " Ada", want: " Ada"},
+		{name: "only spaces", cell: "   ", want: "   "},
+		{name: "formula character later", cell: "a=b", want: "a=b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := csvSafe(tt.cell); got != tt.want {
+				t.Errorf("csvSafe(%q) = %q, want %q", tt.cell, got, tt.want)
+			}
+		})
+	}
+}
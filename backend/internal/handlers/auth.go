@@ -1,109 +1,153 @@
 package handlers
 
 import (
-	"crypto/rand"
-	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/identity"
 	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
-func (h *Handler) GoogleLogin(w http.ResponseWriter, r *http.Request) {
-	// Get redirect_uri parameter (where to send user after auth)
-	redirectURI := r.URL.Query().Get("redirect_uri")
-	if redirectURI == "" {
-		// Default to first allowed origin if not specified
-		redirectURI = h.cfg.AllowedOrigins[0]
-	}
-
-	// Validate redirect_uri is in allowed origins
-	validRedirect := false
-	for _, origin := range h.cfg.AllowedOrigins {
-		if redirectURI == origin || strings.HasPrefix(redirectURI, origin+"/") {
-			validRedirect = true
-			break
-		}
+// loginFlowTTL is how long the cookies that carry state through the
+// identity provider redirect stay valid
+const loginFlowTTL = 10 * time.Minute
+
+// ListProviders returns the identity providers users can sign in with
+func (h *Handler) ListProviders(w http.ResponseWriter, r *http.Request) {
+	type providerResponse struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+		LoginURL    string `json:"login_url"`
+	}
+
+	providers := []providerResponse{}
+	for _, p := range h.providers.List() {
+		providers = append(providers, providerResponse{
+			Name:        p.Name(),
+			DisplayName: p.DisplayName(),
+			LoginURL:    "/api/auth/" + p.Name() + "/login",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"providers": providers,
+	})
+}
+
+// Login starts a login with an identity provider for the auth-service's own
+// frontend or, with a client_id, for a registered application. redirect_uri
+// must be allowed for the application (or be in ALLOWED_ORIGINS without one).
+// response_mode=fragment asks for the legacy callback with the access token
+// in the fragment instead of a login code.
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	provider, err := h.providers.Get(chi.URLParam(r, "provider"))
+	if err != nil {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
 	}
-	if !validRedirect {
+
+	clientID := r.URL.Query().Get("client_id")
+
+	// Get redirect_uri parameter (where to send user after auth)
+	redirectURI, err := h.authService.LoginRedirect(r.Context(), clientID, r.URL.Query().Get("redirect_uri"))
+	if err != nil {
 		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
 		return
 	}
 
-	// Generate random state
-	b := make([]byte, 16)
-	rand.Read(b)
-	state := base64.URLEncoding.EncodeToString(b)
+	responseMode, ok := parseResponseMode(r.URL.Query().Get("response_mode"))
+	if !ok {
+		http.Error(w, "Invalid response_mode", http.StatusBadRequest)
+		return
+	}
 
-	// Store state and redirect_uri in cookies for CSRF protection
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_state",
-		Value:    state,
-		Expires:  time.Now().Add(10 * time.Minute),
-		HttpOnly: true,
-		Secure:   h.cfg.Env == "production",
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-	})
+	// Store redirect_uri, client_id and response_mode in cookies until the
+	// callback
+	h.setFlowCookie(w, "oauth_redirect", redirectURI)
+	if clientID != "" {
+		h.setFlowCookie(w, "oauth_client", clientID)
+	} else {
+		h.clearFlowCookie(w, "oauth_client")
+	}
+	h.setFlowCookie(w, "oauth_response_mode", responseMode)
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_redirect",
-		Value:    redirectURI,
-		Expires:  time.Now().Add(10 * time.Minute),
-		HttpOnly: true,
-		Secure:   h.cfg.Env == "production",
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-	})
+	// A signed-in user is linking another identity (see StartLinkIdentity)
+	if linkToken := r.URL.Query().Get("link_token"); linkToken != "" {
+		h.setFlowCookie(w, "oauth_link", linkToken)
+	} else {
+		h.clearFlowCookie(w, "oauth_link")
+	}
+
+	h.beginLogin(w, r, provider)
+}
+
+// beginLogin redirects the user to an identity provider with a fresh CSRF
+// state, nonce and PKCE verifier
+func (h *Handler) beginLogin(w http.ResponseWriter, r *http.Request, provider identity.Provider) {
+	authReq, err := identity.NewAuthRequest()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	url, err := provider.AuthCodeURL(authReq)
+	if err != nil {
+		log.Printf("Warning: failed to start login with %s: %v", provider.Name(), err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Store the flow in cookies; the state also protects against CSRF
+	h.setFlowCookie(w, "oauth_provider", provider.Name())
+	h.setFlowCookie(w, "oauth_state", authReq.State)
+	h.setFlowCookie(w, "oauth_nonce", authReq.Nonce)
+	h.setFlowCookie(w, "oauth_verifier", authReq.CodeVerifier)
 
-	url := h.authService.GetGoogleAuthURL(state)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
-func (h *Handler) GoogleCallback(w http.ResponseWriter, r *http.Request) {
+// Callback finishes a login when the identity provider redirects back
+func (h *Handler) Callback(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Verify state
-	stateCookie, err := r.Cookie("oauth_state")
+	provider, err := h.providers.Get(chi.URLParam(r, "provider"))
 	if err != nil {
-		http.Error(w, "State cookie not found", http.StatusBadRequest)
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
 		return
 	}
 
-	if r.URL.Query().Get("state") != stateCookie.Value {
-		http.Error(w, "Invalid state parameter", http.StatusBadRequest)
+	// Verify state and that the login was started with this provider
+	authReq, err := h.readLoginFlow(r, provider.Name())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get redirect_uri from cookie
-	redirectCookie, err := r.Cookie("oauth_redirect")
-	if err != nil {
-		http.Error(w, "Redirect URI cookie not found", http.StatusBadRequest)
+	if r.URL.Query().Get("state") != authReq.State {
+		http.Error(w, "Invalid state parameter", http.StatusBadRequest)
 		return
 	}
-	redirectURI := redirectCookie.Value
 
-	// Clear state and redirect cookies
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_state",
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HttpOnly: true,
-		Path:     "/",
-	})
+	// Clear flow cookies
+	for _, name := range []string{"oauth_provider", "oauth_state", "oauth_nonce", "oauth_verifier"} {
+		h.clearFlowCookie(w, name)
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_redirect",
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HttpOnly: true,
-		Path:     "/",
-	})
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		http.Error(w, "Login failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
 
 	// Exchange code for user info
 	code := r.URL.Query().Get("code")
@@ -112,14 +156,24 @@ func (h *Handler) GoogleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userInfo, err := h.authService.ExchangeGoogleCode(ctx, code)
+	externalIdentity, err := provider.Exchange(ctx, code, authReq)
 	if err != nil {
 		http.Error(w, "Failed to exchange code: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if linkCookie, err := r.Cookie("oauth_link"); err == nil {
+		h.clearFlowCookie(w, "oauth_link")
+		h.completeLink(w, r, linkCookie.Value, externalIdentity)
+		return
+	}
+
 	// Create or update user
-	user, err := h.authService.CreateOrUpdateUser(ctx, userInfo)
+	user, err := h.authService.CreateOrUpdateUser(ctx, externalIdentity)
+	if errors.Is(err, auth.ErrEmailInUse) {
+		http.Error(w, "An account with this email already exists. Sign in with the provider you used before and link this one from your account.", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to create user: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -131,31 +185,221 @@ func (h *Handler) GoogleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate tokens
-	tokens, err := h.authService.GenerateTokens(ctx, user)
+	// Collect what is needed to finish the login from the flow cookies
+	loginCtx := &auth.LoginContext{
+		AMR:      []string{auth.AMRFederated},
+		AuthTime: time.Now(),
+	}
+	if authorizeCookie, err := r.Cookie("oidc_authorize"); err == nil {
+		// The login was started by an OpenID Connect client through /authorize
+		loginCtx.AuthorizeRequest = authorizeCookie.Value
+		h.clearFlowCookie(w, "oidc_authorize")
+	} else {
+		redirectCookie, err := r.Cookie("oauth_redirect")
+		if err != nil {
+			http.Error(w, "Redirect URI cookie not found", http.StatusBadRequest)
+			return
+		}
+		loginCtx.RedirectURI = redirectCookie.Value
+		h.clearFlowCookie(w, "oauth_redirect")
+
+		if clientCookie, err := r.Cookie("oauth_client"); err == nil {
+			loginCtx.ClientID = clientCookie.Value
+			h.clearFlowCookie(w, "oauth_client")
+		}
+		if modeCookie, err := r.Cookie("oauth_response_mode"); err == nil {
+			loginCtx.ResponseMode = modeCookie.Value
+			h.clearFlowCookie(w, "oauth_response_mode")
+		}
+	}
+
+	redirectURL, ok := h.continueLogin(w, r, user, loginCtx)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+}
+
+// continueLogin finishes a login whose first factor has been verified. With
+// a second factor enrolled that the login has not proven yet, no tokens are
+// issued: the login waits in a short-lived challenge until the code is
+// verified (see VerifyMFA) and the user is sent to the MFA page. It returns
+// where to send the user; when ok is false an error has been written to w.
+func (h *Handler) continueLogin(w http.ResponseWriter, r *http.Request, user *models.User, loginCtx *auth.LoginContext) (redirectURL string, ok bool) {
+	ctx := r.Context()
+
+	if !slices.Contains(loginCtx.AMR, auth.AMRMFA) {
+		mfaEnabled, err := h.authService.MFAEnabled(ctx, user.ID)
+		if err != nil {
+			http.Error(w, "Failed to check MFA status", http.StatusInternalServerError)
+			return "", false
+		}
+		if mfaEnabled {
+			challenge, err := h.authService.CreateMFAChallenge(ctx, user.ID, loginCtx)
+			if err != nil {
+				http.Error(w, "Failed to start MFA challenge", http.StatusInternalServerError)
+				return "", false
+			}
+			return h.cfg.FrontendURL + "/mfa?challenge=" + url.QueryEscape(challenge), true
+		}
+	}
+
+	return h.completeLogin(w, r, user, loginCtx)
+}
+
+// completeLogin issues the result of a successful login: an authorization
+// code for an OpenID Connect client, or for the frontend or a registered
+// application a login code to exchange for tokens (see ExchangeLoginCode).
+// It returns where to send the user; when ok is false an error has been
+// written to w.
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, loginCtx *auth.LoginContext) (redirectURL string, ok bool) {
+	ctx := r.Context()
+
+	if loginCtx.AuthorizeRequest != "" {
+		redirectURL, ok := h.authorizeRedirect(w, r, user, loginCtx)
+		if ok {
+			h.authService.LogAuthEvent(ctx, &user.ID, "LOGIN", r.RemoteAddr, r.UserAgent())
+		}
+		return redirectURL, ok
+	}
+
+	// Re-check the redirect: the application may have changed meanwhile
+	if _, err := h.authService.LoginRedirect(ctx, loginCtx.ClientID, loginCtx.RedirectURI); err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return "", false
+	}
+
+	if loginCtx.ResponseMode == auth.ResponseModeFragment {
+		return h.completeLegacyLogin(w, r, user, loginCtx)
+	}
+
+	// The URL ends up in browser history, Referer headers and proxy logs,
+	// so it only carries a short-lived single-use code
+	code, err := h.authService.CreateLoginCode(ctx, user.ID, loginCtx)
+	if err != nil {
+		http.Error(w, "Failed to create login code", http.StatusInternalServerError)
+		return "", false
+	}
+
+	h.authService.LogAuthEvent(ctx, &user.ID, "LOGIN", r.RemoteAddr, r.UserAgent())
+
+	return loginCtx.RedirectURI + "/auth/callback?code=" + url.QueryEscape(code), true
+}
+
+// completeLegacyLogin issues tokens right away for response_mode=fragment,
+// sending the access token in the fragment, which browsers do not send to
+// servers
+func (h *Handler) completeLegacyLogin(w http.ResponseWriter, r *http.Request, user *models.User, loginCtx *auth.LoginContext) (redirectURL string, ok bool) {
+	ctx := r.Context()
+
+	tokens, err := h.authService.GenerateTokens(ctx, user, auth.TokenOptions{
+		ClientID: loginCtx.ClientID,
+		AMR:      loginCtx.AMR,
+	})
 	if err != nil {
 		http.Error(w, "Failed to generate tokens: "+err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+
+	h.setRefreshTokenCookie(w, tokens.RefreshToken)
+	h.authService.LogAuthEvent(ctx, &user.ID, "LOGIN", r.RemoteAddr, r.UserAgent())
+
+	return loginCtx.RedirectURI + "/auth/callback#access_token=" + url.QueryEscape(tokens.AccessToken), true
+}
+
+// ExchangeLoginCode trades the code a login redirected with for an access
+// token, setting the refresh token cookie like RefreshToken. The code must
+// come with the redirect_uri and client_id of the login.
+func (h *Handler) ExchangeLoginCode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code        string `json:"code"`
+		RedirectURI string `json:"redirect_uri"`
+		ClientID    string `json:"client_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Set refresh token as HTTP-only cookie
+	_, tokens, err := h.authService.ExchangeLoginCode(r.Context(), req.Code, req.ClientID, req.RedirectURI)
+	if errors.Is(err, auth.ErrInvalidLoginCode) {
+		http.Error(w, "Invalid or expired login code", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to exchange login code", http.StatusInternalServerError)
+		return
+	}
+
+	h.setRefreshTokenCookie(w, tokens.RefreshToken)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": tokens.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokens.ExpiresIn.Seconds()),
+	})
+}
+
+// parseResponseMode validates a login's response_mode, which defaults to
+// query
+func parseResponseMode(mode string) (string, bool) {
+	switch mode {
+	case "", auth.ResponseModeQuery:
+		return auth.ResponseModeQuery, true
+	case auth.ResponseModeFragment:
+		return mode, true
+	}
+	return "", false
+}
+
+// readLoginFlow reads the state beginLogin stored in cookies
+func (h *Handler) readLoginFlow(r *http.Request, provider string) (identity.AuthRequest, error) {
+	var authReq identity.AuthRequest
+
+	providerCookie, err := r.Cookie("oauth_provider")
+	if err != nil || providerCookie.Value != provider {
+		return authReq, errors.New("Login was not started with this provider")
+	}
+
+	for name, value := range map[string]*string{
+		"oauth_state":    &authReq.State,
+		"oauth_nonce":    &authReq.Nonce,
+		"oauth_verifier": &authReq.CodeVerifier,
+	} {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return authReq, errors.New("State cookie not found")
+		}
+		*value = cookie.Value
+	}
+
+	return authReq, nil
+}
+
+// setFlowCookie stores short-lived login flow state. Lax so it survives the
+// top-level redirect back from Google.
+func (h *Handler) setFlowCookie(w http.ResponseWriter, name, value string) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    tokens.RefreshToken,
-		Expires:  time.Now().Add(h.cfg.JWTRefreshTokenExpiry),
+		Name:     name,
+		Value:    value,
+		Expires:  time.Now().Add(loginFlowTTL),
 		HttpOnly: true,
 		Secure:   h.cfg.Env == "production",
-		SameSite: http.SameSiteStrictMode,
+		SameSite: http.SameSiteLaxMode,
 		Path:     "/",
 	})
+}
 
-	// Log auth event
-	h.authService.LogAuthEvent(ctx, &user.ID, "LOGIN", r.RemoteAddr, r.UserAgent())
-
-	// Redirect to application callback with access token
-	// Frontend should extract it and store in memory
-	redirectURL := redirectURI + "/auth/callback?access_token=" + tokens.AccessToken
-	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+func (h *Handler) clearFlowCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HttpOnly: true,
+		Path:     "/",
+	})
 }
 
 func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
@@ -169,22 +413,28 @@ func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Refresh tokens
-	tokens, err := h.authService.RefreshAccessToken(ctx, cookie.Value)
+	tokens, _, err := h.authService.RefreshAccessToken(ctx, auth.RefreshRequest{
+		RefreshToken: cookie.Value,
+		IPAddress:    r.RemoteAddr,
+		UserAgent:    r.UserAgent(),
+	})
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		// The session is gone; make the client start over
+		h.clearRefreshTokenCookie(w)
+		http.Error(w, "Refresh token has already been used", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, auth.ErrSessionExpired) {
+		h.clearRefreshTokenCookie(w)
+		http.Error(w, "Session expired, sign in again", http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to refresh token: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	// Set new refresh token as cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    tokens.RefreshToken,
-		Expires:  time.Now().Add(h.cfg.JWTRefreshTokenExpiry),
-		HttpOnly: true,
-		Secure:   h.cfg.Env == "production",
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-	})
+	h.setRefreshTokenCookie(w, tokens.RefreshToken)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -202,16 +452,13 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 		h.authService.RevokeRefreshToken(ctx, cookie.Value)
 	}
 
+	// The access token would otherwise stay valid until it expires
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		h.authService.RevokeAccessToken(ctx, token)
+	}
+
 	// Clear refresh token cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HttpOnly: true,
-		Secure:   h.cfg.Env == "production",
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-	})
+	h.clearRefreshTokenCookie(w)
 
 	// Log auth event if we have user context
 	if userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID); ok {
@@ -225,6 +472,54 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// LogoutEverywhere signs the current user out of every session, this one
+// included
+func (h *Handler) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.authService.SignOutEverywhere(ctx, userID); err != nil {
+		http.Error(w, "Failed to sign out", http.StatusInternalServerError)
+		return
+	}
+
+	h.clearRefreshTokenCookie(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Logged out of all sessions",
+	})
+}
+
+func (h *Handler) setRefreshTokenCookie(w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Expires:  time.Now().Add(h.cfg.JWTRefreshTokenExpiry),
+		HttpOnly: true,
+		Secure:   h.cfg.Env == "production",
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/",
+	})
+}
+
+func (h *Handler) clearRefreshTokenCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HttpOnly: true,
+		Secure:   h.cfg.Env == "production",
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/",
+	})
+}
+
 func (h *Handler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -235,26 +530,28 @@ func (h *Handler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := `
-		SELECT id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at
+		SELECT id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at,
+		       COALESCE((SELECT array_agg(permission ORDER BY permission) FROM role_permissions WHERE role = users.role), '{}')
 		FROM users
 		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	var user struct {
-		ID        uuid.UUID  `json:"id"`
-		Email     string     `json:"email"`
-		GoogleID  *string    `json:"google_id,omitempty"`
-		Name      string     `json:"name"`
-		AvatarURL *string    `json:"avatar_url,omitempty"`
-		Role      string     `json:"role"`
-		IsActive  bool       `json:"is_active"`
-		CreatedAt time.Time  `json:"created_at"`
-		UpdatedAt time.Time  `json:"updated_at"`
+		ID          uuid.UUID `json:"id"`
+		Email       string    `json:"email"`
+		GoogleID    *string   `json:"google_id,omitempty"`
+		Name        string    `json:"name"`
+		AvatarURL   *string   `json:"avatar_url,omitempty"`
+		Role        string    `json:"role"`
+		Permissions []string  `json:"permissions"`
+		IsActive    bool      `json:"is_active"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
 	}
 
 	err := h.db.QueryRow(ctx, query, userID).Scan(
 		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
-		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt,
+		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.Permissions,
 	)
 
 	if err != nil {
@@ -265,14 +562,3 @@ func (h *Handler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
-
-func (h *Handler) GetPublicKey(w http.ResponseWriter, r *http.Request) {
-	publicKeyBytes := x509.MarshalPKCS1PublicKey(h.cfg.JWTPublicKey)
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	})
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write(publicKeyPEM)
-}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+)
+
+// StartEmailLogin emails a sign-in link or a six-digit code. Like Login, it
+// takes an optional client_id, redirect_uri and response_mode. For codes the
+// response carries the challenge to send back with the code.
+func (h *Handler) StartEmailLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Email        string `json:"email"`
+		Method       string `json:"method"`
+		ClientID     string `json:"client_id"`
+		RedirectURI  string `json:"redirect_uri"`
+		ResponseMode string `json:"response_mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Method == "" {
+		req.Method = auth.EmailLoginLink
+	}
+	if req.Method != auth.EmailLoginLink && req.Method != auth.EmailLoginCode {
+		http.Error(w, "method must be link or code", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := h.authService.LoginRedirect(ctx, req.ClientID, req.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	responseMode, ok := parseResponseMode(req.ResponseMode)
+	if !ok {
+		http.Error(w, "Invalid response_mode", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := h.authService.StartEmailLogin(ctx, req.Email, req.Method, &auth.LoginContext{
+		RedirectURI:  redirectURI,
+		ClientID:     req.ClientID,
+		ResponseMode: responseMode,
+	}, r.RemoteAddr)
+	if errors.Is(err, auth.ErrInvalidEmail) {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrTooManyRequests) {
+		http.Error(w, "Too many sign-in emails requested, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to send sign-in email", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"message": "Check your email to sign in"}
+	if challenge != "" {
+		response["challenge"] = challenge
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// FinishEmailLogin redeems a sign-in link's token, or a challenge and code,
+// and returns where to send the browser
+func (h *Handler) FinishEmailLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Token     string `json:"token"`
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	token := req.Token
+	if req.Challenge != "" {
+		token = req.Challenge
+		if req.Code == "" {
+			http.Error(w, "code is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, loginCtx, err := h.authService.FinishEmailLogin(ctx, token, req.Code)
+	if errors.Is(err, auth.ErrInvalidEmailLogin) {
+		// 400 rather than 401: the frontend treats 401 as an expired session
+		http.Error(w, "This link or code is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	if !user.IsActive {
+		http.Error(w, "User account is inactive", http.StatusForbidden)
+		return
+	}
+
+	redirectURL, ok := h.continueLogin(w, r, user, loginCtx)
+	if !ok {
+		return
+	}
+	h.writeRedirectURL(w, redirectURL)
+}
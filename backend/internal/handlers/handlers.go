@@ -4,19 +4,27 @@ import (
 	"github.com/frans-sjostrom/auth-service/internal/auth"
 	"github.com/frans-sjostrom/auth-service/internal/config"
 	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/frans-sjostrom/auth-service/internal/identity"
 )
 
 type Handler struct {
 	db          *database.DB
 	cfg         *config.Config
+	keys        *auth.KeyRing
+	denylist    *auth.Denylist
+	origins     *auth.OriginRegistry
+	providers   *identity.Registry
 	authService *auth.Service
 }
 
-func New(db *database.DB, cfg *config.Config) *Handler {
-	authService := auth.NewService(db, cfg)
+func New(db *database.DB, cfg *config.Config, keys *auth.KeyRing, denylist *auth.Denylist, origins *auth.OriginRegistry, providers *identity.Registry, authService *auth.Service) *Handler {
 	return &Handler{
 		db:          db,
 		cfg:         cfg,
+		keys:        keys,
+		denylist:    denylist,
+		origins:     origins,
+		providers:   providers,
 		authService: authService,
 	}
 }
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// ListMyIdentities returns the identity provider accounts linked to the
+// current user
+func (h *Handler) ListMyIdentities(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	identities, err := h.authService.ListUserIdentities(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to query identities", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"identities": identities,
+	})
+}
+
+// StartLinkIdentity starts linking an identity at another provider to the
+// current user. The client sends the browser to the returned URL, which
+// runs a normal login with the provider and comes back to redirect_uri with
+// linked=<provider> or link_error=<code>.
+func (h *Handler) StartLinkIdentity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := h.providers.Get(chi.URLParam(r, "provider"))
+	if err != nil {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	var linkReq struct {
+		RedirectURI string `json:"redirect_uri"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&linkReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	redirectURI, err := h.authService.LoginRedirect(ctx, "", linkReq.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	token, err := h.authService.CreateLinkRequest(ctx, userID, provider.Name())
+	if err != nil {
+		http.Error(w, "Failed to start linking", http.StatusInternalServerError)
+		return
+	}
+
+	params := url.Values{
+		"link_token":   {token},
+		"redirect_uri": {redirectURI},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url": h.cfg.IssuerURL + "/api/auth/" + provider.Name() + "/login?" + params.Encode(),
+	})
+}
+
+// completeLink finishes a link started with StartLinkIdentity once the user
+// has signed in with the provider
+func (h *Handler) completeLink(w http.ResponseWriter, r *http.Request, token string, externalIdentity *models.ExternalIdentity) {
+	ctx := r.Context()
+
+	redirectCookie, err := r.Cookie("oauth_redirect")
+	if err != nil {
+		http.Error(w, "Redirect URI cookie not found", http.StatusBadRequest)
+		return
+	}
+	redirectURI := redirectCookie.Value
+	h.clearFlowCookie(w, "oauth_redirect")
+	h.clearFlowCookie(w, "oauth_client")
+
+	userID, err := h.authService.LinkIdentity(ctx, token, externalIdentity)
+	switch {
+	case errors.Is(err, auth.ErrIdentityInUse):
+		http.Redirect(w, r, appendQuery(redirectURI, url.Values{"link_error": {"identity_in_use"}}), http.StatusTemporaryRedirect)
+		return
+	case errors.Is(err, auth.ErrInvalidLinkRequest):
+		http.Redirect(w, r, appendQuery(redirectURI, url.Values{"link_error": {"invalid_request"}}), http.StatusTemporaryRedirect)
+		return
+	case err != nil:
+		http.Error(w, "Failed to link identity: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "IDENTITY_LINKED", r.RemoteAddr, r.UserAgent())
+
+	http.Redirect(w, r, appendQuery(redirectURI, url.Values{"linked": {externalIdentity.Provider}}), http.StatusTemporaryRedirect)
+}
+
+// UnlinkIdentity removes one of the current user's identities. The last
+// one cannot be removed since the user could no longer sign in.
+func (h *Handler) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	identityID, err := uuid.Parse(chi.URLParam(r, "identityID"))
+	if err != nil {
+		http.Error(w, "Invalid identity ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.authService.UnlinkIdentity(ctx, userID, identityID)
+	if errors.Is(err, auth.ErrIdentityNotFound) {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, auth.ErrLastIdentity) {
+		http.Error(w, "Cannot unlink your only sign-in method", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to unlink identity", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "IDENTITY_UNLINKED", r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Identity unlinked successfully",
+	})
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+)
+
+// IntrospectToken is the RFC 7662 introspection endpoint. Resource servers
+// authenticate as confidential applications and learn whether an access or
+// refresh token is active, and its claims.
+func (h *Handler) IntrospectToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_request"})
+		return
+	}
+
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if client.IsPublic {
+		// Anyone could claim a public client's id
+		writeOAuthError(w, http.StatusUnauthorized, &oauthError{Code: "invalid_client"})
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_request", Description: "token is required"})
+		return
+	}
+
+	result, err := h.authService.IntrospectToken(r.Context(), token, client)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, &oauthError{Code: "server_error"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
+
+// RevokeToken is the RFC 7009 revocation endpoint. Applications revoke
+// refresh and access tokens issued to them, for example when a user signs
+// out. The response is empty and the same for unknown tokens.
+func (h *Handler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_request"})
+		return
+	}
+
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_request", Description: "token is required"})
+		return
+	}
+
+	err := h.authService.RevokeToken(r.Context(), token, client)
+	if errors.Is(err, auth.ErrUnauthorizedClient) {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "unauthorized_client"})
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusServiceUnavailable, &oauthError{Code: "temporarily_unavailable"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"time"
+)
+
+// GetPublicKey returns the active signing key as a PKCS#1 PEM. Kept for
+// services that predate the JWKS endpoint; it does not survive key rotation.
+func (h *Handler) GetPublicKey(w http.ResponseWriter, r *http.Request) {
+	publicKeyBytes := x509.MarshalPKCS1PublicKey(&h.keys.Active().PrivateKey.PublicKey)
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	})
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(publicKeyPEM)
+}
+
+// GetJWKS publishes every key tokens may be verified with: the active key,
+// upcoming keys and retired keys that have not yet expired.
+func (h *Handler) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.keys.JWKS())
+}
+
+func (h *Handler) ListSigningKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": h.keys.Keys(),
+	})
+}
+
+// RotateSigningKey schedules a new signing key. It is published in the JWKS
+// straight away and becomes active after activate_in (default
+// JWT_KEY_ROTATION_LEAD), giving verifiers time to refresh their caches.
+func (h *Handler) RotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var rotateReq struct {
+		ActivateIn *string `json:"activate_in"`
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&rotateReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	activateIn := h.cfg.JWTKeyRotationLead
+	if rotateReq.ActivateIn != nil {
+		d, err := time.ParseDuration(*rotateReq.ActivateIn)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid activate_in duration", http.StatusBadRequest)
+			return
+		}
+		activateIn = d
+	}
+
+	key, err := h.keys.ScheduleRotation(ctx, time.Now().Add(activateIn))
+	if err != nil {
+		http.Error(w, "Failed to rotate signing key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn"
+	"github.com/google/uuid"
+)
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// GetMFAStatus returns the current user's second factors
+func (h *Handler) GetMFAStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	status, err := h.authService.GetMFAStatus(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to query MFA status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// BeginTOTPEnrollment generates a TOTP secret for the current user. It is
+// not used for logins until confirmed with ConfirmTOTPEnrollment.
+func (h *Handler) BeginTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.authService.GetActiveUser(ctx, userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	enrollment, err := h.authService.BeginTOTPEnrollment(ctx, user)
+	if errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// ConfirmTOTPEnrollment enables TOTP with a first code from the user's
+// authenticator and returns their recovery codes. They are only shown once.
+func (h *Handler) ConfirmTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var req mfaCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.authService.ConfirmTOTPEnrollment(ctx, userID, req.Code)
+	if errors.Is(err, auth.ErrMFANotEnabled) {
+		http.Error(w, "No enrollment in progress", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrMFALocked) {
+		http.Error(w, "Too many invalid codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to confirm enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "MFA_ENABLED", r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP turns the current user's second factor off. It takes a
+// current code or recovery code.
+func (h *Handler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var req mfaCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.DisableTOTP(ctx, userID, req.Code)
+	if errors.Is(err, auth.ErrMFANotEnabled) {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrMFALocked) {
+		http.Error(w, "Too many invalid codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "MFA_DISABLED", r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes. It
+// takes a current code or recovery code.
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var req mfaCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(ctx, userID, req.Code)
+	if errors.Is(err, auth.ErrMFANotEnabled) {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrMFALocked) {
+		http.Error(w, "Too many invalid codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to regenerate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "MFA_RECOVERY_CODES_REGENERATED", r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// VerifyMFA finishes a login that Callback parked in an MFA challenge, with
+// either a code or a passkey response to BeginMFAPasskey. On success it
+// returns where to send the browser, exactly as Callback would have
+// redirected without a second factor.
+func (h *Handler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Challenge  string                      `json:"challenge"`
+		Code       string                      `json:"code"`
+		Credential *webauthn.AssertionResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var user *models.User
+	var loginCtx *auth.LoginContext
+	var err error
+	if req.Credential != nil {
+		user, loginCtx, err = h.authService.VerifyMFAChallengeWithPasskey(ctx, req.Challenge, req.Credential)
+	} else {
+		user, loginCtx, err = h.authService.VerifyMFAChallenge(ctx, req.Challenge, req.Code)
+	}
+	if errors.Is(err, auth.ErrInvalidMFAChallenge) {
+		http.Error(w, "Login expired, please sign in again", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidMFACode) || errors.Is(err, auth.ErrInvalidPasskey) {
+		h.authService.LogAuthEvent(ctx, nil, "MFA_FAILED", r.RemoteAddr, r.UserAgent())
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+
+	redirectURL, ok := h.completeLogin(w, r, user, loginCtx)
+	if !ok {
+		return
+	}
+	h.writeRedirectURL(w, redirectURL)
+}
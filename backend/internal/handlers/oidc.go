@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/google/uuid"
+)
+
+// supportedScopes are the scopes /authorize grants; others are dropped
+var supportedScopes = []string{"openid", "email", "profile"}
+
+// oauthError is an OAuth 2.0 error response (RFC 6749 section 5.2)
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// authorizeRequest is a validated /authorize request
+type authorizeRequest struct {
+	Client              *models.Application
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Prompt              string
+}
+
+func (h *Handler) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	issuer := h.cfg.IssuerURL
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                         issuer,
+		"authorization_endpoint":                         issuer + "/authorize",
+		"token_endpoint":                                 issuer + "/token",
+		"userinfo_endpoint":                              issuer + "/userinfo",
+		"introspection_endpoint":                         issuer + "/oauth/introspect",
+		"revocation_endpoint":                            issuer + "/oauth/revoke",
+		"jwks_uri":                                       issuer + "/.well-known/jwks.json",
+		"response_types_supported":                       []string{"code"},
+		"response_modes_supported":                       []string{"query"},
+		"grant_types_supported":                          []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{"RS256"},
+		"scopes_supported":                               supportedScopes,
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"introspection_endpoint_auth_methods_supported":  []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":     []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":               []string{auth.CodeChallengeS256},
+		"claims_supported":                               []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "email", "name", "picture"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// Authorize starts the authorization code flow. The request is validated,
+// kept in a cookie while the user signs in with an identity provider, and
+// completed in Callback. The non-standard provider parameter picks the
+// identity provider; the first configured one is used without it.
+func (h *Handler) Authorize(w http.ResponseWriter, r *http.Request) {
+	authReq, oauthErr, err := h.parseAuthorizeRequest(r.Context(), r.URL.Query())
+	if err != nil {
+		// The redirect URI cannot be trusted, so show the error to the user
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if oauthErr != nil {
+		h.redirectAuthorizeError(w, r, authReq, oauthErr)
+		return
+	}
+
+	// There is no session at the auth-service itself, so a login is always
+	// needed
+	if authReq.Prompt == "none" {
+		h.redirectAuthorizeError(w, r, authReq, &oauthError{Code: "login_required"})
+		return
+	}
+
+	provider := h.providers.Default()
+	if name := r.URL.Query().Get("provider"); name != "" {
+		if provider, err = h.providers.Get(name); err != nil {
+			h.redirectAuthorizeError(w, r, authReq, &oauthError{Code: "invalid_request", Description: "unknown provider"})
+			return
+		}
+	}
+
+	h.setFlowCookie(w, "oidc_authorize", base64.RawURLEncoding.EncodeToString([]byte(r.URL.RawQuery)))
+	h.beginLogin(w, r, provider)
+}
+
+// authorizeRedirect finishes an /authorize request for an authenticated user
+// and returns the client redirect carrying an authorization code. When ok is
+// false an error has been written to w.
+func (h *Handler) authorizeRedirect(w http.ResponseWriter, r *http.Request, user *models.User, loginCtx *auth.LoginContext) (redirectURL string, ok bool) {
+	ctx := r.Context()
+
+	rawQuery, err := base64.RawURLEncoding.DecodeString(loginCtx.AuthorizeRequest)
+	if err != nil {
+		http.Error(w, "Invalid authorization request", http.StatusBadRequest)
+		return "", false
+	}
+	query, err := url.ParseQuery(string(rawQuery))
+	if err != nil {
+		http.Error(w, "Invalid authorization request", http.StatusBadRequest)
+		return "", false
+	}
+
+	// Validate again: the cookie is only as trustworthy as the browser
+	authReq, oauthErr, err := h.parseAuthorizeRequest(ctx, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if oauthErr != nil {
+		return h.authorizeErrorURL(authReq, oauthErr), true
+	}
+
+	code := &models.AuthorizationCode{
+		ClientID:    authReq.Client.ClientID,
+		UserID:      user.ID,
+		RedirectURI: authReq.RedirectURI,
+		Scope:       authReq.Scope,
+		AuthTime:    loginCtx.AuthTime,
+		AMR:         loginCtx.AMR,
+	}
+	if authReq.Nonce != "" {
+		code.Nonce = &authReq.Nonce
+	}
+	if authReq.CodeChallenge != "" {
+		code.CodeChallenge = &authReq.CodeChallenge
+		code.CodeChallengeMethod = &authReq.CodeChallengeMethod
+	}
+
+	value, err := h.authService.CreateAuthorizationCode(ctx, code)
+	if err != nil {
+		return h.authorizeErrorURL(authReq, &oauthError{Code: "server_error"}), true
+	}
+
+	params := url.Values{}
+	params.Set("code", value)
+	if authReq.State != "" {
+		params.Set("state", authReq.State)
+	}
+	params.Set("iss", h.cfg.IssuerURL)
+
+	return appendQuery(authReq.RedirectURI, params), true
+}
+
+// parseAuthorizeRequest validates an authorization request. An error means
+// the client or redirect URI is invalid and nothing may be redirected; an
+// oauthError is reported to the client through its redirect URI.
+func (h *Handler) parseAuthorizeRequest(ctx context.Context, q url.Values) (*authorizeRequest, *oauthError, error) {
+	client, err := h.authService.GetClient(ctx, q.Get("client_id"))
+	if err != nil {
+		return nil, nil, errors.New("Invalid client_id")
+	}
+
+	redirectURI := q.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return nil, nil, errors.New("Invalid redirect_uri")
+	}
+
+	authReq := &authorizeRequest{
+		Client:              client,
+		RedirectURI:         redirectURI,
+		State:               q.Get("state"),
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+		Prompt:              q.Get("prompt"),
+	}
+
+	if q.Get("response_type") != "code" {
+		return authReq, &oauthError{Code: "unsupported_response_type", Description: "only response_type=code is supported"}, nil
+	}
+
+	var scopes []string
+	for _, scope := range strings.Fields(q.Get("scope")) {
+		if slices.Contains(supportedScopes, scope) && !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	authReq.Scope = strings.Join(scopes, " ")
+
+	if authReq.CodeChallenge != "" {
+		if authReq.CodeChallengeMethod != auth.CodeChallengeS256 {
+			return authReq, &oauthError{Code: "invalid_request", Description: "code_challenge_method must be S256"}, nil
+		}
+	} else if client.IsPublic {
+		return authReq, &oauthError{Code: "invalid_request", Description: "public clients must use PKCE"}, nil
+	}
+
+	return authReq, nil, nil
+}
+
+func (h *Handler) redirectAuthorizeError(w http.ResponseWriter, r *http.Request, authReq *authorizeRequest, oauthErr *oauthError) {
+	http.Redirect(w, r, h.authorizeErrorURL(authReq, oauthErr), http.StatusFound)
+}
+
+func (h *Handler) authorizeErrorURL(authReq *authorizeRequest, oauthErr *oauthError) string {
+	params := url.Values{}
+	params.Set("error", oauthErr.Code)
+	if oauthErr.Description != "" {
+		params.Set("error_description", oauthErr.Description)
+	}
+	if authReq.State != "" {
+		params.Set("state", authReq.State)
+	}
+	params.Set("iss", h.cfg.IssuerURL)
+
+	return appendQuery(authReq.RedirectURI, params)
+}
+
+// Token is the OAuth 2.0 token endpoint
+func (h *Handler) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_request"})
+		return
+	}
+
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		h.tokenFromAuthorizationCode(w, r, client)
+	case "refresh_token":
+		h.tokenFromRefreshToken(w, r, client)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "unsupported_grant_type"})
+	}
+}
+
+// authenticateClient authenticates the client of a token, introspection or
+// revocation request with HTTP Basic or client_id and client_secret in the
+// form, which must have been parsed. When ok is false an error has been
+// written to w.
+func (h *Handler) authenticateClient(w http.ResponseWriter, r *http.Request) (client *models.Application, ok bool) {
+	clientID, clientSecret, usedBasic := r.BasicAuth()
+	if !usedBasic {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := h.authService.AuthenticateClient(r.Context(), clientID, clientSecret)
+	if err != nil {
+		if usedBasic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, &oauthError{Code: "invalid_client"})
+		return nil, false
+	}
+	return client, true
+}
+
+func (h *Handler) tokenFromAuthorizationCode(w http.ResponseWriter, r *http.Request, client *models.Application) {
+	ctx := r.Context()
+
+	code, err := h.authService.RedeemAuthorizationCode(ctx,
+		r.PostForm.Get("code"), client.ClientID, r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"),
+	)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_grant"})
+		return
+	}
+
+	user, err := h.authService.GetActiveUser(ctx, code.UserID)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_grant"})
+		return
+	}
+
+	tokens, err := h.authService.GenerateTokens(ctx, user, auth.TokenOptions{
+		ClientID: client.ClientID,
+		Scope:    code.Scope,
+		AMR:      code.AMR,
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, &oauthError{Code: "server_error"})
+		return
+	}
+
+	if hasScope(code.Scope, "openid") {
+		nonce := ""
+		if code.Nonce != nil {
+			nonce = *code.Nonce
+		}
+		tokens.IDToken, err = h.authService.GenerateIDToken(user, client.ClientID, nonce, code.AuthTime, tokens)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, &oauthError{Code: "server_error"})
+			return
+		}
+	}
+
+	h.writeTokenResponse(w, tokens)
+}
+
+func (h *Handler) tokenFromRefreshToken(w http.ResponseWriter, r *http.Request, client *models.Application) {
+	ctx := r.Context()
+
+	tokens, user, err := h.authService.RefreshAccessToken(ctx, auth.RefreshRequest{
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		ClientID:     client.ClientID,
+		IPAddress:    r.RemoteAddr,
+		UserAgent:    r.UserAgent(),
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Code: "invalid_grant"})
+		return
+	}
+
+	if hasScope(tokens.Scope, "openid") {
+		tokens.IDToken, err = h.authService.GenerateIDToken(user, client.ClientID, "", time.Time{}, tokens)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, &oauthError{Code: "server_error"})
+			return
+		}
+	}
+
+	h.writeTokenResponse(w, tokens)
+}
+
+func (h *Handler) writeTokenResponse(w http.ResponseWriter, tokens *models.TokenPair) {
+	response := map[string]interface{}{
+		"access_token":  tokens.AccessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(tokens.ExpiresIn.Seconds()),
+		"refresh_token": tokens.RefreshToken,
+		"scope":         tokens.Scope,
+	}
+	if tokens.IDToken != "" {
+		response["id_token"] = tokens.IDToken
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(response)
+}
+
+// UserInfo returns the claims about the authenticated user allowed by the
+// access token's scope
+func (h *Handler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.authService.GetActiveUser(ctx, userID)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "User not found or inactive", http.StatusUnauthorized)
+		return
+	}
+
+	// First-party tokens have no audience and may read everything; tokens
+	// issued to an application only what their scope grants, even if empty
+	clientID, _ := ctx.Value(middleware.ClientIDKey).(string)
+	scope, _ := ctx.Value(middleware.ScopeKey).(string)
+	allClaims := clientID == ""
+
+	claims := map[string]interface{}{
+		"sub": user.ID.String(),
+	}
+	if allClaims || hasScope(scope, "email") {
+		claims["email"] = user.Email
+	}
+	if allClaims || hasScope(scope, "profile") {
+		claims["name"] = user.Name
+		if user.AvatarURL != nil {
+			claims["picture"] = *user.AvatarURL
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(claims)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, oauthErr *oauthError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oauthErr)
+}
+
+func hasScope(scope, want string) bool {
+	return slices.Contains(strings.Fields(scope), want)
+}
+
+// appendQuery adds params to a URL that may already have a query string
+func appendQuery(rawURL string, params url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + params.Encode()
+	}
+	return rawURL + "?" + params.Encode()
+}
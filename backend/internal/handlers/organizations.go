@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// writeOrganizationError maps the organization errors of the auth service
+// to responses, falling back to a 500 with message
+func writeOrganizationError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, auth.ErrOrganizationNotFound):
+		http.Error(w, "Organization not found", http.StatusNotFound)
+	case errors.Is(err, auth.ErrOrganizationForbidden):
+		http.Error(w, "Your organization role does not allow this", http.StatusForbidden)
+	case errors.Is(err, auth.ErrInvalidOrganizationRole):
+		http.Error(w, "role must be owner, admin or member", http.StatusBadRequest)
+	case errors.Is(err, auth.ErrLastOwner):
+		http.Error(w, "An organization must keep at least one owner", http.StatusConflict)
+	case errors.Is(err, auth.ErrMemberNotFound):
+		http.Error(w, "Member not found", http.StatusNotFound)
+	case errors.Is(err, auth.ErrAlreadyMember):
+		http.Error(w, "User is already a member", http.StatusConflict)
+	case errors.Is(err, auth.ErrInvalidInvite):
+		http.Error(w, "This invitation is invalid or has expired", http.StatusBadRequest)
+	case errors.Is(err, auth.ErrInvalidEmail):
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+	default:
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
+
+// organizationParams reads the current user and the {orgID} URL parameter
+func organizationParams(w http.ResponseWriter, r *http.Request) (userID, orgID uuid.UUID, ok bool) {
+	userID, ok = r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	orgID, err := uuid.Parse(chi.URLParam(r, "orgID"))
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	return userID, orgID, true
+}
+
+// ListMyOrganizations returns the organizations the current user is a
+// member of
+func (h *Handler) ListMyOrganizations(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	orgs, err := h.authService.ListOrganizations(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to query organizations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"organizations": orgs,
+	})
+}
+
+// CreateOrganization creates an organization owned by the current user
+func (h *Handler) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.authService.CreateOrganization(r.Context(), userID, req.Name)
+	if err != nil {
+		http.Error(w, "Failed to create organization", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+func (h *Handler) GetOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	org, err := h.authService.GetOrganization(r.Context(), orgID, userID)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to query organization")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// UpdateOrganization renames an organization; requires the admin role in it
+func (h *Handler) UpdateOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.authService.RenameOrganization(r.Context(), orgID, userID, req.Name)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to update organization")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// DeleteOrganization deletes an organization; requires the owner role in it
+func (h *Handler) DeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.authService.DeleteOrganization(r.Context(), orgID, userID); err != nil {
+		writeOrganizationError(w, err, "Failed to delete organization")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Organization deleted successfully",
+	})
+}
+
+func (h *Handler) ListOrganizationMembers(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := h.authService.ListOrganizationMembers(r.Context(), orgID, userID)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to query members")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"members": members,
+	})
+}
+
+// SetOrganizationMemberRole changes a member's role in an organization
+func (h *Handler) SetOrganizationMemberRole(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	memberID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err = h.authService.SetOrganizationMemberRole(r.Context(), orgID, userID, memberID, req.Role)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to update member")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Member updated successfully",
+	})
+}
+
+// RemoveOrganizationMember removes a member from an organization, or lets
+// the current user leave it
+func (h *Handler) RemoveOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	memberID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authService.RemoveOrganizationMember(r.Context(), orgID, userID, memberID); err != nil {
+		writeOrganizationError(w, err, "Failed to remove member")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Member removed successfully",
+	})
+}
+
+func (h *Handler) ListOrganizationInvites(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	invites, err := h.authService.ListOrganizationInvites(r.Context(), orgID, userID)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to query invitations")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invites": invites,
+	})
+}
+
+// InviteToOrganization emails an invitation to join an organization. The
+// role defaults to member.
+func (h *Handler) InviteToOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = "member"
+	}
+
+	invite, err := h.authService.InviteToOrganization(r.Context(), orgID, userID, req.Email, req.Role)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to send invitation")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+func (h *Handler) RevokeOrganizationInvite(w http.ResponseWriter, r *http.Request) {
+	userID, orgID, ok := organizationParams(w, r)
+	if !ok {
+		return
+	}
+
+	inviteID, err := uuid.Parse(chi.URLParam(r, "inviteID"))
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authService.RevokeOrganizationInvite(r.Context(), orgID, userID, inviteID); err != nil {
+		writeOrganizationError(w, err, "Failed to revoke invitation")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Invitation revoked successfully",
+	})
+}
+
+// AcceptOrganizationInvite adds the current user to the organization an
+// emailed invitation token is for
+func (h *Handler) AcceptOrganizationInvite(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.authService.AcceptOrganizationInvite(r.Context(), userID, req.Token)
+	if err != nil {
+		writeOrganizationError(w, err, "Failed to accept invitation")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// SwitchOrganization sets the organization the current user's tokens are
+// issued for, or clears it when organization_id is null. With a refresh
+// token cookie it also rotates the session and returns an access token for
+// the new organization right away.
+func (h *Handler) SwitchOrganization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		OrganizationID *uuid.UUID `json:"organization_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authService.SwitchOrganization(ctx, userID, req.OrganizationID); err != nil {
+		writeOrganizationError(w, err, "Failed to switch organization")
+		return
+	}
+
+	response := map[string]string{"message": "Organization switched successfully"}
+
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		tokens, user, err := h.authService.RefreshAccessToken(ctx, auth.RefreshRequest{
+			RefreshToken: cookie.Value,
+			IPAddress:    r.RemoteAddr,
+			UserAgent:    r.UserAgent(),
+		})
+		if err == nil && user.ID == userID {
+			h.setRefreshTokenCookie(w, tokens.RefreshToken)
+			response["access_token"] = tokens.AccessToken
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// ListPasskeys returns the current user's passkeys
+func (h *Handler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	passkeys, err := h.authService.ListPasskeys(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to query passkeys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"passkeys": passkeys,
+	})
+}
+
+// BeginPasskeyRegistration returns the options for
+// navigator.credentials.create() to add a passkey to the current user
+func (h *Handler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.authService.GetActiveUser(ctx, userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	options, err := h.authService.BeginPasskeyRegistration(ctx, user)
+	if err != nil {
+		http.Error(w, "Failed to start passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": options,
+	})
+}
+
+// FinishPasskeyRegistration stores the passkey created in the browser. The
+// response includes recovery codes when it is the user's first second
+// factor.
+func (h *Handler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name       string                    `json:"name"`
+		Credential webauthn.CreationResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+	if len(req.Name) > 255 {
+		http.Error(w, "Name is too long", http.StatusBadRequest)
+		return
+	}
+
+	passkey, codes, err := h.authService.FinishPasskeyRegistration(ctx, userID, req.Name, &req.Credential)
+	if errors.Is(err, auth.ErrInvalidPasskey) {
+		http.Error(w, "Invalid passkey", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrPasskeyExists) {
+		http.Error(w, "Passkey is already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to register passkey", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "PASSKEY_REGISTERED", r.RemoteAddr, r.UserAgent())
+
+	response := map[string]interface{}{
+		"passkey": passkey,
+	}
+	if codes != nil {
+		response["recovery_codes"] = codes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeletePasskey removes one of the current user's passkeys
+func (h *Handler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	passkeyID, err := uuid.Parse(chi.URLParam(r, "passkeyID"))
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.authService.DeletePasskey(ctx, userID, passkeyID)
+	if errors.Is(err, auth.ErrPasskeyNotFound) {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete passkey", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "PASSKEY_DELETED", r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Passkey deleted successfully",
+	})
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get() to
+// sign in with a passkey instead of an identity provider. Like Login, it
+// takes an optional client_id, redirect_uri and response_mode.
+func (h *Handler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		ClientID     string `json:"client_id"`
+		RedirectURI  string `json:"redirect_uri"`
+		ResponseMode string `json:"response_mode"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	redirectURI, err := h.authService.LoginRedirect(ctx, req.ClientID, req.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	responseMode, ok := parseResponseMode(req.ResponseMode)
+	if !ok {
+		http.Error(w, "Invalid response_mode", http.StatusBadRequest)
+		return
+	}
+
+	options, err := h.authService.BeginPasskeyLogin(ctx, &auth.LoginContext{
+		RedirectURI:  redirectURI,
+		ClientID:     req.ClientID,
+		ResponseMode: responseMode,
+	})
+	if err != nil {
+		http.Error(w, "Failed to start passkey login", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": options,
+	})
+}
+
+// FinishPasskeyLogin signs in with the passkey chosen in the browser and
+// returns where to send the browser. Without user verification on the
+// passkey, users with a second factor still get an MFA challenge.
+func (h *Handler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var credential webauthn.AssertionResponse
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, loginCtx, err := h.authService.FinishPasskeyLogin(ctx, &credential)
+	if errors.Is(err, auth.ErrInvalidPasskey) {
+		h.authService.LogAuthEvent(ctx, nil, "PASSKEY_LOGIN_FAILED", r.RemoteAddr, r.UserAgent())
+		http.Error(w, "Invalid passkey", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "User not found or inactive", http.StatusForbidden)
+		return
+	}
+
+	redirectURL, ok := h.continueLogin(w, r, user, loginCtx)
+	if !ok {
+		return
+	}
+	h.writeRedirectURL(w, redirectURL)
+}
+
+// BeginMFAPasskey returns the options for answering an MFA challenge with a
+// passkey; the result is posted to VerifyMFA
+func (h *Handler) BeginMFAPasskey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	options, err := h.authService.BeginMFAPasskey(r.Context(), req.Challenge)
+	if errors.Is(err, auth.ErrInvalidMFAChallenge) {
+		http.Error(w, "Login expired, please sign in again", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrPasskeyNotFound) {
+		http.Error(w, "No passkeys registered", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to start passkey verification", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": options,
+	})
+}
+
+func (h *Handler) writeRedirectURL(w http.ResponseWriter, redirectURL string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"redirect_url": redirectURL,
+	})
+}
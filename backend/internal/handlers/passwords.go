@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/pkg/password"
+)
+
+// Register creates an email and password account. The response is the same
+// whether or not the email already has an account; either way the owner
+// gets an email.
+func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Name     string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.Register(r.Context(), req.Email, req.Name, req.Password)
+	if writePasswordError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Check your email to finish signing up",
+	})
+}
+
+// VerifyEmail redeems the link sent after registering
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.authService.VerifyEmail(ctx, req.Token)
+	if errors.Is(err, auth.ErrInvalidEmailToken) {
+		http.Error(w, "This link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "EMAIL_VERIFIED", r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Email verified successfully",
+	})
+}
+
+// PasswordLogin signs in with an email and password and returns where to
+// send the browser. Like Login, it takes an optional client_id, redirect_uri
+// and response_mode.
+func (h *Handler) PasswordLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		ClientID     string `json:"client_id"`
+		RedirectURI  string `json:"redirect_uri"`
+		ResponseMode string `json:"response_mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := h.authService.LoginRedirect(ctx, req.ClientID, req.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	responseMode, ok := parseResponseMode(req.ResponseMode)
+	if !ok {
+		http.Error(w, "Invalid response_mode", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.authService.PasswordLogin(ctx, req.Email, req.Password)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		http.Error(w, "Invalid email or password", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrEmailNotVerified) {
+		http.Error(w, "Verify your email address first, using the link we sent you", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	if !user.IsActive {
+		http.Error(w, "User account is inactive", http.StatusForbidden)
+		return
+	}
+
+	redirectURL, ok := h.continueLogin(w, r, user, &auth.LoginContext{
+		RedirectURI:  redirectURI,
+		ClientID:     req.ClientID,
+		ResponseMode: responseMode,
+		AMR:          []string{auth.AMRPassword},
+		AuthTime:     time.Now(),
+	})
+	if !ok {
+		return
+	}
+	h.writeRedirectURL(w, redirectURL)
+}
+
+// ForgotPassword emails a password reset link. It always succeeds so that
+// it cannot be used to find out which emails have accounts.
+func (h *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.RequestPasswordReset(r.Context(), req.Email)
+	if errors.Is(err, auth.ErrInvalidEmail) {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to request password reset", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If the email belongs to an account, a reset link is on its way",
+	})
+}
+
+// ResetPassword sets a new password with a reset link's token
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.authService.ResetPassword(ctx, req.Token, req.Password)
+	if errors.Is(err, auth.ErrInvalidEmailToken) {
+		http.Error(w, "This link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if writePasswordError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	h.authService.LogAuthEvent(ctx, &userID, "PASSWORD_RESET", r.RemoteAddr, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password changed successfully",
+	})
+}
+
+// writePasswordError reports an invalid email or a password rejected by the
+// policy, returning whether err was one of those
+func writePasswordError(w http.ResponseWriter, err error) bool {
+	var policyErr *password.PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		http.Error(w, policyErr.Reason, http.StatusBadRequest)
+	case errors.Is(err, auth.ErrInvalidEmail):
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+	default:
+		return false
+	}
+	return true
+}
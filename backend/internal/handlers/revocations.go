@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"github.com/frans-sjostrom/auth-service/pkg/revocation"
+)
+
+// revocationHeartbeat is how often an idle revocation stream sends a
+// comment, so proxies and clients can tell it is still alive
+const revocationHeartbeat = 30 * time.Second
+
+// ListRevocations returns every revocation of access tokens that have not
+// expired yet, for resource servers that check tokens themselves
+func (h *Handler) ListRevocations(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.authenticateVerifier(w, r); !ok {
+		return
+	}
+
+	entries, err := h.denylist.Entries(r.Context())
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, &oauthError{Code: "server_error"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string][]revocation.Entry{"revocations": entries})
+}
+
+// StreamRevocations pushes revocations to resource servers as server-sent
+// events: a snapshot of the current list, then every new revocation. The
+// stream ends when the server may have missed revocations; clients
+// reconnect and start over from a new snapshot.
+func (h *Handler) StreamRevocations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if _, ok := h.authenticateVerifier(w, r); !ok {
+		return
+	}
+
+	// Subscribe before taking the snapshot so nothing falls in between
+	revoked, unsubscribe := h.denylist.Subscribe()
+	defer unsubscribe()
+
+	entries, err := h.denylist.Entries(ctx)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, &oauthError{Code: "server_error"})
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(w, revocation.EventSnapshot, entries); err != nil || rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(revocationHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry, ok := <-revoked:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, revocation.EventRevoked, entry); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// authenticateVerifier authenticates a confidential application with HTTP
+// Basic authentication, as resource servers fetching revocations do
+func (h *Handler) authenticateVerifier(w http.ResponseWriter, r *http.Request) (*models.Application, bool) {
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return nil, false
+	}
+	if client.IsPublic {
+		// Anyone could claim a public client's id
+		writeOAuthError(w, http.StatusUnauthorized, &oauthError{Code: "invalid_client"})
+		return nil, false
+	}
+	return client, true
+}
+
+// writeEvent writes data as a JSON server-sent event
+func writeEvent(w http.ResponseWriter, event string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+	return err
+}
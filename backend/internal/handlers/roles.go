@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+type roleRequest struct {
+	Name        string   `json:"name"`
+	Description *string  `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func (h *Handler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.authService.ListRoles(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to query roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roles": roles,
+	})
+}
+
+func (h *Handler) GetRole(w http.ResponseWriter, r *http.Request) {
+	role, err := h.authService.GetRole(r.Context(), chi.URLParam(r, "name"))
+	if errors.Is(err, auth.ErrRoleNotFound) {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+func (h *Handler) CreateRole(w http.ResponseWriter, r *http.Request) {
+	var createReq roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&createReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var description string
+	if createReq.Description != nil {
+		description = *createReq.Description
+	}
+
+	role, err := h.authService.CreateRole(r.Context(), createReq.Name, description, createReq.Permissions)
+	if errors.Is(err, auth.ErrInvalidRoleName) {
+		http.Error(w, "Role names are lowercase letters, digits, '-' and '_'", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrUnknownPermission) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrRoleExists) {
+		http.Error(w, "Role already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+// UpdateRole changes a role's description or, if given, replaces its
+// permissions
+func (h *Handler) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	var updateReq roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	role, err := h.authService.UpdateRole(r.Context(), chi.URLParam(r, "name"), auth.RoleUpdate{
+		Description: updateReq.Description,
+		Permissions: updateReq.Permissions,
+	})
+	if errors.Is(err, auth.ErrRoleNotFound) {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, auth.ErrBuiltinRole) {
+		http.Error(w, "The admin role's permissions cannot be changed", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, auth.ErrUnknownPermission) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+func (h *Handler) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	err := h.authService.DeleteRole(r.Context(), chi.URLParam(r, "name"))
+	if errors.Is(err, auth.ErrRoleNotFound) {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, auth.ErrBuiltinRole) {
+		http.Error(w, "Built-in roles cannot be deleted", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, auth.ErrRoleInUse) {
+		http.Error(w, "Role is still assigned to users", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Role deleted successfully",
+	})
+}
+
+func (h *Handler) ListPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions, err := h.authService.ListPermissions(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to query permissions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"permissions": permissions,
+	})
+}
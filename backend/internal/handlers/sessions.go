@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/frans-sjostrom/auth-service/internal/auth"
+	"github.com/frans-sjostrom/auth-service/internal/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// currentSession returns the session of the request: the access token's
+// sid, or for tokens issued before sessions existed, the refresh token
+// cookie's. It returns uuid.Nil if neither names one.
+func (h *Handler) currentSession(r *http.Request) uuid.UUID {
+	if sid, _ := r.Context().Value(middleware.SessionIDKey).(string); sid != "" {
+		if id, err := uuid.Parse(sid); err == nil {
+			return id
+		}
+	}
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		if id, err := h.authService.SessionOfRefreshToken(r.Context(), cookie.Value); err == nil {
+			return id
+		}
+	}
+	return uuid.Nil
+}
+
+func writeSessionError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, auth.ErrSessionNotFound):
+		http.Error(w, "Session not found", http.StatusNotFound)
+	case errors.Is(err, auth.ErrInvalidSessionName):
+		http.Error(w, "Session names are at most 100 characters", http.StatusBadRequest)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) writeSessions(w http.ResponseWriter, r *http.Request, userID, current uuid.UUID) {
+	sessions, err := h.authService.ListSessions(r.Context(), userID, current)
+	if err != nil {
+		http.Error(w, "Failed to query sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// ListMySessions returns the devices the current user is signed in on
+func (h *Handler) ListMySessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	h.writeSessions(w, r, userID, h.currentSession(r))
+}
+
+// RenameMySession names one of the current user's sessions
+func (h *Handler) RenameMySession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID, err := uuid.Parse(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authService.RenameSession(r.Context(), userID, sessionID, req.Name); err != nil {
+		writeSessionError(w, err, "Failed to rename session")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Session renamed successfully",
+	})
+}
+
+// RevokeMySession signs the current user out of one of their sessions,
+// which may be this one
+func (h *Handler) RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID, err := uuid.Parse(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	current := h.currentSession(r)
+	if err := h.authService.RevokeSession(ctx, userID, sessionID); err != nil {
+		writeSessionError(w, err, "Failed to sign out of session")
+		return
+	}
+	if sessionID == current {
+		h.clearRefreshTokenCookie(w)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Signed out of session",
+	})
+}
+
+// RevokeOtherSessions signs the current user out of every session but this
+// one
+func (h *Handler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	current := h.currentSession(r)
+	if current == uuid.Nil {
+		http.Error(w, "Current session not found, sign in again", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := h.authService.RevokeOtherSessions(ctx, userID, current)
+	if err != nil {
+		writeSessionError(w, err, "Failed to sign out of other sessions")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Signed out of other sessions",
+		"revoked": revoked,
+	})
+}
+
+// ListUserSessions returns the sessions of any user
+func (h *Handler) ListUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	h.writeSessions(w, r, userID, h.currentSession(r))
+}
+
+// RevokeUserSession signs any user out of one of their sessions
+func (h *Handler) RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	sessionID, err := uuid.Parse(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authService.RevokeSession(r.Context(), userID, sessionID); err != nil {
+		writeSessionError(w, err, "Failed to sign out of session")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Signed out of session",
+	})
+}
+
+// RevokeUserSessions signs any user out of every session. Unlike a user
+// signing out of their other sessions, this also revokes every access token
+// issued to them.
+func (h *Handler) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authService.SignOutEverywhere(r.Context(), userID); err != nil {
+		http.Error(w, "Failed to sign out", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Signed out of all sessions",
+	})
+}
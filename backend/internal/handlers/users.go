@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/auth"
 	"github.com/frans-sjostrom/auth-service/internal/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
 type UserResponse struct {
@@ -24,6 +29,59 @@ type UserResponse struct {
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
+const userResponseColumns = `id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at`
+
+func scanUserResponse(row pgx.Row) (*UserResponse, error) {
+	var user UserResponse
+	err := row.Scan(
+		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
+		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// changeUser runs update, an UPDATE of userID returning
+// userResponseColumns, and records action with the changed fields in the
+// same transaction. It returns pgx.ErrNoRows for unknown and deleted users.
+func (h *Handler) changeUser(ctx context.Context, userID uuid.UUID, action, update string, args ...any) (*UserResponse, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := scanUserResponse(tx.QueryRow(ctx,
+		`SELECT `+userResponseColumns+` FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, userID,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := scanUserResponse(tx.QueryRow(ctx, update, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	err = audit.Record(ctx, tx, audit.Event{
+		Action:     action,
+		UserID:     &userID,
+		TargetType: audit.TargetUser,
+		TargetID:   userID.String(),
+		Changes:    audit.Diff(before, after),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
 type ListUsersResponse struct {
 	Users      []UserResponse `json:"users"`
 	Total      int            `json:"total"`
@@ -127,11 +185,10 @@ func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Authorization: users can view themselves, admins can view anyone
+	// Authorization: users can view themselves, users:read anyone
 	authUserID, _ := ctx.Value(middleware.UserIDKey).(uuid.UUID)
-	authUserRole, _ := ctx.Value(middleware.RoleKey).(string)
 
-	if authUserRole != "admin" && authUserID != userID {
+	if authUserID != userID && !middleware.HasPermission(ctx, auth.PermissionUsersRead) {
 		http.Error(w, "Forbidden: cannot view other users", http.StatusForbidden)
 		return
 	}
@@ -150,11 +207,10 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Authorization: users can only update themselves, admins can update anyone
+	// Authorization: users can update themselves, users:write anyone
 	authUserID, _ := ctx.Value(middleware.UserIDKey).(uuid.UUID)
-	authUserRole, _ := ctx.Value(middleware.RoleKey).(string)
 
-	if authUserRole != "admin" && authUserID != userID {
+	if authUserID != userID && !middleware.HasPermission(ctx, auth.PermissionUsersWrite) {
 		http.Error(w, "Forbidden: cannot update other users", http.StatusForbidden)
 		return
 	}
@@ -174,16 +230,14 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		SET name = COALESCE($1, name),
 		    avatar_url = COALESCE($2, avatar_url),
 		    updated_at = NOW()
-		WHERE id = $3 AND deleted_at IS NULL
-		RETURNING id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at
-	`
-
-	var user UserResponse
-	err = h.db.QueryRow(ctx, query, updateReq.Name, updateReq.AvatarURL, userID).Scan(
-		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
-		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
-	)
+		WHERE id = $3
+		RETURNING ` + userResponseColumns
 
+	user, err := h.changeUser(ctx, userID, "USER_UPDATED", query, updateReq.Name, updateReq.AvatarURL, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to update user", http.StatusInternalServerError)
 		return
@@ -193,25 +247,73 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user)
 }
 
-func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+// SetUserRole assigns a role to another user
+func (h *Handler) SetUserRole(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	idStr := chi.URLParam(r, "id")
 
-	userID, err := uuid.Parse(idStr)
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
-	// Authorization: only admins can delete users
+	// Prevent locking yourself out, or granting yourself more
 	authUserID, _ := ctx.Value(middleware.UserIDKey).(uuid.UUID)
-	authUserRole, _ := ctx.Value(middleware.RoleKey).(string)
+	if authUserID == userID {
+		http.Error(w, "Forbidden: cannot change your own role", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.authService.SetUserRole(ctx, userID, req.Role)
+	if errors.Is(err, auth.ErrRoleNotFound) {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		return
+	}
 
-	if authUserRole != "admin" {
-		http.Error(w, "Forbidden: admin access required", http.StatusForbidden)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserResponse{
+		ID:        user.ID,
+		Email:     user.Email,
+		GoogleID:  user.GoogleID,
+		Name:      user.Name,
+		AvatarURL: user.AvatarURL,
+		Role:      user.Role,
+		IsActive:  user.IsActive,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		DeletedAt: user.DeletedAt,
+	})
+}
+
+func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	idStr := chi.URLParam(r, "id")
+
+	userID, err := uuid.Parse(idStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
+	// Authorization: the route requires users:delete
+	authUserID, _ := ctx.Value(middleware.UserIDKey).(uuid.UUID)
+
 	// Prevent self-deletion
 	if authUserID == userID {
 		http.Error(w, "Forbidden: cannot delete yourself", http.StatusForbidden)
@@ -220,18 +322,22 @@ func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 
 	query := `
 		UPDATE users
-		SET deleted_at = NOW(), is_active = false
-		WHERE id = $1 AND deleted_at IS NULL
-	`
+		SET deleted_at = NOW(), is_active = false, token_version = token_version + 1
+		WHERE id = $1
+		RETURNING ` + userResponseColumns
 
-	result, err := h.db.Exec(ctx, query, userID)
+	_, err = h.changeUser(ctx, userID, "USER_DELETED", query, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
 	}
 
-	if result.RowsAffected() == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if err := h.authService.RevokeUserTokens(ctx, userID); err != nil {
+		http.Error(w, "Failed to revoke user's tokens", http.StatusInternalServerError)
 		return
 	}
 
@@ -255,20 +361,18 @@ func (h *Handler) ActivateUser(w http.ResponseWriter, r *http.Request) {
 	query := `
 		UPDATE users
 		SET is_active = true, updated_at = NOW()
-		WHERE id = $1 AND deleted_at IS NULL
-		RETURNING id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at
-	`
+		WHERE id = $1
+		RETURNING ` + userResponseColumns
 
-	var user UserResponse
-	err = h.db.QueryRow(ctx, query, userID).Scan(
-		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
-		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
-	)
-
-	if err != nil {
+	user, err := h.changeUser(ctx, userID, "USER_ACTIVATED", query, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Failed to activate user", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
@@ -286,21 +390,24 @@ func (h *Handler) DeactivateUser(w http.ResponseWriter, r *http.Request) {
 
 	query := `
 		UPDATE users
-		SET is_active = false, updated_at = NOW()
-		WHERE id = $1 AND deleted_at IS NULL
-		RETURNING id, email, google_id, name, avatar_url, role, is_active, created_at, updated_at, deleted_at
-	`
+		SET is_active = false, token_version = token_version + 1, updated_at = NOW()
+		WHERE id = $1
+		RETURNING ` + userResponseColumns
 
-	var user UserResponse
-	err = h.db.QueryRow(ctx, query, userID).Scan(
-		&user.ID, &user.Email, &user.GoogleID, &user.Name, &user.AvatarURL,
-		&user.Role, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
-	)
-
-	if err != nil {
+	user, err := h.changeUser(ctx, userID, "USER_DEACTIVATED", query, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Failed to deactivate user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.authService.RevokeUserTokens(ctx, userID); err != nil {
+		http.Error(w, "Failed to revoke user's tokens", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
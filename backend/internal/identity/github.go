@@ -0,0 +1,124 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+const githubAPIURL = "https://api.github.com"
+
+// githubProvider signs users in with a GitHub OAuth app. GitHub has no ID
+// tokens, so the user is read from its REST API.
+type githubProvider struct {
+	cfg    config.ProviderConfig
+	oauth2 *oauth2.Config
+}
+
+type githubUser struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+func newGitHubProvider(cfg config.ProviderConfig) *githubProvider {
+	return &githubProvider{
+		cfg: cfg,
+		oauth2: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+			Endpoint:     github.Endpoint,
+		},
+	}
+}
+
+func (p *githubProvider) Name() string        { return p.cfg.Name }
+func (p *githubProvider) DisplayName() string { return p.cfg.DisplayName }
+
+func (p *githubProvider) AuthCodeURL(req AuthRequest) (string, error) {
+	return p.oauth2.AuthCodeURL(req.State, oauth2.S256ChallengeOption(req.CodeVerifier)), nil
+}
+
+func (p *githubProvider) Exchange(ctx context.Context, code string, req AuthRequest) (*models.ExternalIdentity, error) {
+	ctx = oauth2Context(ctx)
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(req.CodeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+
+	client := p.oauth2.Client(ctx, token)
+
+	var user githubUser
+	if err := getJSON(ctx, client, githubAPIURL+"/user", &user); err != nil {
+		return nil, fmt.Errorf("failed to get user info: %w", err)
+	}
+
+	// The profile email is optional and may be unverified, so use the
+	// primary address from the emails API
+	var emails []githubEmail
+	if err := getJSON(ctx, client, githubAPIURL+"/user/emails", &emails); err != nil {
+		return nil, fmt.Errorf("failed to get user emails: %w", err)
+	}
+
+	identity := &models.ExternalIdentity{
+		Provider: p.cfg.Name,
+		Subject:  strconv.FormatInt(user.ID, 10),
+		Name:     user.Name,
+		Picture:  user.AvatarURL,
+	}
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+			break
+		}
+	}
+
+	if identity.Email == "" {
+		return nil, fmt.Errorf("%s did not return an email address", p.cfg.Name)
+	}
+
+	return identity, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,129 @@
+// Package identity signs users in with upstream identity providers such as
+// Google, GitHub or any OpenID Connect provider.
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"golang.org/x/oauth2"
+)
+
+// ErrUnknownProvider is returned for a provider name that is not configured
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// httpClient is used for all calls to upstream providers
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Provider is an upstream identity provider users can sign in with
+type Provider interface {
+	// Name identifies the provider in URLs and in user_identities
+	Name() string
+
+	// DisplayName is shown on login buttons
+	DisplayName() string
+
+	// AuthCodeURL returns the URL to send the user to for login
+	AuthCodeURL(req AuthRequest) (string, error)
+
+	// Exchange redeems the authorization code the provider sent back and
+	// returns who the user is
+	Exchange(ctx context.Context, code string, req AuthRequest) (*models.ExternalIdentity, error)
+}
+
+// AuthRequest is the per-login state that has to survive the round trip to
+// the provider
+type AuthRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// NewAuthRequest returns an AuthRequest with fresh random values
+func NewAuthRequest() (AuthRequest, error) {
+	state, err := randomString(16)
+	if err != nil {
+		return AuthRequest{}, fmt.Errorf("failed to generate state: %w", err)
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		return AuthRequest{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return AuthRequest{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+	}, nil
+}
+
+// Registry holds the configured providers
+type Registry struct {
+	providers map[string]Provider
+	order     []Provider
+}
+
+// NewRegistry creates a provider for each configured one. OIDC providers are
+// discovered on first use so a provider being down does not stop startup.
+func NewRegistry(cfgs []config.ProviderConfig) (*Registry, error) {
+	r := &Registry{providers: make(map[string]Provider, len(cfgs))}
+
+	for _, cfg := range cfgs {
+		var p Provider
+		switch cfg.Type {
+		case config.ProviderTypeOIDC:
+			p = newOIDCProvider(cfg)
+		case config.ProviderTypeGitHub:
+			p = newGitHubProvider(cfg)
+		default:
+			return nil, fmt.Errorf("provider %s has unsupported type %q", cfg.Name, cfg.Type)
+		}
+
+		r.providers[cfg.Name] = p
+		r.order = append(r.order, p)
+	}
+
+	if len(r.order) == 0 {
+		return nil, fmt.Errorf("no identity providers configured")
+	}
+
+	return r, nil
+}
+
+// Get returns the provider called name
+func (r *Registry) Get(name string) (Provider, error) {
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// Default returns the provider used when a login does not name one
+func (r *Registry) Default() Provider {
+	return r.order[0]
+}
+
+// List returns the providers in configured order
+func (r *Registry) List() []Provider {
+	return r.order
+}
+
+func oauth2Context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
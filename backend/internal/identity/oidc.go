@@ -0,0 +1,148 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/models"
+	"golang.org/x/oauth2"
+)
+
+// oidcProvider signs users in with an OpenID Connect provider found through
+// discovery at its issuer URL
+type oidcProvider struct {
+	cfg config.ProviderConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+type oidcClaims struct {
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Name          string      `json:"name"`
+	Picture       string      `json:"picture"`
+}
+
+func newOIDCProvider(cfg config.ProviderConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg}
+}
+
+func (p *oidcProvider) Name() string        { return p.cfg.Name }
+func (p *oidcProvider) DisplayName() string { return p.cfg.DisplayName }
+
+// discover fetches the provider's discovery document the first time it is
+// needed, retrying on later calls if that fails
+func (p *oidcProvider) discover() (*oidc.Provider, *oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider != nil {
+		return p.provider, p.oauth2, nil
+	}
+
+	// The key set keeps using this context to refetch keys, so it must not
+	// be tied to a request
+	ctx := oidc.ClientContext(context.Background(), httpClient)
+	provider, err := oidc.NewProvider(ctx, p.cfg.IssuerURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover %s: %w", p.cfg.Name, err)
+	}
+
+	p.provider = provider
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Scopes:       p.cfg.Scopes,
+		Endpoint:     provider.Endpoint(),
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.cfg.ClientID})
+
+	return p.provider, p.oauth2, nil
+}
+
+func (p *oidcProvider) AuthCodeURL(req AuthRequest) (string, error) {
+	_, oauth2Config, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	return oauth2Config.AuthCodeURL(req.State,
+		oidc.Nonce(req.Nonce),
+		oauth2.S256ChallengeOption(req.CodeVerifier),
+	), nil
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code string, req AuthRequest) (*models.ExternalIdentity, error) {
+	provider, oauth2Config, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := oauth2Config.Exchange(oauth2Context(ctx), code, oauth2.VerifierOption(req.CodeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify ID token: %w", err)
+	}
+	if idToken.Nonce != req.Nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode ID token claims: %w", err)
+	}
+
+	// Some providers only put profile claims in the UserInfo response
+	if claims.Email == "" && provider.UserInfoEndpoint() != "" {
+		userInfo, err := provider.UserInfo(oidc.ClientContext(ctx, httpClient), oauth2.StaticTokenSource(token))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user info: %w", err)
+		}
+		if userInfo.Subject != idToken.Subject {
+			return nil, fmt.Errorf("user info subject does not match ID token")
+		}
+		if err := userInfo.Claims(&claims); err != nil {
+			return nil, fmt.Errorf("failed to decode user info: %w", err)
+		}
+	}
+
+	if claims.Email == "" {
+		return nil, fmt.Errorf("%s did not return an email address", p.cfg.Name)
+	}
+
+	return &models.ExternalIdentity{
+		Provider:      p.cfg.Name,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: isTrue(claims.EmailVerified),
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+// isTrue reads a boolean claim, which some providers send as a string
+func isTrue(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
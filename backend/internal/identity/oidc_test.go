@@ -0,0 +1,334 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "test-client"
+	testClientSecret = "test-secret"
+	testCode         = "test-code"
+	testKeyID        = "test-key"
+)
+
+// testIssuer is an OpenID Connect provider serving discovery, keys, the
+// token endpoint and UserInfo
+type testIssuer struct {
+	*httptest.Server
+	t *testing.T
+
+	// key is published in the key set; tokens are signed with signingKey,
+	// which is key unless a test swaps it
+	key        *rsa.PrivateKey
+	signingKey *rsa.PrivateKey
+
+	// claims are added to the default ID token claims; a nil value removes
+	// one
+	claims   jwt.MapClaims
+	userInfo map[string]any
+
+	discoveryDown bool
+	codeVerifier  string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	iss := &testIssuer{t: t, key: key, signingKey: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", iss.discovery)
+	mux.HandleFunc("GET /keys", iss.keys)
+	mux.HandleFunc("POST /token", iss.token)
+	mux.HandleFunc("GET /userinfo", iss.userinfo)
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+
+	return iss
+}
+
+func (iss *testIssuer) provider() *oidcProvider {
+	return newOIDCProvider(config.ProviderConfig{
+		Name:         "test",
+		DisplayName:  "Test",
+		Type:         config.ProviderTypeOIDC,
+		IssuerURL:    iss.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  "https://auth.example.com/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+	})
+}
+
+func (iss *testIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	if iss.discoveryDown {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"issuer":                                iss.URL,
+		"authorization_endpoint":                iss.URL + "/authorize",
+		"token_endpoint":                        iss.URL + "/token",
+		"userinfo_endpoint":                     iss.URL + "/userinfo",
+		"jwks_uri":                              iss.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (iss *testIssuer) keys(w http.ResponseWriter, r *http.Request) {
+	pub := iss.key.PublicKey
+	writeJSON(w, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": testKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (iss *testIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != testClientID || secret != testClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != testCode {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	iss.codeVerifier = r.PostForm.Get("code_verifier")
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            iss.URL,
+		"sub":            "user-123",
+		"aud":            testClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada Lovelace",
+		"picture":        "https://example.com/ada.png",
+	}
+	for k, v := range iss.claims {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = testKeyID
+	idToken, err := token.SignedString(iss.signingKey)
+	if err != nil {
+		iss.t.Errorf("failed to sign ID token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"access_token": "test-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (iss *testIssuer) userinfo(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test-access-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, iss.userInfo)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := iss.provider()
+
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatalf("NewAuthRequest: %v", err)
+	}
+	raw, err := p.AuthCodeURL(req)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", raw, err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != iss.URL+"/authorize" {
+		t.Errorf("authorization endpoint = %s, want %s/authorize", got, iss.URL)
+	}
+
+	q := u.Query()
+	want := map[string]string{
+		"client_id":             testClientID,
+		"response_type":         "code",
+		"state":                 req.State,
+		"nonce":                 req.Nonce,
+		"code_challenge_method": "S256",
+		"scope":                 "openid email profile",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), v)
+		}
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge") == req.CodeVerifier {
+		t.Errorf("code_challenge = %q, want the S256 challenge of the verifier", q.Get("code_challenge"))
+	}
+}
+
+func TestOIDCDiscoveryRetries(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := iss.provider()
+	req := AuthRequest{State: "state", Nonce: "nonce", CodeVerifier: "verifier"}
+
+	iss.discoveryDown = true
+	if _, err := p.AuthCodeURL(req); err == nil {
+		t.Fatal("AuthCodeURL succeeded while discovery is down")
+	}
+
+	iss.discoveryDown = false
+	if _, err := p.AuthCodeURL(req); err != nil {
+		t.Fatalf("AuthCodeURL after discovery recovered: %v", err)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := iss.provider()
+
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatalf("NewAuthRequest: %v", err)
+	}
+	iss.claims = jwt.MapClaims{"nonce": req.Nonce}
+
+	identity, err := p.Exchange(context.Background(), testCode, req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	if iss.codeVerifier != req.CodeVerifier {
+		t.Errorf("code_verifier = %q, want %q", iss.codeVerifier, req.CodeVerifier)
+	}
+	if identity.Provider != "test" || identity.Subject != "user-123" {
+		t.Errorf("identity = %s/%s, want test/user-123", identity.Provider, identity.Subject)
+	}
+	if identity.Email != "ada@example.com" || !identity.EmailVerified {
+		t.Errorf("email = %q (verified %t), want ada@example.com (verified)", identity.Email, identity.EmailVerified)
+	}
+	if identity.Name != "Ada Lovelace" || identity.Picture != "https://example.com/ada.png" {
+		t.Errorf("profile = %q, %q", identity.Name, identity.Picture)
+	}
+}
+
+func TestOIDCExchangeUserInfo(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := iss.provider()
+	req := AuthRequest{State: "state", Nonce: "nonce", CodeVerifier: "verifier"}
+
+	iss.claims = jwt.MapClaims{"nonce": req.Nonce, "email": nil, "email_verified": nil}
+	iss.userInfo = map[string]any{
+		"sub":            "user-123",
+		"email":          "ada@example.com",
+		"email_verified": "true",
+	}
+
+	identity, err := p.Exchange(context.Background(), testCode, req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Email != "ada@example.com" || !identity.EmailVerified {
+		t.Errorf("email = %q (verified %t), want ada@example.com (verified)", identity.Email, identity.EmailVerified)
+	}
+
+	iss.userInfo["sub"] = "someone-else"
+	if _, err := p.Exchange(context.Background(), testCode, req); err == nil || !strings.Contains(err.Error(), "subject") {
+		t.Errorf("Exchange with another UserInfo subject = %v, want a subject mismatch", err)
+	}
+}
+
+func TestOIDCExchangeRejectsIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	req := AuthRequest{State: "state", Nonce: "nonce", CodeVerifier: "verifier"}
+
+	tests := []struct {
+		name       string
+		claims     jwt.MapClaims
+		signingKey *rsa.PrivateKey
+		code       string
+	}{
+		{name: "wrong nonce", claims: jwt.MapClaims{"nonce": "other"}},
+		{name: "no nonce", claims: jwt.MapClaims{}},
+		{name: "wrong audience", claims: jwt.MapClaims{"nonce": req.Nonce, "aud": "other-client"}},
+		{name: "wrong issuer", claims: jwt.MapClaims{"nonce": req.Nonce, "iss": "https://evil.example.com"}},
+		{name: "expired", claims: jwt.MapClaims{"nonce": req.Nonce, "exp": time.Now().Add(-time.Hour).Unix()}},
+		{name: "unknown key", claims: jwt.MapClaims{"nonce": req.Nonce}, signingKey: otherKey},
+		{name: "no email", claims: jwt.MapClaims{"nonce": req.Nonce, "email": nil}},
+		{name: "invalid code", claims: jwt.MapClaims{"nonce": req.Nonce}, code: "other-code"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss := newTestIssuer(t)
+			p := iss.provider()
+			iss.claims = tt.claims
+			iss.userInfo = map[string]any{"sub": "user-123"}
+			if tt.signingKey != nil {
+				iss.signingKey = tt.signingKey
+			}
+			code := testCode
+			if tt.code != "" {
+				code = tt.code
+			}
+
+			if identity, err := p.Exchange(context.Background(), code, req); err == nil {
+				t.Errorf("Exchange = %+v, want an error", identity)
+			}
+		})
+	}
+}
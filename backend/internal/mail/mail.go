@@ -0,0 +1,200 @@
+// Package mail sends transactional email such as password reset links,
+// rendered from templates.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+)
+
+// sendTimeout bounds a whole SMTP conversation
+const sendTimeout = 30 * time.Second
+
+// Message is a plain text email to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer delivers messages. Implementations are SMTPMailer, LogMailer and
+// MemoryMailer for tests.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// New returns the service's mailer: templates from MAIL_TEMPLATES_DIR or
+// the built-in ones, sent over SMTP when SMTP_HOST is configured and
+// otherwise only logged
+func New(cfg *config.Config) (*TemplateMailer, error) {
+	templates, err := LoadTemplates(cfg.MailTemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SMTPHost == "" {
+		if cfg.Env == "production" {
+			log.Println("Warning: SMTP_HOST is not set, emails will not be sent")
+		}
+		// Outside production the log doubles as the inbox
+		return &TemplateMailer{
+			Mailer:    &LogMailer{IncludeText: cfg.Env != "production"},
+			Templates: templates,
+		}, nil
+	}
+
+	from, err := mail.ParseAddress(cfg.MailFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+
+	return &TemplateMailer{
+		Mailer: &SMTPMailer{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     from,
+		},
+		Templates: templates,
+	}, nil
+}
+
+// LogMailer writes messages to the log instead of sending them
+type LogMailer struct {
+	// IncludeText logs message bodies, which contain secret links
+	IncludeText bool
+}
+
+func (m *LogMailer) Send(_ context.Context, msg *Message) error {
+	if m.IncludeText {
+		log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	} else {
+		log.Printf("Email to %s not sent: %s", msg.To, msg.Subject)
+	}
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP server, upgrading to TLS with
+// STARTTLS when the server offers it
+type SMTPMailer struct {
+	// Addr is the server's host:port
+	Addr string
+
+	// Username and Password enable PLAIN authentication, which is only
+	// attempted over TLS or to localhost
+	Username string
+	Password string
+
+	From *mail.Address
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	data, err := m.format(to, msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(m.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	if err := client.Mail(m.From.Address); err != nil {
+		return fmt.Errorf("failed to send MAIL: %w", err)
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("failed to send RCPT: %w", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send DATA: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// format renders msg as an RFC 5322 message with a quoted-printable body
+func (m *SMTPMailer) format(to *mail.Address, msg *Message) ([]byte, error) {
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, errors.New("invalid subject")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(m.From.Address, "@")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(msg.Text, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
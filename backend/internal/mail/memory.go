@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryMailer keeps sent messages in memory, for tests
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+	sent     chan struct{}
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{sent: make(chan struct{})}
+}
+
+func (m *MemoryMailer) Send(_ context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, *msg)
+
+	// Wake up everyone waiting in Wait
+	close(m.sent)
+	m.sent = make(chan struct{})
+	return nil
+}
+
+// Messages returns the messages sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
+
+// Wait returns the latest message to to, waiting for one to be sent if
+// there is none yet. The service sends emails in the background, so tests
+// use this rather than Messages.
+func (m *MemoryMailer) Wait(ctx context.Context, to string) (*Message, error) {
+	for {
+		m.mu.Lock()
+		for i := len(m.messages) - 1; i >= 0; i-- {
+			if m.messages[i].To == to {
+				msg := m.messages[i]
+				m.mu.Unlock()
+				return &msg, nil
+			}
+		}
+		sent := m.sent
+		m.mu.Unlock()
+
+		select {
+		case <-sent:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Reset forgets all messages
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = nil
+}
@@ -0,0 +1,146 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Templates of the emails the service sends, named after their file
+// without the .txt extension
+const (
+	TemplateVerifyEmail   = "verify_email"
+	TemplateAccountExists = "account_exists"
+	TemplatePasswordReset = "password_reset"
+	TemplateMagicLink     = "magic_link"
+	TemplateLoginCode     = "login_code"
+
+	TemplateOrganizationInvite = "organization_invite"
+)
+
+//go:embed templates/*.txt
+var defaultTemplates embed.FS
+
+// TemplateData is passed to the built-in templates
+type TemplateData struct {
+	// URL is the link to follow, if any
+	URL string
+
+	// Code is a one-time code to enter, if any
+	Code string
+
+	// ExpiresIn is how long the link or code stays valid
+	ExpiresIn time.Duration
+
+	// Organization is the name of the organization the email is about, if
+	// any
+	Organization string
+}
+
+// funcs are available in templates
+var funcs = template.FuncMap{
+	// duration formats a duration in words, e.g. "30 minutes"
+	"duration": formatDuration,
+}
+
+// Templates render emails. Each template is a text/template file whose
+// "subject" block is the subject and whose remaining text is the body.
+type Templates struct {
+	sets map[string]*template.Template
+}
+
+// LoadTemplates parses the built-in templates. Files in dir, if set,
+// replace the built-in template with the same name.
+func LoadTemplates(dir string) (*Templates, error) {
+	builtIn, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{sets: map[string]*template.Template{}}
+	if err := t.parse(builtIn); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := t.parse(os.DirFS(dir)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Templates) parse(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*.txt")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".txt")
+		set, err := template.New(path.Base(file)).Funcs(funcs).Option("missingkey=error").ParseFS(fsys, file)
+		if err != nil {
+			return fmt.Errorf("failed to parse email template %s: %w", file, err)
+		}
+		if set.Lookup("subject") == nil {
+			return fmt.Errorf("email template %s has no subject", file)
+		}
+		t.sets[name] = set
+	}
+	return nil
+}
+
+// Render returns the message for template name with data, addressed to to
+func (t *Templates) Render(name, to string, data any) (*Message, error) {
+	set, ok := t.sets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %q", name)
+	}
+
+	var subject, body bytes.Buffer
+	if err := set.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s subject: %w", name, err)
+	}
+	if err := set.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s: %w", name, err)
+	}
+
+	return &Message{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    body.String(),
+	}, nil
+}
+
+// TemplateMailer sends emails rendered from templates
+type TemplateMailer struct {
+	Mailer    Mailer
+	Templates *Templates
+}
+
+// Send renders template name with data and sends it to to
+func (m *TemplateMailer) Send(ctx context.Context, to, name string, data any) error {
+	msg, err := m.Templates.Render(name, to, data)
+	if err != nil {
+		return err
+	}
+	return m.Mailer.Send(ctx, msg)
+}
+
+func formatDuration(d time.Duration) string {
+	unit, n := "minute", int(d.Round(time.Minute)/time.Minute)
+	if d >= 2*time.Hour && d%time.Hour == 0 {
+		unit, n = "hour", int(d/time.Hour)
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return strconv.Itoa(n) + " " + unit + "s"
+}
@@ -0,0 +1,60 @@
+// Package metrics counts events in the service and serves the counts in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	mu       sync.Mutex
+	counters []*Counter
+)
+
+// Counter is a count that only goes up
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+// NewCounter registers a counter served as name, which by convention ends
+// in _total
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+
+	mu.Lock()
+	defer mu.Unlock()
+	counters = append(counters, c)
+	return c
+}
+
+// Inc adds one to the count
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Value returns the count
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Handler serves every registered counter
+func Handler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	list := slices.Clone(counters)
+	mu.Unlock()
+	slices.SortFunc(list, func(a, b *Counter) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range list {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+	}
+}
@@ -2,11 +2,13 @@ package middleware
 
 import (
 	"context"
-	"crypto/rsa"
 	"net/http"
+	"slices"
 	"strings"
 
+	"github.com/frans-sjostrom/auth-service/internal/audit"
 	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/google/uuid"
 )
 
 type contextKey string
@@ -16,9 +18,30 @@ const (
 	EmailKey  contextKey = "email"
 	NameKey   contextKey = "name"
 	RoleKey   contextKey = "role"
+	ScopeKey  contextKey = "scope"
+	AMRKey    contextKey = "amr"
+
+	// ClientIDKey holds the client_id of the application a token was
+	// issued to, empty for first-party tokens
+	ClientIDKey contextKey = "clientID"
+
+	PermissionsKey  contextKey = "permissions"
+	TokenVersionKey contextKey = "tokenVersion"
+	OrgIDKey        contextKey = "orgID"
+	OrgRoleKey      contextKey = "orgRole"
+	SessionIDKey    contextKey = "sessionID"
 )
 
-func AuthMiddleware(publicKey *rsa.PublicKey) func(http.Handler) http.Handler {
+// RevocationList reports whether an access token was revoked before it
+// expired. The auth service's denylist and a revocation.Subscriber
+// following its stream both implement it.
+type RevocationList interface {
+	IsRevoked(ctx context.Context, claims *customJWT.Claims) (bool, error)
+}
+
+// AuthMiddleware validates the bearer token against keys, selecting the
+// verification key by the token's kid header, and rejects revoked tokens
+func AuthMiddleware(keys customJWT.KeyLookup, revoked RevocationList) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -34,35 +57,116 @@ func AuthMiddleware(publicKey *rsa.PublicKey) func(http.Handler) http.Handler {
 			}
 
 			tokenString := parts[1]
-			claims, err := customJWT.ValidateAccessToken(tokenString, publicKey)
+			claims, err := customJWT.ValidateAccessToken(tokenString, keys)
 			if err != nil {
 				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 				return
 			}
 
+			isRevoked, err := revoked.IsRevoked(r.Context(), claims)
+			if err != nil {
+				http.Error(w, "Failed to check token revocation", http.StatusInternalServerError)
+				return
+			}
+			if isRevoked {
+				http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+				return
+			}
+
 			ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
 			ctx = context.WithValue(ctx, EmailKey, claims.Email)
 			ctx = context.WithValue(ctx, NameKey, claims.Name)
 			ctx = context.WithValue(ctx, RoleKey, claims.Role)
+			ctx = context.WithValue(ctx, ScopeKey, claims.Scope)
+			ctx = context.WithValue(ctx, ClientIDKey, tokenClientID(claims))
+			ctx = context.WithValue(ctx, AMRKey, claims.AMR)
+			ctx = context.WithValue(ctx, PermissionsKey, claims.Permissions)
+			ctx = context.WithValue(ctx, TokenVersionKey, claims.TokenVersion)
+			ctx = context.WithValue(ctx, OrgIDKey, claims.OrgID)
+			ctx = context.WithValue(ctx, OrgRoleKey, claims.OrgRole)
+			ctx = context.WithValue(ctx, SessionIDKey, claims.SessionID)
+			ctx = audit.WithActor(ctx, claims.UserID)
 
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-// AdminMiddleware ensures the authenticated user is an admin
-// Must be used after AuthMiddleware
-func AdminMiddleware() func(http.Handler) http.Handler {
+// tokenClientID returns the application a token was issued to, from its
+// audience
+func tokenClientID(claims *customJWT.Claims) string {
+	if len(claims.Audience) == 0 {
+		return ""
+	}
+	return claims.Audience[0]
+}
+
+// FirstPartyMiddleware rejects tokens issued to applications, which are
+// only good for the endpoints their scopes grant, such as /userinfo. Must
+// be used after AuthMiddleware.
+func FirstPartyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, _ := r.Context().Value(ClientIDKey).(string)
+		scope, _ := r.Context().Value(ScopeKey).(string)
+
+		if clientID != "" || scope != "" {
+			http.Error(w, "Token was issued to an application", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TokenVersionSource returns a user's current token version. TokenVersion
+// may serve a cached version; ReloadTokenVersion must not.
+type TokenVersionSource interface {
+	TokenVersion(ctx context.Context, userID uuid.UUID) (int, error)
+	ReloadTokenVersion(ctx context.Context, userID uuid.UUID) (int, error)
+}
+
+// TokenVersionMiddleware rejects tokens issued before their user's token
+// version was bumped, for example by a role change or deactivation, so they
+// stop working without waiting for the denylist or for them to expire. A
+// token newer than the cached version was issued after a bump, so the
+// version is reloaded rather than rejecting it. Must be used after
+// AuthMiddleware.
+func TokenVersionMiddleware(versions TokenVersionSource) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			role, ok := r.Context().Value(RoleKey).(string)
-			if !ok {
-				http.Error(w, "Role not found in context", http.StatusInternalServerError)
+			userID, _ := r.Context().Value(UserIDKey).(uuid.UUID)
+			tokenVersion, _ := r.Context().Value(TokenVersionKey).(int)
+
+			current, err := versions.TokenVersion(r.Context(), userID)
+			if err != nil {
+				http.Error(w, "Failed to check token version", http.StatusInternalServerError)
+				return
+			}
+			if tokenVersion > current {
+				current, err = versions.ReloadTokenVersion(r.Context(), userID)
+				if err != nil {
+					http.Error(w, "Failed to check token version", http.StatusInternalServerError)
+					return
+				}
+			}
+			// Unknown users have version -1
+			if current < 0 || tokenVersion < current {
+				http.Error(w, "Token has been invalidated", http.StatusUnauthorized)
 				return
 			}
 
-			if role != "admin" {
-				http.Error(w, "Admin access required", http.StatusForbidden)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequirePermission ensures the authenticated user's role grants
+// permission. Must be used after AuthMiddleware.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasPermission(r.Context(), permission) {
+				http.Error(w, "Permission required: "+permission, http.StatusForbidden)
 				return
 			}
 
@@ -71,10 +175,28 @@ func AdminMiddleware() func(http.Handler) http.Handler {
 	}
 }
 
-// IsAdmin checks if the user is an admin
-func IsAdmin(ctx context.Context) bool {
-	role, ok := ctx.Value(RoleKey).(string)
-	return ok && role == "admin"
+// MFAMiddleware rejects tokens of users in one of requiredRoles that were
+// issued without a second factor. Must be used after AuthMiddleware.
+func MFAMiddleware(requiredRoles []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(RoleKey).(string)
+			amr, _ := r.Context().Value(AMRKey).([]string)
+
+			if slices.Contains(requiredRoles, role) && !slices.Contains(amr, "mfa") {
+				http.Error(w, "Multi-factor authentication required", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HasPermission reports whether the user's token grants permission
+func HasPermission(ctx context.Context, permission string) bool {
+	permissions, _ := ctx.Value(PermissionsKey).([]string)
+	return slices.Contains(permissions, permission)
 }
 
 // GetRole returns the user's role from context
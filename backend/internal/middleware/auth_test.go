@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// cachedVersions serves a cached token version until it is reloaded, like
+// auth.TokenVersions right after a bump
+type cachedVersions struct {
+	cached, current int
+	reloads         int
+}
+
+func (v *cachedVersions) TokenVersion(ctx context.Context, userID uuid.UUID) (int, error) {
+	return v.cached, nil
+}
+
+func (v *cachedVersions) ReloadTokenVersion(ctx context.Context, userID uuid.UUID) (int, error) {
+	v.reloads++
+	v.cached = v.current
+	return v.current, nil
+}
+
+func serveTokenVersion(versions TokenVersionSource, tokenVersion int) int {
+	handler := TokenVersionMiddleware(versions)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ctx := context.WithValue(context.Background(), UserIDKey, uuid.New())
+	ctx = context.WithValue(ctx, TokenVersionKey, tokenVersion)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/user", nil).WithContext(ctx))
+	return rec.Code
+}
+
+func TestTokenVersionMiddleware(t *testing.T) {
+	tests := []struct {
+		name            string
+		cached, current int
+		tokenVersion    int
+		want            int
+		wantReloads     int
+	}{
+		{name: "current", cached: 3, current: 3, tokenVersion: 3, want: http.StatusOK},
+		{name: "issued before a bump", cached: 4, current: 4, tokenVersion: 3, want: http.StatusUnauthorized},
+		{name: "issued right after a bump", cached: 3, current: 4, tokenVersion: 4, want: http.StatusOK, wantReloads: 1},
+		{name: "unknown user", cached: -1, current: -1, tokenVersion: 0, want: http.StatusUnauthorized, wantReloads: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions := &cachedVersions{cached: tt.cached, current: tt.current}
+			if got := serveTokenVersion(versions, tt.tokenVersion); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+			if versions.reloads != tt.wantReloads {
+				t.Errorf("reloads = %d, want %d", versions.reloads, tt.wantReloads)
+			}
+		})
+	}
+}
+
+func TestTokenVersionMiddlewareReloadsOnce(t *testing.T) {
+	versions := &cachedVersions{cached: 0, current: 1}
+
+	// The first request with a new token reloads the version; later ones
+	// find it cached
+	for range 3 {
+		if got := serveTokenVersion(versions, 1); got != http.StatusOK {
+			t.Fatalf("status = %d, want %d", got, http.StatusOK)
+		}
+	}
+	if versions.reloads != 1 {
+		t.Errorf("reloads = %d, want 1", versions.reloads)
+	}
+	if got := serveTokenVersion(versions, 0); got != http.StatusUnauthorized {
+		t.Errorf("token from before the bump: status = %d, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+func TestFirstPartyMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		scope    string
+		want     int
+	}{
+		{name: "first-party", want: http.StatusOK},
+		{name: "issued to an application", clientID: "app", scope: "openid email", want: http.StatusForbidden},
+		{name: "audience without scope", clientID: "app", want: http.StatusForbidden},
+		{name: "scope without audience", scope: "openid", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := FirstPartyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			ctx := context.WithValue(context.Background(), ClientIDKey, tt.clientID)
+			ctx = context.WithValue(ctx, ScopeKey, tt.scope)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/auth/me", nil).WithContext(ctx))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/audit"
+	"github.com/frans-sjostrom/auth-service/internal/metrics"
+	"github.com/frans-sjostrom/auth-service/internal/ratelimit"
+	"github.com/google/uuid"
+)
+
+var rateLimited = metrics.NewCounter("auth_rate_limited_total", "Requests rejected by a rate limit.")
+
+// RateLimitRule limits the requests sharing a key, such as the client's IP
+// address. Requests for which Key returns "" are not limited by the rule,
+// and a rule with a zero Limit limits nothing.
+type RateLimitRule struct {
+	// Name tells the rule's buckets apart from other rules' and is recorded
+	// in the audit log
+	Name  string
+	Limit ratelimit.Limit
+	Key   func(r *http.Request) string
+}
+
+// KeyByIP limits each client IP address; it goes after RealIP
+func KeyByIP(r *http.Request) string {
+	return audit.ClientIP(r.RemoteAddr)
+}
+
+// KeyByUser limits each signed-in user; it goes after AuthMiddleware
+func KeyByUser(r *http.Request) string {
+	if userID, ok := r.Context().Value(UserIDKey).(uuid.UUID); ok {
+		return userID.String()
+	}
+	return ""
+}
+
+// ClientRegistry reports whether a client_id names an active application.
+// auth.OriginRegistry implements it.
+type ClientRegistry interface {
+	IsClient(clientID string) bool
+}
+
+// KeyByClient limits each registered application, named by HTTP Basic or a
+// client_id parameter. Requests naming unknown clients are not limited by
+// it, so made-up client ids cannot fill the store with buckets. The client
+// is not authenticated, so pair it with a rule by IP address.
+func KeyByClient(clients ClientRegistry) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		clientID, _, ok := r.BasicAuth()
+		if !ok {
+			clientID = r.FormValue("client_id")
+		}
+		if clientID == "" || !clients.IsClient(clientID) {
+			return ""
+		}
+		return clientID
+	}
+}
+
+// RefreshTokenOwners looks up who a refresh token was issued to.
+// auth.Service implements it.
+type RefreshTokenOwners interface {
+	RefreshTokenOwner(ctx context.Context, refreshToken string) (userID uuid.UUID, clientID string, err error)
+}
+
+// KeyByRefreshTokenUser limits each user refreshing with the refresh_token
+// cookie, whichever address the requests come from. Replays of rotated
+// tokens count too.
+func KeyByRefreshTokenUser(owners RefreshTokenOwners) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		userID, _, ok := refreshTokenOwner(r, owners)
+		if !ok {
+			return ""
+		}
+		return userID.String()
+	}
+}
+
+// KeyByRefreshTokenClient limits each application whose refresh tokens are
+// refreshed with the refresh_token cookie
+func KeyByRefreshTokenClient(owners RefreshTokenOwners) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		_, clientID, _ := refreshTokenOwner(r, owners)
+		return clientID
+	}
+}
+
+// refreshTokenOwner looks up the owner of the request's refresh_token
+// cookie. Requests without a known one are left to the rules by IP address.
+func refreshTokenOwner(r *http.Request, owners RefreshTokenOwners) (uuid.UUID, string, bool) {
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		return uuid.Nil, "", false
+	}
+	userID, clientID, err := owners.RefreshTokenOwner(r.Context(), cookie.Value)
+	if err != nil {
+		return uuid.Nil, "", false
+	}
+	return userID, clientID, true
+}
+
+// RateLimiter rejects requests over their limits with 429 Too Many Requests
+// and a Retry-After header. Requests are still served when the limiter
+// fails, so that its store being down does not take sign-in with it.
+type RateLimiter struct {
+	limiter ratelimit.Limiter
+	db      audit.DB
+
+	// recorded holds when each limited key may be recorded in the audit log
+	// again, so that a flood of requests is recorded once per window
+	mu       sync.Mutex
+	recorded map[string]time.Time
+}
+
+func NewRateLimiter(limiter ratelimit.Limiter, db audit.DB) *RateLimiter {
+	return &RateLimiter{limiter: limiter, db: db, recorded: make(map[string]time.Time)}
+}
+
+// Limit applies rules to every request, each with its own buckets
+func (l *RateLimiter) Limit(rules ...RateLimitRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, rule := range rules {
+				if rule.Limit.Requests == 0 {
+					continue
+				}
+				key := rule.Key(r)
+				if key == "" {
+					continue
+				}
+				key = rule.Name + ":" + key
+
+				retryAfter, err := l.limiter.Allow(r.Context(), key, rule.Limit)
+				if err != nil {
+					log.Printf("Warning: rate limit %s failed: %v", rule.Name, err)
+					continue
+				}
+				if retryAfter > 0 {
+					rateLimited.Inc()
+					l.record(r, rule, key)
+
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(w, "Too many requests", http.StatusTooManyRequests)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// record writes RATE_LIMITED to the audit log, unless key was recorded less
+// than its rule's window ago
+func (l *RateLimiter) record(r *http.Request, rule RateLimitRule, key string) {
+	now := time.Now()
+
+	l.mu.Lock()
+	if until, ok := l.recorded[key]; ok && now.Before(until) {
+		l.mu.Unlock()
+		return
+	}
+	l.recorded[key] = now.Add(rule.Limit.Per)
+	for k, until := range l.recorded {
+		if now.After(until) {
+			delete(l.recorded, k)
+		}
+	}
+	l.mu.Unlock()
+
+	var userID *uuid.UUID
+	if id, ok := r.Context().Value(UserIDKey).(uuid.UUID); ok {
+		userID = &id
+	}
+	// audit.Record logs and counts failures
+	_ = audit.Record(r.Context(), l.db, audit.Event{
+		Action:     "RATE_LIMITED",
+		UserID:     userID,
+		TargetType: audit.TargetRateLimit,
+		TargetID:   rule.Name,
+	})
+}
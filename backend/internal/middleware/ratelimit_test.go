@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/ratelimit"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// stubLimiter answers every Allow with retryAfter and err, recording the
+// keys it was asked about
+type stubLimiter struct {
+	retryAfter time.Duration
+	err        error
+	keys       []string
+}
+
+func (l *stubLimiter) Allow(ctx context.Context, key string, limit ratelimit.Limit) (time.Duration, error) {
+	l.keys = append(l.keys, key)
+	return l.retryAfter, l.err
+}
+
+func (l *stubLimiter) Run(ctx context.Context, interval time.Duration) {}
+
+// noAuditDB fails to record audit events, which the rate limiter ignores
+type noAuditDB struct{}
+
+func (noAuditDB) Begin(ctx context.Context) (pgx.Tx, error) {
+	return nil, errors.New("no database")
+}
+
+var testRule = RateLimitRule{
+	Name:  "test",
+	Limit: ratelimit.Limit{Requests: 1, Per: time.Minute},
+	Key:   func(r *http.Request) string { return "key" },
+}
+
+func serveLimited(limiter ratelimit.Limiter, rules ...RateLimitRule) *httptest.ResponseRecorder {
+	handler := NewRateLimiter(limiter, noAuditDB{}).Limit(rules...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil))
+	return rec
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		want       string
+	}{
+		{name: "whole seconds", retryAfter: 6 * time.Second, want: "6"},
+		{name: "rounded up", retryAfter: 5*time.Second + time.Millisecond, want: "6"},
+		{name: "less than a second", retryAfter: time.Millisecond, want: "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveLimited(&stubLimiter{retryAfter: tt.retryAfter}, testRule)
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.want {
+				t.Errorf("Retry-After = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllows(t *testing.T) {
+	limiter := &stubLimiter{}
+	other := testRule
+	other.Name = "other"
+
+	rec := serveLimited(limiter, testRule, other)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Header().Get("Retry-After") != "" {
+		t.Error("Retry-After set on an allowed request")
+	}
+	// Each rule has its own buckets
+	if want := []string{"test:key", "other:key"}; strings.Join(limiter.keys, ",") != strings.Join(want, ",") {
+		t.Errorf("keys = %v, want %v", limiter.keys, want)
+	}
+}
+
+func TestRateLimiterFailsOpen(t *testing.T) {
+	rec := serveLimited(&stubLimiter{retryAfter: time.Second, err: errors.New("store down")}, testRule)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status with a failing store = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimiterSkipsRules(t *testing.T) {
+	noLimit := testRule
+	noLimit.Limit = ratelimit.Limit{}
+	noKey := testRule
+	noKey.Key = func(r *http.Request) string { return "" }
+
+	limiter := &stubLimiter{retryAfter: time.Second}
+	if rec := serveLimited(limiter, noLimit, noKey); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if len(limiter.keys) != 0 {
+		t.Errorf("limiter asked about %v", limiter.keys)
+	}
+}
+
+// clientSet is a ClientRegistry of fixed client ids
+type clientSet map[string]bool
+
+func (c clientSet) IsClient(clientID string) bool {
+	return c[clientID]
+}
+
+func TestKeyByClient(t *testing.T) {
+	key := KeyByClient(clientSet{"app": true})
+
+	form := func(clientID string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(url.Values{"client_id": {clientID}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	basic := func(clientID string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/token", nil)
+		r.SetBasicAuth(clientID, "secret")
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want string
+	}{
+		{name: "form", r: form("app"), want: "app"},
+		{name: "basic", r: basic("app"), want: "app"},
+		{name: "query", r: httptest.NewRequest(http.MethodGet, "/authorize?client_id=app", nil), want: "app"},
+		{name: "unknown client", r: form("made-up"), want: ""},
+		{name: "unknown basic client", r: basic("made-up"), want: ""},
+		{name: "no client", r: httptest.NewRequest(http.MethodGet, "/authorize", nil), want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := key(tt.r); got != tt.want {
+				t.Errorf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// refreshTokens is RefreshTokenOwners for a fixed set of tokens
+type refreshTokens map[string]struct {
+	userID   uuid.UUID
+	clientID string
+}
+
+func (tokens refreshTokens) RefreshTokenOwner(ctx context.Context, refreshToken string) (uuid.UUID, string, error) {
+	owner, ok := tokens[refreshToken]
+	if !ok {
+		return uuid.Nil, "", errors.New("refresh token not found")
+	}
+	return owner.userID, owner.clientID, nil
+}
+
+func TestKeyByRefreshToken(t *testing.T) {
+	userID := uuid.New()
+	tokens := refreshTokens{
+		"first-party": {userID: userID},
+		"app":         {userID: userID, clientID: "app"},
+	}
+	byUser := KeyByRefreshTokenUser(tokens)
+	byClient := KeyByRefreshTokenClient(tokens)
+
+	tests := []struct {
+		name       string
+		cookie     string
+		wantUser   string
+		wantClient string
+	}{
+		{name: "first-party", cookie: "first-party", wantUser: userID.String()},
+		{name: "issued to an application", cookie: "app", wantUser: userID.String(), wantClient: "app"},
+		{name: "unknown token", cookie: "made-up"},
+		{name: "no cookie"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "refresh_token", Value: tt.cookie})
+			}
+			if got := byUser(r); got != tt.wantUser {
+				t.Errorf("user key = %q, want %q", got, tt.wantUser)
+			}
+			if got := byClient(r); got != tt.wantClient {
+				t.Errorf("client key = %q, want %q", got, tt.wantClient)
+			}
+		})
+	}
+}
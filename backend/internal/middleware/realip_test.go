@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:4321", want: "203.0.113.7"},
+		{
+			name:         "untrusted peer spoofing X-Forwarded-For",
+			remoteAddr:   "203.0.113.7:4321",
+			forwardedFor: []string{"198.51.100.1"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer spoofing X-Real-IP",
+			remoteAddr: "203.0.113.7:4321",
+			realIP:     "198.51.100.1",
+			want:       "203.0.113.7",
+		},
+		{
+			name:         "one trusted proxy",
+			remoteAddr:   "10.0.0.2:4321",
+			forwardedFor: []string{"203.0.113.7"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "client spoofing hops before the proxy",
+			remoteAddr:   "10.0.0.2:4321",
+			forwardedFor: []string{"198.51.100.1, 203.0.113.7"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "several trusted proxies",
+			remoteAddr:   "10.0.0.2:4321",
+			forwardedFor: []string{"198.51.100.1, 203.0.113.7, 10.0.0.5", "10.0.0.3"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "only trusted hops",
+			remoteAddr:   "10.0.0.2:4321",
+			forwardedFor: []string{"10.0.0.4, 10.0.0.3"},
+			want:         "10.0.0.4",
+		},
+		{
+			name:         "malformed hop",
+			remoteAddr:   "10.0.0.2:4321",
+			forwardedFor: []string{"203.0.113.7, not-an-ip, 10.0.0.3"},
+			want:         "10.0.0.3",
+		},
+		{
+			name:       "X-Real-IP from a trusted proxy",
+			remoteAddr: "10.0.0.2:4321",
+			realIP:     "203.0.113.7",
+			want:       "203.0.113.7",
+		},
+		{
+			name:         "X-Forwarded-For wins over X-Real-IP",
+			remoteAddr:   "10.0.0.2:4321",
+			forwardedFor: []string{"203.0.113.7"},
+			realIP:       "198.51.100.1",
+			want:         "203.0.113.7",
+		},
+		{name: "trusted proxy without headers", remoteAddr: "10.0.0.2:4321", want: "10.0.0.2"},
+		{name: "IPv6 client", remoteAddr: "[2001:db8::1]:4321", want: "2001:db8::1"},
+		{
+			name:         "IPv6 proxy and client",
+			remoteAddr:   "[fd00::2]:4321",
+			forwardedFor: []string{"2001:db8::7, fd00::3"},
+			want:         "2001:db8::7",
+		},
+		{
+			name:         "IPv4-mapped proxy",
+			remoteAddr:   "[::ffff:10.0.0.2]:4321",
+			forwardedFor: []string{"::ffff:203.0.113.7"},
+			want:         "203.0.113.7",
+		},
+		{name: "unparseable peer", remoteAddr: "@", forwardedFor: []string{"203.0.113.7"}, want: "@"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
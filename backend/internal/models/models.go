@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,8 +13,9 @@ const (
 )
 
 type User struct {
-	ID        uuid.UUID  `json:"id" db:"id"`
-	Email     string     `json:"email" db:"email"`
+	ID    uuid.UUID `json:"id" db:"id"`
+	Email string    `json:"email" db:"email"`
+	// GoogleID is only set for users created before user_identities
 	GoogleID  *string    `json:"google_id,omitempty" db:"google_id"`
 	Name      string     `json:"name" db:"name"`
 	AvatarURL *string    `json:"avatar_url,omitempty" db:"avatar_url"`
@@ -29,33 +31,259 @@ func (u *User) IsAdmin() bool {
 	return u.Role == RoleAdmin
 }
 
+// Role grants its users a set of permissions. Built-in roles cannot be
+// deleted.
+type Role struct {
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	Permissions []string  `json:"permissions" db:"permissions"`
+	IsBuiltin   bool      `json:"is_builtin" db:"is_builtin"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Permission is something a role can be allowed to do, such as
+// "users:write"
+type Permission struct {
+	Name        string `json:"name" db:"name"`
+	Description string `json:"description" db:"description"`
+}
+
+// Roles of a user within an organization, from most to least privileged
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+type Organization struct {
+	ID   uuid.UUID `json:"id" db:"id"`
+	Name string    `json:"name" db:"name"`
+	// Role is the current user's role in the organization
+	Role      string    `json:"role,omitempty" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type OrganizationMember struct {
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Email     string    `json:"email" db:"email"`
+	Name      string    `json:"name" db:"name"`
+	AvatarURL *string   `json:"avatar_url,omitempty" db:"avatar_url"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type OrganizationInvite struct {
+	ID             uuid.UUID  `json:"id" db:"id"`
+	OrganizationID uuid.UUID  `json:"organization_id" db:"organization_id"`
+	Email          string     `json:"email" db:"email"`
+	Role           string     `json:"role" db:"role"`
+	InvitedBy      *uuid.UUID `json:"invited_by,omitempty" db:"invited_by"`
+	ExpiresAt      time.Time  `json:"expires_at" db:"expires_at"`
+	AcceptedAt     *time.Time `json:"accepted_at,omitempty" db:"accepted_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
 type RefreshToken struct {
 	ID        uuid.UUID  `json:"id" db:"id"`
 	UserID    uuid.UUID  `json:"user_id" db:"user_id"`
+	Selector  *string    `json:"-" db:"selector"`
 	TokenHash string     `json:"-" db:"token_hash"`
+	FamilyID  uuid.UUID  `json:"family_id" db:"family_id"`
+	ParentID  *uuid.UUID `json:"parent_id,omitempty" db:"parent_id"`
+	ClientID  *string    `json:"client_id,omitempty" db:"client_id"`
+	Scope     string     `json:"scope" db:"scope"`
+	AMR       []string   `json:"amr" db:"amr"`
 	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
 	CreatedAt time.Time  `json:"created_at" db:"created_at"`
 	RevokedAt *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
 }
 
+// Session is a sign-in on one device: a refresh token family, with the
+// device it was last used from
+type Session struct {
+	ID         uuid.UUID `json:"id" db:"id"`
+	UserID     uuid.UUID `json:"user_id" db:"user_id"`
+	ClientID   *string   `json:"client_id,omitempty" db:"client_id"`
+	Name       *string   `json:"name,omitempty" db:"name"`
+	UserAgent  *string   `json:"user_agent,omitempty" db:"user_agent"`
+	IPAddress  *string   `json:"ip_address,omitempty" db:"ip_address"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at" db:"last_used_at"`
+
+	// ExpiresAt is when the session's current refresh token expires
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+
+	// Current is set for the session making the request
+	Current bool `json:"current"`
+}
+
+const (
+	KeyStatusUpcoming = "upcoming"
+	KeyStatusActive   = "active"
+	KeyStatusRetired  = "retired"
+)
+
+type SigningKey struct {
+	ID          string     `json:"kid" db:"id"`
+	Algorithm   string     `json:"alg" db:"algorithm"`
+	Status      string     `json:"status" db:"status"`
+	ActivatesAt time.Time  `json:"activates_at" db:"activates_at"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty" db:"retired_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// AuthAuditLog is an audit event. UserID is the account it is about and
+// ActorID the signed-in user who caused it; Changes maps changed fields to
+// their old and new values. Hash chains the event to the one before it in
+// Seq order; it is empty for events recorded before the chain existed.
 type AuthAuditLog struct {
+	ID         uuid.UUID       `json:"id" db:"id"`
+	Seq        int64           `json:"seq" db:"seq"`
+	UserID     *uuid.UUID      `json:"user_id,omitempty" db:"user_id"`
+	ActorID    *uuid.UUID      `json:"actor_id,omitempty" db:"actor_id"`
+	Action     string          `json:"action" db:"action"`
+	TargetType *string         `json:"target_type,omitempty" db:"target_type"`
+	TargetID   *string         `json:"target_id,omitempty" db:"target_id"`
+	Changes    json.RawMessage `json:"changes,omitempty" db:"changes"`
+	IPAddress  *string         `json:"ip_address,omitempty" db:"ip_address"`
+	UserAgent  *string         `json:"user_agent,omitempty" db:"user_agent"`
+	RequestID  *string         `json:"request_id,omitempty" db:"request_id"`
+	CreatedAt  time.Time       `json:"created_at" db:"created_at"`
+	PrevHash   string          `json:"prev_hash,omitempty" db:"prev_hash"`
+	Hash       string          `json:"hash,omitempty" db:"hash"`
+}
+
+// AuditCheckpoint is a signature, made with the service's signing key
+// KeyID, over the hash of the event Seq
+type AuditCheckpoint struct {
+	Seq       int64     `json:"seq" db:"seq"`
+	Hash      string    `json:"hash" db:"hash"`
+	KeyID     string    `json:"kid" db:"key_id"`
+	Signature string    `json:"signature" db:"signature"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Application is a registered client application: an OAuth/OpenID Connect
+// client and a source of allowed CORS origins and login redirects.
+type Application struct {
+	ClientID        string    `json:"client_id" db:"client_id"`
+	Name            string    `json:"name" db:"name"`
+	IsPublic        bool      `json:"is_public" db:"is_public"`
+	RedirectURIs    []string  `json:"redirect_uris" db:"redirect_uris"`
+	AllowedOrigins  []string  `json:"allowed_origins" db:"allowed_origins"`
+	AccessTokenTTL  *int      `json:"access_token_ttl,omitempty" db:"access_token_ttl"`
+	RefreshTokenTTL *int      `json:"refresh_token_ttl,omitempty" db:"refresh_token_ttl"`
+	IsActive        bool      `json:"is_active" db:"is_active"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type ApplicationSecret struct {
 	ID        uuid.UUID  `json:"id" db:"id"`
-	UserID    *uuid.UUID `json:"user_id,omitempty" db:"user_id"`
-	Action    string     `json:"action" db:"action"`
-	IPAddress *string    `json:"ip_address,omitempty" db:"ip_address"`
-	UserAgent *string    `json:"user_agent,omitempty" db:"user_agent"`
+	ClientID  string     `json:"client_id" db:"client_id"`
 	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+type AuthorizationCode struct {
+	ClientID            string    `db:"client_id"`
+	UserID              uuid.UUID `db:"user_id"`
+	RedirectURI         string    `db:"redirect_uri"`
+	Scope               string    `db:"scope"`
+	Nonce               *string   `db:"nonce"`
+	CodeChallenge       *string   `db:"code_challenge"`
+	CodeChallengeMethod *string   `db:"code_challenge_method"`
+	AMR                 []string  `db:"amr"`
+	AuthTime            time.Time `db:"auth_time"`
+	ExpiresAt           time.Time `db:"expires_at"`
 }
 
 type TokenPair struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+
+	// ExpiresIn is the lifetime of the access token
+	ExpiresIn time.Duration `json:"-"`
+
+	// AMR lists the authentication methods behind the tokens
+	AMR []string `json:"-"`
+}
+
+// TokenIntrospection describes a token as in an RFC 7662 introspection
+// response. Inactive tokens only have Active set.
+type TokenIntrospection struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	JTI       string   `json:"jti,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+
+	// Claims of access tokens beyond RFC 7662
+	Email       string   `json:"email,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	OrgID       string   `json:"org_id,omitempty"`
+	OrgRole     string   `json:"org_role,omitempty"`
+	AMR         []string `json:"amr,omitempty"`
+}
+
+// MFAStatus describes a user's second factors
+type MFAStatus struct {
+	TOTPEnabled            bool       `json:"totp_enabled"`
+	TOTPEnabledAt          *time.Time `json:"totp_enabled_at,omitempty"`
+	RecoveryCodesRemaining int        `json:"recovery_codes_remaining"`
+	Passkeys               int        `json:"passkeys"`
+}
+
+// TOTPEnrollment is a TOTP secret waiting to be confirmed with a first code
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// WebAuthnCredential is a passkey registered by a user
+type WebAuthnCredential struct {
+	ID             uuid.UUID  `json:"id" db:"id"`
+	UserID         uuid.UUID  `json:"-" db:"user_id"`
+	CredentialID   []byte     `json:"-" db:"credential_id"`
+	PublicKey      []byte     `json:"-" db:"public_key"`
+	SignCount      int64      `json:"-" db:"sign_count"`
+	Transports     []string   `json:"transports" db:"transports"`
+	Name           string     `json:"name" db:"name"`
+	BackupEligible bool       `json:"backup_eligible" db:"backup_eligible"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+}
+
+// ExternalIdentity is a user as asserted by an upstream identity provider
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
 }
 
-type GoogleUserInfo struct {
-	ID            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
-	Name          string `json:"name"`
-	Picture       string `json:"picture"`
+// UserIdentity links a user to an account at an upstream identity provider
+type UserIdentity struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	UserID      uuid.UUID  `json:"user_id" db:"user_id"`
+	Provider    string     `json:"provider" db:"provider"`
+	Subject     string     `json:"subject" db:"subject"`
+	Email       *string    `json:"email,omitempty" db:"email"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty" db:"last_login_at"`
 }
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory keeps buckets in the process, so each replica counts on its own
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*bucket)}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), updated: now}
+		m.buckets[key] = b
+	}
+
+	var retryAfter time.Duration
+	b.tokens, retryAfter = limit.take(b.tokens, now.Sub(b.updated))
+	b.updated = now
+	b.full = now.Add(limit.untilFull(b.tokens))
+	return retryAfter, nil
+}
+
+func (m *Memory) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			m.mu.Lock()
+			for key, b := range m.buckets {
+				if now.After(b.full) {
+					delete(m.buckets, key)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
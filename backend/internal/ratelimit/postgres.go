@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/database"
+)
+
+// Postgres keeps buckets in the rate_limits table, so that every replica
+// counts against the same limits
+type Postgres struct {
+	db *database.DB
+}
+
+func NewPostgres(db *database.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO rate_limits (key, tokens, updated_at, full_at)
+		VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (key) DO NOTHING
+	`, key, float64(limit.Requests))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create rate limit bucket: %w", err)
+	}
+
+	// Concurrent requests queue up on the row lock. One that started
+	// before the bucket was last updated sees no time elapsed.
+	var tokens, elapsed float64
+	err = tx.QueryRow(ctx, `
+		SELECT tokens, EXTRACT(EPOCH FROM NOW() - updated_at)::float8
+		FROM rate_limits WHERE key = $1
+		FOR UPDATE
+	`, key).Scan(&tokens, &elapsed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query rate limit bucket: %w", err)
+	}
+
+	tokens, retryAfter := limit.take(tokens, time.Duration(elapsed*float64(time.Second)))
+	_, err = tx.Exec(ctx, `
+		UPDATE rate_limits
+		SET tokens = $2,
+		    updated_at = GREATEST(updated_at, NOW()),
+		    full_at = GREATEST(updated_at, NOW()) + make_interval(secs => $3)
+		WHERE key = $1
+	`, key, tokens, limit.untilFull(tokens).Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to update rate limit bucket: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return retryAfter, nil
+}
+
+func (p *Postgres) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.db.Exec(ctx, `DELETE FROM rate_limits WHERE full_at < NOW()`); err != nil {
+				log.Printf("Warning: failed to delete refilled rate limit buckets: %v", err)
+			}
+		}
+	}
+}
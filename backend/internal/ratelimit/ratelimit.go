@@ -0,0 +1,64 @@
+// Package ratelimit counts requests in token buckets, kept in memory or, to
+// share them between replicas, in Postgres.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/config"
+	"github.com/frans-sjostrom/auth-service/internal/database"
+)
+
+// Limit allows Requests requests every Per, in bursts of up to Requests
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// rate returns how many tokens a bucket regains per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// take refills a bucket of tokens for the time elapsed since it last
+// changed and takes a token from it. It returns the tokens left and, when
+// none could be taken, how long until one can.
+func (l Limit) take(tokens float64, elapsed time.Duration) (float64, time.Duration) {
+	tokens = math.Min(float64(l.Requests), tokens+math.Max(elapsed.Seconds(), 0)*l.rate())
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) / l.rate() * float64(time.Second))
+}
+
+// untilFull returns how long a bucket of tokens takes to refill
+func (l Limit) untilFull(tokens float64) time.Duration {
+	return time.Duration((float64(l.Requests) - tokens) / l.rate() * float64(time.Second))
+}
+
+// Limiter keeps a token bucket per key. Implementations are Memory and
+// Postgres.
+type Limiter interface {
+	// Allow takes a token from the bucket of key, which starts out full.
+	// It returns 0 if the request is allowed, and otherwise how long until
+	// it would be.
+	Allow(ctx context.Context, key string, limit Limit) (time.Duration, error)
+
+	// Run forgets refilled buckets every interval until ctx is cancelled
+	Run(ctx context.Context, interval time.Duration)
+}
+
+// New returns the limiter for RATE_LIMIT_STORE
+func New(cfg *config.Config, db *database.DB) (Limiter, error) {
+	switch cfg.RateLimitStore {
+	case "memory":
+		return NewMemory(), nil
+	case "postgres":
+		return NewPostgres(db), nil
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_STORE: %q", cfg.RateLimitStore)
+	}
+}
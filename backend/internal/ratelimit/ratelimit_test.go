@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestLimitTake(t *testing.T) {
+	limit := Limit{Requests: 10, Per: time.Minute} // a token every 6s
+
+	tests := []struct {
+		name           string
+		tokens         float64
+		elapsed        time.Duration
+		wantTokens     float64
+		wantRetryAfter time.Duration
+	}{
+		{name: "full", tokens: 10, wantTokens: 9},
+		{name: "last token", tokens: 1, wantTokens: 0},
+		{name: "empty", tokens: 0, wantTokens: 0, wantRetryAfter: 6 * time.Second},
+		{name: "partly refilled", tokens: 0.5, wantTokens: 0.5, wantRetryAfter: 3 * time.Second},
+		{name: "refilled by elapsed time", tokens: 0, elapsed: 6 * time.Second, wantTokens: 0},
+		{name: "refill is capped", tokens: 5, elapsed: time.Hour, wantTokens: 9},
+		{name: "clock going back", tokens: 0, elapsed: -time.Minute, wantTokens: 0, wantRetryAfter: 6 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, retryAfter := limit.take(tt.tokens, tt.elapsed)
+			if tokens != tt.wantTokens {
+				t.Errorf("tokens = %v, want %v", tokens, tt.wantTokens)
+			}
+			if retryAfter != tt.wantRetryAfter {
+				t.Errorf("retry after = %v, want %v", retryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestLimitUntilFull(t *testing.T) {
+	limit := Limit{Requests: 10, Per: time.Minute}
+	if got := limit.untilFull(10); got != 0 {
+		t.Errorf("untilFull(10) = %v, want 0", got)
+	}
+	if got := limit.untilFull(4); got != 36*time.Second {
+		t.Errorf("untilFull(4) = %v, want 36s", got)
+	}
+}
+
+// testBurst checks that l allows a burst of limit.Requests requests for key
+// and then rejects the next one
+func testBurst(t *testing.T, l Limiter, key string, limit Limit) {
+	t.Helper()
+	ctx := context.Background()
+
+	for i := range limit.Requests {
+		retryAfter, err := l.Allow(ctx, key, limit)
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		if retryAfter != 0 {
+			t.Fatalf("request %d rejected, retry after %v", i+1, retryAfter)
+		}
+	}
+
+	retryAfter, err := l.Allow(ctx, key, limit)
+	if err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	// A little of the next token has come back since the burst began
+	if perToken := limit.Per / time.Duration(limit.Requests); retryAfter <= 0 || retryAfter > perToken {
+		t.Errorf("retry after = %v, want up to %v", retryAfter, perToken)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	limit := Limit{Requests: 3, Per: time.Hour}
+
+	testBurst(t, m, "a", limit)
+
+	// Other keys have buckets of their own
+	if retryAfter, _ := m.Allow(context.Background(), "b", limit); retryAfter != 0 {
+		t.Errorf("other key rejected, retry after %v", retryAfter)
+	}
+}
+
+func TestMemoryRefill(t *testing.T) {
+	m := NewMemory()
+	limit := Limit{Requests: 1, Per: 50 * time.Millisecond}
+
+	testBurst(t, m, "a", limit)
+	time.Sleep(limit.Per)
+	if retryAfter, _ := m.Allow(context.Background(), "a", limit); retryAfter != 0 {
+		t.Errorf("refilled bucket rejected, retry after %v", retryAfter)
+	}
+}
+
+func TestMemoryRunForgetsRefilledBuckets(t *testing.T) {
+	m := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m.Allow(ctx, "a", Limit{Requests: 1, Per: time.Millisecond})
+	m.Allow(ctx, "b", Limit{Requests: 1, Per: time.Hour})
+	go m.Run(ctx, 5*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		_, a := m.buckets["a"]
+		_, b := m.buckets["b"]
+		m.mu.Unlock()
+		if !a {
+			if !b {
+				t.Error("bucket still refilling was forgotten")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refilled bucket was not forgotten")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	t.Setenv("MIGRATIONS_PATH", "file://../../migrations")
+	if err := database.RunMigrations(url); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	db, err := database.Connect(url)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	key := "test:" + uuid.NewString()
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM rate_limits WHERE key = $1`, key)
+	})
+
+	testBurst(t, NewPostgres(db), key, Limit{Requests: 3, Per: time.Hour})
+
+	// The bucket is full again after the rest of the hour
+	var untilFull float64
+	err = db.QueryRow(context.Background(), `SELECT EXTRACT(EPOCH FROM full_at - updated_at)::float8 FROM rate_limits WHERE key = $1`, key).Scan(&untilFull)
+	if err != nil {
+		t.Fatalf("failed to query bucket: %v", err)
+	}
+	if untilFull < 59*60 || untilFull > 60*60 {
+		t.Errorf("full after %vs, want about an hour", untilFull)
+	}
+}
@@ -0,0 +1,6 @@
+-- Remove indexes
+DROP INDEX IF EXISTS idx_refresh_tokens_legacy;
+DROP INDEX IF EXISTS idx_refresh_tokens_selector;
+
+-- Remove selector column
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS selector;
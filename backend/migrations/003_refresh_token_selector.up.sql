@@ -0,0 +1,13 @@
+-- Selector/verifier refresh tokens: the selector is an indexed lookup id and
+-- token_hash holds a SHA-256 hash of the verifier. Rows without a selector are
+-- legacy bcrypt-hashed tokens that are still accepted until they expire.
+ALTER TABLE refresh_tokens
+ADD COLUMN selector VARCHAR(64);
+
+CREATE UNIQUE INDEX idx_refresh_tokens_selector ON refresh_tokens(selector);
+
+-- Partial index for the legacy bcrypt scan, which only looks at live rows
+CREATE INDEX idx_refresh_tokens_legacy ON refresh_tokens(expires_at)
+WHERE selector IS NULL AND revoked_at IS NULL;
+
+COMMENT ON COLUMN refresh_tokens.selector IS 'Lookup id of a selector/verifier refresh token; NULL for legacy bcrypt tokens';
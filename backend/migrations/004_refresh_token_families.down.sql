@@ -0,0 +1,8 @@
+-- Remove indexes
+DROP INDEX IF EXISTS idx_refresh_tokens_parent_id;
+DROP INDEX IF EXISTS idx_refresh_tokens_family_id;
+
+-- Remove family columns
+ALTER TABLE refresh_tokens DROP CONSTRAINT IF EXISTS fk_refresh_token_parent;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS parent_id;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS family_id;
@@ -0,0 +1,20 @@
+-- Refresh token families: every token issued by rotation points at the token
+-- it replaced (parent_id) and shares the family_id of the original login.
+ALTER TABLE refresh_tokens
+ADD COLUMN family_id UUID,
+ADD COLUMN parent_id UUID;
+
+-- Existing tokens each start their own family
+UPDATE refresh_tokens SET family_id = id WHERE family_id IS NULL;
+
+ALTER TABLE refresh_tokens
+ALTER COLUMN family_id SET NOT NULL;
+
+ALTER TABLE refresh_tokens
+ADD CONSTRAINT fk_refresh_token_parent FOREIGN KEY (parent_id) REFERENCES refresh_tokens(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX idx_refresh_tokens_parent_id ON refresh_tokens(parent_id);
+
+COMMENT ON COLUMN refresh_tokens.family_id IS 'Id of the first token of the login this token was rotated from';
+COMMENT ON COLUMN refresh_tokens.parent_id IS 'Token this one replaced on rotation';
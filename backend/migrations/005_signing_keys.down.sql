@@ -0,0 +1,6 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_signing_keys_status;
+DROP INDEX IF EXISTS idx_signing_keys_active;
+
+-- Drop tables
+DROP TABLE IF EXISTS signing_keys;
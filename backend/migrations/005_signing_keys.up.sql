@@ -0,0 +1,23 @@
+-- Signing key ring. Exactly one key is active and signs new tokens; upcoming
+-- keys are published ahead of their activation so verifiers can cache them,
+-- and retired keys stay published until tokens signed with them have expired.
+CREATE TABLE signing_keys (
+    id VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL DEFAULT 'RS256',
+    private_key TEXT NOT NULL,
+    public_key TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    activates_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    retired_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT valid_signing_key_status CHECK (status IN ('upcoming', 'active', 'retired'))
+);
+
+-- At most one active key at a time
+CREATE UNIQUE INDEX idx_signing_keys_active ON signing_keys(status) WHERE status = 'active';
+CREATE INDEX idx_signing_keys_status ON signing_keys(status);
+
+COMMENT ON COLUMN signing_keys.id IS 'Key id (kid), the RFC 7638 thumbprint of the public key';
+COMMENT ON COLUMN signing_keys.private_key IS 'PKCS#8 PEM encoded private key';
+COMMENT ON COLUMN signing_keys.expires_at IS 'When a retired key stops being published';
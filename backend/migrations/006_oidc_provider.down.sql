@@ -0,0 +1,11 @@
+-- Remove client binding from refresh tokens
+ALTER TABLE refresh_tokens DROP CONSTRAINT IF EXISTS fk_refresh_token_client;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS scope;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS client_id;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_oauth_codes_expires_at;
+
+-- Drop tables
+DROP TABLE IF EXISTS oauth_authorization_codes;
+DROP TABLE IF EXISTS oauth_clients;
@@ -0,0 +1,41 @@
+-- OAuth/OpenID Connect clients that may use /authorize and /token.
+-- Public clients (SPAs, native apps) have no secret and must use PKCE.
+CREATE TABLE oauth_clients (
+    client_id VARCHAR(255) PRIMARY KEY,
+    client_secret_hash VARCHAR(64),
+    name VARCHAR(255) NOT NULL,
+    redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Authorization codes issued by /authorize. Only a SHA-256 hash of the code
+-- is stored; used_at makes every code single-use.
+CREATE TABLE oauth_authorization_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL,
+    user_id UUID NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL DEFAULT '',
+    nonce TEXT,
+    code_challenge VARCHAR(128),
+    code_challenge_method VARCHAR(10),
+    auth_time TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_code_client FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    CONSTRAINT fk_code_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_oauth_codes_expires_at ON oauth_authorization_codes(expires_at);
+
+-- Refresh tokens issued through /token are bound to their client and scope
+ALTER TABLE refresh_tokens
+ADD COLUMN client_id VARCHAR(255),
+ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE refresh_tokens
+ADD CONSTRAINT fk_refresh_token_client FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE;
+
+COMMENT ON COLUMN oauth_clients.client_secret_hash IS 'Hex SHA-256 of the client secret; NULL for public clients';
+COMMENT ON COLUMN refresh_tokens.client_id IS 'OAuth client the token was issued to; NULL for first-party logins';
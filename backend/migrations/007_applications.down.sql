@@ -0,0 +1,31 @@
+-- Drop triggers
+DROP TRIGGER IF EXISTS update_applications_updated_at ON applications;
+
+-- Move the newest secret back onto the client row
+ALTER TABLE applications ADD COLUMN client_secret_hash VARCHAR(64);
+
+UPDATE applications a
+SET client_secret_hash = (
+    SELECT s.secret_hash FROM application_secrets s
+    WHERE s.client_id = a.client_id AND s.revoked_at IS NULL
+    ORDER BY s.created_at DESC
+    LIMIT 1
+);
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_application_secrets_client_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS application_secrets;
+
+-- Remove application columns
+ALTER TABLE applications
+DROP COLUMN IF EXISTS updated_at,
+DROP COLUMN IF EXISTS is_active,
+DROP COLUMN IF EXISTS refresh_token_ttl,
+DROP COLUMN IF EXISTS access_token_ttl,
+DROP COLUMN IF EXISTS allowed_origins,
+DROP COLUMN IF EXISTS is_public;
+
+ALTER TABLE applications RENAME CONSTRAINT applications_pkey TO oauth_clients_pkey;
+ALTER TABLE applications RENAME TO oauth_clients;
@@ -0,0 +1,40 @@
+-- Registered client applications replace the bare oauth_clients table. Each
+-- application has its own redirect URIs, CORS origins and token lifetimes.
+ALTER TABLE oauth_clients RENAME TO applications;
+ALTER TABLE applications RENAME CONSTRAINT oauth_clients_pkey TO applications_pkey;
+
+ALTER TABLE applications
+ADD COLUMN is_public BOOLEAN NOT NULL DEFAULT false,
+ADD COLUMN allowed_origins TEXT[] NOT NULL DEFAULT '{}',
+ADD COLUMN access_token_ttl INTEGER,
+ADD COLUMN refresh_token_ttl INTEGER,
+ADD COLUMN is_active BOOLEAN NOT NULL DEFAULT true,
+ADD COLUMN updated_at TIMESTAMP DEFAULT NOW();
+
+UPDATE applications SET is_public = (client_secret_hash IS NULL);
+
+-- Applications can hold several secrets so they can be rotated without downtime
+CREATE TABLE application_secrets (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    client_id VARCHAR(255) NOT NULL,
+    secret_hash VARCHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    revoked_at TIMESTAMP,
+    CONSTRAINT fk_secret_application FOREIGN KEY (client_id) REFERENCES applications(client_id) ON DELETE CASCADE
+);
+
+INSERT INTO application_secrets (client_id, secret_hash)
+SELECT client_id, client_secret_hash FROM applications WHERE client_secret_hash IS NOT NULL;
+
+ALTER TABLE applications DROP COLUMN client_secret_hash;
+
+CREATE INDEX idx_application_secrets_client_id ON application_secrets(client_id);
+
+CREATE TRIGGER update_applications_updated_at
+    BEFORE UPDATE ON applications
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON COLUMN applications.access_token_ttl IS 'Access token lifetime in seconds; NULL uses JWT_ACCESS_TOKEN_EXPIRY';
+COMMENT ON COLUMN applications.refresh_token_ttl IS 'Refresh token lifetime in seconds; NULL uses JWT_REFRESH_TOKEN_EXPIRY';
+COMMENT ON COLUMN application_secrets.secret_hash IS 'Hex SHA-256 of the client secret';
@@ -0,0 +1,7 @@
+-- Keep Google sign-ins working for users created after the identities table
+UPDATE users u
+SET google_id = i.subject
+FROM user_identities i
+WHERE i.user_id = u.id AND i.provider = 'google' AND u.google_id IS NULL;
+
+DROP TABLE IF EXISTS user_identities;
@@ -0,0 +1,21 @@
+-- Links between users and their accounts at upstream identity providers
+CREATE TABLE user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_login_at TIMESTAMP,
+    CONSTRAINT fk_identity_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT uq_identity_provider_subject UNIQUE (provider, subject)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+
+-- Existing users signed in with Google; their Google ID is the subject of
+-- Google's ID tokens
+INSERT INTO user_identities (user_id, provider, subject, email, created_at)
+SELECT id, 'google', google_id, email, created_at
+FROM users
+WHERE google_id IS NOT NULL;
@@ -0,0 +1,13 @@
+-- Pending requests by signed-in users to link another identity provider
+CREATE TABLE identity_link_requests (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    user_id UUID NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_link_request_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_identity_link_requests_expires_at ON identity_link_requests(expires_at);
@@ -0,0 +1,6 @@
+ALTER TABLE oauth_authorization_codes DROP COLUMN IF EXISTS amr;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS amr;
+
+DROP TABLE IF EXISTS mfa_challenges;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+DROP TABLE IF EXISTS user_totp;
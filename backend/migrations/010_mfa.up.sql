@@ -0,0 +1,42 @@
+-- TOTP authenticators. confirmed_at is NULL until enrollment is confirmed
+-- with a first code.
+CREATE TABLE user_totp (
+    user_id UUID PRIMARY KEY,
+    secret_encrypted BYTEA NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_used_step BIGINT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_totp_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- One-time recovery codes, stored as SHA-256 hashes
+CREATE TABLE mfa_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_recovery_code_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_mfa_recovery_codes_user_id ON mfa_recovery_codes(user_id);
+
+-- Logins waiting for their second factor. login_context holds what is
+-- needed to finish the login once it is verified.
+CREATE TABLE mfa_challenges (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    user_id UUID NOT NULL,
+    login_context JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_mfa_challenge_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_mfa_challenges_expires_at ON mfa_challenges(expires_at);
+
+-- Authentication methods (RFC 8176 amr values) behind issued tokens
+ALTER TABLE refresh_tokens ADD COLUMN amr TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE oauth_authorization_codes ADD COLUMN amr TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,38 @@
+-- WebAuthn credentials (passkeys). public_key is the COSE_Key;
+-- sign_count is the last signature counter the authenticator reported.
+CREATE TABLE webauthn_credentials (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    credential_id BYTEA UNIQUE NOT NULL,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    aaguid BYTEA,
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    name VARCHAR(255) NOT NULL,
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    backup_state BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_used_at TIMESTAMP,
+    CONSTRAINT fk_webauthn_credential_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+-- Pending WebAuthn ceremonies, looked up by the challenge in the client
+-- data. A login ceremony keeps what is needed to finish the login; an mfa
+-- ceremony belongs to an MFA challenge.
+CREATE TABLE webauthn_challenges (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    challenge_hash VARCHAR(64) UNIQUE NOT NULL,
+    ceremony VARCHAR(20) NOT NULL CHECK (ceremony IN ('registration', 'login', 'mfa')),
+    user_id UUID,
+    mfa_challenge_id UUID,
+    login_context JSONB,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_webauthn_challenge_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT fk_webauthn_challenge_mfa FOREIGN KEY (mfa_challenge_id) REFERENCES mfa_challenges(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_webauthn_challenges_expires_at ON webauthn_challenges(expires_at);
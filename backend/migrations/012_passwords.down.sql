@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_users_email_lower;
+DROP TABLE IF EXISTS email_tokens;
+
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at;
+ALTER TABLE users DROP COLUMN IF EXISTS password_changed_at;
+ALTER TABLE users DROP COLUMN IF EXISTS password_hash;
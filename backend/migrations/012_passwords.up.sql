@@ -0,0 +1,23 @@
+-- Email and password accounts. Passwords are argon2id PHC strings;
+-- email_verified_at is set once the user followed a link sent to the email.
+ALTER TABLE users ADD COLUMN password_hash TEXT;
+ALTER TABLE users ADD COLUMN password_changed_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+
+-- Single-use tokens sent by email, stored as SHA-256 hashes
+CREATE TABLE email_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    user_id UUID NOT NULL,
+    purpose VARCHAR(20) NOT NULL CHECK (purpose IN ('verify_email', 'password_reset')),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_email_token_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_email_tokens_user_id ON email_tokens(user_id);
+CREATE INDEX idx_email_tokens_expires_at ON email_tokens(expires_at);
+
+-- Password logins look users up by email case-insensitively
+CREATE INDEX idx_users_email_lower ON users(lower(email));
@@ -0,0 +1,21 @@
+-- Passwordless sign-in requests: a link or a six-digit code sent by email.
+-- token_hash identifies the request: the link's token, or for codes the
+-- challenge the browser holds while the user reads their email. Codes are
+-- stored as HMACs so a leaked table cannot be brute-forced offline.
+CREATE TABLE email_logins (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    code_hash VARCHAR(64),
+    login_context JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    ip_address INET,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Rate limits count recent requests per email and per IP address
+CREATE INDEX idx_email_logins_email_created_at ON email_logins(email, created_at);
+CREATE INDEX idx_email_logins_ip_address_created_at ON email_logins(ip_address, created_at);
+CREATE INDEX idx_email_logins_expires_at ON email_logins(expires_at);
@@ -0,0 +1,18 @@
+-- One-time codes the login callback redirects with instead of an access
+-- token. The frontend exchanges a code for tokens at /api/auth/exchange;
+-- it is bound to the redirect URI and application it was issued for. Only a
+-- SHA-256 hash of the code is stored.
+CREATE TABLE login_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL,
+    client_id VARCHAR(255),
+    redirect_uri TEXT NOT NULL,
+    amr TEXT[] NOT NULL DEFAULT '{}',
+    auth_time TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT fk_login_code_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_login_codes_expires_at ON login_codes(expires_at);
@@ -0,0 +1,11 @@
+-- Access tokens revoked before they expire, by their jti claim. Rows are
+-- only needed until the token would have expired anyway.
+CREATE TABLE revoked_access_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id UUID,
+    client_id VARCHAR(255),
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_revoked_access_tokens_expires_at ON revoked_access_tokens(expires_at);
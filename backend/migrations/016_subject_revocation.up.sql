@@ -0,0 +1,10 @@
+-- Users whose access tokens issued before revoked_at are all revoked, for
+-- example because they were deactivated or their role changed. Rows are
+-- only needed until the longest-lived of those tokens would have expired.
+CREATE TABLE revoked_subjects (
+    user_id UUID PRIMARY KEY,
+    revoked_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_revoked_subjects_expires_at ON revoked_subjects(expires_at);
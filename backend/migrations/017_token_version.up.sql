@@ -0,0 +1,3 @@
+-- Access tokens carry the user's token version; bumping it invalidates
+-- every token issued before
+ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
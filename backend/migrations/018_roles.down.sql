@@ -0,0 +1,14 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS fk_users_role;
+
+-- Users of custom roles fall back to the default role
+UPDATE users SET role = 'user' WHERE role NOT IN ('user', 'admin');
+ALTER TABLE users ALTER COLUMN role TYPE VARCHAR(20);
+ALTER TABLE users
+ADD CONSTRAINT valid_role CHECK (role IN ('user', 'admin'));
+
+COMMENT ON COLUMN users.role IS 'User role: user (default) or admin';
+
+DROP TRIGGER IF EXISTS update_roles_updated_at ON roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
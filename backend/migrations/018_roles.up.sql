@@ -0,0 +1,52 @@
+-- Roles replace the fixed user/admin check. Each role grants a set of
+-- permissions, which the code checks and access tokens carry.
+CREATE TABLE roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    is_builtin BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Permissions are defined by the code that checks them, so only migrations
+-- add them
+CREATE TABLE permissions (
+    name VARCHAR(100) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE ON UPDATE CASCADE,
+    permission VARCHAR(100) NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+CREATE TRIGGER update_roles_updated_at
+    BEFORE UPDATE ON roles
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+INSERT INTO permissions (name, description) VALUES
+    ('users:read', 'View any user'),
+    ('users:write', 'Edit, activate and deactivate any user'),
+    ('users:delete', 'Delete users'),
+    ('roles:read', 'View roles and permissions'),
+    ('roles:write', 'Define roles and assign them to users'),
+    ('applications:read', 'View registered applications'),
+    ('applications:write', 'Register, edit and delete applications and their secrets'),
+    ('keys:read', 'View signing keys'),
+    ('keys:write', 'Rotate signing keys');
+
+INSERT INTO roles (name, description, is_builtin) VALUES
+    ('user', 'Signed-in user without extra permissions', true),
+    ('admin', 'Full access', true);
+
+INSERT INTO role_permissions (role, permission)
+SELECT 'admin', name FROM permissions;
+
+ALTER TABLE users DROP CONSTRAINT valid_role;
+ALTER TABLE users ALTER COLUMN role TYPE VARCHAR(50);
+ALTER TABLE users
+ADD CONSTRAINT fk_users_role FOREIGN KEY (role) REFERENCES roles(name) ON UPDATE CASCADE;
+
+COMMENT ON COLUMN users.role IS 'Name of the user''s role in roles';
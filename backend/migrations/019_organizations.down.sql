@@ -0,0 +1,6 @@
+ALTER TABLE users DROP COLUMN IF EXISTS active_organization_id;
+
+DROP TRIGGER IF EXISTS update_organizations_updated_at ON organizations;
+DROP TABLE IF EXISTS organization_invites;
+DROP TABLE IF EXISTS organization_members;
+DROP TABLE IF EXISTS organizations;
@@ -0,0 +1,6 @@
+DELETE FROM role_permissions WHERE permission = 'audit:read';
+DELETE FROM permissions WHERE name = 'audit:read';
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON auth_audit_log(created_at);
+DROP INDEX IF EXISTS idx_audit_log_created_at_id;
+DROP INDEX IF EXISTS idx_audit_log_action;
@@ -0,0 +1,10 @@
+-- Audit log queries filter by action and page newest first by
+-- (created_at, id)
+CREATE INDEX idx_audit_log_action ON auth_audit_log(action);
+CREATE INDEX idx_audit_log_created_at_id ON auth_audit_log(created_at DESC, id DESC);
+DROP INDEX IF EXISTS idx_audit_log_created_at;
+
+INSERT INTO permissions (name, description) VALUES
+    ('audit:read', 'Query and export the audit log');
+
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'audit:read');
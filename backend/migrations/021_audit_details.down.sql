@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_audit_log_target;
+DROP INDEX IF EXISTS idx_audit_log_actor_id;
+
+ALTER TABLE auth_audit_log
+DROP COLUMN IF EXISTS changes,
+DROP COLUMN IF EXISTS request_id,
+DROP COLUMN IF EXISTS target_id,
+DROP COLUMN IF EXISTS target_type,
+DROP COLUMN IF EXISTS actor_id;
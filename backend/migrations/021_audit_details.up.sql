@@ -0,0 +1,13 @@
+-- Who acted on what: user_id stays the account an event is about, actor_id
+-- is the signed-in user who caused it, and target_type and target_id name
+-- the object that changed. changes maps each changed field to
+-- {"from": ..., "to": ...}.
+ALTER TABLE auth_audit_log
+ADD COLUMN actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+ADD COLUMN target_type VARCHAR(50),
+ADD COLUMN target_id TEXT,
+ADD COLUMN request_id TEXT,
+ADD COLUMN changes JSONB;
+
+CREATE INDEX idx_audit_log_actor_id ON auth_audit_log(actor_id);
+CREATE INDEX idx_audit_log_target ON auth_audit_log(target_type, target_id);
@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS audit_checkpoints;
+
+UPDATE auth_audit_log SET user_id = NULL WHERE user_id NOT IN (SELECT id FROM users);
+UPDATE auth_audit_log SET actor_id = NULL WHERE actor_id NOT IN (SELECT id FROM users);
+ALTER TABLE auth_audit_log
+ADD CONSTRAINT fk_audit_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+ADD CONSTRAINT auth_audit_log_actor_id_fkey FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL;
+
+DROP INDEX IF EXISTS idx_audit_log_seq;
+ALTER TABLE auth_audit_log
+DROP COLUMN IF EXISTS hash,
+DROP COLUMN IF EXISTS prev_hash,
+DROP COLUMN IF EXISTS seq;
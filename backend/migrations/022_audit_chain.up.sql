@@ -0,0 +1,30 @@
+-- Hash chain: every event stores the SHA-256 of its content and of the
+-- previous event's hash, in seq order. Events recorded before the chain
+-- existed are numbered but not hashed.
+ALTER TABLE auth_audit_log
+ADD COLUMN seq BIGINT,
+ADD COLUMN prev_hash VARCHAR(64),
+ADD COLUMN hash VARCHAR(64);
+
+UPDATE auth_audit_log a
+SET seq = numbered.n
+FROM (SELECT id, row_number() OVER (ORDER BY created_at, id) AS n FROM auth_audit_log) numbered
+WHERE a.id = numbered.id;
+
+ALTER TABLE auth_audit_log ALTER COLUMN seq SET NOT NULL;
+CREATE UNIQUE INDEX idx_audit_log_seq ON auth_audit_log(seq);
+
+-- Hashed columns must never change, so deleting a user no longer clears
+-- their id from the log
+ALTER TABLE auth_audit_log DROP CONSTRAINT IF EXISTS fk_audit_user;
+ALTER TABLE auth_audit_log DROP CONSTRAINT IF EXISTS auth_audit_log_actor_id_fkey;
+
+-- Checkpoints sign the hash of an event with the service's signing key, so
+-- that rewriting the chain from an earlier event onwards is detected too
+CREATE TABLE audit_checkpoints (
+    seq BIGINT PRIMARY KEY,
+    hash VARCHAR(64) NOT NULL,
+    key_id VARCHAR(64) NOT NULL,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,38 @@
+DROP INDEX IF EXISTS idx_refresh_tokens_revoked_at;
+
+CREATE TABLE auth_audit_log_unpartitioned (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID,
+    action VARCHAR(50) NOT NULL,
+    ip_address INET,
+    user_agent TEXT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    actor_id UUID,
+    target_type VARCHAR(50),
+    target_id TEXT,
+    request_id TEXT,
+    changes JSONB,
+    seq BIGINT NOT NULL,
+    prev_hash VARCHAR(64),
+    hash VARCHAR(64)
+);
+
+INSERT INTO auth_audit_log_unpartitioned (
+    id, user_id, action, ip_address, user_agent, created_at,
+    actor_id, target_type, target_id, request_id, changes, seq, prev_hash, hash
+)
+SELECT
+    id, user_id, action, ip_address, user_agent, created_at,
+    actor_id, target_type, target_id, request_id, changes, seq, prev_hash, hash
+FROM auth_audit_log;
+
+-- Drops the partitions with it
+DROP TABLE auth_audit_log;
+ALTER TABLE auth_audit_log_unpartitioned RENAME TO auth_audit_log;
+
+CREATE INDEX idx_audit_log_user_id ON auth_audit_log(user_id);
+CREATE INDEX idx_audit_log_action ON auth_audit_log(action);
+CREATE INDEX idx_audit_log_created_at_id ON auth_audit_log(created_at DESC, id DESC);
+CREATE INDEX idx_audit_log_actor_id ON auth_audit_log(actor_id);
+CREATE INDEX idx_audit_log_target ON auth_audit_log(target_type, target_id);
+CREATE UNIQUE INDEX idx_audit_log_seq ON auth_audit_log(seq);
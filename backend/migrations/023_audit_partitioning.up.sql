@@ -0,0 +1,64 @@
+-- Partition the audit log by month of created_at, so that expired months
+-- can be archived and dropped whole. Partitions are named
+-- auth_audit_log_YYYYMM; the service creates upcoming ones ahead of time.
+-- Primary keys and unique indexes of a partitioned table must include
+-- created_at, so seq is no longer unique by index: Record hands out seq
+-- numbers under an advisory lock instead.
+CREATE TABLE auth_audit_log_partitioned (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    user_id UUID,
+    action VARCHAR(50) NOT NULL,
+    ip_address INET,
+    user_agent TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    actor_id UUID,
+    target_type VARCHAR(50),
+    target_id TEXT,
+    request_id TEXT,
+    changes JSONB,
+    seq BIGINT NOT NULL,
+    prev_hash VARCHAR(64),
+    hash VARCHAR(64),
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+
+DO $$
+DECLARE
+    month TIMESTAMP;
+BEGIN
+    FOR month IN
+        SELECT generate_series(
+            date_trunc('month', LEAST((SELECT MIN(created_at) FROM auth_audit_log), NOW() AT TIME ZONE 'UTC')),
+            date_trunc('month', GREATEST((SELECT MAX(created_at) FROM auth_audit_log), NOW() AT TIME ZONE 'UTC')) + INTERVAL '1 month',
+            INTERVAL '1 month'
+        )
+    LOOP
+        EXECUTE format(
+            'CREATE TABLE %I PARTITION OF auth_audit_log_partitioned FOR VALUES FROM (%L) TO (%L)',
+            'auth_audit_log_' || to_char(month, 'YYYYMM'), month, month + INTERVAL '1 month'
+        );
+    END LOOP;
+END $$;
+
+INSERT INTO auth_audit_log_partitioned (
+    id, user_id, action, ip_address, user_agent, created_at,
+    actor_id, target_type, target_id, request_id, changes, seq, prev_hash, hash
+)
+SELECT
+    id, user_id, action, ip_address, user_agent, COALESCE(created_at, NOW()),
+    actor_id, target_type, target_id, request_id, changes, seq, prev_hash, hash
+FROM auth_audit_log;
+
+DROP TABLE auth_audit_log;
+ALTER TABLE auth_audit_log_partitioned RENAME TO auth_audit_log;
+
+CREATE INDEX idx_audit_log_user_id ON auth_audit_log(user_id);
+CREATE INDEX idx_audit_log_action ON auth_audit_log(action);
+CREATE INDEX idx_audit_log_created_at_id ON auth_audit_log(created_at DESC, id DESC);
+CREATE INDEX idx_audit_log_actor_id ON auth_audit_log(actor_id);
+CREATE INDEX idx_audit_log_target ON auth_audit_log(target_type, target_id);
+CREATE INDEX idx_audit_log_seq ON auth_audit_log(seq);
+
+-- Refresh tokens are purged once expired, or some time after they were
+-- revoked
+CREATE INDEX idx_refresh_tokens_revoked_at ON refresh_tokens(revoked_at) WHERE revoked_at IS NOT NULL;
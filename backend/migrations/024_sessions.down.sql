@@ -0,0 +1,2 @@
+ALTER TABLE refresh_tokens DROP CONSTRAINT IF EXISTS fk_refresh_token_session;
+DROP TABLE IF EXISTS sessions;
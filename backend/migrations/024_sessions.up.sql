@@ -0,0 +1,30 @@
+-- A session is a refresh token family: one sign-in on one device, with the
+-- device it was last used from. Its id is the family_id of its tokens.
+CREATE TABLE sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id VARCHAR(255) REFERENCES applications(client_id) ON DELETE CASCADE,
+    name VARCHAR(100),
+    user_agent TEXT,
+    ip_address INET,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+
+-- Existing families become sessions without device info
+INSERT INTO sessions (id, user_id, client_id, created_at, last_used_at)
+SELECT
+    family_id,
+    (array_agg(user_id))[1],
+    (array_agg(client_id))[1],
+    COALESCE(MIN(created_at), NOW()),
+    COALESCE(MAX(created_at), NOW())
+FROM refresh_tokens
+GROUP BY family_id;
+
+ALTER TABLE refresh_tokens
+ADD CONSTRAINT fk_refresh_token_session FOREIGN KEY (family_id) REFERENCES sessions(id) ON DELETE CASCADE;
+
+COMMENT ON COLUMN sessions.ip_address IS 'Address the session was last used from';
@@ -0,0 +1,11 @@
+-- Token buckets of the Postgres rate limiter, shared by every replica.
+-- Unlogged: losing them in a crash only resets the limits.
+CREATE UNLOGGED TABLE rate_limits (
+    key VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    -- When the bucket has refilled and the row can be deleted
+    full_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_rate_limits_full_at ON rate_limits(full_at);
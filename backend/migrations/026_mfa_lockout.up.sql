@@ -0,0 +1,4 @@
+-- Wrong codes entered to turn off TOTP or replace recovery codes are
+-- counted per user; reaching the limit locks these out for a while
+ALTER TABLE users ADD COLUMN mfa_failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN mfa_locked_until TIMESTAMP;
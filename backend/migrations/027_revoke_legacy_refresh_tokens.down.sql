@@ -0,0 +1,5 @@
+-- The revoked legacy tokens stay revoked
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_legacy ON refresh_tokens(expires_at)
+WHERE selector IS NULL AND revoked_at IS NULL;
+
+COMMENT ON COLUMN refresh_tokens.selector IS 'Lookup id of a selector/verifier refresh token; NULL for legacy bcrypt tokens';
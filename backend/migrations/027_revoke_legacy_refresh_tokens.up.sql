@@ -0,0 +1,9 @@
+-- Legacy bcrypt-hashed refresh tokens could only be found by comparing a
+-- token against every live hash. They are no longer accepted: revoke those
+-- left so their users sign in again.
+UPDATE refresh_tokens SET revoked_at = NOW()
+WHERE selector IS NULL AND revoked_at IS NULL;
+
+DROP INDEX IF EXISTS idx_refresh_tokens_legacy;
+
+COMMENT ON COLUMN refresh_tokens.selector IS 'Lookup id of a selector/verifier refresh token; NULL for revoked legacy bcrypt tokens';
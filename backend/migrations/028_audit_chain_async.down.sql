@@ -0,0 +1,13 @@
+DROP INDEX IF EXISTS idx_audit_log_unchained;
+
+-- Events that were never chained are numbered after the chain, unhashed
+UPDATE auth_audit_log a
+SET seq = numbered.n
+FROM (
+    SELECT id, COALESCE((SELECT MAX(seq) FROM auth_audit_log), 0) + row_number() OVER (ORDER BY created_at, id) AS n
+    FROM auth_audit_log
+    WHERE seq IS NULL
+) numbered
+WHERE a.id = numbered.id;
+
+ALTER TABLE auth_audit_log ALTER COLUMN seq SET NOT NULL;
@@ -0,0 +1,6 @@
+-- Events are recorded without a seq and chained once they have committed,
+-- so that recording one does not hold a lock until the recording
+-- transaction ends
+ALTER TABLE auth_audit_log ALTER COLUMN seq DROP NOT NULL;
+
+CREATE INDEX idx_audit_log_unchained ON auth_audit_log(created_at, id) WHERE seq IS NULL;
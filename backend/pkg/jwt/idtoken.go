@@ -0,0 +1,72 @@
+package jwt
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IDTokenClaims are the claims of an OpenID Connect ID token
+type IDTokenClaims struct {
+	Email    string           `json:"email,omitempty"`
+	Name     string           `json:"name,omitempty"`
+	Picture  string           `json:"picture,omitempty"`
+	Nonce    string           `json:"nonce,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	AMR      []string         `json:"amr,omitempty"`
+	AtHash   string           `json:"at_hash,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IDTokenParams holds the values written into an ID token
+type IDTokenParams struct {
+	Issuer   string
+	Subject  string
+	Audience string
+	Email    string
+	Name     string
+	Picture  string
+	Nonce    string
+	AuthTime time.Time
+	AMR      []string
+
+	// AccessToken, when set, is bound to the ID token through at_hash
+	AccessToken string
+}
+
+func GenerateIDToken(params IDTokenParams, key *SigningKey, expiry time.Duration) (string, error) {
+	now := time.Now()
+	claims := IDTokenClaims{
+		Email:   params.Email,
+		Name:    params.Name,
+		Picture: params.Picture,
+		Nonce:   params.Nonce,
+		AMR:     params.AMR,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    params.Issuer,
+			Subject:   params.Subject,
+			Audience:  jwt.ClaimStrings{params.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiry)),
+		},
+	}
+	if !params.AuthTime.IsZero() {
+		claims.AuthTime = jwt.NewNumericDate(params.AuthTime)
+	}
+	if params.AccessToken != "" {
+		claims.AtHash = AccessTokenHash(params.AccessToken)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+// AccessTokenHash computes the at_hash of an RS256 access token: the
+// base64url-encoded left half of its SHA-256 hash.
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
@@ -2,49 +2,120 @@ package jwt
 
 import (
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// AccessTokenIssuer is the "iss" claim of every access token
+const AccessTokenIssuer = "auth-service"
+
 type Claims struct {
 	UserID uuid.UUID `json:"sub"`
 	Email  string    `json:"email"`
 	Name   string    `json:"name"`
 	Role   string    `json:"role"`
+	Scope  string    `json:"scope,omitempty"`
+	AMR    []string  `json:"amr,omitempty"`
+
+	// Permissions are granted by the user's role
+	Permissions []string `json:"permissions,omitempty"`
+
+	// OrgID is the user's active organization and OrgRole their role in it
+	OrgID   string `json:"org_id,omitempty"`
+	OrgRole string `json:"org_role,omitempty"`
+
+	// TokenVersion is the user's token version when the token was issued.
+	// Bumping the version invalidates every earlier token.
+	TokenVersion int `json:"token_version,omitempty"`
+
+	// SessionID is the session, the refresh token family, the token was
+	// issued to
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateAccessToken(userID uuid.UUID, email, name, role string, privateKey *rsa.PrivateKey, expiry time.Duration) (string, error) {
+// AccessTokenParams holds the claims written into an access token
+type AccessTokenParams struct {
+	UserID uuid.UUID
+	Email  string
+	Name   string
+	Role   string
+
+	// Scope is the space-separated scope granted to an OAuth client, empty
+	// for first-party tokens
+	Scope string
+
+	// Audience is the client id of the application the token is issued to
+	Audience string
+
+	// AMR lists the authentication methods (RFC 8176) used to sign in
+	AMR []string
+
+	// Permissions lists what the user's role allows
+	Permissions []string
+
+	// OrgID and OrgRole name the user's active organization and their role
+	// in it, if they have one
+	OrgID   string
+	OrgRole string
+
+	// TokenVersion is the user's current token version
+	TokenVersion int
+
+	// SessionID is the id of the session the token belongs to
+	SessionID string
+}
+
+func GenerateAccessToken(params AccessTokenParams, key *SigningKey, expiry time.Duration) (string, error) {
 	now := time.Now()
 	claims := Claims{
-		UserID: userID,
-		Email:  email,
-		Name:   name,
-		Role:   role,
+		UserID:       params.UserID,
+		Email:        params.Email,
+		Name:         params.Name,
+		Role:         params.Role,
+		Scope:        params.Scope,
+		AMR:          params.AMR,
+		Permissions:  params.Permissions,
+		OrgID:        params.OrgID,
+		OrgRole:      params.OrgRole,
+		TokenVersion: params.TokenVersion,
+		SessionID:    params.SessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    "auth-service",
+			// jti lets a single token be revoked before it expires
+			ID:        uuid.NewString(),
+			Issuer:    AccessTokenIssuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(expiry)),
 		},
 	}
 
+	if params.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{params.Audience}
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(privateKey)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
 }
 
-func ValidateAccessToken(tokenString string, publicKey *rsa.PublicKey) (*Claims, error) {
+// ValidateAccessToken verifies a token against the key named by its "kid"
+// header. Tokens without a kid are looked up with an empty kid.
+func ValidateAccessToken(tokenString string, keys KeyLookup) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return publicKey, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		return keys.PublicKey(kid)
+	}, jwt.WithIssuer(AccessTokenIssuer))
 
 	if err != nil {
 		return nil, err
@@ -57,22 +128,46 @@ func ValidateAccessToken(tokenString string, publicKey *rsa.PublicKey) (*Claims,
 	return nil, fmt.Errorf("invalid token")
 }
 
-func GenerateRefreshToken() (string, error) {
-	b := make([]byte, 32)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
+// Refresh tokens use a selector/verifier format: "<selector>.<verifier>".
+// The selector is stored in plain text and indexed so a token can be found
+// with a single lookup; only a SHA-256 hash of the verifier is stored.
+const refreshTokenSeparator = "."
+
+// GenerateRefreshToken returns a new refresh token together with the selector
+// and verifier hash that should be persisted for it.
+func GenerateRefreshToken() (token, selector, verifierHash string, err error) {
+	s := make([]byte, 16)
+	if _, err := rand.Read(s); err != nil {
+		return "", "", "", err
+	}
+	v := make([]byte, 32)
+	if _, err := rand.Read(v); err != nil {
+		return "", "", "", err
 	}
-	return base64.URLEncoding.EncodeToString(b), nil
+
+	selector = base64.RawURLEncoding.EncodeToString(s)
+	verifier := base64.RawURLEncoding.EncodeToString(v)
+
+	return selector + refreshTokenSeparator + verifier, selector, HashRefreshVerifier(verifier), nil
 }
 
-func HashRefreshToken(token string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
+// SplitRefreshToken splits a selector/verifier refresh token. ok is false for
+// tokens that are not in that format, such as those issued before it.
+func SplitRefreshToken(token string) (selector, verifier string, ok bool) {
+	selector, verifier, ok = strings.Cut(token, refreshTokenSeparator)
+	if !ok || selector == "" || verifier == "" {
+		return "", "", false
 	}
-	return string(hash), nil
+	return selector, verifier, true
+}
+
+// HashRefreshVerifier returns the hex-encoded SHA-256 hash of a verifier
+func HashRefreshVerifier(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return hex.EncodeToString(sum[:])
 }
 
-func CompareRefreshToken(hash, token string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(token))
+// CompareRefreshVerifier reports whether verifier matches hash in constant time
+func CompareRefreshVerifier(hash, verifier string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(HashRefreshVerifier(verifier))) == 1
 }
@@ -0,0 +1,96 @@
+package jwt
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// SigningKey is an RSA private key together with the key id ("kid") that is
+// written into the header of every token it signs.
+type SigningKey struct {
+	ID         string
+	PrivateKey *rsa.PrivateKey
+}
+
+// KeyLookup resolves the public key a token was signed with from the token's
+// "kid" header. kid is empty for tokens issued without one.
+type KeyLookup interface {
+	PublicKey(kid string) (*rsa.PublicKey, error)
+}
+
+// StaticKey is a KeyLookup for a single public key, regardless of kid
+type StaticKey struct {
+	Key *rsa.PublicKey
+}
+
+func (k StaticKey) PublicKey(kid string) (*rsa.PublicKey, error) {
+	return k.Key, nil
+}
+
+// JWK is a JSON Web Key (RFC 7517) holding an RSA public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set as served from /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewRSAJWK returns the JWK representation of an RSA signing public key
+func NewRSAJWK(kid string, pub *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// RSAPublicKey decodes the RSA public key held by the JWK
+func (k JWK) RSAPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// KeyID derives a stable key id from an RSA public key using its RFC 7638
+// JWK thumbprint.
+func KeyID(pub *rsa.PublicKey) string {
+	jwk := NewRSAJWK("", pub)
+
+	// RFC 7638 requires the required members in lexicographic order
+	thumbprintInput, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{jwk.E, jwk.Kty, jwk.N})
+
+	sum := sha256.Sum256(thumbprintInput)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
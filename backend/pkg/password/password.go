@@ -0,0 +1,158 @@
+// Package password hashes passwords with argon2id (RFC 9106) and checks them
+// against a password policy.
+//
+// Hashes use the PHC string format also produced by the reference
+// implementation and libsodium:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	saltSize = 16
+	keySize  = 32
+)
+
+// ErrInvalidHash is returned for a stored hash that is not an argon2id PHC
+// string
+var ErrInvalidHash = errors.New("password: invalid argon2id hash")
+
+var encoding = base64.RawStdEncoding
+
+// Params are the argon2id cost parameters
+type Params struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultParams follow the OWASP recommendation for argon2id
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+}
+
+// Hash returns the PHC string of password hashed with a random salt
+func Hash(password string, p Params) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, keySize)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether password matches hash
+func Verify(password, hash string) (bool, error) {
+	p, salt, key, err := decode(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether hash was made with parameters other than p,
+// so it should be replaced after the next successful Verify
+func NeedsRehash(hash string, p Params) bool {
+	current, salt, key, err := decode(hash)
+	return err != nil || current != p || len(salt) != saltSize || len(key) != keySize
+}
+
+func decode(hash string) (p Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	if salt, err = encoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if key, err = encoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	return p, salt, key, nil
+}
+
+// Policy is what a new password has to satisfy
+type Policy struct {
+	MinLength int
+	MaxLength int
+
+	// MinCharacterClasses is how many of lowercase letters, uppercase
+	// letters, digits and other characters a password must mix
+	MinCharacterClasses int
+}
+
+// PolicyError describes why a password was rejected; its message can be
+// shown to the user
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+// Check returns a *PolicyError if password does not satisfy the policy.
+// Lengths count characters, not bytes.
+func (p Policy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return &PolicyError{Reason: fmt.Sprintf("Password must be at least %d characters", p.MinLength)}
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return &PolicyError{Reason: fmt.Sprintf("Password must be at most %d characters", p.MaxLength)}
+	}
+
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.MinCharacterClasses {
+		return &PolicyError{Reason: fmt.Sprintf("Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinCharacterClasses)}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// testParams keep the tests fast
+var testParams = Params{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func TestHashVerify(t *testing.T) {
+	hash, err := Hash("correct horse battery staple", testParams)
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("hash = %s, want the PHC string of testParams", hash)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{name: "right password", password: "correct horse battery staple", want: true},
+		{name: "wrong password", password: "correct horse battery stapler"},
+		{name: "different case", password: "Correct horse battery staple"},
+		{name: "empty", password: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify(tt.password, hash)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Verify = %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("salted", func(t *testing.T) {
+		other, err := Hash("correct horse battery staple", testParams)
+		if err != nil {
+			t.Fatalf("Hash: %v", err)
+		}
+		if other == hash {
+			t.Error("hashing a password twice gave the same hash")
+		}
+	})
+}
+
+func TestVerifyHonorsEncodedParams(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	encode := func(p Params, key []byte) string {
+		return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
+			p.Memory, p.Iterations, p.Parallelism, encoding.EncodeToString(salt), encoding.EncodeToString(key))
+	}
+
+	// A hash made elsewhere with parameters other than the defaults
+	p := Params{Memory: 2048, Iterations: 2, Parallelism: 3}
+	key := argon2.IDKey([]byte("secret"), salt, p.Iterations, p.Memory, p.Parallelism, 24)
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{name: "as encoded", hash: encode(p, key), want: true},
+		{name: "other memory", hash: encode(Params{Memory: 1024, Iterations: 2, Parallelism: 3}, key)},
+		{name: "other iterations", hash: encode(Params{Memory: 2048, Iterations: 1, Parallelism: 3}, key)},
+		{name: "other parallelism", hash: encode(Params{Memory: 2048, Iterations: 2, Parallelism: 1}, key)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify("secret", tt.hash)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Verify = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	valid, err := Hash("secret", testParams)
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	// withField replaces the i-th $-separated field of valid
+	withField := func(i int, field string) string {
+		fields := strings.Split(valid, "$")
+		fields[i] = field
+		return strings.Join(fields, "$")
+	}
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{name: "empty", hash: ""},
+		{name: "bcrypt", hash: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"},
+		{name: "argon2i", hash: withField(1, "argon2i")},
+		{name: "other version", hash: withField(2, "v=16")},
+		{name: "zero memory", hash: withField(3, "m=0,t=1,p=1")},
+		{name: "missing parameters", hash: withField(3, "m=1024")},
+		{name: "invalid salt", hash: withField(4, "!!")},
+		{name: "empty key", hash: withField(5, "")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify("secret", tt.hash); !errors.Is(err, ErrInvalidHash) {
+				t.Errorf("Verify = %v, want ErrInvalidHash", err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := Hash("secret", testParams)
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		p    Params
+		want bool
+	}{
+		{name: "current", hash: hash, p: testParams, want: false},
+		{name: "stronger params", hash: hash, p: Params{Memory: 2048, Iterations: 1, Parallelism: 1}, want: true},
+		{name: "invalid hash", hash: "invalid", p: testParams, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NeedsRehash(tt.hash, tt.p); got != tt.want {
+				t.Errorf("NeedsRehash = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := Policy{MinLength: 8, MaxLength: 12, MinCharacterClasses: 3}
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "acceptable", password: "Secret123"},
+		{name: "too short", password: "Sec123", wantErr: true},
+		{name: "too long", password: "Secret1234567", wantErr: true},
+		{name: "counts characters", password: "Sécrét123ÄÖ"},
+		{name: "too few classes", password: "secret123", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.password)
+			var policyErr *PolicyError
+			if tt.wantErr != errors.As(err, &policyErr) {
+				t.Errorf("Check = %v, want a *PolicyError: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Package revocation describes revoked access tokens and keeps a verifier's
+// copy of the auth service's revocation list in sync over server-sent
+// events.
+package revocation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+)
+
+// Server-sent event names of the revocation stream
+const (
+	// EventSnapshot carries a JSON array with every current Entry. It is
+	// the first event of a stream and replaces what the subscriber had.
+	EventSnapshot = "snapshot"
+
+	// EventRevoked carries a single new Entry
+	EventRevoked = "revoked"
+)
+
+// ErrNotSynced is returned by Subscriber.IsRevoked until the first snapshot
+// has arrived, so that a verifier does not accept revoked tokens on start
+var ErrNotSynced = errors.New("revocation list not synced yet")
+
+// Entry revokes either a single access token, by JTI, or every access token
+// of Subject issued before RevokedAt. Entries can be forgotten after
+// ExpiresAt, when the tokens they revoke have expired anyway.
+type Entry struct {
+	JTI       string    `json:"jti,omitempty"`
+	Subject   string    `json:"sub,omitempty"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Revokes reports whether e revokes the access token with claims
+func (e Entry) Revokes(claims *customJWT.Claims) bool {
+	if e.JTI != "" {
+		return e.JTI == claims.ID
+	}
+	if e.Subject == "" || e.Subject != claims.UserID.String() {
+		return false
+	}
+	// iat has whole seconds, so a token issued in the second of the
+	// revocation, such as the one refreshed right after it, counts as
+	// issued afterwards
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(e.RevokedAt.Truncate(time.Second))
+}
+
+// Subscriber follows the revocation stream of an auth service and answers
+// IsRevoked from memory. It satisfies the RevocationList of the auth
+// middleware.
+type Subscriber struct {
+	url          string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu       sync.RWMutex
+	synced   bool
+	jtis     map[string]Entry
+	subjects map[string]Entry
+}
+
+// NewSubscriber returns a Subscriber for the stream at url, typically
+// https://auth.example.com/oauth/revocations/stream, authenticating as a
+// confidential application. Call Run to start following it.
+func NewSubscriber(url, clientID, clientSecret string) *Subscriber {
+	return &Subscriber{
+		url:          url,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{},
+		jtis:         make(map[string]Entry),
+		subjects:     make(map[string]Entry),
+	}
+}
+
+// IsRevoked reports whether the access token with claims has been revoked
+func (s *Subscriber) IsRevoked(ctx context.Context, claims *customJWT.Claims) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.synced {
+		return false, ErrNotSynced
+	}
+	if e, ok := s.jtis[claims.ID]; ok && e.Revokes(claims) {
+		return true, nil
+	}
+	if e, ok := s.subjects[claims.UserID.String()]; ok && e.Revokes(claims) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// Run follows the stream until ctx is cancelled, reconnecting with backoff
+// when the connection fails. Every connection starts with a fresh snapshot,
+// so nothing revoked while disconnected is missed.
+func (s *Subscriber) Run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		err := s.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// follow reads one connection to the stream until it ends. It returns nil
+// if the connection delivered a snapshot.
+func (s *Subscriber) follow(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.SetBasicAuth(s.clientID, s.clientSecret)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to revocation stream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocation stream returned status %d", resp.StatusCode)
+	}
+
+	var gotSnapshot bool
+	var event string
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event != "" || data.Len() > 0 {
+				if err := s.apply(event, data.String()); err != nil {
+					return err
+				}
+				if event == EventSnapshot {
+					gotSnapshot = true
+				}
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// Comment, sent as a heartbeat
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if !gotSnapshot {
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read revocation stream: %w", err)
+		}
+		return errors.New("revocation stream ended before its snapshot")
+	}
+	return nil
+}
+
+// apply updates the list with one event of the stream
+func (s *Subscriber) apply(event, data string) error {
+	switch event {
+	case EventSnapshot:
+		var entries []Entry
+		if err := json.Unmarshal([]byte(data), &entries); err != nil {
+			return fmt.Errorf("failed to decode revocation snapshot: %w", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.jtis = make(map[string]Entry, len(entries))
+		s.subjects = make(map[string]Entry)
+		for _, e := range entries {
+			s.add(e)
+		}
+		s.synced = true
+	case EventRevoked:
+		var e Entry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("failed to decode revocation: %w", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.add(e)
+		s.purge()
+	}
+	return nil
+}
+
+// add records e. Callers hold mu.
+func (s *Subscriber) add(e Entry) {
+	switch {
+	case e.JTI != "":
+		s.jtis[e.JTI] = e
+	case e.Subject != "":
+		// A later revocation of a subject covers every earlier one
+		if old, ok := s.subjects[e.Subject]; !ok || e.RevokedAt.After(old.RevokedAt) {
+			s.subjects[e.Subject] = e
+		}
+	}
+}
+
+// purge forgets entries whose tokens have expired. Callers hold mu.
+func (s *Subscriber) purge() {
+	now := time.Now()
+	for jti, e := range s.jtis {
+		if e.ExpiresAt.Before(now) {
+			delete(s.jtis, jti)
+		}
+	}
+	for sub, e := range s.subjects {
+		if e.ExpiresAt.Before(now) {
+			delete(s.subjects, sub)
+		}
+	}
+}
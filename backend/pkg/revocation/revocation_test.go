@@ -0,0 +1,163 @@
+package revocation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	customJWT "github.com/frans-sjostrom/auth-service/pkg/jwt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// revokedAt is a revocation in the middle of a second, as stored with
+// microseconds
+var revokedAt = time.Date(2026, 10, 16, 12, 0, 0, 500_000_000, time.UTC)
+
+func claimsIssuedAt(userID uuid.UUID, iat time.Time) *customJWT.Claims {
+	return &customJWT.Claims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       uuid.NewString(),
+			IssuedAt: jwt.NewNumericDate(iat),
+		},
+	}
+}
+
+func TestEntryRevokes(t *testing.T) {
+	userID := uuid.New()
+	entry := Entry{Subject: userID.String(), RevokedAt: revokedAt, ExpiresAt: revokedAt.Add(time.Hour)}
+
+	tests := []struct {
+		name   string
+		claims *customJWT.Claims
+		want   bool
+	}{
+		{name: "issued the second before", claims: claimsIssuedAt(userID, revokedAt.Add(-time.Second)), want: true},
+		{name: "issued in the same second", claims: claimsIssuedAt(userID, revokedAt), want: false},
+		{name: "issued the second after", claims: claimsIssuedAt(userID, revokedAt.Add(time.Second)), want: false},
+		{name: "without iat", claims: &customJWT.Claims{UserID: userID}, want: true},
+		{name: "other user", claims: claimsIssuedAt(uuid.New(), revokedAt.Add(-time.Second)), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entry.Revokes(tt.claims); got != tt.want {
+				t.Errorf("Revokes = %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("jti", func(t *testing.T) {
+		claims := claimsIssuedAt(userID, revokedAt.Add(time.Minute))
+		if !(Entry{JTI: claims.ID}).Revokes(claims) {
+			t.Error("entry does not revoke the token with its jti")
+		}
+		if (Entry{JTI: uuid.NewString()}).Revokes(claims) {
+			t.Error("entry revokes a token with another jti")
+		}
+	})
+}
+
+// streamServer serves a revocation stream with entries as its snapshot
+func streamServer(t *testing.T, entries []Entry) *httptest.Server {
+	t.Helper()
+
+	snapshot, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", EventSnapshot, snapshot)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// syncedSubscriber follows srv until its snapshot has arrived
+func syncedSubscriber(t *testing.T, srv *httptest.Server) *Subscriber {
+	t.Helper()
+
+	s := NewSubscriber(srv.URL, "client", "secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		srv.CloseClientConnections()
+		<-done
+	})
+
+	probe := claimsIssuedAt(uuid.New(), time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := s.IsRevoked(ctx, probe)
+		if err == nil {
+			return s
+		}
+		if !errors.Is(err, ErrNotSynced) || time.Now().After(deadline) {
+			t.Fatalf("subscriber did not sync: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscriberIsRevoked(t *testing.T) {
+	userID := uuid.New()
+	revokedJTI := uuid.NewString()
+	srv := streamServer(t, []Entry{
+		{Subject: userID.String(), RevokedAt: revokedAt, ExpiresAt: time.Now().Add(time.Hour)},
+		{JTI: revokedJTI, RevokedAt: revokedAt, ExpiresAt: time.Now().Add(time.Hour)},
+	})
+	s := syncedSubscriber(t, srv)
+
+	byJTI := claimsIssuedAt(uuid.New(), revokedAt.Add(time.Minute))
+	byJTI.ID = revokedJTI
+
+	tests := []struct {
+		name   string
+		claims *customJWT.Claims
+		want   bool
+	}{
+		{name: "issued the second before", claims: claimsIssuedAt(userID, revokedAt.Add(-time.Second)), want: true},
+		{name: "issued in the same second", claims: claimsIssuedAt(userID, revokedAt), want: false},
+		{name: "issued after", claims: claimsIssuedAt(userID, revokedAt.Add(time.Minute)), want: false},
+		{name: "revoked jti", claims: byJTI, want: true},
+		{name: "other user", claims: claimsIssuedAt(uuid.New(), revokedAt.Add(-time.Second)), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.IsRevoked(context.Background(), tt.claims)
+			if err != nil {
+				t.Fatalf("IsRevoked: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("IsRevoked = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriberNotSynced(t *testing.T) {
+	s := NewSubscriber("http://127.0.0.1:0", "client", "secret")
+	if _, err := s.IsRevoked(context.Background(), claimsIssuedAt(uuid.New(), time.Now())); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("IsRevoked before a snapshot = %v, want ErrNotSynced", err)
+	}
+}
@@ -0,0 +1,98 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of the RFC 6238 appendix B test vectors
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	// Appendix B lists 8 digit codes; these are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+			if err != nil {
+				t.Fatalf("Code: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("lowercase secret", func(t *testing.T) {
+		got, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+		if err != nil || got != "287082" {
+			t.Errorf("Code = %s, %v, want 287082", got, err)
+		}
+	})
+
+	t.Run("invalid secret", func(t *testing.T) {
+		if _, err := Code("not base32!", 1); err == nil {
+			t.Error("Code accepted an invalid secret")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name     string
+		code     string
+		skew     int
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", code: "050471", skew: 1, wantStep: step, wantOK: true},
+		{name: "previous step within skew", code: "081804", skew: 1, wantStep: step - 1, wantOK: true},
+		{name: "previous step without skew", code: "081804", skew: 0},
+		{name: "wrong code", code: "123456", skew: 1},
+		{name: "too short", code: "05047", skew: 1},
+		{name: "too long", code: "0504711", skew: 1},
+		{name: "empty", skew: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := Validate(rfcSecret, tt.code, now, tt.skew)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("Validate = %d, %t, want %d, %t", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	if a == b {
+		t.Error("GenerateSecret returned the same secret twice")
+	}
+	if _, err := Code(a, 0); err != nil {
+		t.Errorf("generated secret does not decode: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn/internal/cbor"
+)
+
+// COSE algorithm identifiers (RFC 9053) accepted for credentials, in order
+// of preference
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms are offered in registration options
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters
+const (
+	coseKeyType  = 1
+	coseKeyAlg   = 3
+	coseKeyCurve = -1 // n for RSA
+	coseKeyX     = -2 // e for RSA
+	coseKeyY     = -3
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// publicKey is a parsed COSE_Key
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parsePublicKey parses a COSE_Key and returns the bytes following it
+func parsePublicKey(data []byte) (*publicKey, []byte, error) {
+	v, rest, err := cbor.Decode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errors.New("invalid public key: not a map")
+	}
+
+	kty, _ := m[int64(coseKeyType)].(int64)
+	alg, _ := m[int64(coseKeyAlg)].(int64)
+
+	pub := &publicKey{alg: alg}
+	switch {
+	case kty == coseKeyTypeEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseKeyCurve)].(int64)
+		x, _ := m[int64(coseKeyX)].([]byte)
+		y, _ := m[int64(coseKeyY)].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, nil, errors.New("invalid public key: bad EC2 parameters")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, nil, errors.New("invalid public key: point not on curve")
+		}
+		pub.key = key
+
+	case kty == coseKeyTypeOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseKeyCurve)].(int64)
+		x, _ := m[int64(coseKeyX)].([]byte)
+		if crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("invalid public key: bad OKP parameters")
+		}
+		pub.key = ed25519.PublicKey(x)
+
+	case kty == coseKeyTypeRSA && alg == AlgRS256:
+		n, _ := m[int64(coseKeyCurve)].([]byte)
+		e, _ := m[int64(coseKeyX)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, nil, errors.New("invalid public key: bad RSA parameters")
+		}
+		pub.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported public key type %d with algorithm %d", kty, alg)
+	}
+
+	return pub, rest, nil
+}
+
+// verify checks a signature made with the credential's private key
+func (p *publicKey) verify(data, sig []byte) error {
+	ok := false
+	switch key := p.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// EncodeES256PublicKey encodes a P-256 key as a COSE_Key
+func EncodeES256PublicKey(key *ecdsa.PublicKey) ([]byte, error) {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+
+	return cbor.Encode(map[interface{}]interface{}{
+		int64(coseKeyType):  int64(coseKeyTypeEC2),
+		int64(coseKeyAlg):   int64(AlgES256),
+		int64(coseKeyCurve): int64(coseCurveP256),
+		int64(coseKeyX):     x,
+		int64(coseKeyY):     y,
+	})
+}
@@ -0,0 +1,252 @@
+// Package cbor implements the subset of CBOR (RFC 8949) used by WebAuthn:
+// definite-length integers, byte and text strings, arrays, maps and simple
+// values. Floats, tags and indefinite lengths are not supported.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	majorUnsigned = 0
+	majorNegative = 1
+	majorBytes    = 2
+	majorText     = 3
+	majorArray    = 4
+	majorMap      = 5
+	majorSimple   = 7
+)
+
+// maxDepth bounds nesting so hostile input cannot exhaust the stack
+const maxDepth = 16
+
+var errTruncated = errors.New("cbor: unexpected end of data")
+
+// Decode decodes the first CBOR item in data and returns the rest. Integers
+// decode to int64, byte strings to []byte, text to string, arrays to
+// []interface{} and maps to map[interface{}]interface{}.
+func Decode(data []byte) (v interface{}, rest []byte, err error) {
+	return decode(data, 0)
+}
+
+func decode(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == majorSimple {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	arg, data, err := readArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case majorUnsigned:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), data, nil
+
+	case majorNegative:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), data, nil
+
+	case majorBytes, majorText:
+		if uint64(len(data)) < arg {
+			return nil, nil, errTruncated
+		}
+		if major == majorText {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return append([]byte(nil), data[:arg]...), data[arg:], nil
+
+	case majorArray:
+		if arg > uint64(len(data)) {
+			return nil, nil, errTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			item, data, err = decode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+
+	case majorMap:
+		if arg > uint64(len(data)) {
+			return nil, nil, errTruncated
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, data, err = decode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			value, data, err = decode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	}
+
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+func readArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, nil, errTruncated
+		}
+		return uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, nil, errTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, nil, errTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, nil, errTruncated
+		}
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	default:
+		return 0, nil, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+}
+
+// Encode encodes v, which may be built from the types Decode returns (plus
+// int and bool). Map keys are sorted in CTAP2 canonical order.
+func Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(majorSimple<<5 | 22)
+	case bool:
+		if v {
+			buf.WriteByte(majorSimple<<5 | 21)
+		} else {
+			buf.WriteByte(majorSimple<<5 | 20)
+		}
+	case int:
+		return encode(buf, int64(v))
+	case int64:
+		if v >= 0 {
+			writeHead(buf, majorUnsigned, uint64(v))
+		} else {
+			writeHead(buf, majorNegative, uint64(-1-v))
+		}
+	case []byte:
+		writeHead(buf, majorBytes, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		writeHead(buf, majorText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeHead(buf, majorArray, uint64(len(v)))
+		for _, item := range v {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		type entry struct{ key, value []byte }
+		entries := make([]entry, 0, len(v))
+		for key, value := range v {
+			k, err := Encode(key)
+			if err != nil {
+				return err
+			}
+			val, err := Encode(value)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{k, val})
+		}
+		// Shorter keys first, then bytewise
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i].key, entries[j].key
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return bytes.Compare(a, b) < 0
+		})
+		writeHead(buf, majorMap, uint64(len(entries)))
+		for _, e := range entries {
+			buf.Write(e.key)
+			buf.Write(e.value)
+		}
+	default:
+		return fmt.Errorf("cbor: cannot encode %T", v)
+	}
+	return nil
+}
+
+func writeHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
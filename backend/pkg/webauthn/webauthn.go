@@ -0,0 +1,452 @@
+// Package webauthn implements the relying party side of Web Authentication
+// (W3C WebAuthn Level 2) for passkeys: registration and authentication
+// ceremonies with ES256, EdDSA and RS256 credentials.
+//
+// Attestation statements are not verified; any authenticator model is
+// accepted. The caller stores challenges and credentials.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn/internal/cbor"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagBackupEligible         = 0x08
+	flagBackupState            = 0x10
+	flagAttestedCredentialData = 0x40
+	flagExtensionData          = 0x80
+)
+
+// maxCredentialIDLength is the limit set by the specification
+const maxCredentialIDLength = 1023
+
+var (
+	// ErrInvalidSignature is returned when an assertion signature does not
+	// verify with the credential's public key
+	ErrInvalidSignature = errors.New("webauthn: invalid signature")
+
+	// ErrSignCountRegression is returned when an authenticator reports a
+	// signature counter that is not above the stored one, which means the
+	// credential may have been cloned
+	ErrSignCountRegression = errors.New("webauthn: signature counter did not increase")
+)
+
+// Config describes the relying party
+type Config struct {
+	// RPID is the domain credentials are scoped to, e.g. "example.com"
+	RPID   string
+	RPName string
+
+	// Origins are the exact origins ceremonies may run on
+	Origins []string
+
+	// Timeout is the hint given to browsers for how long a ceremony may take
+	Timeout time.Duration
+}
+
+// RelyingParty creates ceremony options and verifies their results
+type RelyingParty struct {
+	cfg      Config
+	rpIDHash [32]byte
+}
+
+func New(cfg Config) *RelyingParty {
+	return &RelyingParty{
+		cfg:      cfg,
+		rpIDHash: sha256.Sum256([]byte(cfg.RPID)),
+	}
+}
+
+// Bytes is binary data encoded as unpadded base64url in JSON, as in the
+// WebAuthn JSON serialization
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return fmt.Errorf("webauthn: invalid base64url: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+type RPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the PublicKeyCredentialCreationOptions passed to
+// navigator.credentials.create()
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RPEntity               `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the PublicKeyCredentialRequestOptions passed to
+// navigator.credentials.get()
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationResponse is the JSON form of the PublicKeyCredential returned by
+// navigator.credentials.create()
+type CreationResponse struct {
+	ID       string              `json:"id"`
+	RawID    Bytes               `json:"rawId"`
+	Type     string              `json:"type"`
+	Response AttestationResponse `json:"response"`
+}
+
+type AttestationResponse struct {
+	ClientDataJSON    Bytes    `json:"clientDataJSON"`
+	AttestationObject Bytes    `json:"attestationObject"`
+	Transports        []string `json:"transports,omitempty"`
+}
+
+// AssertionResponse is the JSON form of the PublicKeyCredential returned by
+// navigator.credentials.get()
+type AssertionResponse struct {
+	ID       string                 `json:"id"`
+	RawID    Bytes                  `json:"rawId"`
+	Type     string                 `json:"type"`
+	Response AuthenticatorAssertion `json:"response"`
+}
+
+type AuthenticatorAssertion struct {
+	ClientDataJSON    Bytes `json:"clientDataJSON"`
+	AuthenticatorData Bytes `json:"authenticatorData"`
+	Signature         Bytes `json:"signature"`
+	UserHandle        Bytes `json:"userHandle,omitempty"`
+}
+
+// Credential is a newly registered credential
+type Credential struct {
+	ID []byte
+
+	// PublicKey is the credential's COSE_Key
+	PublicKey []byte
+
+	SignCount      uint32
+	AAGUID         []byte
+	Transports     []string
+	UserVerified   bool
+	BackupEligible bool
+	BackupState    bool
+}
+
+// Assertion is a verified authentication with a credential
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+	BackupState  bool
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Attested credential data, present during registration
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// NewChallenge returns a random ceremony challenge
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// CreationOptions returns options for registering a discoverable credential
+// (a passkey) for user. exclude lists the user's existing credentials so an
+// authenticator is not registered twice.
+func (rp *RelyingParty) CreationOptions(challenge []byte, user UserEntity, exclude []CredentialDescriptor) *CreationOptions {
+	params := make([]CredentialParameter, len(SupportedAlgorithms))
+	for i, alg := range SupportedAlgorithms {
+		params[i] = CredentialParameter{Type: "public-key", Alg: alg}
+	}
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+
+	return &CreationOptions{
+		Challenge:          challenge,
+		RP:                 RPEntity{ID: rp.cfg.RPID, Name: rp.cfg.RPName},
+		User:               user,
+		PubKeyCredParams:   params,
+		Timeout:            rp.cfg.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "preferred",
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns options for authenticating with one of allow, or
+// with any discoverable credential when allow is empty
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow []CredentialDescriptor) *RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.cfg.Timeout.Milliseconds(),
+		RPID:             rp.cfg.RPID,
+		AllowCredentials: allow,
+		UserVerification: "preferred",
+	}
+}
+
+// Challenge returns the challenge a ceremony response was made for, so the
+// caller can look up the ceremony before verifying it
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, fmt.Errorf("webauthn: invalid client data: %w", err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// VerifyRegistration checks the response to CreationOptions made with
+// challenge and returns the new credential
+func (rp *RelyingParty) VerifyRegistration(resp *CreationResponse, challenge []byte) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, fmt.Errorf("webauthn: unexpected credential type %q", resp.Type)
+	}
+
+	if err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	v, _, err := cbor.Decode(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid attestation object: %w", err)
+	}
+	attestation, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("webauthn: attestation object has no authenticator data")
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return nil, errors.New("webauthn: no attested credential data")
+	}
+	if !bytes.Equal(authData.credentialID, resp.RawID) {
+		return nil, errors.New("webauthn: credential ID mismatch")
+	}
+
+	return &Credential{
+		ID:             authData.credentialID,
+		PublicKey:      authData.publicKey,
+		SignCount:      authData.signCount,
+		AAGUID:         authData.aaguid,
+		Transports:     resp.Response.Transports,
+		UserVerified:   authData.flags&flagUserVerified != 0,
+		BackupEligible: authData.flags&flagBackupEligible != 0,
+		BackupState:    authData.flags&flagBackupState != 0,
+	}, nil
+}
+
+// VerifyAssertion checks the response to RequestOptions made with challenge
+// against a stored credential's COSE public key and signature counter
+func (rp *RelyingParty) VerifyAssertion(resp *AssertionResponse, challenge, publicKey []byte, signCount uint32) (*Assertion, error) {
+	if resp.Type != "public-key" {
+		return nil, fmt.Errorf("webauthn: unexpected credential type %q", resp.Type)
+	}
+
+	if err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	authData, err := rp.parseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: stored %w", err)
+	}
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), resp.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.verify(signed, resp.Response.Signature); err != nil {
+		return nil, err
+	}
+
+	// Authenticators that do not count (most passkey providers) always
+	// report zero
+	if (authData.signCount != 0 || signCount != 0) && authData.signCount <= signCount {
+		return nil, ErrSignCountRegression
+	}
+
+	return &Assertion{
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+		BackupState:  authData.flags&flagBackupState != 0,
+	}, nil
+}
+
+func (rp *RelyingParty) verifyClientData(data []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return fmt.Errorf("webauthn: invalid client data: %w", err)
+	}
+
+	if cd.Type != ceremony {
+		return fmt.Errorf("webauthn: unexpected client data type %q", cd.Type)
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("webauthn: challenge mismatch")
+	}
+
+	if !slices.Contains(rp.cfg.Origins, cd.Origin) {
+		return fmt.Errorf("webauthn: origin %q not allowed", cd.Origin)
+	}
+	if cd.CrossOrigin {
+		return errors.New("webauthn: cross-origin ceremonies are not allowed")
+	}
+
+	return nil
+}
+
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+
+	authData := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if subtle.ConstantTimeCompare(authData.rpIDHash, rp.rpIDHash[:]) != 1 {
+		return nil, errors.New("webauthn: RP ID mismatch")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return nil, errors.New("webauthn: user not present")
+	}
+	if authData.flags&flagBackupState != 0 && authData.flags&flagBackupEligible == 0 {
+		return nil, errors.New("webauthn: invalid backup flags")
+	}
+
+	rest := data[37:]
+	if authData.flags&flagAttestedCredentialData != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("webauthn: attested credential data too short")
+		}
+		authData.aaguid = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > maxCredentialIDLength || len(rest) < idLength {
+			return nil, errors.New("webauthn: invalid credential ID")
+		}
+		authData.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, after, err := parsePublicKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("webauthn: %w", err)
+		}
+		authData.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	if authData.flags&flagExtensionData != 0 {
+		var err error
+		if _, rest, err = cbor.Decode(rest); err != nil {
+			return nil, fmt.Errorf("webauthn: invalid extension data: %w", err)
+		}
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("webauthn: trailing authenticator data")
+	}
+
+	return authData, nil
+}
@@ -0,0 +1,269 @@
+package webauthn_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn/webauthntest"
+)
+
+const testOrigin = "https://auth.example.com"
+
+func newRelyingParty() *webauthn.RelyingParty {
+	return webauthn.New(webauthn.Config{
+		RPID:    "auth.example.com",
+		RPName:  "Auth Service",
+		Origins: []string{testOrigin},
+		Timeout: 5 * time.Minute,
+	})
+}
+
+func newChallenge(t *testing.T) []byte {
+	t.Helper()
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge: %v", err)
+	}
+	return challenge
+}
+
+// register creates a credential on a and verifies it with rp
+func register(t *testing.T, rp *webauthn.RelyingParty, a *webauthntest.Authenticator) *webauthn.Credential {
+	t.Helper()
+
+	challenge := newChallenge(t)
+	user := webauthn.UserEntity{ID: []byte("user-123"), Name: "ada@example.com", DisplayName: "Ada"}
+	resp, err := a.Create(rp.CreationOptions(challenge, user, nil))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	cred, err := rp.VerifyRegistration(resp, challenge)
+	if err != nil {
+		t.Fatalf("VerifyRegistration: %v", err)
+	}
+	return cred
+}
+
+// assert signs in with cred on a, returning the response and its challenge
+func assert(t *testing.T, rp *webauthn.RelyingParty, a *webauthntest.Authenticator, cred *webauthn.Credential) (*webauthn.AssertionResponse, []byte) {
+	t.Helper()
+
+	challenge := newChallenge(t)
+	allow := []webauthn.CredentialDescriptor{{Type: "public-key", ID: cred.ID}}
+	resp, err := a.Get(rp.RequestOptions(challenge, allow))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return resp, challenge
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	rp := newRelyingParty()
+	a := webauthntest.NewAuthenticator(testOrigin)
+
+	cred := register(t, rp, a)
+	if string(cred.ID) != string(a.Credentials()[0].ID) {
+		t.Errorf("credential ID = %x, want %x", cred.ID, a.Credentials()[0].ID)
+	}
+	if !cred.UserVerified || !cred.BackupEligible || !cred.BackupState {
+		t.Errorf("flags = UV %t, BE %t, BS %t, want all set", cred.UserVerified, cred.BackupEligible, cred.BackupState)
+	}
+	if cred.SignCount != 0 {
+		t.Errorf("sign count = %d, want 0", cred.SignCount)
+	}
+
+	// Passkey providers that do not count keep reporting zero
+	for range 2 {
+		resp, challenge := assert(t, rp, a, cred)
+		assertion, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, cred.SignCount)
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if !assertion.UserVerified || assertion.SignCount != 0 {
+			t.Errorf("assertion = %+v, want user verified with sign count 0", assertion)
+		}
+	}
+
+	// Discoverable sign-in, without allowCredentials
+	challenge := newChallenge(t)
+	resp, err := a.Get(rp.RequestOptions(challenge, nil))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(resp.Response.UserHandle) != "user-123" {
+		t.Errorf("user handle = %q, want user-123", resp.Response.UserHandle)
+	}
+	if _, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, 0); err != nil {
+		t.Errorf("VerifyAssertion of a discoverable sign-in: %v", err)
+	}
+}
+
+func TestRegistrationExcludesCredentials(t *testing.T) {
+	rp := newRelyingParty()
+	a := webauthntest.NewAuthenticator(testOrigin)
+	cred := register(t, rp, a)
+
+	user := webauthn.UserEntity{ID: []byte("user-123"), Name: "ada@example.com", DisplayName: "Ada"}
+	exclude := []webauthn.CredentialDescriptor{{Type: "public-key", ID: cred.ID}}
+	if _, err := a.Create(rp.CreationOptions(newChallenge(t), user, exclude)); err == nil {
+		t.Error("Create succeeded for an authenticator holding an excluded credential")
+	}
+}
+
+func TestRegistrationRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		tamper func(resp *webauthn.CreationResponse, challenge []byte) []byte
+	}{
+		{
+			name:   "other origin",
+			origin: "https://evil.example.com",
+		},
+		{
+			name: "other challenge",
+			tamper: func(resp *webauthn.CreationResponse, challenge []byte) []byte {
+				return []byte("another challenge")
+			},
+		},
+		{
+			name: "credential ID mismatch",
+			tamper: func(resp *webauthn.CreationResponse, challenge []byte) []byte {
+				resp.RawID = append([]byte(nil), resp.RawID...)
+				resp.RawID[0] ^= 0xff
+				return challenge
+			},
+		},
+		{
+			name: "not a public key credential",
+			tamper: func(resp *webauthn.CreationResponse, challenge []byte) []byte {
+				resp.Type = "password"
+				return challenge
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newRelyingParty()
+			origin := testOrigin
+			if tt.origin != "" {
+				origin = tt.origin
+			}
+			a := webauthntest.NewAuthenticator(origin)
+
+			challenge := newChallenge(t)
+			user := webauthn.UserEntity{ID: []byte("user-123"), Name: "ada@example.com", DisplayName: "Ada"}
+			resp, err := a.Create(rp.CreationOptions(challenge, user, nil))
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			if tt.tamper != nil {
+				challenge = tt.tamper(resp, challenge)
+			}
+
+			if _, err := rp.VerifyRegistration(resp, challenge); err == nil {
+				t.Error("VerifyRegistration succeeded")
+			}
+		})
+	}
+}
+
+func TestAssertionRejects(t *testing.T) {
+	rp := newRelyingParty()
+	a := webauthntest.NewAuthenticator(testOrigin)
+	cred := register(t, rp, a)
+
+	other := webauthntest.NewAuthenticator(testOrigin)
+	otherCred := register(t, rp, other)
+
+	t.Run("other challenge", func(t *testing.T) {
+		resp, _ := assert(t, rp, a, cred)
+		if _, err := rp.VerifyAssertion(resp, newChallenge(t), cred.PublicKey, 0); err == nil {
+			t.Error("VerifyAssertion succeeded")
+		}
+	})
+
+	t.Run("other public key", func(t *testing.T) {
+		resp, challenge := assert(t, rp, a, cred)
+		_, err := rp.VerifyAssertion(resp, challenge, otherCred.PublicKey, 0)
+		if !errors.Is(err, webauthn.ErrInvalidSignature) {
+			t.Errorf("VerifyAssertion = %v, want ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("tampered authenticator data", func(t *testing.T) {
+		resp, challenge := assert(t, rp, a, cred)
+		resp.Response.AuthenticatorData = append([]byte(nil), resp.Response.AuthenticatorData...)
+		resp.Response.AuthenticatorData[36]++ // sign count
+		_, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, 0)
+		if !errors.Is(err, webauthn.ErrInvalidSignature) {
+			t.Errorf("VerifyAssertion = %v, want ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("registration client data", func(t *testing.T) {
+		challenge := newChallenge(t)
+		user := webauthn.UserEntity{ID: []byte("user-123"), Name: "ada@example.com", DisplayName: "Ada"}
+		created, err := other.Create(rp.CreationOptions(challenge, user, nil))
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		resp, _ := assert(t, rp, a, cred)
+		resp.Response.ClientDataJSON = created.Response.ClientDataJSON
+		if _, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, 0); err == nil {
+			t.Error("VerifyAssertion succeeded")
+		}
+	})
+
+	t.Run("other RP", func(t *testing.T) {
+		otherRP := webauthn.New(webauthn.Config{RPID: "example.org", Origins: []string{testOrigin}})
+		resp, challenge := assert(t, rp, a, cred)
+		if _, err := otherRP.VerifyAssertion(resp, challenge, cred.PublicKey, 0); err == nil {
+			t.Error("VerifyAssertion succeeded")
+		}
+	})
+}
+
+func TestSignCountRegression(t *testing.T) {
+	rp := newRelyingParty()
+	a := webauthntest.NewAuthenticator(testOrigin)
+	a.CountSignatures = true
+	cred := register(t, rp, a)
+
+	stored := cred.SignCount
+	for want := uint32(1); want <= 2; want++ {
+		resp, challenge := assert(t, rp, a, cred)
+		assertion, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, stored)
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if assertion.SignCount != want {
+			t.Fatalf("sign count = %d, want %d", assertion.SignCount, want)
+		}
+		stored = assertion.SignCount
+	}
+
+	t.Run("replayed counter", func(t *testing.T) {
+		// A clone of the authenticator made after the first sign-in
+		a.Credentials()[0].SignCount = 1
+		resp, challenge := assert(t, rp, a, cred)
+		_, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, stored)
+		if !errors.Is(err, webauthn.ErrSignCountRegression) {
+			t.Errorf("VerifyAssertion = %v, want ErrSignCountRegression", err)
+		}
+	})
+
+	t.Run("counter reset to zero", func(t *testing.T) {
+		a.CountSignatures = false
+		a.Credentials()[0].SignCount = 0
+		resp, challenge := assert(t, rp, a, cred)
+		_, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, stored)
+		if !errors.Is(err, webauthn.ErrSignCountRegression) {
+			t.Errorf("VerifyAssertion = %v, want ErrSignCountRegression", err)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+// Package webauthntest provides a software authenticator for exercising
+// WebAuthn ceremonies in Go tests without a browser.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn"
+	"github.com/frans-sjostrom/auth-service/pkg/webauthn/internal/cbor"
+)
+
+// Authenticator is an in-memory passkey provider creating ES256 credentials
+type Authenticator struct {
+	// Origin is reported in client data, as a browser would
+	Origin string
+
+	// UserVerified sets the UV flag, as after a PIN or biometric check
+	UserVerified bool
+
+	// CountSignatures makes the authenticator increment a signature counter;
+	// otherwise it always reports zero like most passkey providers
+	CountSignatures bool
+
+	credentials []*Credential
+}
+
+// Credential is a credential held by an Authenticator
+type Credential struct {
+	ID         []byte
+	RPID       string
+	UserHandle []byte
+	PrivateKey *ecdsa.PrivateKey
+	SignCount  uint32
+}
+
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Credentials returns the credentials created so far
+func (a *Authenticator) Credentials() []*Credential {
+	return a.credentials
+}
+
+// Create performs navigator.credentials.create() with opts
+func (a *Authenticator) Create(opts *webauthn.CreationOptions) (*webauthn.CreationResponse, error) {
+	supported := false
+	for _, param := range opts.PubKeyCredParams {
+		if param.Alg == webauthn.AlgES256 {
+			supported = true
+		}
+	}
+	if !supported {
+		return nil, errors.New("webauthntest: ES256 not offered")
+	}
+
+	for _, excluded := range opts.ExcludeCredentials {
+		if a.find(opts.RP.ID, excluded.ID) != nil {
+			return nil, errors.New("webauthntest: credential already registered")
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	cred := &Credential{ID: id, RPID: opts.RP.ID, UserHandle: opts.User.ID, PrivateKey: key}
+	a.credentials = append(a.credentials, cred)
+
+	publicKey, err := webauthn.EncodeES256PublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, publicKey...)
+
+	authData := a.authenticatorData(cred, 0x40, attested)
+
+	attestationObject, err := cbor.Encode(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataJSON, err := a.clientData("webauthn.create", opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.CreationResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(id),
+		RawID: id,
+		Type:  "public-key",
+		Response: webauthn.AttestationResponse{
+			ClientDataJSON:    clientDataJSON,
+			AttestationObject: attestationObject,
+			Transports:        []string{"internal"},
+		},
+	}, nil
+}
+
+// Get performs navigator.credentials.get() with opts, using the first
+// allowed credential or, without allowCredentials, the first credential
+// for the RP
+func (a *Authenticator) Get(opts *webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	var cred *Credential
+	if len(opts.AllowCredentials) == 0 {
+		cred = a.find(opts.RPID, nil)
+	}
+	for _, allowed := range opts.AllowCredentials {
+		if cred = a.find(opts.RPID, allowed.ID); cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		return nil, errors.New("webauthntest: no matching credential")
+	}
+
+	if a.CountSignatures {
+		cred.SignCount++
+	}
+	authData := a.authenticatorData(cred, 0, nil)
+
+	clientDataJSON, err := a.clientData("webauthn.get", opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.PrivateKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.AssertionResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(cred.ID),
+		RawID: cred.ID,
+		Type:  "public-key",
+		Response: webauthn.AuthenticatorAssertion{
+			ClientDataJSON:    clientDataJSON,
+			AuthenticatorData: authData,
+			Signature:         signature,
+			UserHandle:        cred.UserHandle,
+		},
+	}, nil
+}
+
+func (a *Authenticator) find(rpID string, id []byte) *Credential {
+	for _, cred := range a.credentials {
+		if cred.RPID == rpID && (id == nil || bytes.Equal(cred.ID, id)) {
+			return cred
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) authenticatorData(cred *Credential, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(cred.RPID))
+
+	// User present; passkeys are backup eligible and backed up
+	flags |= 0x01 | 0x08 | 0x10
+	if a.UserVerified {
+		flags |= 0x04
+	}
+
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, cred.SignCount)
+	return append(data, attested...)
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+}
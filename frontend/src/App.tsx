@@ -4,7 +4,14 @@ import { ProtectedRoute } from './components/Auth/ProtectedRoute'
 import AdminRoute from './components/Auth/AdminRoute'
 import LoginPage from './pages/Login'
 import AuthCallback from './pages/AuthCallback'
+import MFAPage from './pages/MFA'
+import RegisterPage from './pages/Register'
+import VerifyEmailPage from './pages/VerifyEmail'
+import ForgotPasswordPage from './pages/ForgotPassword'
+import ResetPasswordPage from './pages/ResetPassword'
+import EmailLoginPage from './pages/EmailLogin'
 import Dashboard from './pages/Dashboard'
+import AcceptInvitePage from './pages/AcceptInvite'
 import Users from './pages/Admin/Users'
 import Layout from './components/Layout/Layout'
 
@@ -15,6 +22,12 @@ function App() {
         <Routes>
           <Route path="/login" element={<LoginPage />} />
           <Route path="/auth/callback" element={<AuthCallback />} />
+          <Route path="/mfa" element={<MFAPage />} />
+          <Route path="/register" element={<RegisterPage />} />
+          <Route path="/verify-email" element={<VerifyEmailPage />} />
+          <Route path="/forgot-password" element={<ForgotPasswordPage />} />
+          <Route path="/reset-password" element={<ResetPasswordPage />} />
+          <Route path="/email-login" element={<EmailLoginPage />} />
 
           <Route element={<Layout />}>
             <Route
@@ -25,6 +38,14 @@ function App() {
                 </ProtectedRoute>
               }
             />
+            <Route
+              path="/invite"
+              element={
+                <ProtectedRoute>
+                  <AcceptInvitePage />
+                </ProtectedRoute>
+              }
+            />
             <Route
               path="/admin/users"
               element={
@@ -0,0 +1,91 @@
+import { useEffect, useState } from 'react'
+import { useSearchParams } from 'react-router-dom'
+import { authAPI, IdentityProvider, UserIdentity } from '../../services/api'
+
+const linkErrors: Record<string, string> = {
+  identity_in_use: 'That account is already linked to another user.',
+  invalid_request: 'The link request expired. Please try again.',
+}
+
+export default function LinkedAccounts() {
+  const [searchParams] = useSearchParams()
+  const [identities, setIdentities] = useState<UserIdentity[]>([])
+  const [providers, setProviders] = useState<IdentityProvider[]>([])
+  const [error, setError] = useState<string | null>(null)
+
+  const load = async () => {
+    try {
+      const [identities, providers] = await Promise.all([
+        authAPI.listIdentities(),
+        authAPI.getProviders(),
+      ])
+      setIdentities(identities)
+      setProviders(providers)
+    } catch (error) {
+      console.error('Failed to load linked accounts:', error)
+    }
+  }
+
+  useEffect(() => {
+    load()
+    const linkError = searchParams.get('link_error')
+    if (linkError) {
+      setError(linkErrors[linkError] || 'Failed to link account.')
+    }
+  }, [searchParams])
+
+  const unlink = async (id: string) => {
+    setError(null)
+    try {
+      await authAPI.unlinkIdentity(id)
+      await load()
+    } catch (error) {
+      console.error('Failed to unlink account:', error)
+      setError('Failed to unlink account. You cannot remove your only sign-in method.')
+    }
+  }
+
+  const displayName = (name: string) =>
+    providers.find((p) => p.name === name)?.display_name || name
+
+  const linked = new Set(identities.map((i) => i.provider))
+
+  return (
+    <div className="bg-white dark:bg-gray-800 shadow rounded-lg p-6 mb-6">
+      <h2 className="text-xl font-semibold text-gray-900 dark:text-white mb-4">
+        Linked Accounts
+      </h2>
+      {error && <p className="text-sm text-red-600 dark:text-red-400 mb-3">{error}</p>}
+      <ul className="space-y-3">
+        {identities.map((identity) => (
+          <li key={identity.id} className="flex items-center justify-between">
+            <div>
+              <p className="text-gray-900 dark:text-white">{displayName(identity.provider)}</p>
+              <p className="text-sm text-gray-500 dark:text-gray-400">{identity.email}</p>
+            </div>
+            <button
+              onClick={() => unlink(identity.id)}
+              disabled={identities.length === 1}
+              className="text-sm text-red-600 hover:text-red-800 disabled:opacity-50 disabled:cursor-not-allowed"
+            >
+              Unlink
+            </button>
+          </li>
+        ))}
+      </ul>
+      <div className="mt-4 flex flex-wrap gap-2">
+        {providers
+          .filter((p) => !linked.has(p.name))
+          .map((provider) => (
+            <button
+              key={provider.name}
+              onClick={() => authAPI.linkIdentity(provider.name)}
+              className="py-2 px-3 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700"
+            >
+              Link {provider.display_name}
+            </button>
+          ))}
+      </div>
+    </div>
+  )
+}
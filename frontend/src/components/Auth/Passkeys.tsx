@@ -0,0 +1,113 @@
+import { FormEvent, useEffect, useState } from 'react'
+import { authAPI, Passkey } from '../../services/api'
+import { webauthnSupported } from '../../services/webauthn'
+
+export default function Passkeys() {
+  const [passkeys, setPasskeys] = useState<Passkey[]>([])
+  const [name, setName] = useState('')
+  const [recoveryCodes, setRecoveryCodes] = useState<string[] | null>(null)
+  const [error, setError] = useState<string | null>(null)
+
+  const load = async () => {
+    try {
+      setPasskeys(await authAPI.listPasskeys())
+    } catch (error) {
+      console.error('Failed to load passkeys:', error)
+    }
+  }
+
+  useEffect(() => {
+    load()
+  }, [])
+
+  const add = async (e: FormEvent) => {
+    e.preventDefault()
+    setError(null)
+    try {
+      const codes = await authAPI.registerPasskey(name.trim())
+      setRecoveryCodes(codes ?? null)
+      setName('')
+      await load()
+    } catch (error) {
+      console.error('Failed to add passkey:', error)
+      setError('Failed to add passkey.')
+    }
+  }
+
+  const remove = async (id: string) => {
+    setError(null)
+    try {
+      await authAPI.deletePasskey(id)
+      await load()
+    } catch (error) {
+      console.error('Failed to delete passkey:', error)
+      setError('Failed to delete passkey.')
+    }
+  }
+
+  return (
+    <div className="bg-white dark:bg-gray-800 shadow rounded-lg p-6 mb-6">
+      <h2 className="text-xl font-semibold text-gray-900 dark:text-white mb-4">
+        Passkeys
+      </h2>
+      {error && <p className="text-sm text-red-600 dark:text-red-400 mb-3">{error}</p>}
+
+      {recoveryCodes && (
+        <div className="mb-4">
+          <p className="text-sm text-gray-700 dark:text-gray-300 mb-2">
+            Your passkey is also used as a second factor. Save these recovery codes
+            somewhere safe, they will not be shown again.
+          </p>
+          <ul className="grid grid-cols-2 gap-1 font-mono text-sm text-gray-900 dark:text-white">
+            {recoveryCodes.map((recoveryCode) => (
+              <li key={recoveryCode}>{recoveryCode}</li>
+            ))}
+          </ul>
+        </div>
+      )}
+
+      <ul className="space-y-3">
+        {passkeys.map((passkey) => (
+          <li key={passkey.id} className="flex items-center justify-between">
+            <div>
+              <p className="text-gray-900 dark:text-white">{passkey.name}</p>
+              <p className="text-sm text-gray-500 dark:text-gray-400">
+                Added {new Date(passkey.created_at).toLocaleDateString()}
+                {passkey.last_used_at &&
+                  `, last used ${new Date(passkey.last_used_at).toLocaleDateString()}`}
+              </p>
+            </div>
+            <button
+              onClick={() => remove(passkey.id)}
+              className="text-sm text-red-600 hover:text-red-800"
+            >
+              Delete
+            </button>
+          </li>
+        ))}
+      </ul>
+
+      {webauthnSupported() ? (
+        <form onSubmit={add} className="mt-4 flex flex-wrap gap-2">
+          <input
+            type="text"
+            value={name}
+            onChange={(e) => setName(e.target.value)}
+            className="px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-900 text-gray-900 dark:text-white"
+            placeholder="Name, e.g. Laptop"
+          />
+          <button
+            type="submit"
+            className="py-2 px-3 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700"
+          >
+            Add passkey
+          </button>
+        </form>
+      ) : (
+        <p className="mt-4 text-sm text-gray-500 dark:text-gray-400">
+          This browser does not support passkeys.
+        </p>
+      )}
+    </div>
+  )
+}
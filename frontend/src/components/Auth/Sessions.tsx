@@ -0,0 +1,108 @@
+import { useEffect, useState } from 'react'
+import { authAPI, Session } from '../../services/api'
+
+export default function Sessions() {
+  const [sessions, setSessions] = useState<Session[]>([])
+  const [error, setError] = useState<string | null>(null)
+
+  const load = async () => {
+    try {
+      setSessions(await authAPI.listSessions())
+    } catch (error) {
+      console.error('Failed to load sessions:', error)
+    }
+  }
+
+  useEffect(() => {
+    load()
+  }, [])
+
+  const rename = async (session: Session) => {
+    const name = window.prompt('Name this session', session.name ?? '')
+    if (name === null) return
+    setError(null)
+    try {
+      await authAPI.renameSession(session.id, name.trim())
+      await load()
+    } catch (error) {
+      console.error('Failed to rename session:', error)
+      setError('Failed to rename session.')
+    }
+  }
+
+  const revoke = async (id: string) => {
+    setError(null)
+    try {
+      await authAPI.revokeSession(id)
+      await load()
+    } catch (error) {
+      console.error('Failed to sign out of session:', error)
+      setError('Failed to sign out of session.')
+    }
+  }
+
+  const revokeOthers = async () => {
+    setError(null)
+    try {
+      await authAPI.revokeOtherSessions()
+      await load()
+    } catch (error) {
+      console.error('Failed to sign out of other sessions:', error)
+      setError('Failed to sign out of other sessions.')
+    }
+  }
+
+  return (
+    <div className="bg-white dark:bg-gray-800 shadow rounded-lg p-6 mb-6">
+      <h2 className="text-xl font-semibold text-gray-900 dark:text-white mb-4">
+        Sessions
+      </h2>
+      {error && <p className="text-sm text-red-600 dark:text-red-400 mb-3">{error}</p>}
+
+      <ul className="space-y-3">
+        {sessions.map((session) => (
+          <li key={session.id} className="flex items-center justify-between">
+            <div>
+              <p className="text-gray-900 dark:text-white">
+                {session.name || session.user_agent || 'Unknown device'}
+                {session.current && (
+                  <span className="ml-2 text-xs text-green-700 dark:text-green-400">This device</span>
+                )}
+              </p>
+              <p className="text-sm text-gray-500 dark:text-gray-400">
+                {session.ip_address && `${session.ip_address}, `}
+                signed in {new Date(session.created_at).toLocaleDateString()}, last used{' '}
+                {new Date(session.last_used_at).toLocaleString()}
+              </p>
+            </div>
+            <div className="flex gap-3">
+              <button
+                onClick={() => rename(session)}
+                className="text-sm text-blue-600 hover:text-blue-800"
+              >
+                Rename
+              </button>
+              {!session.current && (
+                <button
+                  onClick={() => revoke(session.id)}
+                  className="text-sm text-red-600 hover:text-red-800"
+                >
+                  Sign out
+                </button>
+              )}
+            </div>
+          </li>
+        ))}
+      </ul>
+
+      {sessions.some((session) => !session.current) && (
+        <button
+          onClick={revokeOthers}
+          className="mt-4 py-2 px-3 text-sm font-medium rounded-md text-white bg-red-600 hover:bg-red-700"
+        >
+          Sign out of all other sessions
+        </button>
+      )}
+    </div>
+  )
+}
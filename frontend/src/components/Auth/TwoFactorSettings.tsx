@@ -0,0 +1,154 @@
+import { useEffect, useState } from 'react'
+import { authAPI, MFAStatus, TOTPEnrollment } from '../../services/api'
+
+export default function TwoFactorSettings() {
+  const [status, setStatus] = useState<MFAStatus | null>(null)
+  const [enrollment, setEnrollment] = useState<TOTPEnrollment | null>(null)
+  const [recoveryCodes, setRecoveryCodes] = useState<string[] | null>(null)
+  const [code, setCode] = useState('')
+  const [error, setError] = useState<string | null>(null)
+
+  const load = async () => {
+    try {
+      setStatus(await authAPI.getMFAStatus())
+    } catch (error) {
+      console.error('Failed to load two-factor status:', error)
+    }
+  }
+
+  useEffect(() => {
+    load()
+  }, [])
+
+  // Run an action that needs a code, reporting a wrong code inline
+  const withCode = async (action: (code: string) => Promise<void>) => {
+    setError(null)
+    try {
+      await action(code)
+      setCode('')
+      await load()
+    } catch (error) {
+      console.error('Two-factor request failed:', error)
+      setError('Invalid code. Please try again.')
+    }
+  }
+
+  const begin = async () => {
+    setError(null)
+    setRecoveryCodes(null)
+    try {
+      setEnrollment(await authAPI.beginTOTPEnrollment())
+    } catch (error) {
+      console.error('Failed to start enrollment:', error)
+      setError('Failed to start enrollment.')
+    }
+  }
+
+  const confirm = () =>
+    withCode(async (code) => {
+      setRecoveryCodes(await authAPI.confirmTOTPEnrollment(code))
+      setEnrollment(null)
+    })
+
+  const disable = () =>
+    withCode(async (code) => {
+      await authAPI.disableTOTP(code)
+      setRecoveryCodes(null)
+    })
+
+  const regenerate = () =>
+    withCode(async (code) => {
+      setRecoveryCodes(await authAPI.regenerateRecoveryCodes(code))
+    })
+
+  const codeInput = (
+    <input
+      type="text"
+      inputMode="numeric"
+      autoComplete="one-time-code"
+      value={code}
+      onChange={(e) => setCode(e.target.value)}
+      className="px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-900 text-gray-900 dark:text-white"
+      placeholder="Code"
+    />
+  )
+
+  return (
+    <div className="bg-white dark:bg-gray-800 shadow rounded-lg p-6 mb-6">
+      <h2 className="text-xl font-semibold text-gray-900 dark:text-white mb-4">
+        Two-Factor Authentication
+      </h2>
+      {error && <p className="text-sm text-red-600 dark:text-red-400 mb-3">{error}</p>}
+
+      {recoveryCodes && (
+        <div className="mb-4">
+          <p className="text-sm text-gray-700 dark:text-gray-300 mb-2">
+            Save these recovery codes somewhere safe. Each can be used once if you lose
+            your authenticator, and they will not be shown again.
+          </p>
+          <ul className="grid grid-cols-2 gap-1 font-mono text-sm text-gray-900 dark:text-white">
+            {recoveryCodes.map((recoveryCode) => (
+              <li key={recoveryCode}>{recoveryCode}</li>
+            ))}
+          </ul>
+        </div>
+      )}
+
+      {status?.totp_enabled ? (
+        <div className="space-y-3">
+          <p className="text-gray-700 dark:text-gray-300">
+            Enabled. {status.recovery_codes_remaining} recovery codes left.
+          </p>
+          <div className="flex flex-wrap gap-2">
+            {codeInput}
+            <button
+              onClick={regenerate}
+              className="py-2 px-3 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700"
+            >
+              New recovery codes
+            </button>
+            <button
+              onClick={disable}
+              className="py-2 px-3 text-sm font-medium rounded-md text-white bg-red-600 hover:bg-red-700"
+            >
+              Disable
+            </button>
+          </div>
+        </div>
+      ) : enrollment ? (
+        <div className="space-y-3">
+          <p className="text-sm text-gray-700 dark:text-gray-300">
+            Add this key to your authenticator app, then enter the code it shows.
+          </p>
+          <p className="font-mono text-sm break-all text-gray-900 dark:text-white">
+            {enrollment.secret}
+          </p>
+          <a href={enrollment.otpauth_uri} className="text-sm text-blue-600 hover:text-blue-800">
+            Open in authenticator app
+          </a>
+          <div className="flex flex-wrap gap-2">
+            {codeInput}
+            <button
+              onClick={confirm}
+              className="py-2 px-3 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700"
+            >
+              Enable
+            </button>
+          </div>
+        </div>
+      ) : (
+        <div className="space-y-3">
+          <p className="text-gray-700 dark:text-gray-300">
+            Protect your account with a code from an authenticator app when you sign in.
+          </p>
+          <button
+            onClick={begin}
+            className="py-2 px-3 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700"
+          >
+            Set up authenticator
+          </button>
+        </div>
+      )}
+    </div>
+  )
+}
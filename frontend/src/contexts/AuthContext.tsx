@@ -5,7 +5,7 @@ interface AuthContextType {
   user: User | null
   loading: boolean
   isAdmin: boolean
-  login: () => void
+  login: (provider?: string) => void
   logout: () => Promise<void>
   refreshUser: () => Promise<void>
 }
@@ -16,8 +16,8 @@ export function AuthProvider({ children }: { children: ReactNode }) {
   const [user, setUser] = useState<User | null>(null)
   const [loading, setLoading] = useState(true)
 
-  // Compute isAdmin based on user role
-  const isAdmin = user?.role === 'admin'
+  // The admin pages need at least the permission to list users
+  const isAdmin = user?.permissions?.includes('users:read') ?? false
 
   useEffect(() => {
     checkAuth()
@@ -41,8 +41,8 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     }
   }
 
-  const login = () => {
-    authAPI.login()
+  const login = (provider?: string) => {
+    authAPI.login(provider)
   }
 
   const logout = async () => {
@@ -0,0 +1,52 @@
+import { useEffect, useRef, useState } from 'react'
+import { Link, useSearchParams } from 'react-router-dom'
+import { errorMessage, Organization, organizationsAPI } from '../services/api'
+
+export default function AcceptInvitePage() {
+  const [searchParams] = useSearchParams()
+  const token = searchParams.get('token') || ''
+  const [organization, setOrganization] = useState<Organization | null>(null)
+  const [error, setError] = useState<string | null>(null)
+  const started = useRef(false)
+
+  useEffect(() => {
+    // The token is single-use; do not redeem it twice in StrictMode
+    if (started.current) return
+    started.current = true
+
+    organizationsAPI
+      .acceptInvite(token)
+      .then(async (org) => {
+        // Work in the new organization right away
+        const accessToken = await organizationsAPI.switch(org.id)
+        if (accessToken) {
+          sessionStorage.setItem('access_token', accessToken)
+        }
+        setOrganization(org)
+      })
+      .catch((error) => {
+        console.error('Failed to accept invitation:', error)
+        setError(errorMessage(error, 'This invitation is invalid or has expired.'))
+      })
+  }, [token])
+
+  return (
+    <div className="max-w-md mx-auto py-12 space-y-8 text-center">
+      <h2 className="text-3xl font-extrabold text-gray-900 dark:text-white">Join organization</h2>
+      {!organization && !error && (
+        <p className="text-gray-700 dark:text-gray-300">Accepting invitation...</p>
+      )}
+      {organization && (
+        <p className="text-gray-700 dark:text-gray-300">
+          You are now a member of {organization.name}.
+        </p>
+      )}
+      {error && <p className="text-red-600 dark:text-red-400">{error}</p>}
+      <p className="text-sm">
+        <Link to="/dashboard" className="text-blue-600 hover:text-blue-800">
+          Go to dashboard
+        </Link>
+      </p>
+    </div>
+  )
+}
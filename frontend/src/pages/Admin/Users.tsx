@@ -1,5 +1,5 @@
 import { useState, useEffect, useMemo } from 'react'
-import { usersAPI, User } from '../../services/api'
+import { usersAPI, rolesAPI, Role, User } from '../../services/api'
 import { useAuth } from '../../contexts/AuthContext'
 
 export default function Users() {
@@ -9,16 +9,22 @@ export default function Users() {
   const [page, setPage] = useState(1)
   const [totalPages, setTotalPages] = useState(1)
   const [total, setTotal] = useState(0)
+  const [roles, setRoles] = useState<Role[]>([])
 
   // Filter states
   const [searchQuery, setSearchQuery] = useState('')
-  const [roleFilter, setRoleFilter] = useState<'all' | 'admin' | 'user'>('all')
+  const [roleFilter, setRoleFilter] = useState('all')
   const [statusFilter, setStatusFilter] = useState<'all' | 'active' | 'inactive'>('all')
 
   useEffect(() => {
     loadUsers()
   }, [page])
 
+  useEffect(() => {
+    // Users without roles:read still see each user's role, just not change it
+    rolesAPI.list().then(setRoles).catch(() => setRoles([]))
+  }, [])
+
   const loadUsers = async () => {
     try {
       setLoading(true)
@@ -47,6 +53,20 @@ export default function Users() {
     }
   }
 
+  const handleRoleChange = async (user: User, role: string) => {
+    if (!confirm(`Change the role of ${user.name} to ${role}? They will be signed out of their current sessions.`)) {
+      return
+    }
+
+    try {
+      await usersAPI.setRole(user.id, role)
+      loadUsers()
+    } catch (error) {
+      console.error('Failed to change role:', error)
+      alert('Failed to change role')
+    }
+  }
+
   const handleDelete = async (user: User) => {
     // Prevent self-deletion
     if (user.id === currentUser?.id) {
@@ -132,12 +152,22 @@ export default function Users() {
             </label>
             <select
               value={roleFilter}
-              onChange={(e) => setRoleFilter(e.target.value as 'all' | 'admin' | 'user')}
+              onChange={(e) => setRoleFilter(e.target.value)}
               className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white focus:outline-none focus:ring-2 focus:ring-blue-500"
             >
               <option value="all">All Roles</option>
-              <option value="admin">Admin</option>
-              <option value="user">User</option>
+              {roles.length === 0 ? (
+                <>
+                  <option value="admin">Admin</option>
+                  <option value="user">User</option>
+                </>
+              ) : (
+                roles.map((role) => (
+                  <option key={role.name} value={role.name}>
+                    {role.name}
+                  </option>
+                ))
+              )}
             </select>
           </div>
 
@@ -218,15 +248,29 @@ export default function Users() {
                   </div>
                 </td>
                 <td className="px-6 py-4 whitespace-nowrap">
-                  <span
-                    className={`inline-flex items-center px-2.5 py-0.5 rounded-full text-xs font-medium ${
-                      user.role === 'admin'
-                        ? 'bg-purple-100 text-purple-800 dark:bg-purple-900 dark:text-purple-200'
-                        : 'bg-gray-100 text-gray-800 dark:bg-gray-900 dark:text-gray-200'
-                    }`}
-                  >
-                    {user.role}
-                  </span>
+                  {roles.length > 0 && user.id !== currentUser?.id ? (
+                    <select
+                      value={user.role}
+                      onChange={(e) => handleRoleChange(user, e.target.value)}
+                      className="px-2 py-1 text-xs border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
+                    >
+                      {roles.map((role) => (
+                        <option key={role.name} value={role.name}>
+                          {role.name}
+                        </option>
+                      ))}
+                    </select>
+                  ) : (
+                    <span
+                      className={`inline-flex items-center px-2.5 py-0.5 rounded-full text-xs font-medium ${
+                        user.role === 'admin'
+                          ? 'bg-purple-100 text-purple-800 dark:bg-purple-900 dark:text-purple-200'
+                          : 'bg-gray-100 text-gray-800 dark:bg-gray-900 dark:text-gray-200'
+                      }`}
+                    >
+                      {user.role}
+                    </span>
+                  )}
                 </td>
                 <td className="px-6 py-4 whitespace-nowrap">
                   <span
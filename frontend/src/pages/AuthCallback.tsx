@@ -1,24 +1,35 @@
-import { useEffect } from 'react'
+import { useEffect, useRef } from 'react'
 import { useNavigate, useSearchParams } from 'react-router-dom'
 import { useAuth } from '../contexts/AuthContext'
+import { authAPI } from '../services/api'
 
 export default function AuthCallback() {
   const [searchParams] = useSearchParams()
   const navigate = useNavigate()
   const { refreshUser } = useAuth()
+  const started = useRef(false)
 
   useEffect(() => {
-    const accessToken = searchParams.get('access_token')
+    // The code is single-use; do not exchange it twice in StrictMode
+    if (started.current) return
+    started.current = true
 
-    if (accessToken) {
-      sessionStorage.setItem('access_token', accessToken)
-      refreshUser().then(() => {
-        navigate('/dashboard')
+    const code = searchParams.get('code')
+    // Logins started with response_mode=fragment carry the token itself
+    const legacyToken = new URLSearchParams(window.location.hash.slice(1)).get('access_token')
+
+    const accessToken = code ? authAPI.exchangeLoginCode(code) : Promise.resolve(legacyToken)
+    accessToken
+      .then((token) => {
+        if (!token) throw new Error('No code or access token in callback')
+        sessionStorage.setItem('access_token', token)
+        return refreshUser()
+      })
+      .then(() => navigate('/dashboard', { replace: true }))
+      .catch((error) => {
+        console.error('Failed to complete sign in:', error)
+        navigate('/login', { replace: true })
       })
-    } else {
-      console.error('No access token in callback')
-      navigate('/login')
-    }
   }, [searchParams, navigate, refreshUser])
 
   return (
@@ -0,0 +1,93 @@
+import { FormEvent, useEffect, useRef, useState } from 'react'
+import { Link, useSearchParams } from 'react-router-dom'
+import { authAPI, errorMessage } from '../services/api'
+
+export default function EmailLoginPage() {
+  const [searchParams] = useSearchParams()
+  const token = searchParams.get('token') || ''
+  const challenge = searchParams.get('challenge') || ''
+  const [code, setCode] = useState('')
+  const [error, setError] = useState<string | null>(null)
+  const [submitting, setSubmitting] = useState(false)
+  const started = useRef(false)
+
+  useEffect(() => {
+    // The token is single-use; do not redeem it twice in StrictMode
+    if (!token || started.current) return
+    started.current = true
+
+    authAPI
+      .finishEmailLogin({ token })
+      .then((redirectURL) => {
+        window.location.href = redirectURL
+      })
+      .catch((error) => {
+        console.error('Email sign in failed:', error)
+        setError(errorMessage(error, 'This link is invalid or has expired.'))
+      })
+  }, [token])
+
+  const submit = async (e: FormEvent) => {
+    e.preventDefault()
+    setError(null)
+    setSubmitting(true)
+    try {
+      window.location.href = await authAPI.finishEmailLogin({ challenge, code })
+    } catch (error) {
+      console.error('Email sign in failed:', error)
+      setError(errorMessage(error, 'Invalid or expired code. Please try again.'))
+      setCode('')
+      setSubmitting(false)
+    }
+  }
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 dark:bg-gray-900 py-12 px-4 sm:px-6 lg:px-8">
+      <div className="max-w-md w-full space-y-8">
+        <div>
+          <h2 className="mt-6 text-center text-3xl font-extrabold text-gray-900 dark:text-white">
+            Sign in with email
+          </h2>
+          {challenge && (
+            <p className="mt-2 text-center text-sm text-gray-600 dark:text-gray-400">
+              Enter the code we emailed you
+            </p>
+          )}
+        </div>
+        {token && !error && (
+          <p className="text-center text-gray-700 dark:text-gray-300">Signing in...</p>
+        )}
+        {challenge && (
+          <form onSubmit={submit} className="space-y-4">
+            <input
+              type="text"
+              inputMode="numeric"
+              autoComplete="one-time-code"
+              autoFocus
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+              className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-800 text-gray-900 dark:text-white text-center tracking-widest"
+              placeholder="123456"
+            />
+            <button
+              type="submit"
+              disabled={submitting || code.trim() === ''}
+              className="w-full py-3 px-4 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700 disabled:opacity-50"
+            >
+              Sign in
+            </button>
+          </form>
+        )}
+        {error && <p className="text-sm text-center text-red-600 dark:text-red-400">{error}</p>}
+        {!token && !challenge && (
+          <p className="text-center text-red-600 dark:text-red-400">This link is incomplete.</p>
+        )}
+        <p className="text-center text-sm">
+          <Link to="/login" className="text-blue-600 hover:text-blue-800">
+            Back to sign in
+          </Link>
+        </p>
+      </div>
+    </div>
+  )
+}
@@ -0,0 +1,69 @@
+import { FormEvent, useState } from 'react'
+import { Link } from 'react-router-dom'
+import { authAPI, errorMessage } from '../services/api'
+
+export default function ForgotPasswordPage() {
+  const [email, setEmail] = useState('')
+  const [error, setError] = useState<string | null>(null)
+  const [submitting, setSubmitting] = useState(false)
+  const [done, setDone] = useState(false)
+
+  const submit = async (e: FormEvent) => {
+    e.preventDefault()
+    setError(null)
+    setSubmitting(true)
+    try {
+      await authAPI.forgotPassword(email)
+      setDone(true)
+    } catch (error) {
+      console.error('Failed to request password reset:', error)
+      setError(errorMessage(error, 'Something went wrong. Please try again.'))
+    }
+    setSubmitting(false)
+  }
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 dark:bg-gray-900 py-12 px-4 sm:px-6 lg:px-8">
+      <div className="max-w-md w-full space-y-8">
+        <div>
+          <h2 className="mt-6 text-center text-3xl font-extrabold text-gray-900 dark:text-white">
+            Reset your password
+          </h2>
+          <p className="mt-2 text-center text-sm text-gray-600 dark:text-gray-400">
+            We will email you a link to choose a new password
+          </p>
+        </div>
+        {done ? (
+          <p className="text-center text-gray-700 dark:text-gray-300">
+            If {email} belongs to an account, a reset link is on its way.
+          </p>
+        ) : (
+          <form onSubmit={submit} className="space-y-3">
+            <input
+              type="email"
+              autoComplete="email"
+              required
+              value={email}
+              onChange={(e) => setEmail(e.target.value)}
+              className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-800 text-gray-900 dark:text-white"
+              placeholder="Email"
+            />
+            {error && <p className="text-sm text-red-600 dark:text-red-400">{error}</p>}
+            <button
+              type="submit"
+              disabled={submitting}
+              className="w-full py-3 px-4 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700 disabled:opacity-50"
+            >
+              Send reset link
+            </button>
+          </form>
+        )}
+        <p className="text-center text-sm">
+          <Link to="/login" className="text-blue-600 hover:text-blue-800">
+            Back to sign in
+          </Link>
+        </p>
+      </div>
+    </div>
+  )
+}
@@ -1,10 +1,45 @@
-import { useEffect } from 'react'
-import { useNavigate } from 'react-router-dom'
+import { FormEvent, useEffect, useState } from 'react'
+import { Link, useNavigate } from 'react-router-dom'
 import { useAuth } from '../contexts/AuthContext'
+import { authAPI, errorMessage, IdentityProvider } from '../services/api'
+import { webauthnSupported } from '../services/webauthn'
+
+const defaultProviders: IdentityProvider[] = [
+  { name: 'google', display_name: 'Google', login_url: '/api/auth/google/login' },
+]
+
+function GoogleIcon() {
+  return (
+    <svg
+      className="w-5 h-5 mr-2"
+      viewBox="0 0 24 24"
+      fill="currentColor"
+    >
+      <path d="M22.56 12.25c0-.78-.07-1.53-.2-2.25H12v4.26h5.92c-.26 1.37-1.04 2.53-2.21 3.31v2.77h3.57c2.08-1.92 3.28-4.74 3.28-8.09z" />
+      <path d="M12 23c2.97 0 5.46-.98 7.28-2.66l-3.57-2.77c-.98.66-2.23 1.06-3.71 1.06-2.86 0-5.29-1.93-6.16-4.53H2.18v2.84C3.99 20.53 7.7 23 12 23z" />
+      <path d="M5.84 14.09c-.22-.66-.35-1.36-.35-2.09s.13-1.43.35-2.09V7.07H2.18C1.43 8.55 1 10.22 1 12s.43 3.45 1.18 4.93l2.85-2.22.81-.62z" />
+      <path d="M12 5.38c1.62 0 3.06.56 4.21 1.64l3.15-3.15C17.45 2.09 14.97 1 12 1 7.7 1 3.99 3.47 2.18 7.07l3.66 2.84c.87-2.6 3.3-4.53 6.16-4.53z" />
+    </svg>
+  )
+}
 
 export default function LoginPage() {
   const { user, login } = useAuth()
   const navigate = useNavigate()
+  const [providers, setProviders] = useState<IdentityProvider[]>(defaultProviders)
+  const [passkeyError, setPasskeyError] = useState<string | null>(null)
+  const [email, setEmail] = useState('')
+  const [password, setPassword] = useState('')
+  const [passwordError, setPasswordError] = useState<string | null>(null)
+  const [submitting, setSubmitting] = useState(false)
+  const [emailLoginMessage, setEmailLoginMessage] = useState<string | null>(null)
+
+  useEffect(() => {
+    authAPI
+      .getProviders()
+      .then(setProviders)
+      .catch((error) => console.error('Failed to load identity providers:', error))
+  }, [])
 
   useEffect(() => {
     if (user) {
@@ -12,6 +47,55 @@ export default function LoginPage() {
     }
   }, [user, navigate])
 
+  const loginWithPasskey = async () => {
+    setPasskeyError(null)
+    try {
+      window.location.href = await authAPI.loginWithPasskey(window.location.origin)
+    } catch (error) {
+      console.error('Passkey sign in failed:', error)
+      setPasskeyError('Passkey sign in failed. Please try again.')
+    }
+  }
+
+  const loginWithPassword = async (e: FormEvent) => {
+    e.preventDefault()
+    setPasswordError(null)
+    setSubmitting(true)
+    try {
+      window.location.href = await authAPI.loginWithPassword(email, password, window.location.origin)
+    } catch (error) {
+      console.error('Password sign in failed:', error)
+      setPasswordError(errorMessage(error, 'Sign in failed. Please try again.'))
+      setPassword('')
+      setSubmitting(false)
+    }
+  }
+
+  const loginWithEmail = async (method: 'link' | 'code') => {
+    setPasswordError(null)
+    setEmailLoginMessage(null)
+    if (!email) {
+      setPasswordError('Enter your email address first.')
+      return
+    }
+    setSubmitting(true)
+    try {
+      const challenge = await authAPI.startEmailLogin(email, method, window.location.origin)
+      if (challenge) {
+        navigate(`/email-login?challenge=${encodeURIComponent(challenge)}`)
+        return
+      }
+      setEmailLoginMessage(`We sent a sign-in link to ${email}.`)
+    } catch (error) {
+      console.error('Email sign in failed:', error)
+      setPasswordError(errorMessage(error, 'Could not send the email. Please try again.'))
+    }
+    setSubmitting(false)
+  }
+
+  const inputClassName =
+    'w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-800 text-gray-900 dark:text-white'
+
   return (
     <div className="min-h-screen flex items-center justify-center bg-gray-50 dark:bg-gray-900 py-12 px-4 sm:px-6 lg:px-8">
       <div className="max-w-md w-full space-y-8">
@@ -23,23 +107,90 @@ export default function LoginPage() {
             Sign in to continue
           </p>
         </div>
-        <div>
+        <div className="space-y-3">
+          {providers.map((provider) => (
+            <button
+              key={provider.name}
+              onClick={() => login(provider.name)}
+              className="group relative w-full flex justify-center py-3 px-4 border border-transparent text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-blue-500"
+            >
+              {provider.name === 'google' && <GoogleIcon />}
+              Sign in with {provider.display_name}
+            </button>
+          ))}
+          {webauthnSupported() && (
+            <button
+              onClick={loginWithPasskey}
+              className="w-full flex justify-center py-3 px-4 border border-gray-300 dark:border-gray-600 text-sm font-medium rounded-md text-gray-900 dark:text-white bg-white dark:bg-gray-800 hover:bg-gray-50 dark:hover:bg-gray-700 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-blue-500"
+            >
+              Sign in with a passkey
+            </button>
+          )}
+          {passkeyError && (
+            <p className="text-sm text-center text-red-600 dark:text-red-400">{passkeyError}</p>
+          )}
+        </div>
+        <div className="flex items-center gap-3 text-sm text-gray-500 dark:text-gray-400">
+          <div className="flex-1 border-t border-gray-300 dark:border-gray-600" />
+          or
+          <div className="flex-1 border-t border-gray-300 dark:border-gray-600" />
+        </div>
+        <form onSubmit={loginWithPassword} className="space-y-3">
+          <input
+            type="email"
+            autoComplete="username"
+            required
+            value={email}
+            onChange={(e) => setEmail(e.target.value)}
+            className={inputClassName}
+            placeholder="Email"
+          />
+          <input
+            type="password"
+            autoComplete="current-password"
+            required
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            className={inputClassName}
+            placeholder="Password"
+          />
+          {passwordError && <p className="text-sm text-red-600 dark:text-red-400">{passwordError}</p>}
+          {emailLoginMessage && (
+            <p className="text-sm text-gray-700 dark:text-gray-300">{emailLoginMessage}</p>
+          )}
           <button
-            onClick={login}
-            className="group relative w-full flex justify-center py-3 px-4 border border-transparent text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-blue-500"
+            type="submit"
+            disabled={submitting}
+            className="w-full py-3 px-4 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700 disabled:opacity-50"
           >
-            <svg
-              className="w-5 h-5 mr-2"
-              viewBox="0 0 24 24"
-              fill="currentColor"
-            >
-              <path d="M22.56 12.25c0-.78-.07-1.53-.2-2.25H12v4.26h5.92c-.26 1.37-1.04 2.53-2.21 3.31v2.77h3.57c2.08-1.92 3.28-4.74 3.28-8.09z" />
-              <path d="M12 23c2.97 0 5.46-.98 7.28-2.66l-3.57-2.77c-.98.66-2.23 1.06-3.71 1.06-2.86 0-5.29-1.93-6.16-4.53H2.18v2.84C3.99 20.53 7.7 23 12 23z" />
-              <path d="M5.84 14.09c-.22-.66-.35-1.36-.35-2.09s.13-1.43.35-2.09V7.07H2.18C1.43 8.55 1 10.22 1 12s.43 3.45 1.18 4.93l2.85-2.22.81-.62z" />
-              <path d="M12 5.38c1.62 0 3.06.56 4.21 1.64l3.15-3.15C17.45 2.09 14.97 1 12 1 7.7 1 3.99 3.47 2.18 7.07l3.66 2.84c.87-2.6 3.3-4.53 6.16-4.53z" />
-            </svg>
-            Sign in with Google
+            Sign in
           </button>
+          <div className="flex justify-between text-sm">
+            <button
+              type="button"
+              disabled={submitting}
+              onClick={() => loginWithEmail('link')}
+              className="text-blue-600 hover:text-blue-800 disabled:opacity-50"
+            >
+              Email me a sign-in link
+            </button>
+            <button
+              type="button"
+              disabled={submitting}
+              onClick={() => loginWithEmail('code')}
+              className="text-blue-600 hover:text-blue-800 disabled:opacity-50"
+            >
+              Email me a code
+            </button>
+          </div>
+        </form>
+        <div className="flex justify-between text-sm">
+          <Link to="/register" className="text-blue-600 hover:text-blue-800">
+            Create an account
+          </Link>
+          <Link to="/forgot-password" className="text-blue-600 hover:text-blue-800">
+            Forgot your password?
+          </Link>
         </div>
       </div>
     </div>
@@ -0,0 +1,96 @@
+import { FormEvent, useState } from 'react'
+import { Link, useSearchParams } from 'react-router-dom'
+import { authAPI } from '../services/api'
+import { webauthnSupported } from '../services/webauthn'
+
+export default function MFAPage() {
+  const [searchParams] = useSearchParams()
+  const challenge = searchParams.get('challenge') || ''
+  const [code, setCode] = useState('')
+  const [error, setError] = useState<string | null>(null)
+  const [submitting, setSubmitting] = useState(false)
+
+  const submit = async (e: FormEvent) => {
+    e.preventDefault()
+    setError(null)
+    setSubmitting(true)
+    try {
+      const redirectURL = await authAPI.verifyMFA(challenge, code)
+      window.location.href = redirectURL
+    } catch (error) {
+      console.error('Failed to verify code:', error)
+      setError('Invalid or expired code. Please try again.')
+      setCode('')
+      setSubmitting(false)
+    }
+  }
+
+  const verifyWithPasskey = async () => {
+    setError(null)
+    setSubmitting(true)
+    try {
+      window.location.href = await authAPI.verifyMFAWithPasskey(challenge)
+    } catch (error) {
+      console.error('Failed to verify passkey:', error)
+      setError('Passkey verification failed. Please try again.')
+      setSubmitting(false)
+    }
+  }
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 dark:bg-gray-900 py-12 px-4 sm:px-6 lg:px-8">
+      <div className="max-w-md w-full space-y-8">
+        <div>
+          <h2 className="mt-6 text-center text-3xl font-extrabold text-gray-900 dark:text-white">
+            Two-factor authentication
+          </h2>
+          <p className="mt-2 text-center text-sm text-gray-600 dark:text-gray-400">
+            Enter the code from your authenticator app or one of your recovery codes,
+            or use a passkey
+          </p>
+        </div>
+        {challenge ? (
+          <form onSubmit={submit} className="space-y-4">
+            <input
+              type="text"
+              inputMode="numeric"
+              autoComplete="one-time-code"
+              autoFocus
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+              className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-800 text-gray-900 dark:text-white text-center tracking-widest"
+              placeholder="123456"
+            />
+            {error && <p className="text-sm text-red-600 dark:text-red-400">{error}</p>}
+            <button
+              type="submit"
+              disabled={submitting || code.trim() === ''}
+              className="w-full py-3 px-4 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700 disabled:opacity-50"
+            >
+              Verify
+            </button>
+            {webauthnSupported() && (
+              <button
+                type="button"
+                onClick={verifyWithPasskey}
+                disabled={submitting}
+                className="w-full py-3 px-4 text-sm font-medium rounded-md border border-gray-300 dark:border-gray-600 text-gray-900 dark:text-white bg-white dark:bg-gray-800 hover:bg-gray-50 dark:hover:bg-gray-700 disabled:opacity-50"
+              >
+                Use a passkey
+              </button>
+            )}
+          </form>
+        ) : (
+          <p className="text-center text-sm text-red-600 dark:text-red-400">
+            This sign-in link is invalid.
+          </p>
+        )}
+        <p className="text-center text-sm">
+          <Link to="/login" className="text-blue-600 hover:text-blue-800">
+            Start over
+          </Link>
+        </p>
+      </div>
+    </div>
+  )
+}
@@ -0,0 +1,86 @@
+import { FormEvent, useState } from 'react'
+import { Link } from 'react-router-dom'
+import { authAPI, errorMessage } from '../services/api'
+
+export default function RegisterPage() {
+  const [name, setName] = useState('')
+  const [email, setEmail] = useState('')
+  const [password, setPassword] = useState('')
+  const [error, setError] = useState<string | null>(null)
+  const [submitting, setSubmitting] = useState(false)
+  const [done, setDone] = useState(false)
+
+  const submit = async (e: FormEvent) => {
+    e.preventDefault()
+    setError(null)
+    setSubmitting(true)
+    try {
+      await authAPI.register(email, password, name)
+      setDone(true)
+    } catch (error) {
+      console.error('Failed to register:', error)
+      setError(errorMessage(error, 'Failed to create your account. Please try again.'))
+    }
+    setSubmitting(false)
+  }
+
+  const inputClassName =
+    'w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-800 text-gray-900 dark:text-white'
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 dark:bg-gray-900 py-12 px-4 sm:px-6 lg:px-8">
+      <div className="max-w-md w-full space-y-8">
+        <h2 className="mt-6 text-center text-3xl font-extrabold text-gray-900 dark:text-white">
+          Create an account
+        </h2>
+        {done ? (
+          <p className="text-center text-gray-700 dark:text-gray-300">
+            Check your email for a link to finish signing up.
+          </p>
+        ) : (
+          <form onSubmit={submit} className="space-y-3">
+            <input
+              type="text"
+              autoComplete="name"
+              value={name}
+              onChange={(e) => setName(e.target.value)}
+              className={inputClassName}
+              placeholder="Name"
+            />
+            <input
+              type="email"
+              autoComplete="email"
+              required
+              value={email}
+              onChange={(e) => setEmail(e.target.value)}
+              className={inputClassName}
+              placeholder="Email"
+            />
+            <input
+              type="password"
+              autoComplete="new-password"
+              required
+              value={password}
+              onChange={(e) => setPassword(e.target.value)}
+              className={inputClassName}
+              placeholder="Password"
+            />
+            {error && <p className="text-sm text-red-600 dark:text-red-400">{error}</p>}
+            <button
+              type="submit"
+              disabled={submitting}
+              className="w-full py-3 px-4 text-sm font-medium rounded-md text-white bg-blue-600 hover:bg-blue-700 disabled:opacity-50"
+            >
+              Create account
+            </button>
+          </form>
+        )}
+        <p className="text-center text-sm">
+          <Link to="/login" className="text-blue-600 hover:text-blue-800">
+            Back to sign in
+          </Link>
+        </p>
+      </div>
+    </div>
+  )
+}
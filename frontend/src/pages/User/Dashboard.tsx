@@ -1,4 +1,8 @@
 import { useAuth } from '../../contexts/AuthContext'
+import LinkedAccounts from '../../components/Auth/LinkedAccounts'
+import Passkeys from '../../components/Auth/Passkeys'
+import Sessions from '../../components/Auth/Sessions'
+import TwoFactorSettings from '../../components/Auth/TwoFactorSettings'
 
 export default function UserDashboard() {
   const { user } = useAuth()
@@ -37,6 +41,14 @@ export default function UserDashboard() {
         </div>
       </div>
 
+      <LinkedAccounts />
+
+      <Passkeys />
+
+      <TwoFactorSettings />
+
+      <Sessions />
+
       <div className="bg-white dark:bg-gray-800 shadow rounded-lg p-6">
         <h2 className="text-xl font-semibold text-gray-900 dark:text-white mb-4">
           Authentication Service
@@ -0,0 +1,50 @@
+import { useEffect, useRef, useState } from 'react'
+import { Link, useSearchParams } from 'react-router-dom'
+import { authAPI, errorMessage } from '../services/api'
+
+export default function VerifyEmailPage() {
+  const [searchParams] = useSearchParams()
+  const token = searchParams.get('token') || ''
+  const [status, setStatus] = useState<'verifying' | 'verified' | 'failed'>('verifying')
+  const [error, setError] = useState<string | null>(null)
+  const started = useRef(false)
+
+  useEffect(() => {
+    // The token is single-use; do not redeem it twice in StrictMode
+    if (started.current) return
+    started.current = true
+
+    authAPI
+      .verifyEmail(token)
+      .then(() => setStatus('verified'))
+      .catch((error) => {
+        console.error('Failed to verify email:', error)
+        setError(errorMessage(error, 'This link is invalid or has expired.'))
+        setStatus('failed')
+      })
+  }, [token])
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 dark:bg-gray-900 py-12 px-4 sm:px-6 lg:px-8">
+      <div className="max-w-md w-full space-y-8 text-center">
+        <h2 className="mt-6 text-3xl font-extrabold text-gray-900 dark:text-white">
+          Verify your email
+        </h2>
+        {status === 'verifying' && (
+          <p className="text-gray-700 dark:text-gray-300">Verifying...</p>
+        )}
+        {status === 'verified' && (
+          <p className="text-gray-700 dark:text-gray-300">
+            Your email address is verified. You can now sign in.
+          </p>
+        )}
+        {status === 'failed' && <p className="text-red-600 dark:text-red-400">{error}</p>}
+        <p className="text-sm">
+          <Link to="/login" className="text-blue-600 hover:text-blue-800">
+            Go to sign in
+          </Link>
+        </p>
+      </div>
+    </div>
+  )
+}
@@ -1,4 +1,5 @@
 import axios from 'axios'
+import { createCredential, getCredential } from './webauthn'
 
 const API_URL = import.meta.env.VITE_API_URL || 'http://localhost:8080'
 
@@ -50,11 +51,74 @@ export interface User {
   name: string
   avatar_url?: string
   role: string
+  permissions?: string[]
   is_active: boolean
   created_at: string
   updated_at: string
 }
 
+export interface Role {
+  name: string
+  description: string
+  permissions: string[]
+  is_builtin: boolean
+}
+
+export interface Organization {
+  id: string
+  name: string
+  role?: 'owner' | 'admin' | 'member'
+  created_at: string
+  updated_at: string
+}
+
+export interface IdentityProvider {
+  name: string
+  display_name: string
+  login_url: string
+}
+
+export interface UserIdentity {
+  id: string
+  provider: string
+  email?: string
+  created_at: string
+  last_login_at?: string
+}
+
+export interface MFAStatus {
+  totp_enabled: boolean
+  totp_enabled_at?: string
+  recovery_codes_remaining: number
+  passkeys: number
+}
+
+export interface Passkey {
+  id: string
+  name: string
+  transports: string[]
+  backup_eligible: boolean
+  created_at: string
+  last_used_at?: string
+}
+
+export interface Session {
+  id: string
+  client_id?: string
+  name?: string
+  user_agent?: string
+  ip_address?: string
+  created_at: string
+  last_used_at: string
+  expires_at: string
+  current: boolean
+}
+
+export interface TOTPEnrollment {
+  secret: string
+  otpauth_uri: string
+}
+
 export interface ListUsersResponse {
   users: User[]
   total: number
@@ -63,10 +127,35 @@ export interface ListUsersResponse {
   total_pages: number
 }
 
+// errorMessage returns the plain text error the backend responded with, or
+// fallback for other errors
+export const errorMessage = (error: unknown, fallback: string): string => {
+  if (axios.isAxiosError(error) && typeof error.response?.data === 'string' && error.response.data) {
+    return error.response.data.trim()
+  }
+  return fallback
+}
+
 // Auth API
 export const authAPI = {
-  login: () => {
-    window.location.href = `${API_URL}/api/auth/google/login`
+  login: (provider = 'google') => {
+    const redirectURI = encodeURIComponent(window.location.origin)
+    window.location.href = `${API_URL}/api/auth/${provider}/login?redirect_uri=${redirectURI}`
+  },
+
+  // Trades the code a login redirected to /auth/callback with for an access
+  // token; the refresh token arrives as a cookie
+  exchangeLoginCode: async (code: string): Promise<string> => {
+    const response = await api.post('/api/auth/exchange', {
+      code,
+      redirect_uri: window.location.origin,
+    })
+    return response.data.access_token
+  },
+
+  getProviders: async (): Promise<IdentityProvider[]> => {
+    const response = await api.get('/api/auth/providers')
+    return response.data.providers
   },
 
   logout: async () => {
@@ -79,6 +168,151 @@ export const authAPI = {
     return response.data
   },
 
+  listIdentities: async (): Promise<UserIdentity[]> => {
+    const response = await api.get('/api/auth/me/identities')
+    return response.data.identities
+  },
+
+  linkIdentity: async (provider: string) => {
+    const response = await api.post(`/api/auth/me/identities/${provider}`, {
+      redirect_uri: `${window.location.origin}/dashboard`,
+    })
+    window.location.href = response.data.url
+  },
+
+  unlinkIdentity: async (id: string): Promise<void> => {
+    await api.delete(`/api/auth/me/identities/${id}`)
+  },
+
+  verifyMFA: async (challenge: string, code: string): Promise<string> => {
+    const response = await api.post('/api/auth/mfa/verify', { challenge, code })
+    return response.data.redirect_url
+  },
+
+  verifyMFAWithPasskey: async (challenge: string): Promise<string> => {
+    const options = await api.post('/api/auth/mfa/passkey', { challenge })
+    const credential = await getCredential(options.data.publicKey)
+    const response = await api.post('/api/auth/mfa/verify', { challenge, credential })
+    return response.data.redirect_url
+  },
+
+  // Returns where to send the browser: the redirect URI, or the MFA page
+  loginWithPasskey: async (redirectURI: string): Promise<string> => {
+    const options = await api.post('/api/auth/passkey/login/begin', {
+      redirect_uri: redirectURI,
+    })
+    const credential = await getCredential(options.data.publicKey)
+    const response = await api.post('/api/auth/passkey/login/finish', credential)
+    return response.data.redirect_url
+  },
+
+  // Returns where to send the browser: the redirect URI, or the MFA page
+  loginWithPassword: async (email: string, password: string, redirectURI: string): Promise<string> => {
+    const response = await api.post('/api/auth/password/login', {
+      email,
+      password,
+      redirect_uri: redirectURI,
+    })
+    return response.data.redirect_url
+  },
+
+  register: async (email: string, password: string, name: string): Promise<void> => {
+    await api.post('/api/auth/register', { email, password, name })
+  },
+
+  verifyEmail: async (token: string): Promise<void> => {
+    await api.post('/api/auth/verify-email', { token })
+  },
+
+  forgotPassword: async (email: string): Promise<void> => {
+    await api.post('/api/auth/password/forgot', { email })
+  },
+
+  resetPassword: async (token: string, password: string): Promise<void> => {
+    await api.post('/api/auth/password/reset', { token, password })
+  },
+
+  // Returns the challenge to send back with the code, for method 'code'
+  startEmailLogin: async (
+    email: string,
+    method: 'link' | 'code',
+    redirectURI: string,
+  ): Promise<string | undefined> => {
+    const response = await api.post('/api/auth/email/start', {
+      email,
+      method,
+      redirect_uri: redirectURI,
+    })
+    return response.data.challenge
+  },
+
+  // Returns where to send the browser: the redirect URI, or the MFA page
+  finishEmailLogin: async (params: { token: string } | { challenge: string; code: string }): Promise<string> => {
+    const response = await api.post('/api/auth/email/verify', params)
+    return response.data.redirect_url
+  },
+
+  listPasskeys: async (): Promise<Passkey[]> => {
+    const response = await api.get('/api/auth/me/passkeys')
+    return response.data.passkeys
+  },
+
+  // Returns recovery codes when the passkey is the first second factor
+  registerPasskey: async (name: string): Promise<string[] | undefined> => {
+    const options = await api.post('/api/auth/me/passkeys/register/begin')
+    const credential = await createCredential(options.data.publicKey)
+    const response = await api.post('/api/auth/me/passkeys/register/finish', {
+      name,
+      credential,
+    })
+    return response.data.recovery_codes
+  },
+
+  deletePasskey: async (id: string): Promise<void> => {
+    await api.delete(`/api/auth/me/passkeys/${id}`)
+  },
+
+  listSessions: async (): Promise<Session[]> => {
+    const response = await api.get('/api/auth/sessions')
+    return response.data.sessions
+  },
+
+  renameSession: async (id: string, name: string): Promise<void> => {
+    await api.put(`/api/auth/sessions/${id}`, { name })
+  },
+
+  revokeSession: async (id: string): Promise<void> => {
+    await api.delete(`/api/auth/sessions/${id}`)
+  },
+
+  revokeOtherSessions: async (): Promise<void> => {
+    await api.delete('/api/auth/sessions')
+  },
+
+  getMFAStatus: async (): Promise<MFAStatus> => {
+    const response = await api.get('/api/auth/mfa')
+    return response.data
+  },
+
+  beginTOTPEnrollment: async (): Promise<TOTPEnrollment> => {
+    const response = await api.post('/api/auth/mfa/totp')
+    return response.data
+  },
+
+  confirmTOTPEnrollment: async (code: string): Promise<string[]> => {
+    const response = await api.post('/api/auth/mfa/totp/confirm', { code })
+    return response.data.recovery_codes
+  },
+
+  disableTOTP: async (code: string): Promise<void> => {
+    await api.post('/api/auth/mfa/totp/disable', { code })
+  },
+
+  regenerateRecoveryCodes: async (code: string): Promise<string[]> => {
+    const response = await api.post('/api/auth/mfa/recovery-codes', { code })
+    return response.data.recovery_codes
+  },
+
   refreshToken: async () => {
     const response = await api.post('/api/auth/refresh')
     return response.data
@@ -117,4 +351,34 @@ export const usersAPI = {
     const response = await api.post(`/api/users/${id}/deactivate`)
     return response.data
   },
+
+  setRole: async (id: string, role: string): Promise<User> => {
+    const response = await api.put(`/api/users/${id}/role`, { role })
+    return response.data
+  },
+}
+
+export const rolesAPI = {
+  list: async (): Promise<Role[]> => {
+    const response = await api.get('/api/roles')
+    return response.data.roles
+  },
+}
+
+export const organizationsAPI = {
+  list: async (): Promise<Organization[]> => {
+    const response = await api.get('/api/organizations')
+    return response.data.organizations
+  },
+
+  acceptInvite: async (token: string): Promise<Organization> => {
+    const response = await api.post('/api/organizations/invites/accept', { token })
+    return response.data
+  },
+
+  // Returns a new access token for the organization when the session could be rotated
+  switch: async (organizationId: string | null): Promise<string | undefined> => {
+    const response = await api.post('/api/auth/organization', { organization_id: organizationId })
+    return response.data.access_token
+  },
 }
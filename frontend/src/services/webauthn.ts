@@ -0,0 +1,104 @@
+// The backend speaks the WebAuthn JSON format, where binary fields are
+// base64url strings; the browser API wants ArrayBuffers.
+
+const toBuffer = (value: string): ArrayBuffer => {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/')
+  const binary = atob(base64.padEnd(Math.ceil(base64.length / 4) * 4, '='))
+  const bytes = new Uint8Array(binary.length)
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i)
+  }
+  return bytes.buffer
+}
+
+const toBase64URL = (buffer: ArrayBuffer): string => {
+  let binary = ''
+  new Uint8Array(buffer).forEach((byte) => {
+    binary += String.fromCharCode(byte)
+  })
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+interface CredentialDescriptorJSON {
+  type: 'public-key'
+  id: string
+  transports?: AuthenticatorTransport[]
+}
+
+export type CreationOptionsJSON = Omit<
+  PublicKeyCredentialCreationOptions,
+  'challenge' | 'user' | 'excludeCredentials'
+> & {
+  challenge: string
+  user: { id: string; name: string; displayName: string }
+  excludeCredentials?: CredentialDescriptorJSON[]
+}
+
+export type RequestOptionsJSON = Omit<
+  PublicKeyCredentialRequestOptions,
+  'challenge' | 'allowCredentials'
+> & {
+  challenge: string
+  allowCredentials?: CredentialDescriptorJSON[]
+}
+
+const descriptors = (list: CredentialDescriptorJSON[] = []): PublicKeyCredentialDescriptor[] =>
+  list.map((d) => ({ ...d, id: toBuffer(d.id) }))
+
+export const webauthnSupported = () => typeof window.PublicKeyCredential !== 'undefined'
+
+// createCredential runs navigator.credentials.create() with options from the
+// backend and returns the new credential in JSON form
+export async function createCredential(options: CreationOptionsJSON) {
+  const credential = (await navigator.credentials.create({
+    publicKey: {
+      ...options,
+      challenge: toBuffer(options.challenge),
+      user: { ...options.user, id: toBuffer(options.user.id) },
+      excludeCredentials: descriptors(options.excludeCredentials),
+    },
+  })) as PublicKeyCredential | null
+  if (!credential) {
+    throw new Error('No credential created')
+  }
+
+  const response = credential.response as AuthenticatorAttestationResponse
+  return {
+    id: credential.id,
+    rawId: toBase64URL(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64URL(response.clientDataJSON),
+      attestationObject: toBase64URL(response.attestationObject),
+      transports: response.getTransports?.() ?? [],
+    },
+  }
+}
+
+// getCredential runs navigator.credentials.get() with options from the
+// backend and returns the assertion in JSON form
+export async function getCredential(options: RequestOptionsJSON) {
+  const credential = (await navigator.credentials.get({
+    publicKey: {
+      ...options,
+      challenge: toBuffer(options.challenge),
+      allowCredentials: descriptors(options.allowCredentials),
+    },
+  })) as PublicKeyCredential | null
+  if (!credential) {
+    throw new Error('No credential selected')
+  }
+
+  const response = credential.response as AuthenticatorAssertionResponse
+  return {
+    id: credential.id,
+    rawId: toBase64URL(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64URL(response.clientDataJSON),
+      authenticatorData: toBase64URL(response.authenticatorData),
+      signature: toBase64URL(response.signature),
+      userHandle: response.userHandle ? toBase64URL(response.userHandle) : undefined,
+    },
+  }
+}
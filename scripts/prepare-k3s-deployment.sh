@@ -51,6 +51,10 @@ read -p "Enter Admin Email(s) (comma-separated): " ADMIN_EMAILS
 POSTGRES_PASSWORD=$(openssl rand -base64 32)
 echo "✅ Generated secure PostgreSQL password"
 
+# Generate the key that encrypts TOTP secrets
+MFA_ENCRYPTION_KEY=$(openssl rand -base64 32)
+echo "✅ Generated MFA encryption key"
+
 echo ""
 echo "📋 Step 3: Create Sealed Secrets"
 echo "================================"
@@ -63,6 +67,7 @@ kubectl create secret generic auth-service-backend \
   --from-literal=GOOGLE_CLIENT_ID="$GOOGLE_CLIENT_ID" \
   --from-literal=GOOGLE_CLIENT_SECRET="$GOOGLE_CLIENT_SECRET" \
   --from-literal=ADMIN_EMAILS="$ADMIN_EMAILS" \
+  --from-literal=MFA_ENCRYPTION_KEY="$MFA_ENCRYPTION_KEY" \
   --namespace=$NAMESPACE \
   --dry-run=client -o yaml | \
   kubeseal --controller-namespace=sealed-secrets --format=yaml > \